@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// adminToken is the bearer token required by the admin endpoints, which
+// are disabled when it is empty
+var adminToken string
+
+// minPubkeyPrefix is the shortest prefix accepted by the pubkey search, so
+// that it cannot degrade into a full scan
+const minPubkeyPrefix = 8
+
+// maxPubkeySearchResults limits the number of pubkeys returned by a search
+const maxPubkeySearchResults = 10
+
+// pubkeyPrefixPattern matches a lowercase hex pubkey prefix
+var pubkeyPrefixPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// configureAdmin reads ADMIN_TOKEN
+func configureAdmin() {
+	adminToken = strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if adminToken != "" {
+		log.Printf("Admin endpoints enabled")
+	}
+}
+
+// hasAdminToken reports whether r carries the admin bearer token
+func hasAdminToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requireAdmin serves h only to requests carrying the admin bearer token.
+// The endpoints appear not to exist when no token is configured.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Not found")
+			return
+		}
+		if !hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// deleteEventsByPubkey removes all of pubkey's events from event_backup,
+// returning the number of rows removed
+func deleteEventsByPubkey(ctx context.Context, db *sql.DB, pubkey string) (int64, error) {
+	defer observeDBQuery("delete_events", time.Now())
+
+	result, err := db.ExecContext(ctx, `DELETE FROM event_backup WHERE pubkey = $1`, pubkey)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeEventsAPI serves DELETE /api/npub/{npub}/events, removing the whole
+// backup of a pubkey for deletion requests, along with the cached pages and
+// profile that would still show it. It must be wrapped in requireAdmin.
+func purgeEventsAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, hexPubkey string) {
+	ctx := r.Context()
+	if readOnly.Load() {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeReadOnly, "The service is in read-only maintenance mode")
+		return
+	}
+
+	deleted, err := deleteEventsByPubkey(ctx, db, hexPubkey)
+	if err != nil {
+		errorf(ctx, "Failed to purge events of %s: %v", hexPubkey, err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+		return
+	}
+	// Their events also appear on event, thread and multi-author pages, which
+	// cannot be told apart by URL, so every cached page is dropped
+	pages.clear()
+	profiles.delete(hexPubkey)
+	logf(ctx, "Purged %d events of %s requested by %s", deleted, hexPubkey, clientIP(r))
+	writeJSON(w, http.StatusOK, struct {
+		Deleted int64 `json:"deleted"`
+	}{deleted})
+}
+
+// queryPubkeysByPrefix returns up to limit distinct pubkeys in event_backup
+// starting with prefix, ordered by pubkey
+func queryPubkeysByPrefix(ctx context.Context, db *sql.DB, prefix string, limit int) ([]string, error) {
+	defer observeDBQuery("pubkey_prefix", time.Now())
+
+	query := `SELECT DISTINCT pubkey FROM event_backup WHERE pubkey LIKE $1 || '%' ORDER BY pubkey LIMIT $2`
+	rows, err := db.QueryContext(ctx, query, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pubkeys := []string{}
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	return pubkeys, rows.Err()
+}
+
+// pubkeySearchHandler serves GET /api/search/pubkey?prefix= with the stored
+// pubkeys starting with a hex prefix
+func pubkeySearchHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("prefix")))
+		if !pubkeyPrefixPattern.MatchString(prefix) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidPrefix, "Invalid prefix: must be hex")
+			return
+		}
+		if len(prefix) < minPubkeyPrefix {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidPrefix, fmt.Sprintf("Prefix must be at least %d hex characters", minPubkeyPrefix))
+			return
+		}
+
+		pubkeys, err := queryPubkeysByPrefix(r.Context(), dbs.read(), prefix, maxPubkeySearchResults)
+		if err != nil {
+			errorf(r.Context(), "Failed to search pubkeys by prefix %s: %v", prefix, err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+			return
+		}
+		writeJSON(w, http.StatusOK, pubkeys)
+	}
+}
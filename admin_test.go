@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusNotFound},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"valid", "s3cret", "Bearer s3cret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			t.Cleanup(func() { adminToken = "" })
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/npub/x/events", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			requireAdmin(ok).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeEventsAPIEvictsCaches(t *testing.T) {
+	const pubkey = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	const other = "82341f882b6eabcd2ba7f1ef90aad961cf074af15b9ef44a09f9d2a8fbfbe6a2"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectExec(`DELETE FROM event_backup WHERE pubkey = \$1`).WithArgs(pubkey).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	expires := time.Now().Add(time.Minute)
+	pages.set("/npub/npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg", cachedPage{expires: expires})
+	pages.set("/api/event/abc", cachedPage{expires: expires})
+	profiles.set(pubkey, &UserProfile{Name: "purged"})
+	profiles.set(other, &UserProfile{Name: "kept"})
+	t.Cleanup(func() {
+		pages.clear()
+		profiles.delete(other)
+	})
+
+	rec := httptest.NewRecorder()
+	purgeEventsAPI(db, rec, httptest.NewRequest(http.MethodDelete, "/api/npub/x/events", nil), pubkey)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []string{"/npub/npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg", "/api/event/abc"} {
+		if _, ok := pages.get(key); ok {
+			t.Errorf("page %s still cached after purge", key)
+		}
+	}
+	if _, ok := profiles.get(pubkey); ok {
+		t.Error("profile of purged pubkey still cached")
+	}
+	if _, ok := profiles.get(other); !ok {
+		t.Error("profile of another pubkey was evicted")
+	}
+}
+
+func TestPubkeySearchHandler(t *testing.T) {
+	adminToken = "search-token"
+	t.Cleanup(func() { adminToken = "" })
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	matches := []string{
+		"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",
+		"3bf0c63f0000000000000000000000000000000000000000000000000000beef",
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		auth       string
+		expect     func(sqlmock.Sqlmock)
+		wantStatus int
+		wantCode   string
+		want       []string
+	}{
+		{
+			name:  "matching prefix",
+			query: "?prefix=3BF0C63F",
+			auth:  "Bearer search-token",
+			expect: func(m sqlmock.Sqlmock) {
+				rows := sqlmock.NewRows([]string{"pubkey"})
+				for _, pk := range matches {
+					rows.AddRow(pk)
+				}
+				m.ExpectQuery(regexp.QuoteMeta(`WHERE pubkey LIKE $1 || '%' ORDER BY pubkey LIMIT $2`)).
+					WithArgs("3bf0c63f", maxPubkeySearchResults).WillReturnRows(rows)
+			},
+			wantStatus: http.StatusOK,
+			want:       matches,
+		},
+		{
+			name:  "no matches",
+			query: "?prefix=ffffffffff",
+			auth:  "Bearer search-token",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT DISTINCT pubkey`).WithArgs("ffffffffff", maxPubkeySearchResults).
+					WillReturnRows(sqlmock.NewRows([]string{"pubkey"}))
+			},
+			wantStatus: http.StatusOK,
+			want:       []string{},
+		},
+		{name: "too short", query: "?prefix=3bf0c63", auth: "Bearer search-token", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidPrefix},
+		{name: "missing", auth: "Bearer search-token", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidPrefix},
+		{name: "not hex", query: "?prefix=3bf0c63f%25", auth: "Bearer search-token", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidPrefix},
+		{name: "without the admin token", query: "?prefix=3bf0c63f", wantStatus: http.StatusUnauthorized, wantCode: errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/search/pubkey"+tt.query, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			requireAdmin(pubkeySearchHandler(&databases{primary: db})).ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if tt.wantCode != "" {
+				var body apiError
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != tt.wantCode {
+					t.Errorf("error body = %s, want code %q", rec.Body, tt.wantCode)
+				}
+				return
+			}
+			var got []string
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pubkeys = %s, want %v", rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeEventsAPI(t *testing.T) {
+	const pubkey = "4d4b6cd1361032ca9bd2aeb9d900aa4d45d9ead80ac9423374c451a7254d0766"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	adminToken = "purge-token"
+	defer func() { adminToken = ""; blockedPubkeys = map[string]bool{} }()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name        string
+		header      string
+		blocked     bool
+		rows        int64
+		wantStatus  int
+		wantDeleted int64
+	}{
+		{name: "authorized", header: "Bearer purge-token", rows: 12, wantStatus: http.StatusOK, wantDeleted: 12},
+		{name: "nothing stored", header: "Bearer purge-token", rows: 0, wantStatus: http.StatusOK, wantDeleted: 0},
+		{name: "blocked pubkey", header: "Bearer purge-token", blocked: true, rows: 4, wantStatus: http.StatusOK, wantDeleted: 4},
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer purge-tokem", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.wantStatus == http.StatusOK {
+				mock.ExpectExec(`DELETE FROM event_backup WHERE pubkey = \$1`).WithArgs(pubkey).
+					WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			}
+			blockedPubkeys = map[string]bool{pubkey: tt.blocked}
+			logs.Reset()
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/npub/"+npub+"/events", nil)
+			req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, "purge-1"))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			apiNpubHandler(&databases{primary: db})(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			// Unauthorized requests never reach the database
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if logs.Len() != 0 {
+					t.Errorf("rejected purge was logged: %s", logs.String())
+				}
+				return
+			}
+			var got struct {
+				Deleted int64 `json:"deleted"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.Deleted != tt.wantDeleted {
+				t.Errorf("body = %s, want %d deleted", rec.Body, tt.wantDeleted)
+			}
+			if want := fmt.Sprintf("[purge-1] Purged %d events of %s", tt.wantDeleted, pubkey); !strings.Contains(logs.String(), want) {
+				t.Errorf("log = %q, want it to contain %q", logs.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// eventIDPattern matches a 64-character lowercase hex event id
+var eventIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// queryEventByID retrieves the raw event data of a single event by id. A
+// NULL event_data is returned as "", which is not a valid event.
+func queryEventByID(ctx context.Context, db *sql.DB, id string) (string, error) {
+	defer observeDBQuery("event_by_id", time.Now())
+
+	query := `SELECT event_data FROM event_backup WHERE id = $1`
+	var eventData sql.NullString
+	err := db.QueryRowContext(ctx, query, id).Scan(&eventData)
+	if err != nil {
+		return "", err
+	}
+	return eventData.String, nil
+}
+
+// eventAPIHandler serves GET /api/event/{id} with the raw event JSON and
+// GET /api/event/{id}/download with it as an indented attachment
+func eventAPIHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := dbs.read()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/event/"), "/")
+		if action != "" && action != "download" {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Not found")
+			return
+		}
+		if !eventIDPattern.MatchString(id) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid event id")
+			return
+		}
+
+		eventData, err := queryEventByID(r.Context(), db, id)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Event not found")
+			return
+		}
+		if err != nil {
+			errorf(r.Context(), "Failed to query event %s: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+			return
+		}
+		// Events of blocked pubkeys are not served, as their profiles are not
+		var stored struct {
+			PubKey string `json:"pubkey"`
+		}
+		if json.Unmarshal([]byte(eventData), &stored) == nil && isBlocked(stored.PubKey) {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Event not found")
+			return
+		}
+
+		if action == "download" {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, []byte(eventData), "", "  "); err != nil {
+				errorf(r.Context(), "Failed to indent event %s: %v", id, err)
+				writeJSONError(w, http.StatusInternalServerError, errCodeInvalidEvent, "Invalid stored event")
+				return
+			}
+			buf.WriteByte('\n')
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", "attachment; filename="+id+".json")
+			w.Write(buf.Bytes())
+			return
+		}
+
+		if !json.Valid([]byte(eventData)) {
+			errorf(r.Context(), "Stored event %s is not valid JSON", id)
+			writeJSONError(w, http.StatusInternalServerError, errCodeInvalidEvent, "Invalid stored event")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(eventData))
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// API error codes returned in JSON error responses. They are stable so
+// clients can branch on them instead of the message.
+const (
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeNotFound         = "not_found"
+	errCodeInvalidID        = "invalid_id"
+	errCodeInvalidNpub      = "invalid_npub"
+	errCodeInvalidPrefix    = "invalid_prefix"
+	errCodeInvalidEvent     = "invalid_event"
+	errCodeInvalidKind      = "invalid_kind"
+	errCodeUnknownSinceID   = "unknown_since_id"
+	errCodeInvalidCursor    = "invalid_cursor"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeReadOnly         = "read_only"
+	errCodeDB               = "db_error"
+)
+
+// apiError is the body of a JSON error response
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeJSONError writes {"error":{"code":...,"message":...}} with status
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	var body apiError
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+// writeMethodNotAllowed rejects a request to an API endpoint that only
+// serves GET and HEAD
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Allow", "GET, HEAD")
+	writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+}
+
+// apiNpubHandler serves the JSON API under /api/npub/{npub}/
+func apiNpubHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := dbs.read()
+		identifier, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/npub/"), "/")
+
+		hexPubkey, err := resolveIdentifier(r.Context(), identifier)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidNpub, "Invalid npub")
+			return
+		}
+		// Blocked pubkeys can still be purged, so this comes first
+		if action == "events" && r.Method == http.MethodDelete {
+			requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				purgeEventsAPI(dbs.primary, w, r, hexPubkey)
+			})).ServeHTTP(w, r)
+			return
+		}
+		if isBlocked(hexPubkey) {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, unavailableMessage)
+			return
+		}
+		npub, err := nip19.EncodePublicKey(hexPubkey)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidNpub, "Invalid npub")
+			return
+		}
+
+		switch action {
+		case "profile":
+			profileAPI(db, w, r, npub, hexPubkey)
+		case "kinds":
+			kindsAPI(db, w, r, hexPubkey)
+		case "events":
+			eventsAPI(db, w, r, hexPubkey)
+		case "count":
+			countAPI(db, w, r, hexPubkey)
+		case "latest":
+			latestAPI(db, w, r, hexPubkey)
+		default:
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Not found")
+		}
+	}
+}
+
+// profileAPI serves GET /api/npub/{npub}/profile with the user's profile
+func profileAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, npub, hexPubkey string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	profile, err := getProfile(r.Context(), db, hexPubkey)
+	if err != nil {
+		logf(r.Context(), "Error fetching profile for %s: %v", hexPubkey, err)
+		profile = &UserProfile{}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Npub    string       `json:"npub"`
+		Pubkey  string       `json:"pubkey"`
+		Profile *UserProfile `json:"profile"`
+	}{
+		Npub:    npub,
+		Pubkey:  hexPubkey,
+		Profile: profile,
+	})
+}
+
+// queryEventCount returns the number of stored events of pubkey
+func queryEventCount(ctx context.Context, db *sql.DB, pubkey string) (int64, error) {
+	defer observeDBQuery("event_count", time.Now())
+
+	query := `SELECT COUNT(*) FROM event_backup WHERE pubkey = $1`
+	var count int64
+	err := db.QueryRowContext(ctx, query, pubkey).Scan(&count)
+	return count, err
+}
+
+// countAPI serves GET /api/npub/{npub}/count with the number of stored events
+func countAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, hexPubkey string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	count, err := queryEventCount(r.Context(), db, hexPubkey)
+	if err != nil {
+		errorf(r.Context(), "Failed to count events for %s: %v", hexPubkey, err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"count": count})
+}
+
+// queryLatestEvent returns the raw data of the newest stored event of kind
+// for pubkey. Ties on created_at go to the lowest id, as for replaceable
+// events in NIP-01.
+func queryLatestEvent(ctx context.Context, db *sql.DB, pubkey string, kind int) (string, error) {
+	defer observeDBQuery("latest_event", time.Now())
+
+	query := `SELECT event_data FROM event_backup WHERE pubkey = $1 AND event_kind = $2 ORDER BY created_at DESC, id ASC LIMIT 1`
+	var eventData string
+	err := db.QueryRowContext(ctx, query, pubkey, kind).Scan(&eventData)
+	return eventData, err
+}
+
+// latestAPI serves GET /api/npub/{npub}/latest?kind= with the raw JSON of
+// the newest stored event of that kind, such as the current contact list
+func latestAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, hexPubkey string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	kind, err := strconv.Atoi(r.URL.Query().Get("kind"))
+	if err != nil || kind < 0 || kind > 65535 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidKind, "Kind must be an integer between 0 and 65535")
+		return
+	}
+
+	eventData, err := queryLatestEvent(r.Context(), db, hexPubkey, kind)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "No event of this kind found")
+		return
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to query latest kind %d event for %s: %v", kind, hexPubkey, err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(eventData))
+}
+
+// queryKindCounts returns the number of stored events per kind for pubkey,
+// ordered by kind
+func queryKindCounts(ctx context.Context, db *sql.DB, pubkey string) ([]KindCount, error) {
+	defer observeDBQuery("kind_counts", time.Now())
+
+	query := `SELECT event_kind, COUNT(*) FROM event_backup WHERE pubkey = $1 GROUP BY event_kind ORDER BY event_kind`
+	rows, err := db.QueryContext(ctx, query, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []KindCount{}
+	for rows.Next() {
+		var c KindCount
+		if err := rows.Scan(&c.Kind, &c.Count); err != nil {
+			return nil, err
+		}
+		c.Name = kindName(c.Kind)
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// kindsAPI serves GET /api/npub/{npub}/kinds with the event count per kind
+func kindsAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, hexPubkey string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	counts, err := queryKindCounts(r.Context(), db, hexPubkey)
+	if err != nil {
+		errorf(r.Context(), "Failed to count kinds for %s: %v", hexPubkey, err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// queryEventCreatedAt returns the created_at of the stored event id of pubkey
+func queryEventCreatedAt(ctx context.Context, db *sql.DB, pubkey, id string) (int64, error) {
+	defer observeDBQuery("event_created_at", time.Now())
+
+	query := `SELECT created_at FROM event_backup WHERE id = $1 AND pubkey = $2`
+	var createdAt int64
+	err := db.QueryRowContext(ctx, query, id, pubkey).Scan(&createdAt)
+	return createdAt, err
+}
+
+// queryEventsSince returns up to limit events of pubkey that come after
+// the keyset cursor (since, sinceID), oldest first
+func queryEventsSince(ctx context.Context, db *sql.DB, pubkey string, since int64, sinceID string, limit int) ([]Event, error) {
+	defer observeDBQuery("events_since", time.Now())
+
+	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = $1 AND (created_at, id) > ($2, $3) ORDER BY created_at ASC, id ASC LIMIT $4`
+	rows, err := db.QueryContext(ctx, query, pubkey, since, sinceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// eventsAPI serves GET /api/npub/{npub}/events for incremental sync. Events
+// are returned oldest first, at most maxEventsPerRequest at a time, after
+// the position given by ?cursor=, or by ?since_id= naming a stored event.
+// The response's cursor continues after the last event returned, and
+// truncated is set when more events follow it.
+func eventsAPI(db *sql.DB, w http.ResponseWriter, r *http.Request, hexPubkey string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	ctx := r.Context()
+	after := eventCursor{CreatedAt: -1}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		c, err := parseCursor(cursor, "recent")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidCursor, "Invalid cursor")
+			return
+		}
+		after = c
+	} else if sinceID := r.URL.Query().Get("since_id"); sinceID != "" {
+		if !eventIDPattern.MatchString(sinceID) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid since_id")
+			return
+		}
+		createdAt, err := queryEventCreatedAt(ctx, db, hexPubkey, sinceID)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeUnknownSinceID, "since_id does not match a stored event of this pubkey")
+			return
+		}
+		if err != nil {
+			errorf(ctx, "Failed to look up since_id %s: %v", sinceID, err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+			return
+		}
+		after = eventCursor{CreatedAt: createdAt, ID: sinceID}
+	}
+
+	events, err := queryEventsSince(ctx, db, hexPubkey, after.CreatedAt, after.ID, maxEventsPerRequest+1)
+	if err != nil {
+		errorf(ctx, "Failed to query events since %d for %s: %v", after.CreatedAt, hexPubkey, err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeDB, "Database error")
+		return
+	}
+	truncated := len(events) > maxEventsPerRequest
+	if truncated {
+		events = events[:maxEventsPerRequest]
+	}
+	cursor := ""
+	if len(events) > 0 {
+		cursor = encodeCursor(events[len(events)-1], "recent")
+	} else if after.ID != "" {
+		cursor = encodeCursor(Event{CreatedAt: after.CreatedAt, ID: after.ID}, "recent")
+	}
+
+	raw := []json.RawMessage{}
+	for _, event := range events {
+		if json.Valid([]byte(event.EventData)) {
+			raw = append(raw, json.RawMessage(event.EventData))
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Events    []json.RawMessage `json:"events"`
+		Cursor    string            `json:"cursor,omitempty"`
+		Truncated bool              `json:"truncated"`
+	}{
+		Events:    raw,
+		Cursor:    cursor,
+		Truncated: truncated,
+	})
+}
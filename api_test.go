@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// signedNote returns a kind-1 note signed by a fresh key
+func signedNote(t *testing.T, content string) nostr.Event {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	ev := nostr.Event{Kind: 1, Content: content, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	if err := ev.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestEventAPIHandler(t *testing.T) {
+	note := signedNote(t, "hello")
+	blocked := signedNote(t, "spam")
+	blockedPubkeys = map[string]bool{blocked.PubKey: true}
+	t.Cleanup(func() { blockedPubkeys = map[string]bool{} })
+
+	tests := []struct {
+		name        string
+		path        string
+		row         *nostr.Event
+		null        bool
+		queryErr    error
+		wantStatus  int
+		wantCode    string
+		wantAttach  bool
+		wantContent string
+	}{
+		{name: "raw", path: "/api/event/" + note.ID, row: &note, wantStatus: http.StatusOK, wantContent: "hello"},
+		{name: "download", path: "/api/event/" + note.ID + "/download", row: &note, wantStatus: http.StatusOK, wantAttach: true, wantContent: "hello"},
+		{name: "unknown action", path: "/api/event/" + note.ID + "/raw", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "invalid id", path: "/api/event/xyz", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidID},
+		{name: "missing", path: "/api/event/" + note.ID, queryErr: sql.ErrNoRows, wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "database error", path: "/api/event/" + note.ID, queryErr: sql.ErrConnDone, wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+		{name: "blocked raw", path: "/api/event/" + blocked.ID, row: &blocked, wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "blocked download", path: "/api/event/" + blocked.ID + "/download", row: &blocked, wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "null raw", path: "/api/event/" + note.ID, null: true, wantStatus: http.StatusInternalServerError, wantCode: errCodeInvalidEvent},
+		{name: "null download", path: "/api/event/" + note.ID + "/download", null: true, wantStatus: http.StatusInternalServerError, wantCode: errCodeInvalidEvent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			const query = `SELECT event_data FROM event_backup WHERE id = \$1`
+			switch {
+			case tt.row != nil:
+				mock.ExpectQuery(query).WithArgs(tt.row.ID).WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(tt.row.String()))
+			case tt.null:
+				mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(nil))
+			case tt.queryErr != nil:
+				mock.ExpectQuery(query).WillReturnError(tt.queryErr)
+			}
+
+			rec := httptest.NewRecorder()
+			eventAPIHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body struct {
+					Error struct {
+						Code string `json:"code"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != tt.wantCode {
+					t.Errorf("error body = %s, want code %q", rec.Body, tt.wantCode)
+				}
+			}
+			if got := strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment"); got != tt.wantAttach {
+				t.Errorf("attachment = %v, want %v", got, tt.wantAttach)
+			}
+			if tt.wantContent != "" && !strings.Contains(rec.Body.String(), tt.wantContent) {
+				t.Errorf("body = %s, want it to contain %q", rec.Body, tt.wantContent)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			// An invalid id must be refused before the database is queried
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEventsAPIKeysetCursor(t *testing.T) {
+	const pubkey = "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"
+	id := func(c byte) string { return strings.Repeat(string(c), 64) }
+	// Three events share one second, so only the id tells them apart
+	rows := func(ids ...string) *sqlmock.Rows {
+		r := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+		for _, id := range ids {
+			r.AddRow(id, pubkey, int64(1700000100), 1, `{"id":"`+id+`"}`)
+		}
+		return r
+	}
+
+	defer func(limit int) { maxEventsPerRequest = limit }(maxEventsPerRequest)
+	maxEventsPerRequest = 2
+
+	tests := []struct {
+		name          string
+		query         string
+		expect        func(sqlmock.Sqlmock)
+		wantStatus    int
+		wantCode      string
+		wantIDs       []string
+		wantCursor    string
+		wantTruncated bool
+	}{
+		{
+			name:  "first page stops inside a second",
+			query: "",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`\(created_at, id\) > \(\$2, \$3\)`).WithArgs(pubkey, int64(-1), "", 3).
+					WillReturnRows(rows(id('a'), id('b'), id('c')))
+			},
+			wantStatus:    http.StatusOK,
+			wantIDs:       []string{id('a'), id('b')},
+			wantCursor:    "1700000100." + id('b'),
+			wantTruncated: true,
+		},
+		{
+			name:  "cursor resumes within the same second",
+			query: "?cursor=1700000100." + id('b'),
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`\(created_at, id\) > \(\$2, \$3\)`).WithArgs(pubkey, int64(1700000100), id('b'), 3).
+					WillReturnRows(rows(id('c')))
+			},
+			wantStatus: http.StatusOK,
+			wantIDs:    []string{id('c')},
+			wantCursor: "1700000100." + id('c'),
+		},
+		{
+			name:  "empty page keeps the cursor",
+			query: "?cursor=1700000100." + id('c'),
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`FROM event_backup`).WillReturnRows(rows())
+			},
+			wantStatus: http.StatusOK,
+			wantIDs:    []string{},
+			wantCursor: "1700000100." + id('c'),
+		},
+		{
+			name:  "since_id is a cursor at that event",
+			query: "?since_id=" + id('a'),
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT created_at FROM event_backup`).WithArgs(id('a'), pubkey).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(int64(1700000100)))
+				m.ExpectQuery(`\(created_at, id\) > \(\$2, \$3\)`).WithArgs(pubkey, int64(1700000100), id('a'), 3).
+					WillReturnRows(rows(id('b')))
+			},
+			wantStatus: http.StatusOK,
+			wantIDs:    []string{id('b')},
+			wantCursor: "1700000100." + id('b'),
+		},
+		{
+			name:       "malformed cursor",
+			query:      "?cursor=yesterday",
+			expect:     func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidCursor,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			tt.expect(mock)
+
+			rec := httptest.NewRecorder()
+			eventsAPI(db, rec, httptest.NewRequest(http.MethodGet, "/api/npub/x/events"+tt.query, nil), pubkey)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if tt.wantCode != "" {
+				var body apiError
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != tt.wantCode {
+					t.Errorf("error body = %s, want code %q", rec.Body, tt.wantCode)
+				}
+				return
+			}
+
+			var got struct {
+				Events []struct {
+					ID string `json:"id"`
+				} `json:"events"`
+				Cursor    string `json:"cursor"`
+				Truncated bool   `json:"truncated"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, ev := range got.Events {
+				ids = append(ids, ev.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if got.Cursor != tt.wantCursor || got.Truncated != tt.wantTruncated {
+				t.Errorf("cursor, truncated = %q, %v, want %q, %v", got.Cursor, got.Truncated, tt.wantCursor, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestProfileAPIUsesCache(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"grace","about":"cached"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+	t.Cleanup(func() { profiles.delete(pubkey) })
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Registered before newMockRelay's cleanup, so it runs after it
+	relays := readRelays
+	t.Cleanup(func() { readRelays = relays })
+	readRelays = nil
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(eventMessage(req.SubscriptionID, metadata))
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Only the first request looks up the user's relay list
+	mock.ExpectQuery(`event_kind = 10002`).WithArgs(pubkey).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+	handler := apiNpubHandler(&databases{primary: db})
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/npub/"+npub+"/profile", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i+1, rec.Code, rec.Body)
+		}
+		var body struct {
+			Npub    string      `json:"npub"`
+			Pubkey  string      `json:"pubkey"`
+			Profile UserProfile `json:"profile"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Npub != npub || body.Pubkey != pubkey || body.Profile.Name != "grace" || body.Profile.About != "cached" {
+			t.Errorf("request %d: body = %s", i+1, rec.Body)
+		}
+	}
+	if n := relay.count("REQ"); n != 1 {
+		t.Errorf("relay was queried %d times, want 1", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventDownload(t *testing.T) {
+	note := signedNote(t, "download <me> & keep")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(note.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(note.String()))
+
+	rec := httptest.NewRecorder()
+	eventAPIHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/api/event/"+note.ID+"/download", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), "attachment; filename="+note.ID+".json"; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+
+	var indented bytes.Buffer
+	json.Indent(&indented, []byte(note.String()), "", "  ")
+	if got := strings.TrimSuffix(rec.Body.String(), "\n"); got != indented.String() {
+		t.Errorf("body is not the indented event:\n%s", rec.Body)
+	}
+	var downloaded nostr.Event
+	if err := json.Unmarshal(rec.Body.Bytes(), &downloaded); err != nil {
+		t.Fatalf("body is not valid JSON: %v", err)
+	}
+	if ok, err := downloaded.CheckSignature(); !ok || err != nil || downloaded.Content != note.Content {
+		t.Errorf("downloaded event does not verify: %v", err)
+	}
+}
+
+func TestKindsAPI(t *testing.T) {
+	const pubkey = "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name       string
+		method     string
+		rows       [][2]int
+		queryErr   error
+		wantStatus int
+		want       []KindCount
+	}{
+		{
+			name:       "counts by kind",
+			method:     http.MethodGet,
+			rows:       [][2]int{{0, 1}, {1, 42}, {3, 2}, {7, 9}, {30023, 5}},
+			wantStatus: http.StatusOK,
+			want: []KindCount{
+				{Kind: 0, Name: kindName(0), Count: 1},
+				{Kind: 1, Name: kindName(1), Count: 42},
+				{Kind: 3, Name: kindName(3), Count: 2},
+				{Kind: 7, Name: kindName(7), Count: 9},
+				{Kind: 30023, Name: kindName(30023), Count: 5},
+			},
+		},
+		{name: "nothing stored", method: http.MethodGet, wantStatus: http.StatusOK, want: []KindCount{}},
+		{name: "database error", method: http.MethodGet, queryErr: sql.ErrConnDone, wantStatus: http.StatusInternalServerError},
+		{name: "POST", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.method == http.MethodGet {
+				q := mock.ExpectQuery(`GROUP BY event_kind ORDER BY event_kind$`).WithArgs(pubkey)
+				if tt.queryErr != nil {
+					q.WillReturnError(tt.queryErr)
+				} else {
+					rows := sqlmock.NewRows([]string{"event_kind", "count"})
+					for _, r := range tt.rows {
+						rows.AddRow(r[0], r[1])
+					}
+					q.WillReturnRows(rows)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			apiNpubHandler(&databases{primary: db})(rec, httptest.NewRequest(tt.method, "/api/npub/"+npub+"/kinds", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []KindCount
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %s: %v", rec.Body, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kinds = %+v, want %+v", got, tt.want)
+			}
+			if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i].Kind < got[j].Kind }) {
+				t.Error("kinds are not sorted ascending")
+			}
+		})
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSONError(rec, http.StatusNotFound, errCodeNotFound, `No "such" event`)
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("status = %d, Content-Type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if want := `{"error":{"code":"not_found","message":"No \"such\" event"}}` + "\n"; rec.Body.String() != want {
+		t.Errorf("body = %s, want %s", rec.Body, want)
+	}
+}
+
+func TestAPIErrorResponses(t *testing.T) {
+	const pubkey = "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"
+	const blocked = "e493dbf1c10d80f3581e4904930b1404cc6c13900ee0758474fa94abe8c4cd13"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	blockedNpub, _ := nip19.EncodePublicKey(blocked)
+	missing := strings.Repeat("d", 64)
+	blockedPubkeys = map[string]bool{blocked: true}
+	defer func() { blockedPubkeys = map[string]bool{}; adminToken = ""; readOnly.Store(false) }()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dbErr := func(query string) func(sqlmock.Sqlmock) {
+		return func(mock sqlmock.Sqlmock) { mock.ExpectQuery(query).WillReturnError(sql.ErrConnDone) }
+	}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     string
+		admin      string
+		readOnly   bool
+		handler    func(*databases) http.HandlerFunc
+		expect     func(sqlmock.Sqlmock)
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "invalid npub", path: "/api/npub/npub1nope/kinds", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidNpub},
+		{name: "blocked pubkey", path: "/api/npub/" + blockedNpub + "/kinds", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "unknown endpoint", path: "/api/npub/" + npub + "/friends", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "POST to count", method: http.MethodPost, path: "/api/npub/" + npub + "/count", wantStatus: http.StatusMethodNotAllowed, wantCode: errCodeMethodNotAllowed},
+		{name: "kinds database error", path: "/api/npub/" + npub + "/kinds", expect: dbErr(`GROUP BY event_kind`), wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+		{name: "count database error", path: "/api/npub/" + npub + "/count", expect: dbErr(`SELECT COUNT`), wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+		{name: "latest without a kind", path: "/api/npub/" + npub + "/latest", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidKind},
+		{name: "latest kind out of range", path: "/api/npub/" + npub + "/latest?kind=65536", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidKind},
+		{
+			name: "latest of a kind never stored",
+			path: "/api/npub/" + npub + "/latest?kind=3",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`event_kind = \$2`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+			},
+			wantStatus: http.StatusNotFound, wantCode: errCodeNotFound,
+		},
+		{name: "latest database error", path: "/api/npub/" + npub + "/latest?kind=3", expect: dbErr(`event_kind = \$2`), wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+		{name: "events with a bad cursor", path: "/api/npub/" + npub + "/events?cursor=not-a-cursor", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidCursor},
+		{name: "events with a bad since_id", path: "/api/npub/" + npub + "/events?since_id=abc", wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidID},
+		{
+			name: "events since an unknown id",
+			path: "/api/npub/" + npub + "/events?since_id=" + missing,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT created_at`).WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+			},
+			wantStatus: http.StatusNotFound, wantCode: errCodeUnknownSinceID,
+		},
+		{name: "events database error", path: "/api/npub/" + npub + "/events", expect: dbErr(`created_at, id\) >`), wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+		{name: "purge without admin token configured", method: http.MethodDelete, path: "/api/npub/" + npub + "/events", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "purge with a wrong token", method: http.MethodDelete, path: "/api/npub/" + npub + "/events", admin: "secret", header: "Bearer guess", wantStatus: http.StatusUnauthorized, wantCode: errCodeUnauthorized},
+		{name: "purge while read-only", method: http.MethodDelete, path: "/api/npub/" + npub + "/events", admin: "secret", header: "Bearer secret", readOnly: true, wantStatus: http.StatusServiceUnavailable, wantCode: errCodeReadOnly},
+		{
+			name: "purge database error", method: http.MethodDelete, path: "/api/npub/" + npub + "/events", admin: "secret", header: "Bearer secret",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM event_backup`).WillReturnError(sql.ErrConnDone)
+			},
+			wantStatus: http.StatusInternalServerError, wantCode: errCodeDB,
+		},
+		{name: "event with a bad id", path: "/api/event/xyz", handler: eventAPIHandler, wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidID},
+		{name: "DELETE an event", method: http.MethodDelete, path: "/api/event/" + missing, handler: eventAPIHandler, wantStatus: http.StatusMethodNotAllowed, wantCode: errCodeMethodNotAllowed},
+		{name: "search with a short prefix", path: "/api/search/pubkey?prefix=ab", handler: pubkeySearchHandler, wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidPrefix},
+		{name: "search database error", path: "/api/search/pubkey?prefix=abcdef12", handler: pubkeySearchHandler, expect: dbErr(`SELECT DISTINCT pubkey`), wantStatus: http.StatusInternalServerError, wantCode: errCodeDB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			adminToken = tt.admin
+			readOnly.Store(tt.readOnly)
+			handler := tt.handler
+			if handler == nil {
+				handler = apiNpubHandler
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler(&databases{primary: db}).ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			// The body is exactly {"error":{"code":...,"message":...}}
+			var body map[string]map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body) != 1 || len(body["error"]) != 2 {
+				t.Fatalf("body = %s, want a single error object", rec.Body)
+			}
+			if body["error"]["code"] != tt.wantCode || body["error"]["message"] == "" {
+				t.Errorf("error = %v, want code %q and a message", body["error"], tt.wantCode)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCountAPI(t *testing.T) {
+	const pubkey = "2f8bde4d1a07209355b4a7250a5c5128e88b84bddc619ab7cba8d569b240efe4"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	tests := []struct {
+		name       string
+		identifier string
+		count      int64
+		wantStatus int
+		wantBody   string
+	}{
+		{"stored events", npub, 42, http.StatusOK, `{"count":42}`},
+		{"unknown pubkey", npub, 0, http.StatusOK, `{"count":0}`},
+		{"hex pubkey", pubkey, 7, http.StatusOK, `{"count":7}`},
+		{"invalid npub", "npub1invalid", 0, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.wantStatus == http.StatusOK {
+				mock.ExpectQuery(`^SELECT COUNT\(\*\) FROM event_backup WHERE pubkey = \$1$`).WithArgs(pubkey).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+			}
+
+			rec := httptest.NewRecorder()
+			apiNpubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/api/npub/"+tt.identifier+"/count", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+			// The npub is validated before the database is queried
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLatestAPI(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	var contacts []nostr.Event
+	for i, follows := range []string{"one friend", "two friends", "three friends"} {
+		ev := nostr.Event{Kind: 3, Content: follows, CreatedAt: nostr.Timestamp(1700000000 + i*100), Tags: nostr.Tags{}}
+		ev.Sign(sk)
+		contacts = append(contacts, ev)
+	}
+	newest := contacts[2]
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		rows       []nostr.Event
+		wantStatus int
+		wantCode   string
+	}{
+		{"newest contact list", http.MethodGet, "?kind=3", []nostr.Event{newest}, http.StatusOK, ""},
+		{"none of the kind", http.MethodGet, "?kind=10002", nil, http.StatusNotFound, errCodeNotFound},
+		{"missing kind", http.MethodGet, "", nil, http.StatusBadRequest, errCodeInvalidKind},
+		{"negative kind", http.MethodGet, "?kind=-1", nil, http.StatusBadRequest, errCodeInvalidKind},
+		{"kind out of range", http.MethodGet, "?kind=65536", nil, http.StatusBadRequest, errCodeInvalidKind},
+		{"POST", http.MethodPost, "?kind=3", nil, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.wantStatus == http.StatusOK || tt.wantStatus == http.StatusNotFound {
+				rows := sqlmock.NewRows([]string{"event_data"})
+				for _, ev := range tt.rows {
+					rows.AddRow(ev.String())
+				}
+				// The database picks the newest; a tie goes to the lowest id
+				kind, _ := strconv.Atoi(strings.TrimPrefix(tt.query, "?kind="))
+				mock.ExpectQuery(`WHERE pubkey = \$1 AND event_kind = \$2 ORDER BY created_at DESC, id ASC LIMIT 1$`).
+					WithArgs(pubkey, kind).WillReturnRows(rows)
+			}
+
+			rec := httptest.NewRecorder()
+			apiNpubHandler(&databases{primary: db})(rec, httptest.NewRequest(tt.method, "/api/npub/"+npub+"/latest"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var got nostr.Event
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.ID != newest.ID || got.Content != "three friends" {
+					t.Errorf("latest = %s %q, want the newest contact list %s", got.ID, got.Content, newest.ID)
+				}
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("body = %s, want error code %s", rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// backupTimeout bounds how long a backup from relays may run
+const backupTimeout = 60 * time.Second
+
+// maxBackupEvents caps the number of events fetched in a single backup
+const maxBackupEvents = 5000
+
+// kindRange is an inclusive range of event kinds
+type kindRange struct {
+	min, max int
+}
+
+// ingestExcludedKinds are the kinds dropped by backups instead of stored
+var ingestExcludedKinds []kindRange
+
+// parseKindRanges parses a comma-separated list of kinds and inclusive
+// ranges, such as "20000-29999,1063"
+func parseKindRanges(s string) ([]kindRange, error) {
+	var ranges []kindRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid kind %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || last < first {
+				return nil, fmt.Errorf("invalid kind range %q", part)
+			}
+		}
+		ranges = append(ranges, kindRange{min: first, max: last})
+	}
+	return ranges, nil
+}
+
+// configureIngestExclusions reads INGEST_EXCLUDE_KINDS. An invalid value is fatal.
+func configureIngestExclusions() {
+	ranges, err := parseKindRanges(os.Getenv("INGEST_EXCLUDE_KINDS"))
+	if err != nil {
+		log.Fatalf("Invalid INGEST_EXCLUDE_KINDS: %v", err)
+	}
+	ingestExcludedKinds = ranges
+	if len(ranges) > 0 {
+		log.Printf("Backups skip kinds %s", os.Getenv("INGEST_EXCLUDE_KINDS"))
+	}
+}
+
+// isIngestExcluded reports whether backups drop events of kind
+func isIngestExcluded(kind int) bool {
+	for _, r := range ingestExcludedKinds {
+		if kind >= r.min && kind <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// insertEvent stores ev in event_backup, reporting whether it was new
+func insertEvent(ctx context.Context, db *sql.DB, ev *nostr.Event) (bool, error) {
+	defer observeDBQuery("insert_event", time.Now())
+
+	query := `INSERT INTO event_backup (id, pubkey, created_at, event_kind, event_data) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING`
+	res, err := db.ExecContext(ctx, query, ev.ID, ev.PubKey, int64(ev.CreatedAt), ev.Kind, ev.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// backupHandler fetches an author's events from the configured relays and
+// stores new ones in event_backup, streaming progress as plain text. The
+// request must be signed with NIP-98 by the author or carry the admin token.
+func backupHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, npub string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectReadOnly(w) {
+		return
+	}
+
+	hexPubkey, err := npubToHex(npub)
+	if errors.Is(err, errPrivateKey) {
+		http.Error(w, privateKeyMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Invalid npub %q: %v", npub, err)
+		http.Error(w, "Invalid npub format", http.StatusBadRequest)
+		return
+	}
+	if isBlocked(hexPubkey) {
+		http.Error(w, unavailableMessage, http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !authorizeOwner(w, r, hexPubkey, body) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	progress := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\n", args...)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), backupTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{
+		Authors: []string{hexPubkey},
+		Limit:   maxBackupEvents,
+	}
+
+	logf(ctx, "Starting backup for pubkey %s from %d relays, requested by %s", hexPubkey, len(readRelays), clientIP(r))
+	seen := map[string]bool{}
+	stored, excluded, failed := 0, 0, 0
+	for _, url := range readRelays {
+		if len(seen) >= maxBackupEvents {
+			progress("Reached the limit of %d events", maxBackupEvents)
+			break
+		}
+
+		progress("Querying %s", url)
+		events, err := queryRelay(ctx, url, filter)
+		if err != nil {
+			debugf(ctx, "Failed to query relay %s: %v", url, err)
+			failed++
+			progress("%s: failed to query", url)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		received, storedHere := 0, 0
+		for _, ev := range events {
+			if seen[ev.ID] || len(seen) >= maxBackupEvents {
+				continue
+			}
+			if ev.PubKey != hexPubkey {
+				continue
+			}
+			if ok, err := ev.CheckSignature(); !ok || err != nil {
+				logf(ctx, "Skipping event %s with invalid signature from %s", ev.ID, url)
+				continue
+			}
+			seen[ev.ID] = true
+			received++
+			if isIngestExcluded(ev.Kind) {
+				excluded++
+				continue
+			}
+
+			isNew, err := insertEvent(ctx, db, ev)
+			if err != nil {
+				logf(ctx, "Failed to store event %s: %v", ev.ID, err)
+				continue
+			}
+			if isNew {
+				storedHere++
+			}
+		}
+		stored += storedHere
+		progress("%s: received %d events, stored %d new", url, received, storedHere)
+	}
+
+	if failed == len(readRelays) {
+		warnf(ctx, "All %d relays failed during backup for %s", failed, hexPubkey)
+	}
+	logf(ctx, "Backup for pubkey %s completed: %d new events, %d of excluded kinds skipped", hexPubkey, stored, excluded)
+	if excluded > 0 {
+		progress("Skipped %d events of excluded kinds", excluded)
+	}
+	progress("Done: stored %d new events", stored)
+}
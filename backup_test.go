@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestBackupHandler(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	kept := nostr.Event{Kind: 1, Content: "keep me", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	kept.Sign(sk)
+	known := nostr.Event{Kind: 3, Content: "", CreatedAt: 1700000001, Tags: nostr.Tags{{"p", pubkey}}}
+	known.Sign(sk)
+	forged := kept
+	forged.Content = "edited after signing"
+	forged.ID = forged.GetID()
+	stranger := nostr.Event{Kind: 1, Content: "not theirs", CreatedAt: 1700000002, Tags: nostr.Tags{}}
+	stranger.Sign(nostr.GeneratePrivateKey())
+
+	adminToken = "backup-token"
+	defer func() { adminToken = "" }()
+
+	tests := []struct {
+		name       string
+		auth       string
+		readOnly   bool
+		wantStatus int
+		wantBody   []string
+		wantDials  int
+	}{
+		{"unauthenticated", "", false, http.StatusUnauthorized, nil, 0},
+		{"read-only", "Bearer backup-token", true, http.StatusServiceUnavailable, nil, 0},
+		{
+			"admin token", "Bearer backup-token", false, http.StatusOK,
+			[]string{"received 2 events, stored 1 new", "Done: stored 1 new events"}, 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+					for _, ev := range []nostr.Event{kept, known, kept, forged, stranger} {
+						reply(eventMessage(req.SubscriptionID, ev))
+					}
+					reply(`["EOSE","` + req.SubscriptionID + `"]`)
+				}
+			})
+			readRelays = []string{relay.url}
+			readOnly.Store(tt.readOnly)
+			defer readOnly.Store(false)
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.wantStatus == http.StatusOK {
+				mock.ExpectExec(`INSERT INTO event_backup`).WithArgs(kept.ID, pubkey, int64(kept.CreatedAt), 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO event_backup`).WithArgs(known.ID, pubkey, int64(known.CreatedAt), 3, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/backup", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			backupHandler(db, rec, req, npub)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("progress lacks %q:\n%s", want, rec.Body)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if got := relay.connections(); got != tt.wantDials {
+				t.Errorf("relay dialed %d times, want %d", got, tt.wantDials)
+			}
+		})
+	}
+}
+
+func TestParseKindRanges(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []kindRange
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "1063", want: []kindRange{{1063, 1063}}},
+		{in: "20000-29999, 1063 ,", want: []kindRange{{20000, 29999}, {1063, 1063}}},
+		{in: " 5 - 7 ", want: []kindRange{{5, 7}}},
+		{in: "7-5", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "video", wantErr: true},
+		{in: "1-x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseKindRanges(tt.in)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseKindRanges(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBackupSkipsExcludedKinds(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	var events []nostr.Event
+	for i, kind := range []int{1, 20001, 1063, 30023} {
+		ev := nostr.Event{Kind: kind, Content: "kind " + strconv.Itoa(kind), CreatedAt: nostr.Timestamp(1700000000 + i), Tags: nostr.Tags{}}
+		ev.Sign(sk)
+		events = append(events, ev)
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(kinds []kindRange) { ingestExcludedKinds = kinds }(ingestExcludedKinds)
+	t.Setenv("INGEST_EXCLUDE_KINDS", "20000-29999,1063")
+	configureIngestExclusions()
+	adminToken = "backup-token"
+	defer func() { adminToken = "" }()
+
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			for _, ev := range events {
+				reply(eventMessage(req.SubscriptionID, ev))
+			}
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	readRelays = []string{relay.url}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Only the kinds outside the exclusions reach the database
+	mock.MatchExpectationsInOrder(false)
+	for _, ev := range []nostr.Event{events[0], events[3]} {
+		mock.ExpectExec(`INSERT INTO event_backup`).WithArgs(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/backup", nil)
+	req.Header.Set("Authorization", "Bearer backup-token")
+	rec := httptest.NewRecorder()
+	backupHandler(db, rec, req, npub)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{"received 4 events, stored 2 new", "Skipped 2 events of excluded kinds"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("progress lacks %q:\n%s", want, rec.Body)
+		}
+	}
+	if strings.Contains(logs.String(), "Failed to store") {
+		t.Errorf("an excluded event was inserted:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "2 new events, 2 of excluded kinds skipped") {
+		t.Errorf("log does not count the skipped events:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// parseBasePath validates BASE_PATH, returning it with a leading slash and
+// no trailing slash, or "" when the service is served at the root
+func parseBasePath(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "/" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "/") {
+		v = "/" + v
+	}
+	v = strings.TrimSuffix(v, "/")
+	if path.Clean(v) != v || strings.ContainsAny(v, "?#") {
+		return "", fmt.Errorf("invalid BASE_PATH %q: must be a clean path such as /restore", v)
+	}
+	return v, nil
+}
+
+// withBasePath serves h under site.BasePath, stripping the prefix so the
+// routes stay the same. Requests outside the prefix are not found.
+func withBasePath(h http.Handler) http.Handler {
+	if site.BasePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == site.BasePath {
+			http.Redirect(w, r, site.BasePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, site.BasePath+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
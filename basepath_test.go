@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestParseBasePath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"/restore", "/restore", false},
+		{"restore/", "/restore", false},
+		{" /tools/restore ", "/tools/restore", false},
+		{"/a//b", "", true},
+		{"/a/../b", "", true},
+		{"/restore?x=1", "", true},
+		{"/restore#top", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseBasePath(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBasePath(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	defer func(base string) { site.BasePath = base }(site.BasePath)
+	site.BasePath = "/restore"
+	h := withBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "routed "+r.URL.Path)
+	}))
+
+	tests := []struct {
+		path         string
+		wantCode     int
+		wantBody     string
+		wantLocation string
+	}{
+		{"/restore/", http.StatusOK, "routed /", ""},
+		{"/restore/npub/npub1xyz", http.StatusOK, "routed /npub/npub1xyz", ""},
+		{"/restore/static/style.css", http.StatusOK, "routed /static/style.css", ""},
+		{"/restore", http.StatusMovedPermanently, "", "/restore/"},
+		{"/", http.StatusNotFound, "", ""},
+		{"/restored/", http.StatusNotFound, "", ""},
+		{"/npub/npub1xyz", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("GET %s: status = %d, want %d", tt.path, rec.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("GET %s: body = %q, want %q", tt.path, rec.Body, tt.wantBody)
+		}
+		if got := rec.Header().Get("Location"); got != tt.wantLocation {
+			t.Errorf("GET %s: Location = %q, want %q", tt.path, got, tt.wantLocation)
+		}
+	}
+}
+
+func TestHomePageUnderBasePath(t *testing.T) {
+	const pubkey = "c1d3e5f7a9b1c3d5e7f9a1b3c5d7e9f1a3b5c7d9e1f3a5b7c9d1e3f5a7b9c1d3"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	defer func(base string, recent bool) { site.BasePath, showRecent = base, recent }(site.BasePath, showRecent)
+	site.BasePath, showRecent = "/restore", true
+	profiles.set(pubkey, &UserProfile{Name: "heron"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(`SELECT pubkey, MAX\(created_at\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"pubkey", "latest"}).AddRow(pubkey, int64(1700000000)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", homeHandler(&databases{primary: db}))
+	srv := httptest.NewServer(withBasePath(mux))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/restore/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	page := string(body)
+	for _, want := range []string{
+		`href="/restore/static/style.css`,
+		`src="/restore/static/script.js`,
+		`action="/restore/npub/"`,
+		`href="/restore/npub/` + npub + `">heron</a>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("home page lacks %s", want)
+		}
+	}
+	for _, unwanted := range []string{`href="/static/`, `src="/static/`, `action="/npub/`, `href="/npub/`} {
+		if strings.Contains(page, unwanted) {
+			t.Errorf("home page has the unprefixed link %s", unwanted)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// basicAuthUser and basicAuthPass are the credentials required for every
+// page when both are set, for private archives
+var basicAuthUser, basicAuthPass string
+
+// configureBasicAuth reads BASIC_AUTH_USER and BASIC_AUTH_PASS. Setting only
+// one of them is fatal, since it would silently leave the site open.
+func configureBasicAuth() {
+	basicAuthUser = os.Getenv("BASIC_AUTH_USER")
+	basicAuthPass = os.Getenv("BASIC_AUTH_PASS")
+	if (basicAuthUser == "") != (basicAuthPass == "") {
+		log.Fatal("BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together")
+	}
+	if basicAuthUser != "" {
+		log.Printf("Basic authentication enabled for user %s", basicAuthUser)
+	}
+}
+
+// requireBasicAuth serves h only to requests with the basic auth
+// credentials when they are configured. Health checks, admin requests and
+// NIP-98 signed requests, which authenticate on their own, are let through.
+func requireBasicAuth(h http.Handler) http.Handler {
+	if basicAuthUser == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || hasAdminToken(r) || isHTTPAuthRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, pass, _ := r.BasicAuth()
+		// Both are compared so the response does not reveal which was wrong
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(basicAuthUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(basicAuthPass)) == 1
+		if !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isHTTPAuthRequest reports whether r is a POST carrying a NIP-98
+// Authorization header to an endpoint that verifies it. The header takes
+// the place of basic auth credentials, which it cannot be sent with.
+func isHTTPAuthRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Authorization"), "Nostr ") {
+		return false
+	}
+	if r.URL.Path == "/restore-selected" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/npub/")
+	if !ok {
+		return false
+	}
+	_, action, _ := strings.Cut(rest, "/")
+	return action == "restore-all" || action == "backup"
+}
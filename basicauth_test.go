@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestConfigureBasicAuth(t *testing.T) {
+	defer func(user, pass string) { basicAuthUser, basicAuthPass = user, pass }(basicAuthUser, basicAuthPass)
+	t.Setenv("BASIC_AUTH_USER", "archivist")
+	t.Setenv("BASIC_AUTH_PASS", "s3cret")
+	configureBasicAuth()
+	if basicAuthUser != "archivist" || basicAuthPass != "s3cret" {
+		t.Errorf("credentials = %q/%q", basicAuthUser, basicAuthPass)
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	defer func(user, pass, token string) {
+		basicAuthUser, basicAuthPass, adminToken = user, pass, token
+	}(basicAuthUser, basicAuthPass, adminToken)
+	basicAuthUser, basicAuthPass, adminToken = "archivist", "s3cret", "basic-admin"
+	h := requireBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "archive")
+	}))
+
+	tests := []struct {
+		name     string
+		path     string
+		auth     func(r *http.Request)
+		wantCode int
+	}{
+		{"missing credentials", "/", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", "/", func(r *http.Request) { r.SetBasicAuth("archivist", "guess") }, http.StatusUnauthorized},
+		{"wrong user", "/", func(r *http.Request) { r.SetBasicAuth("visitor", "s3cret") }, http.StatusUnauthorized},
+		{"password prefix", "/", func(r *http.Request) { r.SetBasicAuth("archivist", "s3c") }, http.StatusUnauthorized},
+		{"not basic", "/npub/x", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusUnauthorized},
+		{"correct credentials", "/", func(r *http.Request) { r.SetBasicAuth("archivist", "s3cret") }, http.StatusOK},
+		{"correct credentials on a page", "/npub/x", func(r *http.Request) { r.SetBasicAuth("archivist", "s3cret") }, http.StatusOK},
+		{"health check", "/healthz", func(*http.Request) {}, http.StatusOK},
+		{"admin token", "/api/admin/stats", func(r *http.Request) { r.Header.Set("Authorization", "Bearer basic-admin") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			tt.auth(r)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			challenge := rec.Header().Get("WWW-Authenticate")
+			if tt.wantCode == http.StatusUnauthorized {
+				if challenge != `Basic realm="restricted", charset="UTF-8"` {
+					t.Errorf("WWW-Authenticate = %q", challenge)
+				}
+				if rec.Body.String() == "archive" {
+					t.Error("the page was served without credentials")
+				}
+			} else if challenge != "" || rec.Body.String() != "archive" {
+				t.Errorf("got challenge %q and body %q", challenge, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRequireBasicAuthDisabled(t *testing.T) {
+	defer func(user, pass string) { basicAuthUser, basicAuthPass = user, pass }(basicAuthUser, basicAuthPass)
+	basicAuthUser, basicAuthPass = "", ""
+	rec := httptest.NewRecorder()
+	requireBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "open")
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "open" {
+		t.Errorf("status = %d, body = %q", rec.Code, rec.Body)
+	}
+}
+
+func TestRequireBasicAuthLetsSignedRequestsThrough(t *testing.T) {
+	defer func(user, pass string) { basicAuthUser, basicAuthPass = user, pass }(basicAuthUser, basicAuthPass)
+	basicAuthUser, basicAuthPass = "archivist", "s3cret"
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	// The signature is still checked by the endpoint behind basic auth
+	h := requireBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if signer, ok := authorizeRequest(w, r, body); ok {
+			io.WriteString(w, signer)
+		}
+	}))
+
+	body := `["` + strings.Repeat("a", 64) + `"]`
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		auth     string
+		wantCode int
+	}{
+		{"restore selected", http.MethodPost, "/restore-selected", "signed", http.StatusOK},
+		{"restore all", http.MethodPost, "/npub/npub1x/restore-all", "signed", http.StatusOK},
+		{"backup", http.MethodPost, "/npub/npub1x/backup", "signed", http.StatusOK},
+		{"forged signature", http.MethodPost, "/restore-selected", "forged", http.StatusUnauthorized},
+		{"unsigned", http.MethodPost, "/restore-selected", "", http.StatusUnauthorized},
+		{"page", http.MethodPost, "/npub/npub1x", "signed", http.StatusUnauthorized},
+		{"export", http.MethodPost, "/npub/npub1x/export.json", "signed", http.StatusUnauthorized},
+		{"not a post", http.MethodGet, "/npub/npub1x/restore-all", "signed", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			switch tt.auth {
+			case "signed":
+				r.Header.Set("Authorization", nip98Authorization(sk, tt.method, "http://example.com"+tt.path, []byte(body), nil))
+			case "forged":
+				// Another author's key on this header's signature
+				raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(nip98Authorization(sk, tt.method, "http://example.com"+tt.path, []byte(body), nil), "Nostr "))
+				other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+				forged := strings.Replace(string(raw), pubkey, other, 1)
+				r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(forged)))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode == http.StatusOK && rec.Body.String() != pubkey {
+				t.Errorf("signer = %q, want %s", rec.Body, pubkey)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blockedPubkeys are hex pubkeys whose events and profiles are not shown
+var blockedPubkeys = map[string]bool{}
+
+// unavailableMessage is shown for blocked pubkeys without saying why
+const unavailableMessage = "This profile is unavailable."
+
+// configureBlocklist reads the comma-separated hex pubkeys or npubs in
+// BLOCKLIST. An invalid entry is fatal.
+func configureBlocklist() {
+	for _, s := range strings.Split(os.Getenv("BLOCKLIST"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pubkey := strings.ToLower(s)
+		if strings.HasPrefix(s, "npub1") {
+			var err error
+			if pubkey, err = decodeNpub(s); err != nil {
+				log.Fatalf("Invalid BLOCKLIST entry %q: %v", s, err)
+			}
+		} else if !nostr.IsValidPublicKeyHex(pubkey) {
+			log.Fatalf("Invalid BLOCKLIST entry %q", s)
+		}
+		blockedPubkeys[pubkey] = true
+	}
+	if len(blockedPubkeys) > 0 {
+		log.Printf("Blocking %d pubkeys", len(blockedPubkeys))
+	}
+}
+
+// isBlocked reports whether pubkey is on the blocklist
+func isBlocked(pubkey string) bool {
+	return blockedPubkeys[pubkey]
+}
+
+// blockedList returns the blocked pubkeys for use in queries
+func blockedList() []string {
+	list := make([]string, 0, len(blockedPubkeys))
+	for pubkey := range blockedPubkeys {
+		list = append(list, pubkey)
+	}
+	return list
+}
+
+// rejectBlocked renders the unavailable page and returns true when pubkey
+// is blocked
+func rejectBlocked(w http.ResponseWriter, pubkey string) bool {
+	if !isBlocked(pubkey) {
+		return false
+	}
+	renderError(w, http.StatusNotFound, unavailableMessage)
+	return true
+}
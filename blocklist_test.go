@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestConfigureBlocklist(t *testing.T) {
+	const spammer = "4f6f9a7cbbcf0e0d0d8bf14c6bc6e3a89b43fd4d6f0bc7fbb0ed71d17f2a1c7e"
+	const troll = "9c2e204b3e0c48ea7c3a0a1c7b5d5b4b7cb0ad7f5c9b0e36a8e615e38abf6ad1"
+	trollNpub, _ := nip19.EncodePublicKey(troll)
+	defer func(blocked map[string]bool) { blockedPubkeys = blocked }(blockedPubkeys)
+
+	tests := []struct {
+		name string
+		env  string
+		want map[string]bool
+	}{
+		{"unset", "", map[string]bool{}},
+		{"hex and npub", spammer + "," + trollNpub, map[string]bool{spammer: true, troll: true}},
+		{"uppercase hex and spaces", " " + strings.ToUpper(spammer) + " ,, ", map[string]bool{spammer: true}},
+		{"duplicate as npub", troll + "," + trollNpub, map[string]bool{troll: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BLOCKLIST", tt.env)
+			blockedPubkeys = map[string]bool{}
+			configureBlocklist()
+			if !reflect.DeepEqual(blockedPubkeys, tt.want) {
+				t.Errorf("blockedPubkeys = %v, want %v", blockedPubkeys, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockedPubkeyPageIsUnavailable(t *testing.T) {
+	const blocked = "4f6f9a7cbbcf0e0d0d8bf14c6bc6e3a89b43fd4d6f0bc7fbb0ed71d17f2a1c7e"
+	const allowed = "0a3f4e2b1c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f"
+	defer func(blocked map[string]bool) { blockedPubkeys = blocked }(blockedPubkeys)
+	t.Setenv("BLOCKLIST", blocked)
+	blockedPubkeys = map[string]bool{}
+	configureBlocklist()
+	profiles.set(allowed, &UserProfile{Name: "mia"})
+	defer profiles.delete(allowed)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		name    string
+		pubkey  string
+		blocked bool
+	}{
+		{"blocklisted", blocked, true},
+		{"not blocklisted", allowed, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			npub, _ := nip19.EncodePublicKey(tt.pubkey)
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			if !tt.blocked {
+				mock.ExpectQuery(`ORDER BY event_kind ASC`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+			}
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+			body := rec.Body.String()
+			if tt.blocked {
+				if rec.Code != http.StatusNotFound || !strings.Contains(body, unavailableMessage) {
+					t.Errorf("status = %d, want 404 saying %q", rec.Code, unavailableMessage)
+				}
+				// The page is neutral, revealing nothing about the pubkey
+				if strings.Contains(body, tt.pubkey) || strings.Contains(body, "block") {
+					t.Error("unavailable page mentions the pubkey or the blocklist")
+				}
+			} else if rec.Code != http.StatusOK || !strings.Contains(body, "mia") {
+				t.Errorf("status = %d, want the profile page", rec.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
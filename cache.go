@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// profileCacheTTL is how long fetched profiles are reused
+var profileCacheTTL = 10 * time.Minute
+
+type profileCacheEntry struct {
+	profile *UserProfile
+	expires time.Time
+}
+
+// profileCache is an in-memory cache of profiles fetched from relays
+type profileCache struct {
+	mu      sync.Mutex
+	entries map[string]profileCacheEntry
+	stats   cacheStats
+}
+
+var profiles = &profileCache{entries: map[string]profileCacheEntry{}}
+
+// get returns the cached profile for pubkey if it has not expired
+func (c *profileCache) get(pubkey string) (*UserProfile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[pubkey]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, pubkey)
+		c.stats.miss()
+		return nil, false
+	}
+	c.stats.hit()
+	return entry.profile, true
+}
+
+// set stores profile for pubkey
+func (c *profileCache) set(pubkey string, profile *UserProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[pubkey] = profileCacheEntry{profile: profile, expires: time.Now().Add(profileCacheTTL)}
+}
+
+// delete drops the cached profile of pubkey
+func (c *profileCache) delete(pubkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, pubkey)
+}
+
+// hitRatio returns the ratio of cache hits to lookups
+func (c *profileCache) hitRatio() float64 {
+	return hitRatio(c.stats.load())
+}
+
+// getProfile returns the profile for pubkey from the cache or from relays,
+// trying the read relays in the user's stored NIP-65 list first. It falls
+// back to the newest kind-0 event stored in event_backup.
+func getProfile(ctx context.Context, db *sql.DB, pubkey string) (*UserProfile, error) {
+	if profile, ok := profiles.get(pubkey); ok {
+		return profile, nil
+	}
+
+	var preferred []string
+	if !relayFetchDisabled {
+		preferred = readRelaysForPubkey(ctx, db, pubkey)
+	}
+	profile, err := fetchProfileFromRelays(ctx, pubkey, preferred)
+	if err != nil {
+		logf(ctx, "Error fetching profile for %s: %v", pubkey, err)
+		profile = &UserProfile{}
+	}
+	profile = withStoredProfile(ctx, db, pubkey, profile)
+	// Don't cache a profile that may be incomplete because the request was cancelled
+	if ctx.Err() != nil {
+		return profile, ctx.Err()
+	}
+	profiles.set(pubkey, profile)
+	return profile, nil
+}
+
+// withStoredProfile returns profile, or the newest kind-0 event stored in
+// event_backup for pubkey when profile is empty
+func withStoredProfile(ctx context.Context, db *sql.DB, pubkey string, profile *UserProfile) *UserProfile {
+	if !profile.isEmpty() {
+		return profile
+	}
+	stored, err := profileFromBackup(ctx, db, pubkey)
+	if err == nil {
+		logf(ctx, "Using stored kind-0 profile for pubkey %s", pubkey)
+		return stored
+	}
+	if err != sql.ErrNoRows {
+		logf(ctx, "Failed to load stored profile for %s: %v", pubkey, err)
+	}
+	return profile
+}
+
+// npubCacheSize is the maximum number of cached npub conversions
+const npubCacheSize = 1024
+
+// lruCache is a bounded LRU cache of values by string key
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruCacheEntry[V any] struct {
+	key   string
+	value V
+}
+
+// npubs caches npub to hex pubkey conversions
+var npubs = newLRUCache[string](npubCacheSize)
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the cached value for key
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruCacheEntry[V]).value, true
+}
+
+// add stores value for key, evicting the least recently used entry when full
+func (c *lruCache[V]) add(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruCacheEntry[V]).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruCacheEntry[V]{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry[V]).key)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestNpubToHexMatchesDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		npub string
+	}{
+		{"fiatjaf", "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w6"},
+		{"generated", func() string {
+			pk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+			npub, _ := nip19.EncodePublicKey(pk)
+			return npub
+		}()},
+		{"wrong prefix", "note1fntxtkcy9pjwucqwa9mddn7v03wwwsu9j330jj350nvhpky2tuaspk6nqc"},
+		{"bad checksum", "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantErr := decodeNpub(tt.npub)
+			// The first call fills the cache and the second is served from it
+			for i := 0; i < 2; i++ {
+				got, err := npubToHex(tt.npub)
+				if got != want || (err == nil) != (wantErr == nil) {
+					t.Errorf("call %d: npubToHex() = %q, %v, want %q, %v", i+1, got, err, want, wantErr)
+				}
+			}
+			if _, cached := npubs.get(tt.npub); cached != (wantErr == nil) {
+				t.Errorf("cached = %v, want %v", cached, wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestNpubCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache[string](2)
+	c.add("npub-a", "a")
+	c.add("npub-b", "b")
+	c.get("npub-a")
+	c.add("npub-c", "c")
+
+	for npub, want := range map[string]bool{"npub-a": true, "npub-b": false, "npub-c": true} {
+		if _, ok := c.get(npub); ok != want {
+			t.Errorf("get(%s) cached = %v, want %v", npub, ok, want)
+		}
+	}
+}
+
+func BenchmarkNpubToHex(b *testing.B) {
+	const npub = "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w6"
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeNpub(npub); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		npubToHex(npub)
+		for i := 0; i < b.N; i++ {
+			if _, err := npubToHex(npub); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached miss", func(b *testing.B) {
+		keys := make([]string, 4*npubCacheSize)
+		for i := range keys {
+			npub, _ := nip19.EncodePublicKey(fmt.Sprintf("%064x", i))
+			keys[i] = npub
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			npubToHex(keys[i%len(keys)])
+		}
+	})
+}
+
+func TestGetProfileFallsBackToStoredProfile(t *testing.T) {
+	// Nothing listens on a port whose listener was closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "ws://" + l.Addr().String()
+	l.Close()
+	defer func(relays []string, retries int, gateway string) {
+		readRelays, relayConnectRetries, profileGatewayURL = relays, retries, gateway
+	}(readRelays, relayConnectRetries, profileGatewayURL)
+	readRelays, relayConnectRetries, profileGatewayURL = []string{down}, 0, ""
+
+	tests := []struct {
+		name     string
+		pubkey   string
+		stored   string
+		wantName string
+		wantRaw  string
+	}{
+		{
+			name:     "stored kind-0 is used",
+			pubkey:   "b0635d6a9851d3aed0cd6c495b282167acf761729078d975fc341b22650b07b9",
+			stored:   `{"kind":0,"content":"{\"name\":\"ivan\",\"about\":\"from the backup\"}"}`,
+			wantName: "ivan",
+			wantRaw:  `{"name":"ivan","about":"from the backup"}`,
+		},
+		{
+			name:   "nothing stored",
+			pubkey: "6e468422dfb74a5738702a8823b9b28168abab8655faacb6853cd0ee15deee93",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer profiles.delete(tt.pubkey)
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(`event_kind = 10002`).WithArgs(tt.pubkey).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+			stored := sqlmock.NewRows([]string{"event_data"})
+			if tt.stored != "" {
+				stored.AddRow(tt.stored)
+			}
+			mock.ExpectQuery(`event_kind = 0`).WithArgs(tt.pubkey).WillReturnRows(stored)
+
+			profile, err := getProfile(context.Background(), db, tt.pubkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Name != tt.wantName || profile.RawContent != tt.wantRaw {
+				t.Errorf("profile = %+v, want name %q from %q", profile, tt.wantName, tt.wantRaw)
+			}
+			if tt.wantName != "" && profile.Source() != "backup" {
+				t.Errorf("Source() = %q, want backup", profile.Source())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if cached, ok := profiles.get(tt.pubkey); !ok || cached.Name != tt.wantName {
+				t.Errorf("cached profile = %+v, %v", cached, ok)
+			}
+		})
+	}
+}
+
+func TestGetProfileWithRelayFetchDisabled(t *testing.T) {
+	const pubkey = "a1b52e5f7b1f4b9d9b2d64a64c3a5a2b59fd0ac04b4ed5f0d0ad682bae92aa01"
+	defer profiles.delete(pubkey)
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	var gatewayHits atomic.Int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatewayHits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer gateway.Close()
+	defer func(disabled bool, url string) { relayFetchDisabled, profileGatewayURL = disabled, url }(relayFetchDisabled, profileGatewayURL)
+	relayFetchDisabled, profileGatewayURL = true, gateway.URL
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Neither the relay list nor anything else leads to a relay
+	mock.ExpectQuery(`event_kind = 0`).WithArgs(pubkey).
+		WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(`{"kind":0,"content":"{\"name\":\"offline\"}"}`))
+
+	profile, err := getProfile(context.Background(), db, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "offline" || profile.Source() != "backup" {
+		t.Errorf("profile = %+v, want the stored one", profile)
+	}
+	if n := relay.connections(); n != 0 {
+		t.Errorf("relay was dialed %d times with relay fetching disabled", n)
+	}
+	if n := gatewayHits.Load(); n != 0 {
+		t.Errorf("gateway was asked %d times with relay fetching disabled", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
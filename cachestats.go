@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cacheStatsInterval is how often cache statistics are logged, set with
+// CACHE_STATS_INTERVAL; 0 disables the log line
+var cacheStatsInterval = 5 * time.Minute
+
+// cacheStats counts the lookups of a cache. The counters are cumulative,
+// like the Prometheus metrics; the periodic log line reports the change
+// since the previous line.
+type cacheStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (s *cacheStats) hit()  { s.hits.Add(1) }
+func (s *cacheStats) miss() { s.misses.Add(1) }
+
+// load returns the current hit and miss counts
+func (s *cacheStats) load() (hits, misses uint64) {
+	return s.hits.Load(), s.misses.Load()
+}
+
+// hitRatio returns the ratio of hits to lookups, or 0 without lookups
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// namedCacheStats are the caches included in the periodic log line
+var namedCacheStats = []struct {
+	name  string
+	stats *cacheStats
+}{
+	{"profiles", &profiles.stats},
+	{"pages", &pages.stats},
+}
+
+// cacheStatsSummary formats the lookups of each cache since prev, updating
+// prev to the current counts. Caches without lookups are left out.
+func cacheStatsSummary(prev map[string][2]uint64) string {
+	var parts []string
+	for _, c := range namedCacheStats {
+		hits, misses := c.stats.load()
+		last := prev[c.name]
+		prev[c.name] = [2]uint64{hits, misses}
+		hits, misses = hits-last[0], misses-last[1]
+		if hits+misses == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %d hits / %d misses (%.1f%%)", c.name, hits, misses, 100*hitRatio(hits, misses)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// startCacheStatsLogger logs the cache hit ratios every cacheStatsInterval
+func startCacheStatsLogger() {
+	if cacheStatsInterval <= 0 {
+		return
+	}
+	go func() {
+		prev := map[string][2]uint64{}
+		for range time.Tick(cacheStatsInterval) {
+			if summary := cacheStatsSummary(prev); summary != "" {
+				log.Printf("Cache stats over the last %v: %s", cacheStatsInterval, summary)
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProfileCacheCountsLookups(t *testing.T) {
+	defer func(ttl time.Duration) { profileCacheTTL = ttl }(profileCacheTTL)
+	profileCacheTTL = time.Hour
+	c := &profileCache{entries: map[string]profileCacheEntry{}}
+	c.set("cached", &UserProfile{Name: "quill"})
+	c.entries["stale"] = profileCacheEntry{profile: &UserProfile{}, expires: time.Now().Add(-time.Second)}
+
+	// Lookups from many goroutines must all be counted
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.get("cached")
+			c.get("cached")
+			c.get("unknown")
+		}()
+	}
+	wg.Wait()
+	c.get("stale")
+
+	if hits, misses := c.stats.load(); hits != 100 || misses != 51 {
+		t.Errorf("hits, misses = %d, %d, want 100, 51", hits, misses)
+	}
+	if got, want := c.hitRatio(), 100.0/151; got != want {
+		t.Errorf("hitRatio() = %v, want %v", got, want)
+	}
+}
+
+func TestPageCacheCountsLookups(t *testing.T) {
+	c := &pageCache{entries: map[string]cachedPage{}}
+	c.set("/npub/fresh", cachedPage{body: []byte("page"), expires: time.Now().Add(time.Minute)})
+	c.set("/npub/old", cachedPage{body: []byte("page"), expires: time.Now().Add(-time.Minute)})
+
+	c.get("/npub/fresh")
+	c.get("/npub/old")
+	c.get("/npub/old")
+	c.get("/npub/missing")
+	if hits, misses := c.stats.load(); hits != 1 || misses != 3 {
+		t.Errorf("hits, misses = %d, %d, want 1, 3", hits, misses)
+	}
+}
+
+func TestHitRatio(t *testing.T) {
+	tests := []struct {
+		hits, misses uint64
+		want         float64
+	}{
+		{0, 0, 0},
+		{3, 1, 0.75},
+		{0, 5, 0},
+		{5, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := hitRatio(tt.hits, tt.misses); got != tt.want {
+			t.Errorf("hitRatio(%d, %d) = %v, want %v", tt.hits, tt.misses, got, tt.want)
+		}
+	}
+}
+
+func TestCacheStatsSummary(t *testing.T) {
+	prev := map[string][2]uint64{}
+	// Counts from earlier tests are not reported again
+	cacheStatsSummary(prev)
+	if got := cacheStatsSummary(prev); got != "" {
+		t.Errorf("summary without lookups = %q, want empty", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		profiles.stats.hit()
+	}
+	profiles.stats.miss()
+	if got, want := cacheStatsSummary(prev), "profiles 3 hits / 1 misses (75.0%)"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+
+	profiles.stats.miss()
+	pages.stats.hit()
+	pages.stats.miss()
+	// Only the lookups since the previous line are reported
+	if got, want := cacheStatsSummary(prev), "profiles 0 hits / 1 misses (0.0%), pages 1 hits / 1 misses (50.0%)"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.7,2001:db8::1")
+	trustedProxies = nil
+	configureTrustedProxies()
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{name: "direct client", remote: "203.0.113.5:51000", want: "203.0.113.5"},
+		{name: "untrusted source cannot spoof", remote: "203.0.113.5:51000", xff: "198.51.100.1", realIP: "198.51.100.2", want: "203.0.113.5"},
+		{name: "trusted proxy", remote: "10.1.2.3:443", xff: "198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted single address", remote: "192.0.2.7:443", xff: "198.51.100.1", want: "198.51.100.1"},
+		{name: "address next to a trusted one", remote: "192.0.2.8:443", xff: "198.51.100.1", want: "192.0.2.8"},
+		{name: "trusted IPv6 proxy", remote: "[2001:db8::1]:443", xff: "2001:db8:ffff::9", want: "2001:db8:ffff::9"},
+		{name: "chain through trusted proxies", remote: "10.0.0.1:443", xff: "198.51.100.1, 10.0.0.9, 10.0.0.2", want: "198.51.100.1"},
+		{name: "client-supplied hops are ignored", remote: "10.0.0.1:443", xff: "6.6.6.6, 198.51.100.1", want: "198.51.100.1"},
+		{name: "all hops trusted", remote: "10.0.0.1:443", xff: "10.9.9.9, 10.0.0.2", want: "10.9.9.9"},
+		{name: "X-Real-IP from a trusted proxy", remote: "10.0.0.1:443", realIP: "198.51.100.3", want: "198.51.100.3"},
+		{name: "garbage hop falls back to X-Real-IP", remote: "10.0.0.1:443", xff: "198.51.100.1, nonsense", realIP: "198.51.100.3", want: "198.51.100.3"},
+		{name: "trusted proxy without headers", remote: "10.0.0.1:443", want: "10.0.0.1"},
+		{name: "remote without a port", remote: "203.0.113.5", want: "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
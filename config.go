@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// relayTimeout bounds how long relay queries may take
+var relayTimeout = 15 * time.Second
+
+// Config is the optional JSON configuration file loaded from CONFIG_FILE
+type Config struct {
+	ReadRelays      []string `json:"read_relays"`
+	WriteRelays     []string `json:"write_relays"`
+	RelayTimeout    string   `json:"relay_timeout"`
+	ProfileCacheTTL string   `json:"profile_cache_ttl"`
+}
+
+// loadConfig reads and validates the JSON configuration file at path
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	if cfg.RelayTimeout != "" {
+		if _, err := time.ParseDuration(cfg.RelayTimeout); err != nil {
+			return nil, fmt.Errorf("invalid relay_timeout in %s: %v", path, err)
+		}
+	}
+	if cfg.ProfileCacheTTL != "" {
+		if _, err := time.ParseDuration(cfg.ProfileCacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid profile_cache_ttl in %s: %v", path, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// durationFromEnv returns the duration in the named environment variable,
+// or def when it is unset. An invalid value is fatal.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// intFromEnv returns the non-negative integer in the named environment
+// variable, or def when it is unset. An invalid value is fatal.
+func intFromEnv(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s: %q", name, v)
+	}
+	return n
+}
+
+// databaseURLFromEnv returns DATABASE_URL, or the contents of the file named
+// by DATABASE_URL_FILE when it is unset
+func databaseURLFromEnv() (string, error) {
+	if v := os.Getenv("DATABASE_URL"); v != "" {
+		return v, nil
+	}
+
+	path := os.Getenv("DATABASE_URL_FILE")
+	if path == "" {
+		return "", fmt.Errorf("DATABASE_URL or DATABASE_URL_FILE environment variable is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read DATABASE_URL_FILE: %v", err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("DATABASE_URL_FILE %s is empty", path)
+	}
+	return v, nil
+}
+
+// siteInfo is the branding shown in page titles and headers
+type siteInfo struct {
+	Title       string
+	Description string
+	BasePath    string // path prefix the service is served under, from BASE_PATH
+}
+
+// site is the branding, overridable with SITE_TITLE and SITE_DESCRIPTION
+var site = siteInfo{
+	Title:       "Nostr Event Restore Service",
+	Description: "This service allows you to restore and view Nostr events by npub identifier.",
+}
+
+// configure applies defaults, then the config file, then environment variables
+func configure() {
+	configureLogLevel()
+	writeConfigured := false
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded config file %s", path)
+
+		if len(cfg.ReadRelays) > 0 {
+			readRelays = cfg.ReadRelays
+		}
+		if len(cfg.WriteRelays) > 0 {
+			writeRelays = cfg.WriteRelays
+			writeConfigured = true
+		}
+		if cfg.RelayTimeout != "" {
+			relayTimeout, _ = time.ParseDuration(cfg.RelayTimeout)
+		}
+		if cfg.ProfileCacheTTL != "" {
+			profileCacheTTL, _ = time.ParseDuration(cfg.ProfileCacheTTL)
+		}
+	}
+
+	readRelays = relaysFromEnv("NOSTR_READ_RELAYS", readRelays)
+	// Write relays default to the read relays unless set in the config file
+	if !writeConfigured {
+		writeRelays = readRelays
+	}
+	writeRelays = relaysFromEnv("NOSTR_WRITE_RELAYS", writeRelays)
+	relayTimeout = durationFromEnv("RELAY_TIMEOUT", relayTimeout)
+	relayConnectRetries = intFromEnv("RELAY_CONNECT_RETRIES", relayConnectRetries)
+	relayRetryDelay = durationFromEnv("RELAY_RETRY_DELAY", relayRetryDelay)
+	serviceSecretKey = secretKeyFromEnv("NOSTR_SECKEY")
+	profileCacheTTL = durationFromEnv("PROFILE_CACHE_TTL", profileCacheTTL)
+	profileWait = durationFromEnv("PROFILE_WAIT", profileWait)
+	if profileWait <= 0 {
+		log.Fatal("PROFILE_WAIT must be positive")
+	}
+	showRecent = os.Getenv("SHOW_RECENT") == "true"
+	relayFetchDisabled = os.Getenv("DISABLE_RELAY_FETCH") == "true"
+	robotsAllow = os.Getenv("ROBOTS_ALLOW") == "true"
+	configureDisplayTZ()
+	if v := os.Getenv("SITE_TITLE"); v != "" {
+		site.Title = v
+	}
+	if v := os.Getenv("SITE_DESCRIPTION"); v != "" {
+		site.Description = v
+	}
+	basePath, err := parseBasePath(os.Getenv("BASE_PATH"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	site.BasePath = basePath
+	configurePageCache()
+	cacheStatsInterval = durationFromEnv("CACHE_STATS_INTERVAL", cacheStatsInterval)
+	staticMaxAge = durationFromEnv("STATIC_MAX_AGE", staticMaxAge)
+	futureSkew = durationFromEnv("FUTURE_SKEW", futureSkew)
+	if futureSkew < 0 {
+		log.Fatal("FUTURE_SKEW must not be negative")
+	}
+	neventHints = intFromEnv("NEVENT_HINTS", neventHints)
+	maxRenderContent = intFromEnv("MAX_RENDER_CONTENT", maxRenderContent)
+	maxEventsPerRequest = intFromEnv("MAX_EVENTS_PER_REQUEST", maxEventsPerRequest)
+	if maxEventsPerRequest == 0 {
+		log.Fatal("MAX_EVENTS_PER_REQUEST must be positive")
+	}
+	if n := intFromEnv("MAX_RELAY_CONNS", maxRelayConns); n != maxRelayConns {
+		if n == 0 {
+			log.Fatal("MAX_RELAY_CONNS must be positive")
+		}
+		relayConns = make(chan struct{}, n)
+	}
+	configureProxy(os.Getenv("RELAY_PROXY"))
+	gateway, err := parseGatewayURL(os.Getenv("PROFILE_GATEWAY_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	profileGatewayURL = gateway
+
+	readRelays = normalizeRelays(readRelays)
+	if len(readRelays) == 0 {
+		log.Fatal("No valid read relays configured")
+	}
+	writeRelays = normalizeRelays(writeRelays)
+	if len(writeRelays) == 0 {
+		log.Fatal("No valid write relays configured")
+	}
+
+	log.Printf("Read relays: %s", strings.Join(readRelays, ", "))
+	log.Printf("Write relays: %s", strings.Join(writeRelays, ", "))
+	if serviceSecretKey != "" {
+		log.Printf("NIP-42 relay authentication enabled")
+	}
+	if profileGatewayURL != "" {
+		log.Printf("Profile gateway fallback: %s", profileGatewayURL)
+	}
+	if relayFetchDisabled {
+		log.Printf("Relay profile fetching disabled; using stored profiles only")
+	}
+}
+
+// secretKeyFromEnv returns the hex secret key in the named environment
+// variable, accepting either hex or nsec. An invalid value is fatal.
+func secretKeyFromEnv(name string) string {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return ""
+	}
+
+	if strings.HasPrefix(v, "nsec1") {
+		prefix, value, err := nip19.Decode(v)
+		if err != nil || prefix != "nsec" {
+			log.Fatalf("Invalid %s", name)
+		}
+		v = value.(string)
+	}
+
+	if _, err := nostr.GetPublicKey(v); err != nil {
+		log.Fatalf("Invalid %s", name)
+	}
+	return v
+}
+
+// configureProxy routes relay websocket connections and outbound HTTP
+// requests (such as NIP-05 lookups) through the given http://, https:// or
+// socks5:// proxy. An invalid value is fatal.
+func configureProxy(proxy string) {
+	if proxy == "" {
+		return
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		log.Fatalf("Invalid RELAY_PROXY: %q", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		log.Fatalf("Invalid RELAY_PROXY scheme %q: must be http, https or socks5", u.Scheme)
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		log.Fatal("Cannot configure RELAY_PROXY: unexpected default transport")
+	}
+	transport.Proxy = http.ProxyURL(u)
+
+	dial, err := proxyDialer(u)
+	if err != nil {
+		log.Fatalf("Invalid RELAY_PROXY: %v", err)
+	}
+	relayNetDial = dial
+
+	log.Printf("Relay connections and outbound HTTP requests use proxy %s://%s", u.Scheme, u.Host)
+}
+
+// listenAddr returns the address to listen on: bindAddr when set, such as
+// "127.0.0.1:8080" or "[::1]:8080", otherwise all interfaces on port
+func listenAddr(bindAddr, port string) (string, error) {
+	if bindAddr == "" {
+		return ":" + port, nil
+	}
+
+	host, p, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid BIND_ADDR %q: %v", bindAddr, err)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid BIND_ADDR %q: bad port %q", bindAddr, p)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("invalid BIND_ADDR %q: %v", bindAddr, err)
+		}
+	}
+	return bindAddr, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// restoreRelayConfig puts back the relay settings configure overwrites
+func restoreRelayConfig(t *testing.T) {
+	read, write := readRelays, writeRelays
+	timeout, ttl := relayTimeout, profileCacheTTL
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		readRelays, writeRelays = read, write
+		relayTimeout, profileCacheTTL = timeout, ttl
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func TestConfigureWriteRelays(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		env       map[string]string
+		wantRead  []string
+		wantWrite []string
+	}{
+		{
+			name:      "write relays default to the read relays",
+			env:       map[string]string{"NOSTR_READ_RELAYS": "wss://r1.example, wss://r2.example"},
+			wantRead:  []string{"wss://r1.example", "wss://r2.example"},
+			wantWrite: []string{"wss://r1.example", "wss://r2.example"},
+		},
+		{
+			name: "NOSTR_WRITE_RELAYS is separate from the read relays",
+			env: map[string]string{
+				"NOSTR_READ_RELAYS":  "wss://r1.example",
+				"NOSTR_WRITE_RELAYS": "wss://W1.example/,wss://w2.example",
+			},
+			wantRead:  []string{"wss://r1.example"},
+			wantWrite: []string{"wss://w1.example", "wss://w2.example"},
+		},
+		{
+			name:      "config file write relays survive env read relays",
+			config:    `{"read_relays":["wss://file-r.example"],"write_relays":["wss://file-w.example"]}`,
+			env:       map[string]string{"NOSTR_READ_RELAYS": "wss://env-r.example"},
+			wantRead:  []string{"wss://env-r.example"},
+			wantWrite: []string{"wss://file-w.example"},
+		},
+		{
+			name:      "env write relays override the config file",
+			config:    `{"write_relays":["wss://file-w.example"]}`,
+			env:       map[string]string{"NOSTR_READ_RELAYS": "wss://r1.example", "NOSTR_WRITE_RELAYS": "wss://env-w.example"},
+			wantRead:  []string{"wss://r1.example"},
+			wantWrite: []string{"wss://env-w.example"},
+		},
+		{
+			name:      "duplicate and invalid relays are dropped",
+			env:       map[string]string{"NOSTR_READ_RELAYS": "wss://r1.example,WSS://R1.example/,http://r2.example,wss://r3.example"},
+			wantRead:  []string{"wss://r1.example", "wss://r3.example"},
+			wantWrite: []string{"wss://r1.example", "wss://r3.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreRelayConfig(t)
+			if tt.config != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("CONFIG_FILE", path)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			configure()
+			if !reflect.DeepEqual(readRelays, tt.wantRead) {
+				t.Errorf("readRelays = %q, want %q", readRelays, tt.wantRead)
+			}
+			if !reflect.DeepEqual(writeRelays, tt.wantWrite) {
+				t.Errorf("writeRelays = %q, want %q", writeRelays, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func TestConfigureProxy(t *testing.T) {
+	restoreRelayConfig(t)
+	transport := http.DefaultTransport.(*http.Transport)
+	defer func(d netDialFunc) { relayNetDial = d }(relayNetDial)
+	defer func(proxy func(*http.Request) (*url.URL, error)) { transport.Proxy = proxy }(transport.Proxy)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{"names":{}}`))
+	}))
+	defer proxy.Close()
+
+	configureProxy(proxy.URL)
+	const target = "http://nip05.invalid/.well-known/nostr.json?name=alice"
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != target {
+		t.Errorf("proxy received %q, want [%s]", proxied, target)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *Config
+		wantErr string
+	}{
+		{
+			name: "sample config",
+			content: `{
+	"read_relays": ["wss://nos.lol", "wss://yabu.me"],
+	"write_relays": ["wss://relay.example"],
+	"relay_timeout": "20s",
+	"profile_cache_ttl": "1h"
+}`,
+			want: &Config{
+				ReadRelays:      []string{"wss://nos.lol", "wss://yabu.me"},
+				WriteRelays:     []string{"wss://relay.example"},
+				RelayTimeout:    "20s",
+				ProfileCacheTTL: "1h",
+			},
+		},
+		{name: "empty object", content: `{}`, want: &Config{}},
+		{name: "unknown field", content: `{"read_relay": ["wss://typo.example"]}`, wantErr: "unknown field"},
+		{name: "bad timeout", content: `{"relay_timeout": "soon"}`, wantErr: "invalid relay_timeout"},
+		{name: "bad ttl", content: `{"profile_cache_ttl": "10"}`, wantErr: "invalid profile_cache_ttl"},
+		{name: "not json", content: `read_relays = ["wss://nos.lol"]`, wantErr: "invalid config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadConfig() of a missing file succeeded")
+	}
+}
+
+func TestDatabaseURLFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "database_url")
+	os.WriteFile(secret, []byte("postgres://restore:s3cret@db/nostr?sslmode=disable\r\n\n"), 0o600)
+	blank := filepath.Join(dir, "blank")
+	os.WriteFile(blank, []byte(" \n"), 0o600)
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		want    string
+		wantErr string
+	}{
+		{name: "from the environment", env: "postgres://env@db/nostr", want: "postgres://env@db/nostr"},
+		{name: "environment wins over the file", env: "postgres://env@db/nostr", file: secret, want: "postgres://env@db/nostr"},
+		{name: "from a secret file", file: secret, want: "postgres://restore:s3cret@db/nostr?sslmode=disable"},
+		{name: "neither set", wantErr: "DATABASE_URL or DATABASE_URL_FILE environment variable is required"},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: "failed to read DATABASE_URL_FILE"},
+		{name: "blank file", file: blank, wantErr: "is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DATABASE_URL", tt.env)
+			t.Setenv("DATABASE_URL_FILE", tt.file)
+			got, err := databaseURLFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("databaseURLFromEnv() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("databaseURLFromEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		bindAddr string
+		want     string
+		wantErr  bool
+	}{
+		{"", ":8080", false},
+		{"127.0.0.1:9000", "127.0.0.1:9000", false},
+		{"[::1]:9000", "[::1]:9000", false},
+		{"[::]:9000", "[::]:9000", false},
+		{":9000", ":9000", false},
+		{"localhost:9000", "localhost:9000", false},
+		{"127.0.0.1", "", true},
+		{"::1:9000", "", true},
+		{"127.0.0.1:http", "", true},
+		{"127.0.0.1:70000", "", true},
+	}
+	for _, tt := range tests {
+		got, err := listenAddr(tt.bindAddr, "8080")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("listenAddr(%q) = %q, %v, want %q", tt.bindAddr, got, err, tt.want)
+		}
+		if err != nil && !strings.Contains(err.Error(), "BIND_ADDR") {
+			t.Errorf("listenAddr(%q) error %q does not name BIND_ADDR", tt.bindAddr, err)
+		}
+	}
+}
+
+func TestSiteBranding(t *testing.T) {
+	tests := []struct {
+		name            string
+		title           string
+		description     string
+		wantTitle       string
+		wantDescription string
+	}{
+		{"defaults", "", "", "Nostr Event Restore Service", "This service allows you to restore and view Nostr events by npub identifier."},
+		{"custom", "Acme Backups", "Your notes, kept safe & sound.", "Acme Backups", "Your notes, kept safe &amp; sound."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreRelayConfig(t)
+			defer func(s siteInfo) { site = s }(site)
+			t.Setenv("SITE_TITLE", tt.title)
+			t.Setenv("SITE_DESCRIPTION", tt.description)
+			configure()
+
+			rec := httptest.NewRecorder()
+			homeHandler(&databases{})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			body := rec.Body.String()
+			if !strings.Contains(body, "<title>"+tt.wantTitle+"</title>") {
+				t.Errorf("home page <title> is not %q", tt.wantTitle)
+			}
+			if !strings.Contains(body, "<h1>"+tt.wantTitle+"</h1>") {
+				t.Errorf("home page header is not %q", tt.wantTitle)
+			}
+			if !strings.Contains(body, tt.wantDescription) {
+				t.Errorf("home page lacks the description %q", tt.wantDescription)
+			}
+			if tt.title != "" && strings.Contains(body, "Nostr Event Restore Service") {
+				t.Error("home page still shows the default title")
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// corsOrigins are the origins allowed to call the JSON API; "*" allows any
+var corsOrigins []string
+
+// configureCORS reads the allowed API origins from CORS_ORIGINS
+func configureCORS() {
+	for _, s := range strings.Split(os.Getenv("CORS_ORIGINS"), ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			corsOrigins = append(corsOrigins, strings.TrimSuffix(s, "/"))
+		}
+	}
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin,
+// or "" when it is not allowed
+func allowedOrigin(origin string) string {
+	for _, o := range corsOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		if origin != "" {
+			allowed = allowedOrigin(origin)
+		}
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllow   string
+		wantHandled bool
+	}{
+		{"allowed origin", []string{"https://client.example"}, http.MethodGet, "https://client.example", false, http.StatusOK, "https://client.example", true},
+		{"origin matched ignoring case", []string{"https://client.example"}, http.MethodGet, "https://Client.Example", false, http.StatusOK, "https://Client.Example", true},
+		{"disallowed origin", []string{"https://client.example"}, http.MethodGet, "https://evil.example", false, http.StatusOK, "", true},
+		{"any origin", []string{"*"}, http.MethodGet, "https://anyone.example", false, http.StatusOK, "*", true},
+		{"same-origin request", []string{"https://client.example"}, http.MethodGet, "", false, http.StatusOK, "", true},
+		{"preflight", []string{"https://client.example"}, http.MethodOptions, "https://client.example", true, http.StatusNoContent, "https://client.example", false},
+		{"preflight from a disallowed origin", []string{"https://client.example"}, http.MethodOptions, "https://evil.example", true, http.StatusForbidden, "", false},
+		{"not configured", nil, http.MethodOptions, "https://client.example", true, http.StatusForbidden, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(o []string) { corsOrigins = o }(corsOrigins)
+			corsOrigins = tt.origins
+			handled := false
+			h := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handled = true }))
+
+			req := httptest.NewRequest(tt.method, "/api/npub/x/profile", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("request reached the API = %v, want %v", handled, tt.wantHandled)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, HEAD, OPTIONS" {
+					t.Errorf("Access-Control-Allow-Methods = %q", got)
+				}
+				if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+					t.Errorf("Access-Control-Allow-Headers = %q", got)
+				}
+			}
+			if tt.wantAllow != "" && tt.wantAllow != "*" && rec.Header().Get("Vary") != "Origin" {
+				t.Error("response for a specific origin does not vary by Origin")
+			}
+		})
+	}
+}
+
+func TestConfigureCORS(t *testing.T) {
+	defer func(o []string) { corsOrigins = o }(corsOrigins)
+	corsOrigins = nil
+	t.Setenv("CORS_ORIGINS", " https://a.example/ ,,https://b.example")
+	configureCORS()
+	if len(corsOrigins) != 2 || corsOrigins[0] != "https://a.example" || corsOrigins[1] != "https://b.example" {
+		t.Errorf("corsOrigins = %q", corsOrigins)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// databases is the primary database, which takes all writes, and the
+// optional read replicas that serve the browsing queries
+type databases struct {
+	primary  *sql.DB
+	replicas []*sql.DB
+	next     atomic.Uint64
+}
+
+// openDatabases opens the primary and each comma-separated replica DSN
+func openDatabases(primaryURL, replicaURLs string) (*databases, error) {
+	primary, err := sql.Open("postgres", primaryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dbs := &databases{primary: primary}
+	for _, dsn := range strings.Split(replicaURLs, ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		replica, err := sql.Open("postgres", dsn)
+		if err != nil {
+			dbs.Close()
+			return nil, err
+		}
+		dbs.replicas = append(dbs.replicas, replica)
+	}
+	if len(dbs.replicas) > 0 {
+		log.Printf("Using %d database read replicas", len(dbs.replicas))
+	}
+	return dbs, nil
+}
+
+// read returns the database for a read-only request, rotating through the
+// replicas and falling back to the primary when there are none
+func (d *databases) read() *sql.DB {
+	if len(d.replicas) == 0 {
+		return d.primary
+	}
+	n := d.next.Add(1)
+	return d.replicas[n%uint64(len(d.replicas))]
+}
+
+// Close closes the primary and all replicas
+func (d *databases) Close() error {
+	errs := []error{d.primary.Close()}
+	for _, replica := range d.replicas {
+		errs = append(errs, replica.Close())
+	}
+	return errors.Join(errs...)
+}
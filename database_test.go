@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestDatabasesReadFallsBackToPrimary(t *testing.T) {
+	primary := &sql.DB{}
+	dbs := &databases{primary: primary}
+	for i := 0; i < 3; i++ {
+		if dbs.read() != primary {
+			t.Fatal("read() without replicas is not the primary")
+		}
+	}
+}
+
+func TestReadsUseReplicasAndWritesThePrimary(t *testing.T) {
+	note := nostr.Event{Kind: 1, Content: "replicated", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	note.Sign(nostr.GeneratePrivateKey())
+	npub, _ := nip19.EncodePublicKey(note.PubKey)
+	adminToken = "replica-token"
+	defer func() { adminToken = "" }()
+
+	open := func() (*sql.DB, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db, mock
+	}
+	primary, primaryMock := open()
+	replica1, mock1 := open()
+	replica2, mock2 := open()
+	for _, mock := range []sqlmock.Sqlmock{mock1, mock2} {
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).
+				WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(note.String()))
+		}
+	}
+	primaryMock.ExpectExec(`DELETE FROM event_backup WHERE pubkey = \$1`).WithArgs(note.PubKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbs := &databases{primary: primary, replicas: []*sql.DB{replica1, replica2}}
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		eventAPIHandler(dbs)(rec, httptest.NewRequest(http.MethodGet, "/api/event/"+note.ID, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("read %d: status = %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/npub/"+npub+"/events", nil)
+	req.Header.Set("Authorization", "Bearer replica-token")
+	rec := httptest.NewRecorder()
+	apiNpubHandler(dbs)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("purge: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// Each replica took half of the reads and only the primary was written
+	for name, mock := range map[string]sqlmock.Sqlmock{"primary": primaryMock, "replica 1": mock1, "replica 2": mock2} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
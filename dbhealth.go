@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dbRetryInterval is how often an unavailable database is pinged
+const dbRetryInterval = 5 * time.Second
+
+// dbUnavailableMessage is shown while the database cannot be reached
+const dbUnavailableMessage = "The service is temporarily unavailable. Please try again shortly."
+
+// unavailableDBs holds each database currently being pinged until it is
+// reachable again, so only one reconnect loop runs per database
+var unavailableDBs sync.Map
+
+// isDBClosed reports whether err comes from a closed sql.DB, whose error
+// database/sql does not export
+func isDBClosed(err error) bool {
+	return err != nil && err.Error() == "sql: database is closed"
+}
+
+// isDBUnavailable reports whether err means the database could not be
+// reached at all, as opposed to a failed query
+func isDBUnavailable(err error) bool {
+	// A slow query or a client that went away says nothing about the
+	// database, even though the driver surfaces it as a network timeout
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if isDBClosed(err) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	// Class 08 is connection exceptions; 57P are shutdowns and startups
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code := string(pqErr.Code)
+		return strings.HasPrefix(code, "08") || strings.HasPrefix(code, "57P")
+	}
+	return false
+}
+
+// watchDB pings db in the background until it is reachable again. The
+// connection pool reconnects by itself; this only reports when it has.
+func watchDB(ctx context.Context, db *sql.DB, err error) {
+	if _, running := unavailableDBs.LoadOrStore(db, struct{}{}); running {
+		return
+	}
+	warnf(ctx, "Database unavailable: %v", err)
+	go func() {
+		defer unavailableDBs.Delete(db)
+		ticker := time.NewTicker(dbRetryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pingCtx, cancel := context.WithTimeout(context.Background(), dbRetryInterval)
+			err := db.PingContext(pingCtx)
+			cancel()
+			if err == nil {
+				log.Printf("Database connection restored")
+				return
+			}
+			// A closed pool never recovers, as during shutdown
+			if isDBClosed(err) {
+				return
+			}
+		}
+	}()
+}
+
+// renderDBError renders the page for a failed database query: a 503 asking
+// to retry when the database is unreachable, or a 500 with message
+func renderDBError(w http.ResponseWriter, r *http.Request, db *sql.DB, err error, message string) {
+	if isDBUnavailable(err) {
+		watchDB(r.Context(), db, err)
+		w.Header().Set("Retry-After", "10")
+		renderError(w, http.StatusServiceUnavailable, dbUnavailableMessage)
+		return
+	}
+	renderError(w, http.StatusInternalServerError, message)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestIsDBUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"wrapped cancel", fmt.Errorf("query: %w", context.Canceled), false},
+		{"timeout op error with deadline", fmt.Errorf("%w: %w", context.DeadlineExceeded, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), false},
+		{"syntax error", &pq.Error{Code: "42601"}, false},
+		{"statement timeout", &pq.Error{Code: "57014"}, false},
+		{"closed pool", errors.New("sql: database is closed"), true},
+		{"bad conn", driver.ErrBadConn, true},
+		{"conn done", sql.ErrConnDone, true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"refused", &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, true},
+		{"reset", syscall.ECONNRESET, true},
+		{"dns failure", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "db"}}, true},
+		{"bare dns error", &net.DNSError{Err: "no such host", Name: "db"}, false},
+		{"connection exception", &pq.Error{Code: "08006"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDBUnavailable(tt.err); got != tt.want {
+				t.Errorf("isDBUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpubPageDatabaseUnavailable(t *testing.T) {
+	const pubkey = "d2f6a0c4e8b2d6f0a4c8e2b6d0f4a8c2e6b0d4f8a2c6e0b4d8f2a6c0e4b8d2f6"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "moss"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name        string
+		setup       func(db *sql.DB, mock sqlmock.Sqlmock)
+		wantStatus  int
+		wantMessage string
+		wantWatched bool
+	}{
+		{
+			name:        "closed database",
+			setup:       func(db *sql.DB, _ sqlmock.Sqlmock) { db.Close() },
+			wantStatus:  http.StatusServiceUnavailable,
+			wantMessage: dbUnavailableMessage,
+			wantWatched: true,
+		},
+		{
+			name: "connection lost",
+			setup: func(_ *sql.DB, mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnError(&pq.Error{Code: "08006"})
+			},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantMessage: dbUnavailableMessage,
+			wantWatched: true,
+		},
+		{
+			name: "failed query",
+			setup: func(_ *sql.DB, mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnError(&pq.Error{Code: "42P01"})
+			},
+			wantStatus:  http.StatusInternalServerError,
+			wantMessage: "Failed to load events. Please try again later.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			defer unavailableDBs.Delete(db)
+			mock.MatchExpectationsInOrder(false)
+			tt.setup(db, mock)
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.wantMessage) || !strings.Contains(body, "<!DOCTYPE html>") {
+				t.Errorf("page lacks %q:\n%s", tt.wantMessage, body)
+			}
+			if strings.Contains(body, "sql:") || strings.Contains(body, "pq:") {
+				t.Errorf("page shows the database error:\n%s", body)
+			}
+			if got := rec.Header().Get("Retry-After"); (got == "10") != tt.wantWatched {
+				t.Errorf("Retry-After = %q", got)
+			}
+			if _, watched := unavailableDBs.Load(db); watched != tt.wantWatched {
+				t.Errorf("database watched = %v, want %v", watched, tt.wantWatched)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// deletionKind is the kind of NIP-09 deletion events
+const deletionKind = 5
+
+// deletedIDs returns the ids referenced by the "e" tags of the deletion
+// events among events, each mapped to the pubkey that deleted it
+func deletedIDs(events []Event) map[string]string {
+	deleted := map[string]string{}
+	for _, event := range events {
+		if event.Kind != deletionKind {
+			continue
+		}
+		ev, err := event.parse()
+		if err != nil {
+			continue
+		}
+		for _, tag := range ev.Tags {
+			if len(tag) >= 2 && tag[0] == "e" && eventIDPattern.MatchString(tag[1]) {
+				deleted[tag[1]] = ev.PubKey
+			}
+		}
+	}
+	return deleted
+}
+
+// queryDeletions returns the ids deleted by the stored deletion events of
+// pubkey. A listing page may not contain the deletion event itself, so all
+// of them are loaded.
+func queryDeletions(ctx context.Context, db *sql.DB, pubkey string) map[string]string {
+	defer observeDBQuery("deletions", time.Now())
+
+	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = $1 AND event_kind = 5`
+	rows, err := db.QueryContext(ctx, query, pubkey)
+	if err != nil {
+		logf(ctx, "Failed to query deletions for %s: %v", pubkey, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			logf(ctx, "Failed to scan deletion for %s: %v", pubkey, err)
+			return nil
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		logf(ctx, "Failed to read deletions for %s: %v", pubkey, err)
+		return nil
+	}
+	return deletedIDs(events)
+}
+
+// markDeleted flags the events in deleted. As in NIP-09, a deletion only
+// applies to events of the same author.
+func markDeleted(events []Event, deleted map[string]string) {
+	for i, event := range events {
+		if pubkey, ok := deleted[event.ID]; ok && pubkey == event.Pubkey {
+			events[i].Deleted = true
+		}
+	}
+}
+
+// filterDeleted drops the events flagged as deleted, returning the rest
+// and how many were dropped
+func filterDeleted(events []Event) ([]Event, int) {
+	kept := events[:0]
+	for _, event := range events {
+		if !event.Deleted {
+			kept = append(kept, event)
+		}
+	}
+	return kept, len(events) - len(kept)
+}
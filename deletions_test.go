@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// backupRow returns ev as a row of event_backup
+func backupRow(ev nostr.Event) Event {
+	return Event{ID: ev.ID, Pubkey: ev.PubKey, CreatedAt: int64(ev.CreatedAt), Kind: ev.Kind, EventData: ev.String()}
+}
+
+func TestMarkDeleted(t *testing.T) {
+	author := nostr.GeneratePrivateKey()
+	stranger := nostr.GeneratePrivateKey()
+	sign := func(sk string, ev nostr.Event) nostr.Event {
+		ev.Sign(sk)
+		return ev
+	}
+	kept := sign(author, nostr.Event{Kind: 1, Content: "kept", CreatedAt: 1700000000, Tags: nostr.Tags{}})
+	regretted := sign(author, nostr.Event{Kind: 1, Content: "regretted", CreatedAt: 1700000001, Tags: nostr.Tags{}})
+	targeted := sign(author, nostr.Event{Kind: 1, Content: "targeted by someone else", CreatedAt: 1700000002, Tags: nostr.Tags{}})
+
+	tests := []struct {
+		name     string
+		deletion nostr.Event
+		want     []bool
+	}{
+		{
+			name:     "own deletion",
+			deletion: sign(author, nostr.Event{Kind: 5, CreatedAt: 1700000100, Tags: nostr.Tags{{"e", regretted.ID}, {"k", "1"}}}),
+			want:     []bool{false, true, false},
+		},
+		{
+			name:     "another author's deletion is ignored",
+			deletion: sign(stranger, nostr.Event{Kind: 5, CreatedAt: 1700000100, Tags: nostr.Tags{{"e", targeted.ID}}}),
+			want:     []bool{false, false, false},
+		},
+		{
+			name:     "malformed e tags are ignored",
+			deletion: sign(author, nostr.Event{Kind: 5, CreatedAt: 1700000100, Tags: nostr.Tags{{"e", "short"}, {"e"}}}),
+			want:     []bool{false, false, false},
+		},
+		{
+			name:     "e tags of other kinds delete nothing",
+			deletion: sign(author, nostr.Event{Kind: 1, CreatedAt: 1700000100, Tags: nostr.Tags{{"e", regretted.ID}}}),
+			want:     []bool{false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := []Event{backupRow(kept), backupRow(regretted), backupRow(targeted), backupRow(tt.deletion)}
+			markDeleted(events, deletedIDs(events))
+			var got []bool
+			for _, event := range events[:3] {
+				got = append(got, event.Deleted)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deleted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpubPageFlagsDeletedEvents(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	note := nostr.Event{Kind: 1, Content: "posted in haste", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	note.Sign(sk)
+	other := nostr.Event{Kind: 1, Content: "still stands", CreatedAt: 1700000050, Tags: nostr.Tags{}}
+	other.Sign(sk)
+	deletion := nostr.Event{Kind: 5, Content: "oops", CreatedAt: 1700000100, Tags: nostr.Tags{{"e", note.ID}}}
+	deletion.Sign(sk)
+	profiles.set(pubkey, &UserProfile{Name: "wren"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		query      string
+		wantNote   bool
+		wantLabel  int
+		wantNotice string
+	}{
+		{"", true, 1, `1 events were deleted by their author. <a href="?hide_deleted=1">Hide them</a>`},
+		{"?hide_deleted=1", false, 0, `1 events deleted by their author hidden. <a href="?hide_deleted=0">Show them</a>`},
+	}
+	for _, tt := range tests {
+		t.Run("query "+tt.query, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			columns := []string{"id", "pubkey", "created_at", "event_kind", "event_data"}
+			// The page is paged by kind, so the deletion comes from its own query
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(note.ID, pubkey, int64(note.CreatedAt), 1, note.String()).
+					AddRow(other.ID, pubkey, int64(other.CreatedAt), 1, other.String()))
+			mock.ExpectQuery(`AND event_kind = 5$`).WithArgs(pubkey).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(deletion.ID, pubkey, int64(deletion.CreatedAt), 5, deletion.String()))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "posted in haste"); got != tt.wantNote {
+				t.Errorf("deleted note shown = %v, want %v", got, tt.wantNote)
+			}
+			if !strings.Contains(body, "still stands") {
+				t.Error("the note that was not deleted is missing")
+			}
+			if n := strings.Count(body, `<span class="deleted-label">deleted by author</span>`); n != tt.wantLabel {
+				t.Errorf("%d deleted labels, want %d", n, tt.wantLabel)
+			}
+			if !strings.Contains(body, tt.wantNotice) {
+				t.Errorf("page lacks the notice %s", tt.wantNotice)
+			}
+		})
+	}
+}
+
+func TestRestoreAllSkipsDeletedEvents(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	note := nostr.Event{Kind: 1, Content: "take it back", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	note.Sign(sk)
+	deletion := nostr.Event{Kind: 5, CreatedAt: 1700000100, Tags: nostr.Tags{{"e", note.ID}}}
+	deletion.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	adminToken = "deletions-token"
+	defer func() { adminToken = "" }()
+
+	var mu sync.Mutex
+	var published []string
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			mu.Lock()
+			published = append(published, env.Event.ID)
+			mu.Unlock()
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	tests := []struct {
+		body        string
+		wantDeleted int
+		want        []string
+	}{
+		{`{}`, 1, []string{deletion.ID}},
+		{`{"include_deleted":true}`, 0, []string{deletion.ID, note.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(`WHERE pubkey = \$1 ORDER BY created_at DESC`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(deletion.ID, pubkey, int64(deletion.CreatedAt), 5, deletion.String()).
+					AddRow(note.ID, pubkey, int64(note.CreatedAt), 1, note.String()))
+			mock.ExpectQuery(`event_kind = 5`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(deletion.ID, pubkey, int64(deletion.CreatedAt), 5, deletion.String()))
+			mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+			mu.Lock()
+			published = nil
+			mu.Unlock()
+
+			r := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/restore-all", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", "Bearer deletions-token")
+			rec := httptest.NewRecorder()
+			restoreAllHandler(db, rec, r, npub)
+			var summary restoreAllSummary
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &summary) != nil {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if summary.Deleted != tt.wantDeleted {
+				t.Errorf("deleted = %d, want %d", summary.Deleted, tt.wantDeleted)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(published, tt.want) {
+				t.Errorf("published %v, want %v", published, tt.want)
+			}
+		})
+	}
+}
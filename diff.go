@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// diffTimeout bounds how long the relay is queried when diffing a backup
+const diffTimeout = 30 * time.Second
+
+// diffChunkSize is the number of event ids asked for per subscription.
+// Relays cap the events they return, commonly at about 500, so a backup is
+// checked in chunks of ids below that.
+var diffChunkSize = 250
+
+// diffLimiter limits each client to a few diffs a minute, since every diff
+// dials a relay of the client's choosing
+var diffLimiter = newRateLimiter(5, time.Minute)
+
+// queryEventIDs returns the ids of all backed-up events of pubkey
+func queryEventIDs(ctx context.Context, db *sql.DB, pubkey string) ([]string, error) {
+	defer observeDBQuery("event_ids", time.Now())
+
+	query := `SELECT id FROM event_backup WHERE pubkey = $1 ORDER BY created_at DESC, id DESC`
+	rows, err := db.QueryContext(ctx, query, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// diffHandler serves POST /npub/{npub}/diff, reporting which backed-up
+// events of the author are missing from the relay given in the "relay"
+// field, which must not be a private address
+func diffHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, npub string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hexPubkey, err := npubToHex(npub)
+	if err != nil {
+		http.Error(w, "Invalid npub format", http.StatusBadRequest)
+		return
+	}
+	if isBlocked(hexPubkey) {
+		http.Error(w, unavailableMessage, http.StatusNotFound)
+		return
+	}
+	relays := normalizeRelays([]string{r.FormValue("relay")})
+	if len(relays) != 1 {
+		http.Error(w, "A valid ws:// or wss:// relay URL is required", http.StatusBadRequest)
+		return
+	}
+	relayURL := relays[0]
+	if u, _ := url.Parse(relayURL); !isPublicHost(u.Hostname()) {
+		http.Error(w, "The relay must not be a private address", http.StatusBadRequest)
+		return
+	}
+	if !diffLimiter.allow(clientIP(r), time.Now()) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many diff requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), diffTimeout)
+	defer cancel()
+
+	ids, err := queryEventIDs(ctx, db, hexPubkey)
+	if err != nil {
+		errorf(ctx, "Failed to query event ids for %s: %v", hexPubkey, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var filters []nostr.Filter
+	for start := 0; start < len(ids); start += diffChunkSize {
+		chunk := ids[start:min(start+diffChunkSize, len(ids))]
+		filters = append(filters, nostr.Filter{IDs: chunk, Authors: []string{hexPubkey}, Limit: len(chunk)})
+	}
+	events, err := queryRelayEach(ctx, relayURL, filters)
+	if err != nil {
+		logf(ctx, "Failed to query relay %s for diff: %v", relayURL, err)
+		http.Error(w, "Failed to query relay", http.StatusBadGateway)
+		return
+	}
+
+	present := map[string]bool{}
+	for _, ev := range events {
+		present[ev.ID] = true
+	}
+	missing := []string{}
+	for _, id := range ids {
+		if !present[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Relay    string   `json:"relay"`
+		BackedUp int      `json:"backed_up"`
+		OnRelay  int      `json:"on_relay"`
+		Missing  []string `json:"missing"`
+	}{
+		Relay:    relayURL,
+		BackedUp: len(ids),
+		OnRelay:  len(ids) - len(missing),
+		Missing:  missing,
+	})
+}
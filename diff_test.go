@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// postDiff posts relay to the diff endpoint of npub
+func postDiff(db *sql.DB, npub, relay string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/diff", strings.NewReader(url.Values{"relay": {relay}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "203.0.113.9:40000"
+	rec := httptest.NewRecorder()
+	diffHandler(db, rec, req, npub)
+	return rec
+}
+
+func TestDiffHandler(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	notes := make([]nostr.Event, 4)
+	for i := range notes {
+		notes[i] = nostr.Event{Kind: 1, Content: "migrated " + strings.Repeat("!", i), CreatedAt: nostr.Timestamp(1700000400 - i*100), Tags: nostr.Tags{}}
+		notes[i].Sign(sk)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// The relay has kept the first three notes, but returns at most two
+	// events per subscription
+	kept := map[string]nostr.Event{}
+	for _, ev := range notes[:3] {
+		kept[ev.ID] = ev
+	}
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			sent := 0
+			for _, id := range req.Filters[0].IDs {
+				if ev, ok := kept[id]; ok && sent < 2 {
+					reply(eventMessage(req.SubscriptionID, ev))
+					sent++
+				}
+			}
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	// Loopback relays are refused, so a public name is dialed on the mock
+	mock, _ := url.Parse(relay.url)
+	dial := relayNetDial
+	defer func() { relayNetDial = dial }()
+	relayNetDial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, mock.Host)
+	}
+	const target = "ws://relay.example"
+	readRelays = append(readRelays, target)
+	defer func(l *rateLimiter, chunk int) { diffLimiter, diffChunkSize = l, chunk }(diffLimiter, diffChunkSize)
+	diffLimiter, diffChunkSize = newRateLimiter(5, time.Minute), 2
+
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows := sqlmock.NewRows([]string{"id"})
+	for _, ev := range notes {
+		rows.AddRow(ev.ID)
+	}
+	sqlMock.ExpectQuery(`SELECT id FROM event_backup WHERE pubkey = \$1`).WithArgs(pubkey).WillReturnRows(rows)
+
+	rec := postDiff(db, npub, target)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := sqlMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	var got struct {
+		Relay    string   `json:"relay"`
+		BackedUp int      `json:"backed_up"`
+		OnRelay  int      `json:"on_relay"`
+		Missing  []string `json:"missing"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Relay != target || got.BackedUp != 4 || got.OnRelay != 3 {
+		t.Errorf("relay, backed_up, on_relay = %s, %d, %d, want %s, 4, 3", got.Relay, got.BackedUp, got.OnRelay, target)
+	}
+	if want := []string{notes[3].ID}; !reflect.DeepEqual(got.Missing, want) {
+		t.Errorf("missing = %v, want %v", got.Missing, want)
+	}
+	// Each chunk of ids is its own subscription on the one connection
+	if relay.count("REQ") != 2 || relay.connections() != 1 {
+		t.Errorf("relay received %d subscriptions on %d connections, want 2 on 1", relay.count("REQ"), relay.connections())
+	}
+}
+
+func TestDiffHandlerRejects(t *testing.T) {
+	npub, _ := nip19.EncodePublicKey("2c7cc62a697ea3a7826521f3fd34f0cb273693cbe5e9310f35449f43622a5cdc")
+	defer func(l *rateLimiter) { diffLimiter = l }(diffLimiter)
+
+	tests := []struct {
+		name       string
+		relay      string
+		wantStatus int
+	}{
+		{"missing relay", "", http.StatusBadRequest},
+		{"not a websocket URL", "https://relay.example", http.StatusBadRequest},
+		{"loopback", "ws://127.0.0.1:7777", http.StatusBadRequest},
+		{"localhost", "ws://localhost", http.StatusBadRequest},
+		{"private network", "wss://10.0.0.5", http.StatusBadRequest},
+		{"link-local", "wss://[fe80::1]", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffLimiter = newRateLimiter(5, time.Minute)
+			// Each request is refused before the database is used
+			rec := postDiff(nil, npub, tt.relay)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		diffLimiter = newRateLimiter(1, time.Minute)
+		diffLimiter.allow("203.0.113.9", time.Now())
+		rec := postDiff(nil, npub, "wss://relay.example")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("status = %d, Retry-After = %q, want 429 after 60s", rec.Code, rec.Header().Get("Retry-After"))
+		}
+	})
+	t.Run("GET", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		diffHandler(nil, rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+"/diff", nil), npub)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("status = %d, want 405", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runDump implements the dump subcommand, writing a pubkey's events as JSONL
+func runDump(db *sql.DB, args []string) error {
+	fset := flag.NewFlagSet("dump", flag.ExitOnError)
+	npub := fset.String("npub", "", "npub whose events are dumped")
+	out := fset.String("out", "-", "output file (- for stdout)")
+	sort := fset.String("sort", "kind", "sort order: kind or recent")
+	fset.Parse(args)
+
+	if *npub == "" {
+		return fmt.Errorf("--npub is required")
+	}
+
+	hexPubkey, err := npubToHex(*npub)
+	if err != nil {
+		return err
+	}
+
+	events, _, err := queryEventsByPubkey(context.Background(), db, hexPubkey, listOptions{Sort: *sort, Uncapped: true})
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeJSONL(w, events); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Dumped %d events\n", len(events))
+	return nil
+}
+
+// writeJSONL writes the raw event data of each event on its own line
+func writeJSONL(w io.Writer, events []Event) error {
+	bw := bufio.NewWriter(w)
+	for _, event := range events {
+		if _, err := fmt.Fprintln(bw, event.EventData); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRunDump(t *testing.T) {
+	const hex = "91cf94e5ca8d8b0a3c2f3e5b4b7d1e9a3c0f6d2b8e4a1c7f5d3b9e2a6c8f4d1e"
+	npub, _ := nip19.EncodePublicKey(hex)
+
+	lines := []string{
+		`{"id":"aa","kind":0,"content":"{\"name\":\"frank\"}"}`,
+		`{"id":"bb","kind":1,"content":"first"}`,
+		`{"id":"cc","kind":1,"content":"second\nline"}`,
+	}
+	tests := []struct {
+		name      string
+		args      func(out string) []string
+		wantOrder string
+		wantErr   string
+	}{
+		{
+			name:      "kind order to a file",
+			args:      func(out string) []string { return []string{"--npub", npub, "--out", out} },
+			wantOrder: `ORDER BY event_kind ASC`,
+		},
+		{
+			name:      "recent order",
+			args:      func(out string) []string { return []string{"--npub=" + npub, "--sort=recent", "--out=" + out} },
+			wantOrder: `ORDER BY created_at DESC`,
+		},
+		{
+			name:    "missing npub",
+			args:    func(out string) []string { return []string{"--out", out} },
+			wantErr: "--npub is required",
+		},
+		{
+			name:    "invalid npub",
+			args:    func(out string) []string { return []string{"--npub", "npub1invalid", "--out", out} },
+			wantErr: "invalid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.wantOrder != "" {
+				rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+				for i, line := range lines {
+					rows.AddRow(string(rune('a'+i)), hex, int64(1700000000+i), 1, line)
+				}
+				mock.ExpectQuery(tt.wantOrder).WithArgs(hex).WillReturnRows(rows)
+			}
+
+			out := filepath.Join(t.TempDir(), "events.jsonl")
+			err = runDump(db, tt.args(out))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runDump() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(lines, "\n") + "\n"; string(got) != want {
+				t.Errorf("dump =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
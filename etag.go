@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventsETag computes an ETag for a pubkey's events from their count and
+// newest created_at, returning also the newest created_at
+func eventsETag(ctx context.Context, db *sql.DB, pubkey string) (string, int64, error) {
+	defer observeDBQuery("events_etag", time.Now())
+
+	query := `SELECT COUNT(*), COALESCE(MAX(created_at), 0) FROM event_backup WHERE pubkey = $1`
+	var count, latest int64
+	err := db.QueryRowContext(ctx, query, pubkey).Scan(&count, &latest)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf(`"%s-%d-%d"`, pubkey[:16], count, latest), latest, nil
+}
+
+// etagMatches reports whether the If-None-Match header matches etag
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
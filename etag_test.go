@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestNpubPageNotModified(t *testing.T) {
+	const (
+		pubkey = "e8f6c1a0d3b2948576a4c3b2e1d0f9e8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2"
+		noteID = "4376c65d2f232afbe9b882a35baa4f6fe8667c4e684749af565f981833ed6a65"
+	)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "dave"})
+	defer profiles.delete(pubkey)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	etagRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"count", "max"}).AddRow(1, int64(1700000000))
+	}
+	// A full page also looks up deletions and the relay list
+	expectPage := func() {
+		mock.ExpectQuery(`SELECT COUNT\(\*\), COALESCE\(MAX\(created_at\), 0\)`).WithArgs(pubkey).WillReturnRows(etagRow())
+		mock.ExpectQuery(`ORDER BY event_kind ASC`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+				AddRow(noteID, pubkey, int64(1700000000), 1, `{"id":"`+noteID+`","kind":1,"content":"gm","tags":[]}`))
+		mock.ExpectQuery(`event_kind = 5`).WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+		mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+	}
+	expectPage()
+	handler := npubHandler(&databases{primary: db})
+
+	first := httptest.NewRecorder()
+	handler(first, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Last-Modified") != "Tue, 14 Nov 2023 22:13:20 GMT" {
+		t.Fatalf("first request: ETag %q, Last-Modified %q", etag, first.Header().Get("Last-Modified"))
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"matching", etag, http.StatusNotModified},
+		{"weak and listed", `"other", W/` + etag, http.StatusNotModified},
+		{"stale", `"` + pubkey[:16] + `-0-0"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantStatus == http.StatusOK {
+				expectPage()
+			} else {
+				mock.ExpectQuery(`SELECT COUNT\(\*\), COALESCE\(MAX\(created_at\), 0\)`).WithArgs(pubkey).WillReturnRows(etagRow())
+			}
+			req := httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil)
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 has a body: %q", rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
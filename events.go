@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// parse decodes the stored event data into a nostr event
+func (e Event) parse() (*nostr.Event, error) {
+	var ev nostr.Event
+	if err := json.Unmarshal([]byte(e.EventData), &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// errEventIDMismatch is returned for stored events whose id does not match
+// their serialized content
+var errEventIDMismatch = errors.New("event id does not match its content")
+
+// canonicalEvent parses stored event data and re-serializes it as a NIP-01
+// event object with only the standard fields, in order. Data that cannot
+// be parsed or whose id does not match is an error, since relays would
+// reject it.
+func canonicalEvent(eventData string) (*nostr.Event, []byte, error) {
+	var stored nostr.Event
+	if err := json.Unmarshal([]byte(eventData), &stored); err != nil {
+		return nil, nil, err
+	}
+	// Rebuilding the event drops unknown fields kept by the decoder
+	ev := &nostr.Event{
+		ID:        stored.ID,
+		PubKey:    stored.PubKey,
+		CreatedAt: stored.CreatedAt,
+		Kind:      stored.Kind,
+		Tags:      stored.Tags,
+		Content:   stored.Content,
+		Sig:       stored.Sig,
+	}
+	if ev.Tags == nil {
+		ev.Tags = nostr.Tags{}
+	}
+	if ev.GetID() != ev.ID {
+		return nil, nil, errEventIDMismatch
+	}
+	// Marshaling directly keeps encoding/json from escaping <, > and &
+	b, err := ev.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ev, b, nil
+}
+
+// Canonical returns the stored event and its canonical NIP-01 JSON
+func (e Event) Canonical() (*nostr.Event, []byte, error) {
+	return canonicalEvent(e.EventData)
+}
+
+// scanEvent scans an event_backup row. A NULL event_data is read as empty
+// so that a single damaged row does not fail the whole listing.
+func scanEvent(rows *sql.Rows) (Event, error) {
+	var event Event
+	var eventData sql.NullString
+	err := rows.Scan(&event.ID, &event.Pubkey, &event.CreatedAt, &event.Kind, &eventData)
+	event.EventData = eventData.String
+	return event, err
+}
+
+// Unparseable reports whether the stored event data is not a valid event
+func (e Event) Unparseable() bool {
+	_, err := e.parse()
+	return err != nil
+}
+
+// Indented returns the stored event data indented with two spaces for
+// display, or the raw data if it is not valid JSON. Data larger than
+// maxRenderContent is cut short without indenting.
+func (e Event) Indented() string {
+	if e.ContentTruncated() {
+		s, _ := truncateBytes(e.EventData, maxRenderContent)
+		return s + "…"
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(e.EventData), "", "  "); err != nil {
+		return e.EventData
+	}
+	return buf.String()
+}
+
+// expiration returns the NIP-40 expiration timestamp of ev, if it has one
+func expiration(ev *nostr.Event) (int64, bool) {
+	tag := ev.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(tag.Value(), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// isExpired reports whether ev has a NIP-40 expiration that has passed
+func isExpired(ev *nostr.Event, now time.Time) bool {
+	ts, ok := expiration(ev)
+	return ok && ts <= now.Unix()
+}
+
+// IsExpired reports whether the event has a NIP-40 expiration that has
+// passed, so relays are expected to have dropped it
+func (e Event) IsExpired() bool {
+	ev, err := e.parse()
+	if err != nil {
+		return false
+	}
+	return isExpired(ev, time.Now())
+}
+
+// futureSkew is how far ahead of now created_at may be before an event is
+// flagged as future-dated, set with FUTURE_SKEW
+var futureSkew = 15 * time.Minute
+
+// isFutureDated reports whether createdAt is more than futureSkew after now,
+// which points to clock skew or forgery and is rejected by some relays
+func isFutureDated(createdAt int64, now time.Time) bool {
+	return time.Unix(createdAt, 0).After(now.Add(futureSkew))
+}
+
+// IsFutureDated reports whether the event is dated too far in the future
+func (e Event) IsFutureDated() bool {
+	return isFutureDated(e.CreatedAt, time.Now())
+}
+
+// isReplaceable reports whether only the newest event of kind is current
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// isParameterizedReplaceable reports whether only the newest event of kind
+// per d tag is current
+func isParameterizedReplaceable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// markSuperseded flags every replaceable event that has a newer version
+// among events. Ties on created_at are won by the lowest id, as in NIP-01.
+func markSuperseded(events []Event) {
+	type key struct {
+		pubkey string
+		kind   int
+		d      string
+	}
+
+	newest := map[key]int{}
+	for i, event := range events {
+		k := key{pubkey: event.Pubkey, kind: event.Kind}
+		switch {
+		case isReplaceable(event.Kind):
+		case isParameterizedReplaceable(event.Kind):
+			if ev, err := event.parse(); err == nil {
+				if tag := ev.Tags.GetFirst([]string{"d", ""}); tag != nil {
+					k.d = tag.Value()
+				}
+			}
+		default:
+			continue
+		}
+
+		j, ok := newest[k]
+		if !ok {
+			newest[k] = i
+			continue
+		}
+		current := events[j]
+		if event.CreatedAt > current.CreatedAt || (event.CreatedAt == current.CreatedAt && event.ID < current.ID) {
+			events[j].Superseded = true
+			newest[k] = i
+		} else {
+			events[i].Superseded = true
+		}
+	}
+}
+
+// kindNames are human-readable names of well-known event kinds
+var kindNames = map[int]string{
+	0:     "profile",
+	1:     "notes",
+	3:     "contacts",
+	4:     "encrypted messages",
+	5:     "deletions",
+	6:     "reposts",
+	7:     "reactions",
+	8:     "badge awards",
+	16:    "generic reposts",
+	40:    "channel creations",
+	41:    "channel metadata",
+	42:    "channel messages",
+	1984:  "reports",
+	9735:  "zaps",
+	10000: "mute list",
+	10001: "pin list",
+	10002: "relay list",
+	30000: "follow sets",
+	30008: "profile badges",
+	30009: "badge definitions",
+	30023: "long-form articles",
+	30078: "app data",
+}
+
+// kindName returns the human-readable name of kind, or "kind N" if unknown
+func kindName(kind int) string {
+	if name, ok := kindNames[kind]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind %d", kind)
+}
+
+// KindName returns the human-readable name of the event's kind
+func (e Event) KindName() string {
+	return kindName(e.Kind)
+}
+
+// KindCount is the number of events of a single kind
+type KindCount struct {
+	Kind  int    `json:"kind"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// countKinds returns the number of events per kind, ordered by kind
+func countKinds(events []Event) []KindCount {
+	counts := map[int]int{}
+	for _, event := range events {
+		counts[event.Kind]++
+	}
+
+	result := make([]KindCount, 0, len(counts))
+	for kind, count := range counts {
+		result = append(result, KindCount{Kind: kind, Name: kindName(kind), Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Kind < result[j].Kind })
+	return result
+}
+
+// orderGroupsByCount reorders events grouped by kind so the kinds with the
+// most events come first, breaking ties by kind. The order within each kind
+// is kept. It returns the kind counts in the same order.
+func orderGroupsByCount(events []Event) []KindCount {
+	counts := countKinds(events)
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+
+	rank := map[int]int{}
+	for i, c := range counts {
+		rank[c.Kind] = i
+	}
+	sort.SliceStable(events, func(i, j int) bool { return rank[events[i].Kind] < rank[events[j].Kind] })
+	return counts
+}
+
+// IDMismatch reports whether the stored or claimed event id differs from
+// the id computed from the serialized event fields
+func (e Event) IDMismatch() bool {
+	ev, err := e.parse()
+	if err != nil {
+		return false
+	}
+	computed := ev.GetID()
+	return computed != ev.ID || computed != e.ID
+}
+
+// filterDMs removes encrypted direct messages (kind 4) from events,
+// returning the remaining events and the number removed
+func filterDMs(events []Event) ([]Event, int) {
+	kept := events[:0]
+	hidden := 0
+	for _, event := range events {
+		if event.Kind == 4 {
+			hidden++
+			continue
+		}
+		kept = append(kept, event)
+	}
+	return kept, hidden
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMarkSuperseded(t *testing.T) {
+	const alice, bob = "aa", "bb"
+	// article is a stored kind-30023 event with the d tag d
+	article := func(id string, createdAt int64, d string) Event {
+		return Event{ID: id, Pubkey: alice, Kind: 30023, CreatedAt: createdAt,
+			EventData: fmt.Sprintf(`{"kind":30023,"tags":[["title","x"],["d",%q]]}`, d)}
+	}
+
+	tests := []struct {
+		name       string
+		events     []Event
+		superseded []string
+	}{
+		{
+			name: "older profiles and contact lists",
+			events: []Event{
+				{ID: "p1", Pubkey: alice, Kind: 0, CreatedAt: 100},
+				{ID: "p2", Pubkey: alice, Kind: 0, CreatedAt: 300},
+				{ID: "p3", Pubkey: alice, Kind: 0, CreatedAt: 200},
+				{ID: "c1", Pubkey: alice, Kind: 3, CreatedAt: 50},
+			},
+			superseded: []string{"p1", "p3"},
+		},
+		{
+			name: "10000 range per author",
+			events: []Event{
+				{ID: "m1", Pubkey: alice, Kind: 10002, CreatedAt: 100},
+				{ID: "m2", Pubkey: alice, Kind: 10002, CreatedAt: 200},
+				{ID: "m3", Pubkey: bob, Kind: 10002, CreatedAt: 50},
+				{ID: "m4", Pubkey: alice, Kind: 19999, CreatedAt: 10},
+			},
+			superseded: []string{"m1"},
+		},
+		{
+			name: "ties go to the lowest id",
+			events: []Event{
+				{ID: "t2", Pubkey: alice, Kind: 10000, CreatedAt: 100},
+				{ID: "t1", Pubkey: alice, Kind: 10000, CreatedAt: 100},
+			},
+			superseded: []string{"t2"},
+		},
+		{
+			name: "30000 range per d tag",
+			events: []Event{
+				article("a1", 100, "intro"),
+				article("a2", 200, "intro"),
+				article("a3", 150, "recipes"),
+				article("a4", 90, "recipes"),
+				article("a5", 10, ""),
+			},
+			superseded: []string{"a1", "a4"},
+		},
+		{
+			name: "regular and ephemeral kinds are kept",
+			events: []Event{
+				{ID: "n1", Pubkey: alice, Kind: 1, CreatedAt: 100},
+				{ID: "n2", Pubkey: alice, Kind: 1, CreatedAt: 200},
+				{ID: "e1", Pubkey: alice, Kind: 20001, CreatedAt: 100},
+				{ID: "e2", Pubkey: alice, Kind: 20001, CreatedAt: 200},
+				{ID: "r1", Pubkey: alice, Kind: 40000, CreatedAt: 100},
+				{ID: "r2", Pubkey: alice, Kind: 40000, CreatedAt: 200},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markSuperseded(tt.events)
+			want := map[string]bool{}
+			for _, id := range tt.superseded {
+				want[id] = true
+			}
+			for _, ev := range tt.events {
+				if ev.Superseded != want[ev.ID] {
+					t.Errorf("%s superseded = %v, want %v", ev.ID, ev.Superseded, want[ev.ID])
+				}
+			}
+		})
+	}
+}
+
+func TestOrderGroupsByCount(t *testing.T) {
+	// Events arrive grouped by kind, newest first within each kind
+	events := []Event{
+		{ID: "p", Kind: 0},
+		{ID: "n1", Kind: 1}, {ID: "n2", Kind: 1},
+		{ID: "f", Kind: 3},
+		{ID: "r1", Kind: 7}, {ID: "r2", Kind: 7}, {ID: "r3", Kind: 7},
+		{ID: "a1", Kind: 30023}, {ID: "a2", Kind: 30023},
+	}
+	counts := orderGroupsByCount(events)
+
+	wantCounts := []KindCount{
+		{7, kindName(7), 3},
+		{1, kindName(1), 2},
+		{30023, kindName(30023), 2},
+		{0, kindName(0), 1},
+		{3, kindName(3), 1},
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("counts = %v, want %v", counts, wantCounts)
+	}
+	var ids []string
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+	if got, want := strings.Join(ids, ","), "r1,r2,r3,n1,n2,a1,a2,p,f"; got != want {
+		t.Errorf("event order = %s, want %s", got, want)
+	}
+}
+
+func TestIndented(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			"minified",
+			`{"id":"ab","kind":1,"tags":[["p","cd"]],"content":"gm"}`,
+			"{\n  \"id\": \"ab\",\n  \"kind\": 1,\n  \"tags\": [\n    [\n      \"p\",\n      \"cd\"\n    ]\n  ],\n  \"content\": \"gm\"\n}",
+		},
+		{"already indented", "{\n\t\"kind\": 1\n}", "{\n  \"kind\": 1\n}"},
+		{"escaped content is kept", `{"content":"line\nbreak \u003cb\u003e"}`, "{\n  \"content\": \"line\\nbreak \\u003cb\\u003e\"\n}"},
+		{"invalid json", `{"kind":1,`, `{"kind":1,`},
+		{"not json at all", "gm", "gm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Event{EventData: tt.data}).Indented(); got != tt.want {
+				t.Errorf("Indented() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountKinds(t *testing.T) {
+	kinds := func(ks ...int) []Event {
+		events := make([]Event, len(ks))
+		for i, k := range ks {
+			events[i] = Event{ID: fmt.Sprint(i), Kind: k}
+		}
+		return events
+	}
+	tests := []struct {
+		name   string
+		events []Event
+		want   []KindCount
+	}{
+		{"none", nil, []KindCount{}},
+		{"one kind", kinds(1, 1, 1), []KindCount{{1, "notes", 3}}},
+		{
+			"mixed and unknown kinds",
+			kinds(7, 1, 0, 7, 31337, 1, 7),
+			[]KindCount{{0, "profile", 1}, {1, "notes", 2}, {7, kindName(7), 3}, {31337, "kind 31337", 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := countKinds(tt.events)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("countKinds() = %v, want %v", got, tt.want)
+			}
+			total := 0
+			for _, c := range got {
+				total += c.Count
+			}
+			if total != len(tt.events) {
+				t.Errorf("counts add up to %d, want %d", total, len(tt.events))
+			}
+		})
+	}
+}
+
+func TestEventIDMismatch(t *testing.T) {
+	ev := nostr.Event{Kind: 1, Content: "original", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	ev.Sign(nostr.GeneratePrivateKey())
+	altered := ev
+	altered.ID = strings.Repeat("0", 64)
+	tampered := ev
+	tampered.Content = "edited after signing"
+
+	tests := []struct {
+		name    string
+		storeID string
+		data    nostr.Event
+		want    bool
+		// wantRefused is whether the event data itself would be refused for
+		// restoring, whatever id it is stored under
+		wantRefused bool
+	}{
+		{"correct", ev.ID, ev, false, false},
+		{"id field altered", altered.ID, altered, true, true},
+		{"content altered", ev.ID, tampered, true, true},
+		{"stored under another id", altered.ID, ev, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Event{ID: tt.storeID, EventData: tt.data.String()}
+			if got := e.IDMismatch(); got != tt.want {
+				t.Errorf("IDMismatch() = %v, want %v", got, tt.want)
+			}
+			_, _, err := canonicalEvent(e.EventData)
+			if got := err == errEventIDMismatch; got != tt.wantRefused {
+				t.Errorf("canonicalEvent() error = %v", err)
+			}
+		})
+	}
+
+	if (Event{EventData: "{"}).IDMismatch() {
+		t.Error("unparseable data is reported as an id mismatch")
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+	tests := []struct {
+		name string
+		tags nostr.Tags
+		want bool
+	}{
+		{"expired", nostr.Tags{{"expiration", at(-time.Hour)}}, true},
+		{"expires now", nostr.Tags{{"expiration", at(0)}}, true},
+		{"not yet expired", nostr.Tags{{"expiration", at(time.Hour)}}, false},
+		{"no expiration", nostr.Tags{{"t", "forever"}}, false},
+		{"malformed expiration", nostr.Tags{{"expiration", "tomorrow"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := nostr.Event{Kind: 1, Tags: tt.tags}
+			if got := isExpired(&ev, now); got != tt.want {
+				t.Errorf("isExpired() = %v, want %v", got, tt.want)
+			}
+			if got := (Event{EventData: ev.String()}).IsExpired(); got != tt.want {
+				t.Errorf("IsExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if (Event{EventData: "{"}).IsExpired() {
+		t.Error("unparseable data is reported as expired")
+	}
+}
+
+func TestIsFutureDated(t *testing.T) {
+	defer func(skew time.Duration) { futureSkew = skew }(futureSkew)
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		skew   time.Duration
+		offset time.Duration
+		want   bool
+	}{
+		{"in the past", 15 * time.Minute, -time.Hour, false},
+		{"now", 15 * time.Minute, 0, false},
+		{"slightly ahead", 15 * time.Minute, 2 * time.Minute, false},
+		{"at the skew", 15 * time.Minute, 15 * time.Minute, false},
+		{"just past the skew", 15 * time.Minute, 15*time.Minute + time.Second, true},
+		{"significantly ahead", 15 * time.Minute, 30 * 24 * time.Hour, true},
+		{"slightly ahead of no skew", 0, time.Second, true},
+		{"within a wider skew", 2 * time.Hour, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			futureSkew = tt.skew
+			if got := isFutureDated(now.Add(tt.offset).Unix(), now); got != tt.want {
+				t.Errorf("isFutureDated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	ev := nostr.Event{Kind: 1, Content: "a <b> & \"c\"\n", CreatedAt: 1700000000, Tags: nostr.Tags{{"t", "nostr"}}}
+	ev.Sign(sk)
+	bare := nostr.Event{Kind: 1, Content: "no tags", CreatedAt: 1700000001, Tags: nostr.Tags{}}
+	bare.Sign(sk)
+	want := func(ev nostr.Event) string {
+		b, _ := ev.MarshalJSON()
+		return string(b)
+	}
+	tags := `[["t","nostr"]]`
+
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr error
+	}{
+		{"already canonical", ev.String(), want(ev), nil},
+		{
+			"reordered with extra fields",
+			fmt.Sprintf(`{ "sig":"%s", "content":%q, "relay":"wss://relay.example", "tags":%s,
+				"kind":1, "created_at":%d, "pubkey":"%s", "id":"%s", "seen_at":1700000099 }`,
+				ev.Sig, ev.Content, tags, ev.CreatedAt, ev.PubKey, ev.ID),
+			want(ev), nil,
+		},
+		{
+			"HTML-escaped content",
+			fmt.Sprintf(`{"id":"%s","pubkey":"%s","created_at":%d,"kind":1,"tags":%s,"content":"a \u003cb\u003e \u0026 \"c\"\n","sig":"%s"}`,
+				ev.ID, ev.PubKey, ev.CreatedAt, tags, ev.Sig),
+			want(ev), nil,
+		},
+		{
+			"missing tags",
+			fmt.Sprintf(`{"id":"%s","pubkey":"%s","created_at":%d,"kind":1,"content":"no tags","sig":"%s"}`,
+				bare.ID, bare.PubKey, bare.CreatedAt, bare.Sig),
+			want(bare), nil,
+		},
+		{"content edited", strings.Replace(ev.String(), "nostr", "nostr!", 1), "", errEventIDMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, b, err := (Event{EventData: tt.data}).Canonical()
+			if err != tt.wantErr {
+				t.Fatalf("Canonical() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(b) != tt.want {
+				t.Errorf("Canonical() =\n%s\nwant\n%s", b, tt.want)
+			}
+			// The round trip keeps the id and signature valid
+			if got.GetID() != got.ID {
+				t.Errorf("canonical id %s does not match its content", got.ID)
+			}
+			if ok, _ := got.CheckSignature(); !ok {
+				t.Error("canonical event fails signature verification")
+			}
+		})
+	}
+
+	if _, _, err := (Event{EventData: `{"id":`}).Canonical(); err == nil || err == errEventIDMismatch {
+		t.Errorf("Canonical() of unparseable data = %v, want a parse error", err)
+	}
+}
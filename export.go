@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// exportHandler serves GET /npub/{npub}/export.json with all of the author's
+// stored events as a single JSON array of NIP-01 event objects. The array is
+// written as rows are read so large backups are not held in memory.
+func exportHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, npub string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	hexPubkey, err := npubToHex(npub)
+	if errors.Is(err, errPrivateKey) {
+		http.Error(w, privateKeyMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid npub format", http.StatusBadRequest)
+		return
+	}
+	if isBlocked(hexPubkey) {
+		http.Error(w, unavailableMessage, http.StatusNotFound)
+		return
+	}
+
+	defer observeDBQuery("export_events", time.Now())
+
+	query, args, err := buildEventsQuery(hexPubkey, listOptions{Sort: "recent", Uncapped: true})
+	if err != nil {
+		errorf(ctx, "Failed to build export query for %s: %v", hexPubkey, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errorf(ctx, "Failed to query events for export of %s: %v", hexPubkey, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename="+npub+".json")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// The status is sent with the first write, so later failures can only
+	// be logged and leave the array unterminated
+	w.Write([]byte("["))
+	count, skipped := 0, 0
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			logf(ctx, "Failed to scan event during export of %s: %v", hexPubkey, err)
+			return
+		}
+		// Only valid events are exported, in canonical form, so the file can
+		// be imported as is
+		_, b, err := event.Canonical()
+		if err != nil {
+			debugf(ctx, "Skipping event %s in export of %s: %v", event.ID, hexPubkey, err)
+			skipped++
+			continue
+		}
+		if count > 0 {
+			w.Write([]byte(",\n"))
+		} else {
+			w.Write([]byte("\n"))
+		}
+		if _, err := w.Write(b); err != nil {
+			logf(ctx, "Export of %s aborted: %v", hexPubkey, err)
+			return
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		logf(ctx, "Failed to read events during export of %s: %v", hexPubkey, err)
+		return
+	}
+	w.Write([]byte("\n]\n"))
+
+	logf(ctx, "Exported %d events for %s (%d invalid skipped)", count, hexPubkey, skipped)
+}
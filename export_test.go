@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestExportHandler(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	events := []nostr.Event{
+		{Kind: 1, Content: "note with \"quotes\"\nand lines", CreatedAt: 1700000300, Tags: nostr.Tags{{"t", "export"}}},
+		{Kind: 0, Content: `{"name":"pat"}`, CreatedAt: 1700000200, Tags: nostr.Tags{}},
+		{Kind: 3, Content: "", CreatedAt: 1700000100, Tags: nostr.Tags{{"p", pubkey, "wss://relay.example"}}},
+	}
+	for i := range events {
+		events[i].Sign(sk)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		method   string
+		rows     func(*sqlmock.Rows)
+		wantBody bool
+		want     []nostr.Event
+	}{
+		{
+			name:   "valid events in order, invalid ones skipped",
+			method: http.MethodGet,
+			rows: func(rows *sqlmock.Rows) {
+				for i, ev := range events {
+					rows.AddRow(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, ev.String())
+					if i == 0 {
+						rows.AddRow(strings.Repeat("f", 64), pubkey, int64(1700000250), 1, `{"id":"broken"`)
+					}
+				}
+			},
+			wantBody: true,
+			want:     events,
+		},
+		{name: "no events", method: http.MethodGet, rows: func(*sqlmock.Rows) {}, wantBody: true, want: []nostr.Event{}},
+		{name: "HEAD", method: http.MethodHead, rows: func(*sqlmock.Rows) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			tt.rows(rows)
+			mock.ExpectQuery(`ORDER BY created_at DESC, id DESC$`).WithArgs(pubkey).WillReturnRows(rows)
+
+			rec := httptest.NewRecorder()
+			exportHandler(db, rec, httptest.NewRequest(tt.method, "/npub/"+npub+"/export.json", nil), npub)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); cd != "attachment; filename="+npub+".json" {
+				t.Errorf("Content-Disposition = %q", cd)
+			}
+			if !tt.wantBody {
+				if rec.Body.Len() != 0 {
+					t.Errorf("HEAD body = %q", rec.Body)
+				}
+				return
+			}
+
+			var raw []map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+				t.Fatalf("export is not a JSON array: %v\n%s", err, rec.Body)
+			}
+			if len(raw) != len(tt.want) {
+				t.Fatalf("export has %d events, want %d", len(raw), len(tt.want))
+			}
+			for i, obj := range raw {
+				var fields []string
+				for k := range obj {
+					fields = append(fields, k)
+				}
+				sort.Strings(fields)
+				if want := []string{"content", "created_at", "id", "kind", "pubkey", "sig", "tags"}; !reflect.DeepEqual(fields, want) {
+					t.Errorf("event %d has fields %v, want %v", i, fields, want)
+				}
+				var ev nostr.Event
+				b, _ := json.Marshal(obj)
+				json.Unmarshal(b, &ev)
+				if ok, _ := ev.CheckSignature(); !ok || ev.ID != tt.want[i].ID || ev.Content != tt.want[i].Content {
+					t.Errorf("event %d = %+v, want %s with a valid signature", i, ev, tt.want[i].ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// profileGatewayURL is an njump-style HTTP endpoint profiles are fetched
+// from when no relay returns one, such as https://njump.me/{npub}.json.
+// {npub} or {pubkey} is replaced; otherwise the npub is appended as a path
+// segment. Empty disables the fallback.
+var profileGatewayURL string
+
+// profileGatewayTimeout bounds a profile fetch from the gateway
+const profileGatewayTimeout = 5 * time.Second
+
+// maxGatewayResponse limits the size of a gateway response
+const maxGatewayResponse = 1 << 20
+
+// parseGatewayURL validates PROFILE_GATEWAY_URL
+func parseGatewayURL(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(strings.NewReplacer("{npub}", "npub", "{pubkey}", "pubkey").Replace(v))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid PROFILE_GATEWAY_URL %q: must be an http(s) URL", v)
+	}
+	return v, nil
+}
+
+// gatewayProfileURL returns the gateway URL for pubkey
+func gatewayProfileURL(pubkey string) (string, error) {
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(profileGatewayURL, "{npub}") && !strings.Contains(profileGatewayURL, "{pubkey}") {
+		return strings.TrimSuffix(profileGatewayURL, "/") + "/" + npub, nil
+	}
+	return strings.NewReplacer("{npub}", npub, "{pubkey}", pubkey).Replace(profileGatewayURL), nil
+}
+
+// parseGatewayProfile parses a gateway response, which is either the signed
+// kind-0 event of pubkey or the profile metadata itself, into a profile
+func parseGatewayProfile(body []byte, pubkey string) (*UserProfile, error) {
+	content := body
+	var ev nostr.Event
+	if err := json.Unmarshal(body, &ev); err == nil && (ev.PubKey != "" || ev.Sig != "") {
+		if ev.Kind != 0 || ev.PubKey != pubkey {
+			return nil, fmt.Errorf("gateway returned a kind %d event of %s", ev.Kind, ev.PubKey)
+		}
+		if ok, err := ev.CheckSignature(); err != nil || !ok {
+			return nil, fmt.Errorf("gateway returned an event with an invalid signature")
+		}
+		content = []byte(ev.Content)
+	}
+
+	var profile UserProfile
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return nil, fmt.Errorf("gateway returned an invalid profile: %v", err)
+	}
+	profile.RawContent = string(content)
+	return &profile, nil
+}
+
+// fetchProfileFromGateway fetches the profile of pubkey from the configured
+// HTTP gateway
+func fetchProfileFromGateway(ctx context.Context, pubkey string) (*UserProfile, error) {
+	u, err := gatewayProfileURL(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, profileGatewayTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxGatewayResponse))
+	if err != nil {
+		return nil, err
+	}
+	profile, err := parseGatewayProfile(body, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	profile.SourceRelay = u
+	return profile, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestParseGatewayURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{" https://njump.me/{npub}.json ", "https://njump.me/{npub}.json", false},
+		{"http://gateway.example/profile/{pubkey}", "http://gateway.example/profile/{pubkey}", false},
+		{"https://gateway.example/p/", "https://gateway.example/p/", false},
+		{"ftp://gateway.example/{npub}", "", true},
+		{"njump.me/{npub}.json", "", true},
+		{"https:///{npub}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseGatewayURL(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseGatewayURL(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGatewayProfileURL(t *testing.T) {
+	const pubkey = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	defer func(gateway string) { profileGatewayURL = gateway }(profileGatewayURL)
+
+	for gateway, want := range map[string]string{
+		"https://njump.me/{npub}.json":        "https://njump.me/" + npub + ".json",
+		"https://gateway.example/?p={pubkey}": "https://gateway.example/?p=" + pubkey,
+		"https://gateway.example/profiles":    "https://gateway.example/profiles/" + npub,
+		"https://gateway.example/profiles/":   "https://gateway.example/profiles/" + npub,
+	} {
+		profileGatewayURL = gateway
+		if got, err := gatewayProfileURL(pubkey); err != nil || got != want {
+			t.Errorf("gatewayProfileURL() with %s = %q, %v, want %q", gateway, got, err, want)
+		}
+	}
+	if _, err := gatewayProfileURL("not-a-pubkey"); err == nil {
+		t.Error("an invalid pubkey was encoded")
+	}
+}
+
+func TestParseGatewayProfile(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	sign := func(ev nostr.Event) string {
+		ev.Sign(sk)
+		return ev.String()
+	}
+	metadata := sign(nostr.Event{Kind: 0, Content: `{"name":"sorrel","about":"via http"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}})
+	note := sign(nostr.Event{Kind: 1, Content: `{"name":"sorrel"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}})
+	forged := strings.Replace(metadata, "via http", "via forgery", 1)
+	stranger := nostr.Event{Kind: 0, Content: `{"name":"imposter"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	stranger.Sign(nostr.GeneratePrivateKey())
+
+	tests := []struct {
+		name     string
+		body     string
+		wantName string
+		wantErr  bool
+	}{
+		{"signed kind-0 event", metadata, "sorrel", false},
+		{"bare metadata", `{"name":"sorrel","picture":"https://img.example/s.png"}`, "sorrel", false},
+		{"not a profile event", note, "", true},
+		{"another author's event", stranger.String(), "", true},
+		{"tampered event", forged, "", true},
+		{"not JSON", `<html>blocked</html>`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := parseGatewayProfile([]byte(tt.body), pubkey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGatewayProfile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && profile.Name != tt.wantName {
+				t.Errorf("name = %q, want %q", profile.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestProfileFetchFallsBackToGateway(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"rowan","about":"websockets are blocked here"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+
+	// Nothing listens on a port whose listener was closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "ws://" + l.Addr().String()
+	l.Close()
+	defer func(relays []string, retries int, gateway string) {
+		readRelays, relayConnectRetries, profileGatewayURL = relays, retries, gateway
+	}(readRelays, relayConnectRetries, profileGatewayURL)
+	readRelays, relayConnectRetries = []string{down}, 0
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantName string
+	}{
+		{"signed event", http.StatusOK, metadata.String(), "rowan"},
+		{"metadata", http.StatusOK, `{"name":"rowan"}`, "rowan"},
+		{"not found", http.StatusNotFound, `{"error":"not found"}`, ""},
+		{"unsigned garbage", http.StatusOK, `{"pubkey":"` + pubkey + `","kind":0,"content":"{}"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested, accept string
+			gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested, accept = r.URL.Path, r.Header.Get("Accept")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer gateway.Close()
+			profileGatewayURL = gateway.URL + "/{npub}.json"
+
+			profile, err := fetchProfileFromRelays(context.Background(), pubkey, nil)
+			if err != nil {
+				t.Fatalf("fetchProfileFromRelays() error = %v", err)
+			}
+			if requested != "/"+npub+".json" || accept != "application/json" {
+				t.Errorf("gateway was asked for %s accepting %q", requested, accept)
+			}
+			if profile.Name != tt.wantName {
+				t.Errorf("name = %q, want %q", profile.Name, tt.wantName)
+			}
+			if tt.wantName != "" && profile.SourceRelay != gateway.URL+"/"+npub+".json" {
+				t.Errorf("source = %q, want the gateway URL", profile.SourceRelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	large := strings.Repeat(`{"kind":1,"content":"gm"},`, 200)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		status         int
+		wantGzip       bool
+	}{
+		{"large json", "gzip, deflate", "application/json", large, http.StatusOK, true},
+		{"large sniffed html", "gzip", "", "<!DOCTYPE html><html>" + large, http.StatusOK, true},
+		{"large error keeps status", "gzip", "text/plain", large, http.StatusInternalServerError, true},
+		{"small body", "gzip", "text/html", "<p>hi</p>", http.StatusOK, false},
+		{"client without gzip", "", "application/json", large, http.StatusOK, false},
+		{"image", "gzip", "image/png", "\x89PNG\r\n\x1a\n" + large, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.status)
+				// Written in pieces, as templates do
+				for i := 0; i < len(tt.body); i += 100 {
+					io.WriteString(w, tt.body[i:min(i+100, len(tt.body))])
+				}
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+				t.Error("Vary: Accept-Encoding missing")
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+			body := rec.Body.String()
+			if gzipped {
+				if rec.Body.Len() >= len(tt.body) {
+					t.Errorf("compressed body of %d bytes is not smaller than %d", rec.Body.Len(), len(tt.body))
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+			if body != tt.body {
+				t.Errorf("body differs from the original (%d bytes, want %d)", len(body), len(tt.body))
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// supportedIdentifiers describes the accepted identifier formats for users
+const supportedIdentifiers = "npub (npub1...), nprofile (nprofile1...), 64-character hex pubkey, or NIP-05 address (name@example.com)"
+
+// nip05Timeout bounds how long a NIP-05 lookup may take
+const nip05Timeout = 5 * time.Second
+
+// maxNip05Response caps the size of a nostr.json document read
+const maxNip05Response = 1 << 20
+
+// errPrivateKey is returned for a pasted nsec. Callers must neither log nor
+// echo the input that caused it, and show privateKeyMessage instead.
+var errPrivateKey = errors.New("input is a private key")
+
+// privateKeyMessage warns the user who pasted a private key
+const privateKeyMessage = "You pasted a private key (nsec). Never share this with anyone; the input has been cleared."
+
+// isPrivateKey reports whether input looks like a bech32 nsec
+func isPrivateKey(input string) bool {
+	return strings.Contains(strings.ToLower(input), "nsec1")
+}
+
+// resolveIdentifier converts an npub, nprofile, hex pubkey, or NIP-05
+// address into a hex pubkey. A NIP-05 lookup ends with ctx.
+func resolveIdentifier(ctx context.Context, input string) (string, error) {
+	input = strings.TrimSpace(input)
+	input = strings.TrimPrefix(input, "nostr:")
+
+	switch {
+	case input == "":
+		return "", fmt.Errorf("empty identifier")
+	case isPrivateKey(input):
+		return "", errPrivateKey
+	case strings.HasPrefix(input, "npub1"):
+		return npubToHex(input)
+	case strings.HasPrefix(input, "nprofile1"):
+		prefix, value, err := nip19.Decode(input)
+		if err != nil {
+			return "", fmt.Errorf("invalid nprofile: %v", err)
+		}
+		pointer, ok := value.(nostr.ProfilePointer)
+		if prefix != "nprofile" || !ok {
+			return "", fmt.Errorf("not an nprofile: prefix is %s", prefix)
+		}
+		return pointer.PublicKey, nil
+	case nostr.IsValidPublicKeyHex(strings.ToLower(input)):
+		return strings.ToLower(input), nil
+	case strings.Contains(input, "."):
+		ctx, cancel := context.WithTimeout(ctx, nip05Timeout)
+		defer cancel()
+
+		pointer, err := queryNip05(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("NIP-05 lookup for %s failed: %w", input, err)
+		}
+		if pointer == nil || !nostr.IsValidPublicKeyHex(pointer.PublicKey) {
+			return "", fmt.Errorf("NIP-05 address %s not found", input)
+		}
+		return pointer.PublicKey, nil
+	}
+
+	return "", fmt.Errorf("unrecognized identifier format")
+}
+
+// queryNip05 looks up a NIP-05 identifier like nip05.QueryIdentifier, but
+// through publicHTTPClient, since the domain is chosen by users
+func queryNip05(ctx context.Context, identifier string) (*nostr.ProfilePointer, error) {
+	name, domain, ok := strings.Cut(identifier, "@")
+	if !ok {
+		name, domain = "_", identifier
+	}
+	if name == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@/?#") {
+		return nil, fmt.Errorf("not a valid NIP-05 identifier")
+	}
+
+	u := "https://" + domain + "/.well-known/nostr.json?name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := publicHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	var result nip05.WellKnownResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxNip05Response)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid nostr.json: %v", err)
+	}
+	pubkey := result.Names[name]
+	return &nostr.ProfilePointer{PublicKey: pubkey, Relays: result.Relays[pubkey]}, nil
+}
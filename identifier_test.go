@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestIsPrivateKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"nsec", "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5", true},
+		{"uppercase nsec", "NSEC1VL029MGPSPEDVA04G90VLTKH6FVH240ZQTV9K0T9AF8935KE9LAQSNLFE5", true},
+		{"nsec with nostr prefix", "nostr:nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5", true},
+		{"nsec with surrounding text", "my key is nsec1abc ", true},
+		{"npub", "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg", false},
+		{"hex", "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e", false},
+		{"nip05", "bob@example.com", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPrivateKey(tt.input); got != tt.want {
+				t.Errorf("isPrivateKey(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveIdentifierRejectsPrivateKey(t *testing.T) {
+	_, err := resolveIdentifier(context.Background(), "  nostr:nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5 ")
+	if !errors.Is(err, errPrivateKey) {
+		t.Fatalf("resolveIdentifier(nsec) error = %v, want errPrivateKey", err)
+	}
+}
+
+func TestResolveIdentifierNip05Guarded(t *testing.T) {
+	// The loopback domain is refused before any request is made
+	if _, err := resolveIdentifier(context.Background(), "bob@127.0.0.1"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("loopback NIP-05 error = %v, want errPrivateAddress", err)
+	}
+
+	// A lookup ends with the request it was made for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolveIdentifier(ctx, "bob@nip05.example"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled NIP-05 error = %v, want context.Canceled", err)
+	}
+}
+
+func TestNpubHandlerRedirectsIdentifiers(t *testing.T) {
+	const pubkey = "32e1827635450ebb3c5a7d12c1f8e7b2b514439ac10a67eef3d9fd9c5c68e245"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	nprofile, _ := nip19.EncodeProfile(pubkey, []string{"wss://relay.example"})
+
+	// NIP-05 lookups go over https to the host of the address
+	wellKnown := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{"grace": pubkey}})
+	}))
+	defer wellKnown.Close()
+	defer func(rt http.RoundTripper) { publicHTTPClient.Transport = rt }(publicHTTPClient.Transport)
+	publicHTTPClient.Transport = wellKnown.Client().Transport
+	domain := strings.TrimPrefix(wellKnown.URL, "https://")
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTarget string
+	}{
+		{"hex", pubkey, http.StatusFound, "/npub/" + npub},
+		{"uppercase hex", strings.ToUpper(pubkey), http.StatusFound, "/npub/" + npub},
+		{"nprofile", nprofile, http.StatusFound, "/npub/" + npub},
+		{"nostr uri", "nostr:" + npub, http.StatusFound, "/npub/" + npub},
+		{"nip05", "grace@" + domain, http.StatusFound, "/npub/" + npub},
+		{"unknown nip05 name", "heidi@" + domain, http.StatusBadRequest, ""},
+		{"garbage", "hello", http.StatusBadRequest, ""},
+		{"truncated npub", npub[:20], http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/npub/?q="+url.QueryEscape(tt.query), nil)
+			npubHandler(&databases{})(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantTarget {
+				t.Errorf("Location = %q, want %q", got, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestPastedPrivateKeyIsRefusedWithoutLogging(t *testing.T) {
+	const nsec = "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(l logLevel) { minLogLevel = l }(minLogLevel)
+	minLogLevel = levelDebug
+
+	npub, _ := nip19.EncodePublicKey("32e1827635450ebb3c5a7d12c1f8e7b2b514439ac10a67eef3d9fd9c5c68e245")
+	tests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{"npub page", http.MethodGet, "/npub/" + nsec},
+		{"search box", http.MethodGet, "/npub/?q=" + url.QueryEscape(" nostr:"+nsec+" ")},
+		{"in a list", http.MethodGet, "/npub/?q=" + url.QueryEscape(npub+","+nsec)},
+		{"backup", http.MethodPost, "/npub/" + nsec + "/backup"},
+		{"export", http.MethodGet, "/npub/" + nsec + "/export.json"},
+		{"restore all", http.MethodPost, "/npub/" + nsec + "/restore-all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			rec := httptest.NewRecorder()
+			// The key is refused before the database is used
+			npubHandler(&databases{})(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", rec.Code)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, "You pasted a private key (nsec). Never share this with anyone") {
+				t.Errorf("response does not explain the refusal: %s", body)
+			}
+			if strings.Contains(body, nsec[5:]) {
+				t.Error("response echoes the private key")
+			}
+			if strings.Contains(logs.String(), nsec[5:]) {
+				t.Errorf("private key was logged: %s", logs.String())
+			}
+		})
+	}
+}
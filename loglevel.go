@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// logLevel is the severity of a log line
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps LOG_LEVEL values to levels
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLogLevel is the least severe level that is logged
+var minLogLevel = levelInfo
+
+// configureLogLevel reads LOG_LEVEL. An invalid value is fatal.
+func configureLogLevel() {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL")))
+	if v == "" {
+		return
+	}
+	level, ok := logLevels[v]
+	if !ok {
+		log.Fatalf("Invalid LOG_LEVEL %q: must be debug, info, warn or error", v)
+	}
+	minLogLevel = level
+}
+
+// logAt logs like log.Printf at level, prefixed with the request id from ctx
+func logAt(ctx context.Context, level logLevel, format string, args ...any) {
+	if level < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if id := requestID(ctx); id != "" {
+		msg = "[" + id + "] " + msg
+	}
+	log.Print(msg)
+}
+
+// debugf logs routine details, such as individual relay failures
+func debugf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, levelDebug, format, args...)
+}
+
+// warnf logs problems that degrade the service, such as all relays failing
+func warnf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, levelWarn, format, args...)
+}
+
+// errorf logs failures that make a request fail
+func errorf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, levelError, format, args...)
+}
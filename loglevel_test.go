@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigureLogLevel(t *testing.T) {
+	defer func(level logLevel) { minLogLevel = level }(minLogLevel)
+	for env, want := range map[string]logLevel{
+		"":       levelInfo,
+		"debug":  levelDebug,
+		" WARN ": levelWarn,
+		"error":  levelError,
+		"Info":   levelInfo,
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", env)
+			minLogLevel = levelInfo
+			configureLogLevel()
+			if minLogLevel != want {
+				t.Errorf("minLogLevel = %d, want %d", minLogLevel, want)
+			}
+		})
+	}
+}
+
+func TestLogAt(t *testing.T) {
+	defer func(level logLevel) { minLogLevel = level }(minLogLevel)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-7")
+
+	tests := []struct {
+		min  logLevel
+		want []string
+	}{
+		{levelDebug, []string{"debug", "info", "warn", "error"}},
+		{levelInfo, []string{"info", "warn", "error"}},
+		{levelWarn, []string{"warn", "error"}},
+		{levelError, []string{"error"}},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		minLogLevel = tt.min
+		debugf(ctx, "line %s", "debug")
+		logf(ctx, "line %s", "info")
+		warnf(ctx, "line %s", "warn")
+		errorf(ctx, "line %s", "error")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			_, msg, ok := strings.Cut(line, "[req-7] line ")
+			if !ok {
+				t.Errorf("line %q lacks the request id", line)
+			}
+			got = append(got, msg)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("at minimum level %d logged %v, want %v", tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestRelayFailuresLogLevel(t *testing.T) {
+	const pubkey = "a8c3f0e1d2b5a4c7e6f9d8b1a0c3e2f5d4b7a6c9e8f1d0b3a2c5e4f7d6b9a8c1"
+	var down []string
+	for i := 0; i < 2; i++ {
+		// Nothing listens on a port whose listener was closed
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		down = append(down, "ws://"+l.Addr().String())
+		l.Close()
+	}
+	defer func(relays []string, retries int, gateway string, level logLevel) {
+		readRelays, relayConnectRetries, profileGatewayURL, minLogLevel = relays, retries, gateway, level
+	}(readRelays, relayConnectRetries, profileGatewayURL, minLogLevel)
+	readRelays, relayConnectRetries, profileGatewayURL = down, 0, ""
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		level        logLevel
+		wantPerRelay bool
+	}{
+		{levelInfo, false},
+		{levelDebug, true},
+		{levelWarn, false},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		minLogLevel = tt.level
+		fetchProfileFromRelays(context.Background(), pubkey, nil)
+		logs := buf.String()
+		if got := strings.Contains(logs, "Failed to query relay "+down[0]); got != tt.wantPerRelay {
+			t.Errorf("at level %d, individual relay failure logged = %v, want %v:\n%s", tt.level, got, tt.wantPerRelay, logs)
+		}
+		if !strings.Contains(logs, "All 2 relays failed to answer the profile fetch") {
+			t.Errorf("at level %d, total failure not logged:\n%s", tt.level, logs)
+		}
+	}
+}
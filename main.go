@@ -1,22 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed static/*
@@ -29,60 +35,282 @@ type Event struct {
 	CreatedAt int64
 	Kind      int
 	EventData string // JSON data containing the full event
+	Nevent    string // bech32 nevent reference for sharing
+
+	Superseded bool   // a newer version of this replaceable event exists
+	Deleted    bool   // the author deleted this event with NIP-09
+	ReplyTo    *Event // the stored parent of a reply, shown as context
+
+	loc *time.Location // the time zone dates are shown in
 }
 
 // UserProfile holds user profile information from kind 0 events
 type UserProfile struct {
-	Name    string `json:"name"`
-	About   string `json:"about"`
-	Picture string `json:"picture"`
-	Nip05   string `json:"nip05"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	About       string `json:"about"`
+	Picture     string `json:"picture"`
+	Banner      string `json:"banner"`
+	Website     string `json:"website"`
+	Nip05       string `json:"nip05"`
+	Lud16       string `json:"lud16"`
+	Lud06       string `json:"lud06"`
+
+	// SourceRelay is the relay the kind-0 event was fetched from
+	SourceRelay string `json:"-"`
+	// RawContent is the kind-0 content the profile was parsed from
+	RawContent string `json:"-"`
+}
+
+// Source describes where the profile came from
+func (p *UserProfile) Source() string {
+	if p.SourceRelay != "" {
+		return p.SourceRelay
+	}
+	return "backup"
+}
+
+// PrettyRawContent returns the raw kind-0 content indented for display
+func (p *UserProfile) PrettyRawContent() string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(p.RawContent), "", "  "); err != nil {
+		return p.RawContent
+	}
+	return buf.String()
+}
+
+// lud16Pattern matches email-style lightning addresses
+var lud16Pattern = regexp.MustCompile(`^[a-zA-Z0-9._+-]+@[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)+$`)
+
+// ZapAddress returns the profile's lightning address if it looks valid,
+// falling back to the LNURL from lud06
+func (p *UserProfile) ZapAddress() string {
+	if lud16Pattern.MatchString(p.Lud16) {
+		return p.Lud16
+	}
+	if strings.HasPrefix(strings.ToLower(p.Lud06), "lnurl1") {
+		return p.Lud06
+	}
+	return ""
+}
+
+// DisplayedName returns the display_name, falling back to name
+func (p *UserProfile) DisplayedName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Name
+}
+
+// WebsiteURL returns the profile's website if it is an http(s) URL.
+// A bare host is assumed to be https.
+func (p *UserProfile) WebsiteURL() string {
+	website := strings.TrimSpace(p.Website)
+	if website == "" {
+		return ""
+	}
+	if !strings.Contains(website, "://") {
+		website = "https://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// BannerURL returns the profile's banner image if it is an http(s) URL
+func (p *UserProfile) BannerURL() string {
+	u, err := url.Parse(strings.TrimSpace(p.Banner))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// isEmpty reports whether no profile metadata fields are set. A kind-0
+// event of "{}" still records its source and raw content, but shows nothing.
+func (p *UserProfile) isEmpty() bool {
+	meta := *p
+	meta.SourceRelay, meta.RawContent = "", ""
+	return meta == UserProfile{}
+}
+
+// profileFromBackup parses the newest kind-0 event stored for pubkey
+func profileFromBackup(ctx context.Context, db *sql.DB, pubkey string) (*UserProfile, error) {
+	defer observeDBQuery("stored_profile", time.Now())
+
+	query := `SELECT event_data FROM event_backup WHERE pubkey = $1 AND event_kind = 0 ORDER BY created_at DESC, id ASC LIMIT 1`
+	var eventData string
+	err := db.QueryRowContext(ctx, query, pubkey).Scan(&eventData)
+	if err != nil {
+		return nil, err
+	}
+
+	var ev nostr.Event
+	if err := json.Unmarshal([]byte(eventData), &ev); err != nil {
+		return nil, err
+	}
+	var profile UserProfile
+	if err := json.Unmarshal([]byte(ev.Content), &profile); err != nil {
+		return nil, err
+	}
+	profile.RawContent = ev.Content
+	return &profile, nil
 }
 
 // GetFormattedDate returns the created_at timestamp as a human-readable date
 func (e Event) GetFormattedDate() string {
-	return time.Unix(e.CreatedAt, 0).Format("2006-01-02 15:04:05")
+	return formatTimestamp(e.CreatedAt, e.loc)
+}
+
+// neventHints is the number of relay hints included in shared nevent
+// references, set with NEVENT_HINTS
+var neventHints = 2
+
+// encodeNevents sets the nevent reference of each event using relays as
+// hints, along with the event's author so clients can look up its relays
+func encodeNevents(events []Event, relays []string) {
+	if len(relays) > neventHints {
+		relays = relays[:neventHints]
+	}
+	for i := range events {
+		nevent, err := nip19.EncodeEvent(events[i].ID, relays, events[i].Pubkey)
+		if err != nil {
+			log.Printf("Failed to encode nevent for %s: %v", events[i].ID, err)
+			continue
+		}
+		events[i].Nevent = nevent
+	}
 }
 
-// fetchProfileFromRelays attempts to fetch user profile (kind 0) from relays
-func fetchProfileFromRelays(pubkey string) (*UserProfile, error) {
+// summaryLength is the maximum number of characters shown in an event summary
+const summaryLength = 120
+
+// Summary returns the beginning of the event content, truncated at a rune
+// boundary to at most summaryLength characters
+func (e Event) Summary() string {
+	var ev struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(e.EventData), &ev); err != nil {
+		return ""
+	}
+	return truncateRunes(strings.Join(strings.Fields(ev.Content), " "), summaryLength)
+}
+
+// truncateRunes truncates s to at most n runes, appending an ellipsis if cut
+func truncateRunes(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i] + "…"
+		}
+		count++
+	}
+	return s
+}
+
+// fetchProfileFromRelays attempts to fetch user profile (kind 0) from the
+// preferred relays and the configured read relays at once
+func fetchProfileFromRelays(ctx context.Context, pubkey string, preferred []string) (*UserProfile, error) {
+	// An empty profile makes getProfile use the stored kind-0 event
+	if relayFetchDisabled {
+		return &UserProfile{}, nil
+	}
+
 	// Create a filter to get kind 0 event for the pubkey
+	// Relays send the newest event first, so one is enough
 	filter := nostr.Filter{
 		Authors: []string{pubkey},
 		Kinds:   []int{0},
-		//Limit:   1,
+		Limit:   1,
 	}
 
-	// Try common public relays
-	relays := []string{
-		//"wss://relay.damus.io",
-		"wss://nos.lol",
-		"wss://yabu.me",
-		"wss://nostr.compile-error.net",
-	}
+	relays := profileRelays(preferred)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	// The gateway gets its own time budget once the relays have used theirs
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
 	defer cancel()
 
-	log.Printf("Attempting to fetch profile for pubkey %s from %d relays", pubkey, len(relays))
-	pool := nostr.NewSimplePool(ctx)
-	ev := pool.QuerySingle(ctx, relays, filter)
-	log.Printf("QuerySingle completed. Event found: %v", ev != nil)
+	debugf(ctx, "Attempting to fetch profile for pubkey %s from %d relays", pubkey, len(relays))
+	type relayAnswer struct {
+		url    string
+		events []*nostr.Event
+		err    error
+	}
+	// The relays are raced, so one that connects but never answers cannot
+	// hold up the rest; the first to return a profile wins
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	defer cancelRace()
+	answers := make(chan relayAnswer, len(relays))
+	for _, url := range relays {
+		go func(url string) {
+			start := time.Now()
+			relayCtx, cancelRelay := context.WithTimeout(raceCtx, profileWait)
+			defer cancelRelay()
+			events, err := queryRelay(relayCtx, url, filter)
+			// Failures caused by our own deadline or by losing the race
+			// say nothing about the relay
+			if raceCtx.Err() == nil {
+				relayHealth.record(url, err, time.Since(start))
+			}
+			answers <- relayAnswer{url: url, events: events, err: err}
+		}(url)
+	}
+
+	var ev *nostr.Event
+	var source string
+	failed := 0
+	for range relays {
+		answer := <-answers
+		if answer.err != nil {
+			debugf(ctx, "Failed to query relay %s: %v", answer.url, answer.err)
+			failed++
+			continue
+		}
+		for _, e := range answer.events {
+			if ev == nil || e.CreatedAt > ev.CreatedAt {
+				ev = e
+			}
+		}
+		if ev != nil {
+			source = answer.url
+			break
+		}
+	}
+	if failed == len(relays) && ctx.Err() == nil {
+		warnf(ctx, "All %d relays failed to answer the profile fetch for %s", failed, pubkey)
+	}
+	debugf(ctx, "Relay query completed. Event found: %v", ev != nil)
 
 	if ev != nil {
-		log.Printf("Profile event found for pubkey %s: content length=%d", pubkey, len(ev.Content))
+		debugf(ctx, "Profile event found for pubkey %s: content length=%d", pubkey, len(ev.Content))
 		var profile UserProfile
 		err := json.Unmarshal([]byte(ev.Content), &profile)
 		if err != nil {
-			log.Printf("Failed to unmarshal profile from event: %v", err)
+			logf(ctx, "Failed to unmarshal profile from event: %v", err)
 			return &UserProfile{}, nil
 		}
-		log.Printf("Successfully parsed profile: name=%s, picture=%s", profile.Name, profile.Picture)
+		profile.SourceRelay = source
+		profile.RawContent = ev.Content
+		debugf(ctx, "Successfully parsed profile from %s: name=%s, picture=%s", source, profile.Name, profile.Picture)
 		return &profile, nil
 	}
 
+	// Fall back to the HTTP gateway, for when websocket relays are blocked
+	if profileGatewayURL != "" && parent.Err() == nil {
+		profile, err := fetchProfileFromGateway(parent, pubkey)
+		if err == nil {
+			debugf(ctx, "Fetched profile for pubkey %s from gateway", pubkey)
+			return profile, nil
+		}
+		debugf(ctx, "Failed to fetch profile for %s from gateway: %v", pubkey, err)
+	}
+
 	// If no profile found, return empty profile
-	log.Printf("No profile event found for pubkey %s from relays", pubkey)
+	debugf(ctx, "No profile event found for pubkey %s from relays", pubkey)
 	return &UserProfile{}, nil
 }
 
@@ -92,19 +320,47 @@ func main() {
 		port = "8080"
 	}
 
-	databaseURL := os.Getenv("DATABASE_URL")
-	if databaseURL == "" {
-		log.Fatal("DATABASE_URL environment variable is required")
+	databaseURL, err := databaseURLFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	db, err := sql.Open("postgres", databaseURL)
+	dbs, err := openDatabases(databaseURL, os.Getenv("DATABASE_READ_URLS"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer dbs.Close()
 
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/npub/", npubHandler(db))
+	// Run as a CLI when a subcommand is given
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		if err := runDump(dbs.primary, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	configure()
+	configureReadOnly()
+	configureCORS()
+	configureTrustedProxies()
+	configureBlocklist()
+	configureAdmin()
+	configureIngestExclusions()
+	configureBasicAuth()
+	startCacheStatsLogger()
+
+	http.Handle("/", instrument("/", homeHandler(dbs)))
+	http.Handle("/npub/", instrument("/npub/", cachePages(npubHandler(dbs))))
+	http.Handle("/naddr/", instrument("/naddr/", naddrHandler(dbs)))
+	http.Handle("/restore-selected", instrument("/restore-selected", restoreSelectedHandler(dbs)))
+	http.Handle("/relays", instrument("/relays", http.HandlerFunc(relaysHandler)))
+	http.Handle("/api/event/", instrument("/api/event/", cors(eventAPIHandler(dbs))))
+	http.Handle("/api/npub/", instrument("/api/npub/", cors(apiNpubHandler(dbs))))
+	http.Handle("/api/search/pubkey", instrument("/api/search/pubkey", requireAdmin(pubkeySearchHandler(dbs))))
+	http.Handle("/robots.txt", instrument("/robots.txt", http.HandlerFunc(robotsHandler)))
+	http.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	http.Handle("/version", instrument("/version", http.HandlerFunc(versionHandler)))
+	http.Handle("/metrics", promhttp.Handler())
 
 	// Serve embedded static files
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -112,47 +368,99 @@ func main() {
 		log.Fatal(err)
 	}
 	staticServer := http.FileServer(http.FS(staticFS))
-	http.Handle("/static/", http.StripPrefix("/static/", staticServer))
+	http.Handle("/static/", instrument("/static/", staticHandler(http.StripPrefix("/static/", staticServer))))
 
-	log.Printf("Server starting on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
+	addr, err := listenAddr(os.Getenv("BIND_ADDR"), port)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-// homeHandler serves the static homepage with service introduction
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+	certFile, keyFile, err := tlsFilesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := withRequestID(gzipHandler(withBasePath(requireBasicAuth(http.DefaultServeMux))))
+	if socket := os.Getenv("UNIX_SOCKET"); socket != "" {
+		if certFile != "" {
+			log.Fatal("UNIX_SOCKET cannot be combined with TLS_CERT_FILE; terminate TLS at the reverse proxy")
+		}
+		mode, err := socketModeFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Server %s (%s) starting on unix socket %s", version, commit, socket)
+		if err := serveUnix(socket, mode, handler); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
+	if certFile != "" {
+		if redirectPort := os.Getenv("HTTP_REDIRECT_PORT"); redirectPort != "" {
+			go serveHTTPSRedirect(":"+redirectPort, addr)
+		}
+		log.Printf("Server %s (%s) starting on %s with TLS", version, commit, addr)
+		log.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, handler))
+	}
+
+	log.Printf("Server %s (%s) starting on %s", version, commit, addr)
+	log.Fatal(http.ListenAndServe(addr, handler))
+}
+
+// homeHandler serves the homepage with service introduction and, when
+// enabled, the recently backed-up pubkeys
+func homeHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		renderHome(w, r, dbs.read(), "")
+	}
+}
 
+// renderHome renders the homepage, showing message below the search box
+func renderHome(w http.ResponseWriter, r *http.Request, db *sql.DB, message string) {
 	tmpl := `
 <!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Nostr Event Restore Service</title>
-    <link rel="stylesheet" href="/static/style.css">
+    <title>{{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
     <script src="https://cdn.jsdelivr.net/npm/sweetalert2@11"></script>
-    <script src="/static/script.js"></script>
+    <script src="{{$.Site.Asset "script.js"}}"></script>
 </head>
 <body>
     <div class="container">
         <div class="header">
-            <h1>Nostr Event Restore Service</h1>
-            <p>This service allows you to restore and view Nostr events by npub identifier.</p>
+            <h1>{{.Site.Title}}</h1>
+            <p>{{.Site.Description}}</p>
             <p>Enter an npub (e.g., npub1...) in the box below to view stored events.</p>
         </div>
 
         <div class="search-box">
-            <form action="/npub/" method="GET">
-                <input type="text" name="q" placeholder="Enter npub (e.g., npub1...)" />
+            <form action="{{$.Site.BasePath}}/npub/" method="GET">
+                <input type="text" name="q" placeholder="Enter npub, nprofile, hex, or NIP-05" />
                 <button type="submit">Search Events</button>
             </form>
+            {{with .Message}}<p class="form-message">{{.}}</p>{{end}}
         </div>
 
+        {{if .Recent}}
+        <div class="recent-pubkeys">
+            <h2>Recently backed up</h2>
+            <ul>
+                {{range .Recent}}
+                <li><a href="{{$.Site.BasePath}}/npub/{{.Npub}}">{{with .Name}}{{.}}{{else}}{{.Npub}}{{end}}</a> <span class="event-timestamp">{{.GetFormattedDate}}</span></li>
+                {{end}}
+            </ul>
+        </div>
+        {{end}}
+
         <footer>
-            <p>Nostr Event Restore Service &copy; 2025</p>
+            <p>{{.Site.Title}} &copy; 2025</p>
         </footer>
     </div>
 </body>
@@ -165,44 +473,275 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = t.Execute(w, nil)
+	data := struct {
+		Site    siteInfo
+		Message string
+		Recent  []RecentPubkey
+	}{Site: site, Message: message}
+	if showRecent {
+		data.Recent = recentPubkeys(r.Context(), db)
+		loc := requestLocation(r)
+		for i := range data.Recent {
+			data.Recent[i].loc = loc
+		}
+	}
+
+	err = t.Execute(w, data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// renderError renders a styled error page with a message safe to show to users
+func renderError(w http.ResponseWriter, status int, message string) {
+	tmpl := `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Error - {{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
+</head>
+<body>
+    <div class="container">
+        <div class="back-link">
+            <a href="{{$.Site.BasePath}}/">← Back to Home</a>
+        </div>
+
+        <div class="error-box">
+            <h1>{{.Status}} {{.StatusText}}</h1>
+            <p>{{.Message}}</p>
+        </div>
+
+        <footer>
+            <p>{{.Site.Title}} &copy; 2025</p>
+        </footer>
+    </div>
+</body>
+</html>
+`
+	tmpl = strings.TrimSpace(tmpl)
+	t, err := template.New("error").Parse(tmpl)
+	if err != nil {
+		log.Printf("Failed to parse error template: %v", err)
+		http.Error(w, message, status)
+		return
+	}
+
+	data := struct {
+		Site       siteInfo
+		Status     int
+		StatusText string
+		Message    string
+	}{
+		Site:       site,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = t.Execute(w, data)
+	if err != nil {
+		log.Printf("Failed to render error template: %v", err)
+	}
+}
+
 // npubHandler handles npub lookup and event display
-func npubHandler(db *sql.DB) http.HandlerFunc {
+func npubHandler(dbs *databases) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		npub := strings.TrimPrefix(r.URL.Path, "/npub/")
+		db := dbs.read()
+		ctx := r.Context()
+		npub, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/npub/"), "/")
+		switch action {
+		case "":
+		case "backup":
+			backupHandler(dbs.primary, w, r, npub)
+			return
+		case "diff":
+			diffHandler(db, w, r, npub)
+			return
+		case "export.json":
+			exportHandler(db, w, r, npub)
+			return
+		case "restore-all":
+			restoreAllHandler(db, w, r, npub)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
 
 		// If npub not in URL path, check query param
 		if npub == "" {
 			npub = r.URL.Query().Get("q")
 		}
 
-		// Validate and convert npub to hex
-		hexPubkey, err := npubToHex(npub)
+		// An empty search goes back to the home page with a prompt
+		if strings.TrimSpace(npub) == "" {
+			renderHome(w, r, db, "Please enter an npub, nprofile, hex pubkey, or NIP-05 address.")
+			return
+		}
+
+		// Several comma-separated npubs are shown grouped by author
+		if strings.Contains(npub, ",") {
+			multiNpubHandler(db, w, r, npub)
+			return
+		}
+
+		// Resolve npub, nprofile, hex, or NIP-05 to a hex pubkey
+		hexPubkey, err := resolveIdentifier(ctx, npub)
+		if errors.Is(err, errPrivateKey) {
+			renderError(w, http.StatusBadRequest, privateKeyMessage)
+			return
+		}
+		if err != nil {
+			logf(ctx, "Invalid identifier %q: %v", npub, err)
+			renderError(w, http.StatusBadRequest, "Unrecognized identifier. Supported formats: "+supportedIdentifiers+".")
+			return
+		}
+		if rejectBlocked(w, hexPubkey) {
+			return
+		}
+
+		// Redirect other identifier forms to the canonical npub page
+		if canonical, err := nip19.EncodePublicKey(hexPubkey); err == nil && canonical != npub {
+			query := r.URL.Query()
+			query.Del("q")
+			target := site.BasePath + "/npub/" + canonical
+			if len(query) > 0 {
+				target += "?" + query.Encode()
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+
+		// Serve 304 Not Modified when the backup has not changed
+		etag, latest, err := eventsETag(ctx, db, hexPubkey)
 		if err != nil {
-			http.Error(w, "Invalid npub format", http.StatusBadRequest)
+			logf(ctx, "Failed to compute ETag for %s: %v", hexPubkey, err)
+		} else {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			if latest > 0 {
+				w.Header().Set("Last-Modified", time.Unix(latest, 0).UTC().Format(http.TimeFormat))
+			}
+			if etagMatches(r, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		opts, err := parseListOptions(r)
+		if err != nil {
+			logf(ctx, "Invalid listing options: %v", err)
+			renderError(w, http.StatusBadRequest, "Invalid pagination parameters.")
 			return
 		}
 
 		// Query events by pubkey from event_backup table
-		events, err := queryEventsByPubkey(db, hexPubkey)
+		events, truncated, err := queryEventsByPubkey(ctx, db, hexPubkey, opts)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
+			errorf(ctx, "Failed to query events for %s: %v", hexPubkey, err)
+			renderDBError(w, r, db, err, "Failed to load events. Please try again later.")
 			return
 		}
 
-		// Fetch user profile from relays
-		profile, err := fetchProfileFromRelays(hexPubkey)
+		// Page links are computed before DMs are filtered so hidden events
+		// still count towards a full page
+		var prevURL, nextURL string
+		if opts.Page > 0 && opts.Before == "" {
+			if opts.Page > 1 {
+				prevURL = pageURL(r, "page", strconv.Itoa(opts.Page-1))
+			}
+			if len(events) == opts.PerPage {
+				nextURL = pageURL(r, "page", strconv.Itoa(opts.Page+1))
+			}
+		} else if cursor := nextCursor(events, opts); cursor != "" {
+			nextURL = pageURL(r, "before", cursor, "page")
+		} else if truncated {
+			nextURL = pageURL(r, "before", encodeCursor(events[len(events)-1], opts.Sort))
+		}
+
+		// Encrypted DMs are unreadable ciphertext, so hide them unless requested
+		hiddenDMs := 0
+		showDMs := r.URL.Query().Get("show_dms") == "1"
+		if !showDMs {
+			events, hiddenDMs = filterDMs(events)
+		}
+
+		// Events the author deleted are flagged, or hidden on request
+		markDeleted(events, queryDeletions(ctx, db, hexPubkey))
+		hideDeleted := r.URL.Query().Get("hide_deleted") == "1"
+		deletedURL := pageURL(r, "hide_deleted", "1")
+		deletedCount := 0
+		if hideDeleted {
+			deletedURL = pageURL(r, "hide_deleted", "0")
+			events, deletedCount = filterDeleted(events)
+		} else {
+			for _, event := range events {
+				if event.Deleted {
+					deletedCount++
+				}
+			}
+		}
+
+		// Fetch user profile from cache, relays, or the backup itself
+		profile, err := getProfile(ctx, db, hexPubkey)
 		if err != nil {
-			log.Printf("Error fetching profile for %s: %v", hexPubkey, err)
+			logf(ctx, "Error fetching profile for %s: %v", hexPubkey, err)
 			profile = &UserProfile{} // Use empty profile if fetch fails
 		}
 
+		nip05Status := ""
+		if profile.Nip05 != "" {
+			nip05Status = verifyNip05(ctx, profile.Nip05, hexPubkey)
+		}
+
+		// Prefer the user's own NIP-65 write relays for restore
+		relays := writeRelaysForPubkey(ctx, db, hexPubkey)
+		encodeNevents(events, relays)
+		markSuperseded(events)
+		attachReplyParents(ctx, db, events)
+		setLocation(events, requestLocation(r))
+
+		// Reactions can be summarized per target instead of listed one by one.
+		// They are grouped before the kinds are counted, which only counts
+		// the events listed.
+		groupedReactions := r.URL.Query().Get("reactions") == "grouped"
+		reactionsURL := pageURL(r, "reactions", "grouped")
+		var reactionGroups []ReactionGroup
+		if groupedReactions {
+			reactionsURL = pageURL(r, "reactions", "list")
+			reactionGroups, events = groupReactions(events)
+		}
+
+		// Kind groups are ordered by kind unless ?group_order=count asks for
+		// the most populous kinds first
+		var kindCounts []KindCount
+		if opts.Sort != "recent" && r.URL.Query().Get("group_order") == "count" {
+			kindCounts = orderGroupsByCount(events)
+		} else {
+			kindCounts = countKinds(events)
+		}
+
+		// The tags toggle link flips the current setting
+		showTags := r.URL.Query().Get("tags") == "1"
+		tagsToggle := "1"
+		if showTags {
+			tagsToggle = "0"
+		}
+
+		// The compact view shows one dense card per event, expanded on click
+		compact := r.URL.Query().Get("view") == "compact"
+		viewURL := pageURL(r, "view", "compact")
+		if compact {
+			viewURL = pageURL(r, "view", "full")
+		}
+
 		// Render events template
 		tmpl := `
 <!DOCTYPE html>
@@ -210,95 +749,257 @@ func npubHandler(db *sql.DB) http.HandlerFunc {
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Events for {{.Profile.Name}}</title>
-    <link rel="stylesheet" href="/static/style.css">
+    <title>Events for {{.Profile.DisplayedName}} - {{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
     <script src="https://cdn.jsdelivr.net/npm/sweetalert2@11"></script>
-    <script src="/static/script.js"></script>
+    <script>window.writeRelays = {{.WriteRelays}}; window.readOnly = {{.ReadOnly}};</script>
+    <script src="{{$.Site.Asset "script.js"}}"></script>
 </head>
 <body>
     <div class="container">
         <div class="back-link">
-            <a href="/">← Back to Home</a>
+            <a href="{{$.Site.BasePath}}/">← Back to Home</a>
         </div>
 
+        {{with .Profile.BannerURL}}<img src="{{.}}" alt="" class="profile-banner" onerror="this.remove()">{{end}}
         <div class="profile-header" style="display: flex; align-items: center; margin-bottom: 30px; padding-bottom: 20px; border-bottom: 1px solid #eee;">
             {{if .Profile.Picture}}
             <img src="{{.Profile.Picture}}" alt="Profile Picture" class="profile-pic" style="width: 60px; height: 60px; border-radius: 50%; object-fit: cover; margin-right: 15px;">
             {{end}}
             <div>
-                <h1>{{if .Profile.Name}}{{.Profile.Name}}{{else}}Nostr User{{end}}</h1>
+                <h1>{{with .Profile.DisplayedName}}{{.}}{{else}}Nostr User{{end}}</h1>
                 <p><strong>npub:</strong> {{.Npub}}</p>
                 <p><strong>Hex Pubkey:</strong> {{.HexPubkey}}</p>
-                {{if .Profile.Nip05}}<p><strong>Verification:</strong> {{.Profile.Nip05}}</p>{{end}}
+                {{if .Profile.Nip05}}<p><strong>Verification:</strong> {{.Profile.Nip05}}
+                    {{if eq .Nip05Status "verified"}}<span class="nip05-badge verified">✓ verified</span>{{else if eq .Nip05Status "unverified"}}<span class="nip05-badge unverified">✗ unverified</span>{{else}}<span class="nip05-badge unreachable">? unreachable</span>{{end}}</p>{{end}}
+                {{with .Profile.ZapAddress}}<p><strong>Zap address:</strong> {{.}}</p>{{end}}
                 {{if .Profile.About}}<p><strong>About:</strong> {{.Profile.About}}</p>{{end}}
+                {{with .Profile.WebsiteURL}}<p><strong>Website:</strong> <a href="{{.}}" target="_blank" rel="noopener noreferrer nofollow">{{.}}</a></p>{{end}}
                 <p><strong>Total Events Found:</strong> {{len .Events}}</p>
+                {{with .Profile.SourceRelay}}<p class="profile-source">Profile from {{.}}</p>{{end}}
+                {{if .Profile.RawContent}}
+                <details class="raw-profile">
+                    <summary>Raw profile JSON ({{.Profile.Source}})</summary>
+                    <pre style="white-space: pre-wrap; word-break: break-all;">{{.Profile.PrettyRawContent}}</pre>
+                </details>
+                {{end}}
             </div>
         </div>
 
+        {{if .Truncated}}
+        <div class="notice">Only the first {{len .Events}} events are shown. <a href="{{.NextURL}}">Continue with the next page</a></div>
+        {{end}}
+
+        {{if .HiddenDMs}}
+        <div class="notice">{{.HiddenDMs}} encrypted messages hidden. <a href="{{.ShowDMsURL}}">Show them</a></div>
+        {{end}}
+
+        {{if .DeletedCount}}{{if .HideDeleted}}
+        <div class="notice">{{.DeletedCount}} events deleted by their author hidden. <a href="{{.DeletedURL}}">Show them</a></div>
+        {{else}}
+        <div class="notice">{{.DeletedCount}} events were deleted by their author. <a href="{{.DeletedURL}}">Hide them</a></div>
+        {{end}}{{end}}
+
+        {{if .KindCounts}}
+        <div class="kind-summary">
+            {{range $i, $k := .KindCounts}}{{if $i}}, {{end}}<a href="{{$.Site.BasePath}}/npub/{{$.Npub}}#kind-{{$k.Kind}}">{{$k.Count}} {{$k.Name}}</a>{{end}}
+        </div>
+        {{end}}
+
+        <form class="contains-search" action="{{$.Site.BasePath}}/npub/{{.Npub}}" method="GET">
+            <input type="text" name="contains" value="{{.Contains}}" placeholder="Search within these events" />
+            <button type="submit">Search</button>
+            {{if .Contains}}<a href="{{$.Site.BasePath}}/npub/{{.Npub}}">Clear</a>{{end}}
+        </form>
+
+        <div class="view-options">
+            {{if .ShowTags}}<a href="{{.TagsURL}}">Hide tags</a>{{else}}<a href="{{.TagsURL}}">Show all tags</a>{{end}}
+            {{if .Compact}}<a href="{{.ViewURL}}">Full view</a>{{else}}<a href="{{.ViewURL}}">Compact view</a>{{end}}
+            {{if .GroupedReactions}}<a href="{{.ReactionsURL}}">List reactions</a>{{else}}<a href="{{.ReactionsURL}}">Group reactions</a>{{end}}
+        </div>
+
+        {{if .ReactionGroups}}
+        <div class="reaction-groups" id="kind-7">
+            <h2 class="kind-header">Reactions by target</h2>
+            <table class="reaction-table">
+                <tr><th>Target event</th><th>Reactions</th><th>Breakdown</th></tr>
+                {{range .ReactionGroups}}<tr><td><a href="{{$.Site.BasePath}}/api/event/{{.Target}}">{{.Target}}</a></td><td>{{.Count}}</td><td>{{range $i, $e := .Emojis}}{{if $i}}, {{end}}{{$e.Emoji}} × {{$e.Count}}{{end}}</td></tr>
+                {{end}}
+            </table>
+        </div>
+        {{end}}
+
         <div class="events-container">
             {{$currentKind := -1}}
             {{range .Events}}
-                {{if ne .Kind $currentKind}}
+                {{if not $.Recent}}{{if ne .Kind $currentKind}}
                     {{if ne $currentKind -1}}</div>{{end}}
-                    <div class="kind-group">
-                        <h2 class="kind-header">Kind {{.Kind}}</h2>
+                    <div class="kind-group" id="kind-{{.Kind}}">
+                        <h2 class="kind-header">Kind {{.Kind}} ({{.KindName}})</h2>
                     {{$currentKind = .Kind}}
-                {{end}}
-                <div class="event">
+                {{end}}{{end}}
+                {{if $.Compact}}
+                <details class="event-card{{if .Superseded}} superseded{{end}}{{if .Deleted}} deleted{{end}}">
+                    <summary>
+                        <span class="kind-badge">Kind {{.Kind}}</span>
+                        <span class="event-timestamp">{{.GetFormattedDate}}</span>
+                        <span class="event-card-preview">{{.Summary}}</span>
+                        <span class="event-card-id">{{.ID}}</span>
+                    </summary>
+                    <div class="event-content" {{if .ContentTruncated}}data-event-url="{{$.Site.BasePath}}/api/event/{{.ID}}"{{else}}data-content="{{.EventData}}"{{end}}><pre style="white-space: pre-wrap; word-break: break-all;">{{.Indented}}</pre></div>
+                    {{if .ContentTruncated}}<p class="content-truncated">Content truncated. <a href="{{$.Site.BasePath}}/api/event/{{.ID}}/download">Download</a> the event to see it in full.</p>{{end}}
+                </details>
+                {{else}}
+                <div class="event{{if .Superseded}} superseded{{end}}{{if .Deleted}} deleted{{end}}">
                     <div class="event-header">
                         <div class="event-header-left">
+                            {{if $.Recent}}<span class="kind-badge">Kind {{.Kind}}</span>{{end}}
                             <span class="event-timestamp">{{.GetFormattedDate}}</span>
+                            {{if .Superseded}}<span class="superseded-label">superseded</span>{{end}}
+                            {{if .Unparseable}}<span class="warning-label">unparseable</span>{{else if .IDMismatch}}<span class="warning-label">id mismatch</span>{{end}}
+                            {{if .IsExpired}}<span class="expired-label">expired</span>{{end}}
+                            {{if .IsFutureDated}}<span class="warning-label">future-dated</span>{{end}}
+                            {{if .Deleted}}<span class="deleted-label">deleted by author</span>{{end}}
                         </div>
                         <div class="event-actions">
-                            {{if eq .Kind 3}}<button class="restore-btn" onclick="showRestoreConfirmation(this)">Restore</button>{{end}}
+                            {{if and (eq .Kind 3) (not $.ReadOnly) (not .Unparseable) (not .IsExpired) (not .Deleted)}}<button class="restore-btn" onclick="showRestoreConfirmation(this)">Restore</button>{{end}}
                             <button class="copy-btn" onclick="copyEventData(this)">Copy</button>
+                            {{if .Nevent}}<button class="copy-btn" data-nevent="{{.Nevent}}" onclick="copyNevent(this)">Copy nostr: URI</button>{{end}}
+                            <a class="download-link" href="{{$.Site.BasePath}}/api/event/{{.ID}}/download">Download</a>
                         </div>
                     </div>
-                    <details>
-                        <div class="event-content" data-content="{{.EventData}}"><pre style="white-space: pre-wrap; word-break: break-all;">{{.EventData}}</pre></div>
+                    {{with .ReplyTo}}<blockquote class="reply-context">In reply to {{.GetFormattedDate}}: {{.Summary}}</blockquote>{{end}}
+                    {{if $.Contains}}<div class="note-content">{{.HighlightedContent $.Contains}}</div>
+                    {{else if and $.Render (eq .Kind 1)}}<div class="note-content">{{.RenderedContent}}</div>{{end}}
+                    {{if $.ShowTags}}{{with .TagInfos}}
+                    <table class="tag-table">
+                        <tr><th>Tag</th><th>Values</th><th>Meaning</th></tr>
+                        {{range .}}{{$name := .Name}}<tr><td>{{.Name}}</td><td>{{range $i, $v := .Values}}{{if $i}}<br>{{end}}{{if and (eq $i 0) (eq $name "p")}}{{npubLink $v}}{{else}}{{$v}}{{end}}{{end}}</td><td>{{.Description}}</td></tr>{{end}}
+                    </table>
+                    {{end}}{{end}}
+                    <details{{if $.Expand}} open{{end}}>
+                        <summary class="event-summary">Kind {{.Kind}} · {{.GetFormattedDate}}{{with .Summary}} · {{.}}{{end}}</summary>
+                        <div class="event-content" {{if .ContentTruncated}}data-event-url="{{$.Site.BasePath}}/api/event/{{.ID}}"{{else}}data-content="{{.EventData}}"{{end}}><pre style="white-space: pre-wrap; word-break: break-all;">{{.Indented}}</pre></div>
+                        {{if .ContentTruncated}}<p class="content-truncated">Content truncated. <a href="{{$.Site.BasePath}}/api/event/{{.ID}}/download">Download</a> the event to see it in full.</p>{{end}}
                     </details>
                     <div class="event-id">{{.ID}}</div>
                 </div>
+                {{end}}
             {{else}}
                 <p>No events found for this pubkey.</p>
             {{end}}
-            {{if gt (len .Events) 0}}</div>{{end}}
+            {{if and (not .Recent) (gt (len .Events) 0)}}</div>{{end}}
+        </div>
+        {{if or .PrevURL .NextURL}}
+        <div class="pagination">
+            {{with .PrevURL}}<a href="{{.}}">← Previous page</a>{{end}}
+            {{with .NextURL}}<a href="{{.}}">Next page →</a>{{end}}
         </div>
+        {{end}}
         <footer>
-            <p>Nostr Event Restore Service &copy; 2025</p>
+            <p>{{.Site.Title}} &copy; 2025</p>
         </footer>
     </div>
 </body>
 </html>
 `
-		t, err := template.New("events").Parse(tmpl)
+		t, err := template.New("events").Funcs(templateFuncs).Parse(tmpl)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorf(ctx, "Failed to parse events template: %v", err)
+			renderError(w, http.StatusInternalServerError, "Failed to render page.")
 			return
 		}
 
 		data := struct {
-			Npub      string
-			HexPubkey string
-			Events    []Event
-			Profile   *UserProfile
+			Site             siteInfo
+			Npub             string
+			HexPubkey        string
+			Events           []Event
+			Profile          *UserProfile
+			Nip05Status      string
+			WriteRelays      []string
+			Expand           bool
+			Recent           bool
+			KindCounts       []KindCount
+			HiddenDMs        int
+			ShowDMsURL       string
+			HideDeleted      bool
+			DeletedCount     int
+			DeletedURL       string
+			Render           bool
+			Contains         string
+			ShowTags         bool
+			TagsURL          string
+			Compact          bool
+			ViewURL          string
+			GroupedReactions bool
+			ReactionsURL     string
+			ReactionGroups   []ReactionGroup
+
+			ReadOnly  bool
+			PrevURL   string
+			NextURL   string
+			Truncated bool
 		}{
-			Npub:      npub,
-			HexPubkey: hexPubkey,
-			Events:    events,
-			Profile:   profile,
+			Site:             site,
+			Npub:             npub,
+			HexPubkey:        hexPubkey,
+			Events:           events,
+			Profile:          profile,
+			Nip05Status:      nip05Status,
+			WriteRelays:      relays,
+			Expand:           r.URL.Query().Get("expand") == "1",
+			Recent:           opts.Sort == "recent",
+			KindCounts:       kindCounts,
+			HiddenDMs:        hiddenDMs,
+			ShowDMsURL:       pageURL(r, "show_dms", "1"),
+			HideDeleted:      hideDeleted,
+			DeletedCount:     deletedCount,
+			DeletedURL:       deletedURL,
+			Render:           r.URL.Query().Get("render") == "1",
+			Contains:         opts.Contains,
+			ShowTags:         showTags,
+			TagsURL:          pageURL(r, "tags", tagsToggle),
+			Compact:          compact,
+			ViewURL:          viewURL,
+			GroupedReactions: groupedReactions,
+			ReactionsURL:     reactionsURL,
+			ReactionGroups:   reactionGroups,
+			ReadOnly:         readOnly.Load(),
+			PrevURL:          prevURL,
+			NextURL:          nextURL,
+			Truncated:        truncated,
 		}
 
 		err = t.Execute(w, data)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorf(ctx, "Failed to render events template: %v", err)
+			renderError(w, http.StatusInternalServerError, "Failed to render page.")
 			return
 		}
 	}
 }
 
-// npubToHex converts npub string to hex pubkey
+// npubToHex converts npub string to hex pubkey, using the decode cache
 func npubToHex(npub string) (string, error) {
+	if hexPubkey, ok := npubs.get(npub); ok {
+		return hexPubkey, nil
+	}
+
+	hexPubkey, err := decodeNpub(npub)
+	if err != nil {
+		invalidNpubs.Inc()
+		return "", err
+	}
+	npubs.add(npub, hexPubkey)
+	return hexPubkey, nil
+}
+
+// decodeNpub decodes an npub string into a hex pubkey
+func decodeNpub(npub string) (string, error) {
+	if isPrivateKey(npub) {
+		return "", errPrivateKey
+	}
 	if !strings.HasPrefix(npub, "npub1") {
 		return "", fmt.Errorf("invalid npub format: does not start with npub1")
 	}
@@ -322,25 +1023,44 @@ func npubToHex(npub string) (string, error) {
 	return hexPubkey, nil
 }
 
-// queryEventsByPubkey retrieves events from event_backup table by pubkey
-func queryEventsByPubkey(db *sql.DB, pubkey string) ([]Event, error) {
+// eventOrderBy returns the ORDER BY clause for the requested sort.
+// "recent" orders purely by date, anything else groups by kind. Ties are
+// broken by id so the order is deterministic.
+func eventOrderBy(sort string) string {
+	if sort == "recent" {
+		// Sort by created_at DESC (newest first) across all kinds
+		return "ORDER BY created_at DESC, id DESC"
+	}
 	// Sort by event_kind ASC (0 to higher), then by created_at DESC (newest first)
-	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = $1 ORDER BY event_kind ASC, created_at DESC`
-	rows, err := db.Query(query, pubkey)
+	return "ORDER BY event_kind ASC, created_at DESC, id DESC"
+}
+
+// queryEventsByPubkey retrieves events from event_backup table by pubkey.
+// It reports whether an unpaginated listing was cut at maxEventsPerRequest.
+func queryEventsByPubkey(ctx context.Context, db *sql.DB, pubkey string, opts listOptions) ([]Event, bool, error) {
+	defer observeDBQuery("events_by_pubkey", time.Now())
+
+	query, args, err := buildEventsQuery(pubkey, opts)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
 	}
 	defer rows.Close()
 
 	var events []Event
 	for rows.Next() {
-		var event Event
-		err := rows.Scan(&event.ID, &event.Pubkey, &event.CreatedAt, &event.Kind, &event.EventData)
+		event, err := scanEvent(rows)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		events = append(events, event)
 	}
 
-	return events, nil
+	if opts.PerPage == 0 && !opts.Uncapped && len(events) > maxEventsPerRequest {
+		return events[:maxEventsPerRequest], true, nil
+	}
+	return events, false, nil
 }
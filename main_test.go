@@ -0,0 +1,1131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestUserProfileIsEmpty(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile UserProfile
+		want    bool
+	}{
+		{"zero", UserProfile{}, true},
+		{"empty content from relay", UserProfile{SourceRelay: "wss://relay.example", RawContent: "{}"}, true},
+		{"unknown fields only", UserProfile{RawContent: `{"pronouns":"they/them"}`}, true},
+		{"name", UserProfile{Name: "alice"}, false},
+		{"picture from relay", UserProfile{Picture: "https://example.com/a.png", SourceRelay: "wss://relay.example"}, false},
+		{"lud06", UserProfile{Lud06: "lnurl1..."}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.isEmpty(); got != tt.want {
+				t.Errorf("isEmpty() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpubHandlerHidesDBErrors(t *testing.T) {
+	const pubkey = "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	tests := []struct {
+		name     string
+		err      error
+		leaked   string
+		wantBody string
+	}{
+		{
+			"syntax error",
+			&pq.Error{Code: "42601", Message: `syntax error at or near "ORDER"`},
+			`syntax error at or near "ORDER"`,
+			"Failed to load events. Please try again later.",
+		},
+		{
+			"missing relation",
+			&pq.Error{Code: "42P01", Message: `relation "event_backup" does not exist`},
+			"event_backup",
+			"Failed to load events. Please try again later.",
+		},
+		{
+			"driver error with the query",
+			errors.New("pq: column event_data::jsonb does not exist in SELECT id, pubkey"),
+			"SELECT id, pubkey",
+			"Failed to load events. Please try again later.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(`SELECT COUNT\(\*\), COALESCE`).WillReturnError(tt.err)
+			mock.ExpectQuery(`FROM event_backup`).WillReturnError(tt.err)
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500", rec.Code)
+			}
+			body := rec.Body.String()
+			if strings.Contains(body, tt.leaked) || strings.Contains(body, "pq:") {
+				t.Errorf("body leaks the database error: %s", body)
+			}
+			if !strings.Contains(body, tt.wantBody) || !strings.Contains(body, `class="error-box"`) {
+				t.Errorf("body is not the error page with %q: %s", tt.wantBody, body)
+			}
+			if !strings.Contains(logs.String(), tt.leaked) {
+				t.Errorf("database error was not logged: %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestEventSummary(t *testing.T) {
+	long := strings.Repeat("a", summaryLength)
+	tests := []struct {
+		name      string
+		eventData string
+		want      string
+	}{
+		{"short", `{"content":"gm"}`, "gm"},
+		{"whitespace collapsed", `{"content":"  gm\n\n  nostr\t!"}`, "gm nostr !"},
+		{"exactly the limit", `{"content":"` + long + `"}`, long},
+		{"ascii cut", `{"content":"` + long + `b"}`, long + "…"},
+		{"japanese cut at a rune", `{"content":"` + strings.Repeat("日本", summaryLength) + `"}`, strings.Repeat("日本", summaryLength/2) + "…"},
+		{"emoji kept whole", `{"content":"` + strings.Repeat("🤙", summaryLength+1) + `"}`, strings.Repeat("🤙", summaryLength) + "…"},
+		{"invalid json", `{"content":`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Event{EventData: tt.eventData}).Summary(); got != tt.want {
+				t.Errorf("Summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeNeventsRoundTrip(t *testing.T) {
+	events := []Event{
+		{ID: "5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36", Pubkey: "8d2e9b0c48ba9f2fa9a1a2b25fdfd1bd78c9e4c1d7ab5b1ae3c5d0d9f7e3c2a1"},
+		{ID: "0000000000000000000000000000000000000000000000000000000000000001"},
+		{ID: "not-hex"},
+	}
+	encodeNevents(events, nil)
+
+	for _, ev := range events[:2] {
+		prefix, value, err := nip19.Decode(ev.Nevent)
+		if err != nil || prefix != "nevent" {
+			t.Fatalf("Decode(%q) = %q, %v", ev.Nevent, prefix, err)
+		}
+		if pointer := value.(nostr.EventPointer); pointer.ID != ev.ID {
+			t.Errorf("nevent decodes to id %s, want %s", pointer.ID, ev.ID)
+		}
+	}
+	if events[2].Nevent != "" {
+		t.Errorf("invalid id encoded as %q", events[2].Nevent)
+	}
+}
+
+func TestEncodeNeventsRelayHints(t *testing.T) {
+	const (
+		id     = "9a4c2e0b8d6f4a2c0e8b6d4f2a0c8e6b4d2f0a8c6e4b2d0f8a6c4e2b0d8f6a4c"
+		author = "3e5a7c9b1d3f5e7a9c1b3d5f7e9a1c3b5d7f9e1a3c5b7d9f1e3a5c7b9d1f3e5a"
+	)
+	relays := []string{"wss://relay.one.example", "wss://relay.two.example", "wss://relay.three.example"}
+	defer func(hints int) { neventHints = hints }(neventHints)
+
+	tests := []struct {
+		name      string
+		hints     int
+		relays    []string
+		wantHints []string
+	}{
+		{"default two hints", 2, relays, relays[:2]},
+		{"one hint", 1, relays, relays[:1]},
+		{"more hints than relays", 5, relays, relays},
+		{"no hints", 0, relays, nil},
+		{"no relays", 2, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			neventHints = tt.hints
+			events := []Event{{ID: id, Pubkey: author}}
+			encodeNevents(events, tt.relays)
+
+			prefix, value, err := nip19.Decode(events[0].Nevent)
+			if err != nil || prefix != "nevent" {
+				t.Fatalf("Decode(%q) = %q, %v", events[0].Nevent, prefix, err)
+			}
+			pointer := value.(nostr.EventPointer)
+			if pointer.ID != id || pointer.Author != author {
+				t.Errorf("nevent decodes to id %s by %s, want %s by %s", pointer.ID, pointer.Author, id, author)
+			}
+			if strings.Join(pointer.Relays, " ") != strings.Join(tt.wantHints, " ") {
+				t.Errorf("relay hints = %q, want %q", pointer.Relays, tt.wantHints)
+			}
+		})
+	}
+}
+
+func TestNpubPageOrdering(t *testing.T) {
+	const pubkey = "d4a6e2c8b0f19375a6c4e2b0d8f6a4c2e0b8d6f4a2c0e8b6d4f2a0c8e6b4d2f0"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "erin"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	note := `{"id":"` + strings.Repeat("1", 64) + `","kind":1,"content":"note","tags":[]}`
+	reaction := `{"id":"` + strings.Repeat("7", 64) + `","kind":7,"content":"+","tags":[]}`
+	tests := []struct {
+		name       string
+		query      string
+		wantOrder  string
+		wantHeader bool
+		wantBadge  bool
+	}{
+		{"grouped by kind", "", `ORDER BY event_kind ASC, created_at DESC, id DESC`, true, false},
+		{"recent first", "?sort=recent", `ORDER BY created_at DESC, id DESC`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(regexp.QuoteMeta(tt.wantOrder) + ` LIMIT`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(strings.Repeat("7", 64), pubkey, int64(1700000200), 7, reaction).
+					AddRow(strings.Repeat("1", 64), pubkey, int64(1700000100), 1, note))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, `<h2 class="kind-header">`); got != tt.wantHeader {
+				t.Errorf("kind headers shown = %v, want %v", got, tt.wantHeader)
+			}
+			if got := strings.Contains(body, `<span class="kind-badge">Kind 7</span>`); got != tt.wantBadge {
+				t.Errorf("kind badges shown = %v, want %v", got, tt.wantBadge)
+			}
+		})
+	}
+}
+
+func TestNpubPageBreaksTiesByID(t *testing.T) {
+	const pubkey = "a1f3c5e7092b4d6f8a1c3e5f7092b4d6f8a1c3e5f7092b4d6f8a1c3e5f7092b4"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "frank"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Both notes share a kind and created_at, so only the id orders them
+	low, high := strings.Repeat("2", 64), strings.Repeat("9", 64)
+	for _, query := range []string{"", "?sort=recent"} {
+		t.Run("query "+query, func(t *testing.T) {
+			var pages []string
+			for i := 0; i < 2; i++ {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.MatchExpectationsInOrder(false)
+				// Rows come back as a database applying the ORDER BY would return them
+				mock.ExpectQuery(`created_at DESC, id DESC LIMIT`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+						AddRow(high, pubkey, int64(1700000000), 1, `{"id":"`+high+`","kind":1,"content":"tied high","tags":[]}`).
+						AddRow(low, pubkey, int64(1700000000), 1, `{"id":"`+low+`","kind":1,"content":"tied low","tags":[]}`))
+
+				rec := httptest.NewRecorder()
+				npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+query, nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+				}
+				if err := mock.ExpectationsWereMet(); err != nil {
+					t.Fatal(err)
+				}
+				db.Close()
+				pages = append(pages, rec.Body.String())
+			}
+			if pages[0] != pages[1] {
+				t.Error("repeated queries rendered different pages")
+			}
+			h, l := strings.Index(pages[0], "tied high"), strings.Index(pages[0], "tied low")
+			if h < 0 || l < 0 || h > l {
+				t.Errorf("tied notes at %d and %d, want the higher id first", h, l)
+			}
+		})
+	}
+}
+
+// profilePagePubkey is the pubkey whose page renderProfilePage renders
+const profilePagePubkey = "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2"
+
+// renderProfilePage renders the npub page of profilePagePubkey without
+// events and with profile already cached, returning the HTML
+func renderProfilePage(t *testing.T, profile *UserProfile) string {
+	t.Helper()
+	const pubkey = profilePagePubkey
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, profile)
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestProfileZapAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"lud16", `{"name":"judy","lud16":"judy@getalby.com"}`, "judy@getalby.com"},
+		{"lud16 preferred over lud06", `{"lud16":"judy@walletofsatoshi.com","lud06":"lnurl1dp68gurn8ghj7"}`, "judy@walletofsatoshi.com"},
+		{"lud06 fallback", `{"lud06":"LNURL1DP68GURN8GHJ7"}`, "LNURL1DP68GURN8GHJ7"},
+		{"invalid lud16", `{"lud16":"not an address"}`, ""},
+		{"lud16 with markup", `{"lud16":"<b>x</b>@evil.example"}`, ""},
+		{"none", `{"name":"judy"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var profile UserProfile
+			if err := json.Unmarshal([]byte(tt.content), &profile); err != nil {
+				t.Fatal(err)
+			}
+			if got := profile.ZapAddress(); got != tt.want {
+				t.Fatalf("ZapAddress() = %q, want %q", got, tt.want)
+			}
+
+			page := renderProfilePage(t, &profile)
+			shown := strings.Contains(page, "<strong>Zap address:</strong>")
+			if shown != (tt.want != "") || (tt.want != "" && !strings.Contains(page, "<strong>Zap address:</strong> "+tt.want+"</p>")) {
+				t.Errorf("page shows the zap address = %v, want %q", shown, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpubPageHidesDMs(t *testing.T) {
+	const pubkey = "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "frank"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const ciphertext = "c2VjcmV0IG1lc3NhZ2U=?iv=YWJjZGVmZ2hpamtsbW5vcA=="
+	dm := func(id string) string {
+		return `{"id":"` + id + `","kind":4,"content":"` + ciphertext + `","tags":[["p","` + pubkey + `"]]}`
+	}
+	tests := []struct {
+		name       string
+		query      string
+		wantShown  bool
+		wantNotice string
+	}{
+		{"hidden by default", "", false, "2 encrypted messages hidden."},
+		{"shown on request", "?show_dms=1", true, ""},
+		{"other values keep them hidden", "?show_dms=yes", false, "2 encrypted messages hidden."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(strings.Repeat("1", 64), pubkey, int64(1700000300), 1, `{"id":"`+strings.Repeat("1", 64)+`","kind":1,"content":"public note","tags":[]}`).
+					AddRow(strings.Repeat("4", 64), pubkey, int64(1700000200), 4, dm(strings.Repeat("4", 64))).
+					AddRow(strings.Repeat("5", 64), pubkey, int64(1700000100), 4, dm(strings.Repeat("5", 64))))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, "public note") {
+				t.Error("other events are missing")
+			}
+			if got := strings.Contains(body, ciphertext); got != tt.wantShown {
+				t.Errorf("encrypted messages shown = %v, want %v", got, tt.wantShown)
+			}
+			if tt.wantNotice != "" && !strings.Contains(body, tt.wantNotice) {
+				t.Errorf("page lacks the notice %q", tt.wantNotice)
+			}
+			if tt.wantNotice == "" && strings.Contains(body, "encrypted messages hidden") {
+				t.Error("page notes hidden messages although they are shown")
+			}
+		})
+	}
+}
+
+func TestCancelledRequestAbortsWork(t *testing.T) {
+	const pubkey = "2f8bde4d1a07209355b4a7250a5c5128e88b84bddc619ab7cba8d569b240efe4"
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	t.Run("database query", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		mock.ExpectQuery(`FROM event_backup`).WillDelayFor(time.Minute).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if _, _, err := queryEventsByPubkey(ctx, db, pubkey, listOptions{}); err == nil {
+			t.Fatal("queryEventsByPubkey() succeeded after the request was cancelled")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("query ran on for %v after the request was cancelled", d)
+		}
+	})
+
+	t.Run("relay fetch", func(t *testing.T) {
+		// Registered before newMockRelay's cleanup, so it runs after it
+		relays, timeout, wait, gateway := readRelays, relayTimeout, profileWait, profileGatewayURL
+		t.Cleanup(func() {
+			readRelays, relayTimeout, profileWait, profileGatewayURL = relays, timeout, wait, gateway
+		})
+		readRelays, relayTimeout, profileWait, profileGatewayURL = nil, time.Minute, time.Minute, ""
+		// The relay takes the subscription but never answers it
+		relay := newMockRelay(t, "", func(func(string), []byte) {})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		fetchProfileFromRelays(ctx, pubkey, nil)
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("relay fetch ran on for %v after the request was cancelled", d)
+		}
+		if relay.count("REQ") != 1 {
+			t.Errorf("relay received %d subscriptions, want 1", relay.count("REQ"))
+		}
+	})
+}
+
+func TestNpubPageCapsEvents(t *testing.T) {
+	const pubkey = "e493dbf1c10d80f3581e4904930b1404cc6c13900ee0758474fa94abe8c4cd13"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "heidi"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(n int) { maxEventsPerRequest = n }(maxEventsPerRequest)
+	maxEventsPerRequest = 3
+
+	tests := []struct {
+		name      string
+		query     string
+		wantLimit string
+		rows      int
+		wantShown int
+		wantCut   bool
+	}{
+		{"no pagination params", "", "LIMIT 4", 4, 3, true},
+		{"under the cap", "", "LIMIT 4", 2, 2, false},
+		{"per_page above the cap", "?per_page=100", "LIMIT 3", 3, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			for i := 0; i < tt.rows; i++ {
+				id := fmt.Sprintf("%064d", i)
+				rows.AddRow(id, pubkey, int64(1700000000-i), 1, fmt.Sprintf(`{"id":"%s","kind":1,"content":"capped note %d","tags":[]}`, id, i))
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(tt.wantLimit) + `$`).WillReturnRows(rows)
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			body := rec.Body.String()
+			for i := 0; i < tt.rows; i++ {
+				if got := strings.Contains(body, fmt.Sprintf("capped note %d", i)); got != (i < tt.wantShown) {
+					t.Errorf("event %d shown = %v, want only the first %d", i, got, tt.wantShown)
+				}
+			}
+			banner := fmt.Sprintf("Only the first %d events are shown.", tt.wantShown)
+			if got := strings.Contains(body, banner); got != tt.wantCut {
+				t.Errorf("truncation banner shown = %v, want %v", got, tt.wantCut)
+			}
+			if tt.wantCut && !strings.Contains(body, `href="?before=`) {
+				t.Error("truncation banner does not link to the next page")
+			}
+		})
+	}
+}
+
+func TestFetchProfileRecordsSourceRelay(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"ivan"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Registered before newMockRelay's cleanup, so it runs after it
+	relays := readRelays
+	t.Cleanup(func() { readRelays = relays })
+	readRelays = nil
+	empty := func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	}
+	newMockRelay(t, "", empty)
+	answering := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(eventMessage(req.SubscriptionID, metadata))
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	newMockRelay(t, "", empty)
+
+	profile, err := fetchProfileFromRelays(context.Background(), pubkey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "ivan" || profile.SourceRelay != answering.url {
+		t.Fatalf("profile = %+v, want ivan from %s", profile, answering.url)
+	}
+
+	page := renderProfilePage(t, profile)
+	if !strings.Contains(page, `<p class="profile-source">Profile from `+answering.url+`</p>`) {
+		t.Error("page does not show the source relay")
+	}
+	if strings.Contains(renderProfilePage(t, &UserProfile{Name: "ivan"}), "profile-source") {
+		t.Error("page shows a source relay for a profile without one")
+	}
+}
+
+func TestProfileDisplayNameAndWebsite(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantName    string
+		wantWebsite string
+	}{
+		{"display_name preferred", `{"name":"judy_k","display_name":"Judy K.","website":"https://judy.example/blog"}`, "Judy K.", "https://judy.example/blog"},
+		{"name fallback", `{"name":"judy_k","display_name":""}`, "judy_k", ""},
+		{"bare host website", `{"display_name":"Judy","website":"judy.example"}`, "Judy", "https://judy.example"},
+		{"unsafe website dropped", `{"name":"judy","website":"javascript:alert(1)"}`, "judy", ""},
+		{"neither", `{"about":"no names"}`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var profile UserProfile
+			if err := json.Unmarshal([]byte(tt.content), &profile); err != nil {
+				t.Fatal(err)
+			}
+			if got := profile.DisplayedName(); got != tt.wantName {
+				t.Errorf("DisplayedName() = %q, want %q", got, tt.wantName)
+			}
+			if got := profile.WebsiteURL(); got != tt.wantWebsite {
+				t.Errorf("WebsiteURL() = %q, want %q", got, tt.wantWebsite)
+			}
+
+			page := renderProfilePage(t, &profile)
+			heading := "<h1>Nostr User</h1>"
+			if tt.wantName != "" {
+				heading = "<h1>" + template.HTMLEscapeString(tt.wantName) + "</h1>"
+			}
+			if !strings.Contains(page, heading) {
+				t.Errorf("page lacks the heading %s", heading)
+			}
+			link := `<a href="` + tt.wantWebsite + `" target="_blank"`
+			if got := strings.Contains(page, "<strong>Website:</strong>"); got != (tt.wantWebsite != "") || (got && !strings.Contains(page, link)) {
+				t.Errorf("page website link shown = %v, want %q", got, tt.wantWebsite)
+			}
+		})
+	}
+}
+
+func TestProfileBanner(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantBanner string
+	}{
+		{"banner", `{"name":"kit","banner":"https://img.example/banner.jpg"}`, "https://img.example/banner.jpg"},
+		{"padded", `{"name":"kit","banner":" http://img.example/b.png "}`, "http://img.example/b.png"},
+		{"no banner", `{"name":"kit"}`, ""},
+		{"not a URL", `{"name":"kit","banner":"banner.jpg"}`, ""},
+		{"unsafe scheme", `{"name":"kit","banner":"javascript:alert(1)"}`, ""},
+		{"data URL", `{"name":"kit","banner":"data:image/png;base64,AAAA"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var profile UserProfile
+			if err := json.Unmarshal([]byte(tt.content), &profile); err != nil {
+				t.Fatal(err)
+			}
+			if got := profile.BannerURL(); got != tt.wantBanner {
+				t.Errorf("BannerURL() = %q, want %q", got, tt.wantBanner)
+			}
+
+			page := renderProfilePage(t, &profile)
+			img := `<img src="` + tt.wantBanner + `" alt="" class="profile-banner" onerror="this.remove()">`
+			if got := strings.Contains(page, `class="profile-banner"`); got != (tt.wantBanner != "") || (got && !strings.Contains(page, img)) {
+				t.Errorf("page banner shown = %v, want %q", got, tt.wantBanner)
+			}
+		})
+	}
+}
+
+func TestEmptySearchPrompts(t *testing.T) {
+	const prompt = "Please enter an npub, nprofile, hex pubkey, or NIP-05 address."
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantPrompt bool
+	}{
+		{"empty q", "/npub/?q=", http.StatusOK, true},
+		{"blank q", "/npub/?q=%20%09", http.StatusOK, true},
+		{"no q", "/npub/", http.StatusOK, true},
+		{"invalid q", "/npub/?q=npub1nope", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The prompt is answered without a database
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{})(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, prompt); got != tt.wantPrompt {
+				t.Errorf("prompt shown = %v, want %v", got, tt.wantPrompt)
+			}
+			if tt.wantPrompt && !strings.Contains(body, `name="q"`) {
+				t.Error("prompt is not shown with the search form")
+			}
+		})
+	}
+}
+
+func TestNpubPageFlagsUnparseableEvents(t *testing.T) {
+	const pubkey = "02d8e3a0a5d3d6e8e3a4e0a0b2bd5d1e9f9c5a9b5a47e2f0c2b5b6e4f4d9a1c3"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "kim"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name string
+		data string
+		raw  string
+	}{
+		{"truncated JSON", `{"id":"` + strings.Repeat("b", 64) + `","kind":3,"content":"cut sh`, `&#34;content&#34;:&#34;cut sh`},
+		{"not an object", `<p>not json</p>`, `&lt;p&gt;not json&lt;/p&gt;`},
+		{"wrong field types", `{"kind":"three","tags":"none"}`, `&#34;tags&#34;:&#34;none&#34;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(strings.Repeat("a", 64), pubkey, int64(1700000100), 1, `{"id":"`+strings.Repeat("a", 64)+`","kind":1,"content":"fine","tags":[]}`).
+					AddRow(strings.Repeat("b", 64), pubkey, int64(1700000000), 3, tt.data))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			if n := strings.Count(body, `<span class="warning-label">unparseable</span>`); n != 1 {
+				t.Errorf("%d events flagged unparseable, want 1", n)
+			}
+			if !strings.Contains(body, tt.raw) {
+				t.Errorf("page does not show the raw stored text %s", tt.raw)
+			}
+			// A follow list that cannot be parsed cannot be restored
+			if strings.Contains(body, `class="restore-btn"`) {
+				t.Error("unparseable follow list has a restore button")
+			}
+		})
+	}
+}
+
+func TestNpubPageContainsFilter(t *testing.T) {
+	const pubkey = "f2d4b6a8c0e1f3d5b7a9c1e3f5d7b9a1c3e5f7d9b1a3c5e7f9d1b3a5c7e9f1d3"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "judy"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	id := strings.Repeat("c", 64)
+	mock.ExpectQuery(regexp.QuoteMeta(`THEN event_data::jsonb->>'content' END ILIKE $2`)).
+		WithArgs(pubkey, `%<b>%`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(id, pubkey, int64(1700000000), 1, `{"id":"`+id+`","kind":1,"content":"use <B> for <script>bold</script>","tags":[]}`))
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+"?contains=%3Cb%3E", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `use <mark>&lt;B&gt;</mark> for &lt;script&gt;bold&lt;/script&gt;`) {
+		t.Error("matched content is not highlighted and escaped")
+	}
+	if strings.Contains(body, "<script>bold") {
+		t.Error("content markup reached the page unescaped")
+	}
+	if !strings.Contains(body, `value="&lt;b&gt;"`) {
+		t.Error("search box does not keep the escaped term")
+	}
+}
+
+func TestProfileRawJSONSection(t *testing.T) {
+	const raw = `{"name":"ken","about":"<i>hi</i>","nip05":"ken@example.com","custom_field":[1,2]}`
+	const pretty = "{\n  &#34;name&#34;: &#34;ken&#34;,\n  &#34;about&#34;: &#34;&lt;i&gt;hi&lt;/i&gt;&#34;," +
+		"\n  &#34;nip05&#34;: &#34;ken@example.com&#34;,\n  &#34;custom_field&#34;: [\n    1,\n    2\n  ]\n}"
+	tests := []struct {
+		name        string
+		profile     *UserProfile
+		wantSummary string
+		wantContent string
+	}{
+		{
+			name:        "stored profile",
+			profile:     &UserProfile{Name: "ken", RawContent: raw},
+			wantSummary: "<summary>Raw profile JSON (backup)</summary>",
+			wantContent: pretty,
+		},
+		{
+			name:        "relay profile",
+			profile:     &UserProfile{Name: "ken", RawContent: raw, SourceRelay: "wss://relay.example"},
+			wantSummary: "<summary>Raw profile JSON (wss://relay.example)</summary>",
+			wantContent: pretty,
+		},
+		{
+			name:        "content that is not JSON is shown as is",
+			profile:     &UserProfile{RawContent: `{"name":<b>`},
+			wantSummary: "<summary>Raw profile JSON (backup)</summary>",
+			wantContent: `{&#34;name&#34;:&lt;b&gt;`,
+		},
+		{name: "no raw content", profile: &UserProfile{Name: "ken"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := renderProfilePage(t, tt.profile)
+			if tt.wantSummary == "" {
+				if strings.Contains(page, "raw-profile") {
+					t.Error("raw profile section shown without raw content")
+				}
+				return
+			}
+			if !strings.Contains(page, tt.wantSummary) {
+				t.Errorf("page does not contain %s", tt.wantSummary)
+			}
+			if !strings.Contains(page, tt.wantContent) {
+				t.Errorf("page does not contain the raw content %s", tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestNpubPageGroupOrder(t *testing.T) {
+	const pubkey = "e0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "leo"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// One note, two follow lists and three reactions, as grouped by kind
+	kinds := []int{1, 3, 3, 7, 7, 7}
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 3, 7}},
+		{"?group_order=kind", []int{1, 3, 7}},
+		{"?group_order=count", []int{7, 3, 1}},
+	}
+	for _, tt := range tests {
+		t.Run("query "+tt.query, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			for i, kind := range kinds {
+				id := fmt.Sprintf("%064x", i+1)
+				rows.AddRow(id, pubkey, int64(1700000000-i), kind, fmt.Sprintf(`{"id":"%s","kind":%d,"content":"","tags":[]}`, id, kind))
+			}
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnRows(rows)
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var got []int
+			for _, m := range regexp.MustCompile(`<h2 class="kind-header">Kind (\d+) `).FindAllStringSubmatch(rec.Body.String(), -1) {
+				var kind int
+				fmt.Sscan(m[1], &kind)
+				got = append(got, kind)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("kind groups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpubPageIndentsEventJSON(t *testing.T) {
+	const pubkey = "b7e3a9c1d5f2e8a4b6c0d9e3f7a1b5c8d2e6f0a4b8c1d5e9f3a7b0c4d8e2f6a9"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "nina"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	id := strings.Repeat("d", 64)
+	raw := `{"id":"` + id + `","kind":1,"content":"gm","tags":[]}`
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(id, pubkey, int64(1700000000), 1, raw))
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	indented := template.HTMLEscapeString("{\n  \"id\": \"" + id + "\",\n  \"kind\": 1,\n  \"content\": \"gm\",\n  \"tags\": []\n}")
+	if !strings.Contains(body, `word-break: break-all;">`+indented+`</pre>`) {
+		t.Error("event JSON is not shown indented")
+	}
+	if !strings.Contains(body, `data-content="`+template.HTMLEscapeString(raw)+`"`) {
+		t.Error("raw event JSON is not kept for copying")
+	}
+}
+
+func TestNpubPageTruncatesOversizedEvents(t *testing.T) {
+	const pubkey = "c8f2a6e0b4d8c2f6a0e4b8d2c6f0a4e8b2d6c0f4a8e2b6d0c4f8a2e6b0d4c8f2"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "oscar"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(n int) { maxRenderContent = n }(maxRenderContent)
+	maxRenderContent = 200
+
+	small, big := strings.Repeat("5", 64), strings.Repeat("b", 64)
+	smallData := `{"id":"` + small + `","kind":1,"content":"fits","tags":[]}`
+	bigData := `{"id":"` + big + `","kind":1,"content":"` + strings.Repeat("A", 300) + `END","tags":[]}`
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(big, pubkey, int64(1700000100), 1, bigData).
+			AddRow(small, pubkey, int64(1700000000), 1, smallData))
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "AEND") {
+		t.Error("oversized content is shown in full")
+	}
+	if !strings.Contains(body, template.HTMLEscapeString(bigData[:200])+"…</pre>") {
+		t.Error("oversized event does not show its beginning")
+	}
+	if n := strings.Count(body, `class="content-truncated"`); n != 1 {
+		t.Errorf("%d truncation notices, want 1", n)
+	}
+	if !strings.Contains(body, `<a href="/api/event/`+big+`/download">Download</a>`) {
+		t.Error("truncation notice does not link to the download")
+	}
+	// Copying fetches the full event instead of embedding it
+	if !strings.Contains(body, `data-event-url="/api/event/`+big+`"`) {
+		t.Error("oversized event cannot be copied in full")
+	}
+	if !strings.Contains(body, `data-content="`+template.HTMLEscapeString(smallData)+`"`) {
+		t.Error("small event is not embedded for copying")
+	}
+}
+
+func TestNpubPageCompactView(t *testing.T) {
+	const pubkey = "d9c3b7a1e5f9d3c7b1a5e9f3d7c1b5a9e3f7d1c5b9a3e7f1d5c9b3a7e1f5d9c3"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "quinn"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	id := strings.Repeat("e", 64)
+	data := `{"id":"` + id + `","kind":1,"content":"first line\n\n  second   line <b>","tags":[]}`
+	tests := []struct {
+		query       string
+		wantCompact bool
+		wantToggle  string
+	}{
+		{"", false, `<a href="?view=compact">Compact view</a>`},
+		{"?view=compact", true, `<a href="?view=full">Full view</a>`},
+	}
+	for _, tt := range tests {
+		t.Run("query "+tt.query, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(id, pubkey, int64(1700000000), 1, data))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			preview := `<span class="event-card-preview">first line second line &lt;b&gt;</span>`
+			if got := strings.Contains(body, preview); got != tt.wantCompact {
+				t.Errorf("preview line shown = %v, want %v", got, tt.wantCompact)
+			}
+			if got := strings.Contains(body, `<details class="event-card">`); got != tt.wantCompact {
+				t.Errorf("expandable card shown = %v, want %v", got, tt.wantCompact)
+			}
+			if tt.wantCompact && !strings.Contains(body, `<span class="event-card-id">`+id+`</span>`) {
+				t.Error("card does not show the event id")
+			}
+			if !strings.Contains(body, tt.wantToggle) {
+				t.Errorf("page does not link to the other view with %s", tt.wantToggle)
+			}
+		})
+	}
+}
+
+func TestNpubPageLabelsExpiredEvents(t *testing.T) {
+	const pubkey = "5b1d9f3a7c5e1b9d3f7a5c1e9b3d7f1a5c9e3b7d1f5a9c3e7b1d5f9a3c7e1b5d"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "tove"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	future := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+	for i, tags := range []string{`[["expiration","1700003600"]]`, `[["expiration","` + future + `"]]`, `[]`} {
+		id := strings.Repeat(strconv.Itoa(i+1), 64)
+		rows.AddRow(id, pubkey, int64(1700000000+i), 3, `{"id":"`+id+`","kind":3,"content":"","tags":`+tags+`}`)
+	}
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnRows(rows)
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if n := strings.Count(body, `<span class="expired-label">expired</span>`); n != 1 {
+		t.Errorf("%d events labelled expired, want 1", n)
+	}
+	// The expired contact list cannot be restored, the other two can
+	if n := strings.Count(body, `<button class="restore-btn"`); n != 2 {
+		t.Errorf("%d restore buttons, want 2", n)
+	}
+}
+
+func TestNpubPageLabelsFutureDatedEvents(t *testing.T) {
+	const pubkey = "e0c4a8b2d6f0e4c8a2b6d0f4e8c2a6b0d4f8e2c6a0b4d8f2e6c0a4b8d2f6e0c4"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "ilse"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+	for i, at := range []time.Time{now.Add(-time.Hour), now.Add(5 * time.Minute), now.Add(48 * time.Hour)} {
+		id := strings.Repeat(strconv.Itoa(i+4), 64)
+		rows.AddRow(id, pubkey, at.Unix(), 1, `{"id":"`+id+`","kind":1,"content":"note `+strconv.Itoa(i)+`","tags":[]}`)
+	}
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnRows(rows)
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	// Only the note two days ahead is past the default skew
+	if n := strings.Count(rec.Body.String(), `<span class="warning-label">future-dated</span>`); n != 1 {
+		t.Errorf("%d events labelled future-dated, want 1", n)
+	}
+}
+
+func TestProfileFetchStopsWaiting(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"uma"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		answers  bool
+		wantName string
+	}{
+		{"a relay that never sends", false, ""},
+		{"the first profile ends the wait", true, "uma"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Registered before newMockRelay's cleanup, so it runs after it
+			relays, timeout, wait, gateway := readRelays, relayTimeout, profileWait, profileGatewayURL
+			t.Cleanup(func() {
+				readRelays, relayTimeout, profileWait, profileGatewayURL = relays, timeout, wait, gateway
+			})
+			readRelays, relayTimeout, profileWait, profileGatewayURL = nil, time.Minute, 200*time.Millisecond, ""
+			silent := newMockRelay(t, "", func(func(string), []byte) {})
+			if tt.answers {
+				newMockRelay(t, "", func(reply func(string), msg []byte) {
+					if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+						reply(eventMessage(req.SubscriptionID, metadata))
+						reply(`["EOSE","` + req.SubscriptionID + `"]`)
+					}
+				})
+			}
+
+			start := time.Now()
+			profile, err := fetchProfileFromRelays(context.Background(), pubkey, nil)
+			d := time.Since(start)
+			if err != nil || profile.Name != tt.wantName {
+				t.Errorf("fetchProfileFromRelays() = %+v, %v, want name %q", profile, err, tt.wantName)
+			}
+			// Well short of the one minute relay timeout
+			if limit := profileWait + time.Second; d > limit {
+				t.Errorf("fetch took %v, want at most %v", d, limit)
+			}
+			if tt.answers && d >= profileWait {
+				t.Errorf("fetch took %v, waiting on the silent relay after a profile arrived", d)
+			}
+			if !tt.answers && silent.count("REQ") != 1 {
+				t.Errorf("silent relay received %d subscriptions, want 1", silent.count("REQ"))
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_restore_http_requests_total",
+		Help: "Total number of HTTP requests by path and status code.",
+	}, []string{"path", "code"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nostr_restore_db_query_duration_seconds",
+		Help:    "Duration of database queries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+
+	relayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nostr_restore_relay_duration_seconds",
+		Help:    "Duration of relay connect and subscribe operations.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30},
+	}, []string{"operation"})
+
+	invalidNpubs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nostr_restore_invalid_npubs_total",
+		Help: "Total number of npubs that failed to decode.",
+	})
+
+	profileCacheHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nostr_restore_profile_cache_hit_ratio",
+		Help: "Ratio of profile cache hits to lookups.",
+	}, func() float64 { return profiles.hitRatio() })
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, dbQueryDuration, relayDuration, invalidNpubs, profileCacheHitRatio)
+}
+
+// instrument wraps handler so its requests are counted under path
+func instrument(path string, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(prometheus.Labels{"path": path}), handler)
+}
+
+// observeDBQuery records the duration of the named query started at start
+func observeDBQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// observeRelay records the duration of the relay operation started at start
+func observeRelay(operation string, start time.Time) {
+	relayDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	// Vectors only appear once they have a labelled series. The labels are
+	// fresh for every run, since the counters are global.
+	label := "metrics_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	teapot := instrument("/"+label, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	teapot.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/teapot", nil))
+	observeDBQuery(label, time.Now())
+	observeRelay(label, time.Now())
+
+	srv := httptest.NewServer(promhttp.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`nostr_restore_http_requests_total{code="418",path="/` + label + `"} 1`,
+		`nostr_restore_db_query_duration_seconds_count{query="` + label + `"} 1`,
+		`nostr_restore_relay_duration_seconds_count{operation="` + label + `"} 1`,
+		"nostr_restore_invalid_npubs_total",
+		"nostr_restore_profile_cache_hit_ratio",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output lacks %s", want)
+		}
+	}
+}
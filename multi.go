@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// maxPubkeys caps the number of pubkeys accepted in a single search
+const maxPubkeys = 20
+
+// AuthorEvents groups the events of a single author
+type AuthorEvents struct {
+	Npub      string
+	HexPubkey string
+	Profile   *UserProfile
+	Events    []Event
+}
+
+// parseNpubList splits a comma-separated list of identifiers and resolves
+// each to an npub and hex pubkey, dropping duplicates
+func parseNpubList(ctx context.Context, list string) ([]string, []string, error) {
+	var npubs, hexPubkeys []string
+	seen := map[string]bool{}
+	for _, npub := range strings.Split(list, ",") {
+		npub = strings.TrimSpace(npub)
+		if npub == "" {
+			continue
+		}
+
+		hexPubkey, err := resolveIdentifier(ctx, npub)
+		if errors.Is(err, errPrivateKey) {
+			return nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", npub, err)
+		}
+		npub, err = nip19.EncodePublicKey(hexPubkey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[hexPubkey] || isBlocked(hexPubkey) {
+			continue
+		}
+		seen[hexPubkey] = true
+
+		npubs = append(npubs, npub)
+		hexPubkeys = append(hexPubkeys, hexPubkey)
+	}
+
+	if len(hexPubkeys) == 0 {
+		return nil, nil, fmt.Errorf("no npub given")
+	}
+	if len(hexPubkeys) > maxPubkeys {
+		return nil, nil, fmt.Errorf("too many npubs: %d (max %d)", len(hexPubkeys), maxPubkeys)
+	}
+	return npubs, hexPubkeys, nil
+}
+
+// queryEventsByPubkeys retrieves events from event_backup table for several
+// pubkeys, reporting whether they were cut at maxEventsPerRequest
+func queryEventsByPubkeys(ctx context.Context, db *sql.DB, pubkeys []string) ([]Event, bool, error) {
+	defer observeDBQuery("events_by_pubkeys", time.Now())
+
+	query := fmt.Sprintf(`SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = ANY($1) ORDER BY pubkey, event_kind ASC, created_at DESC, id DESC LIMIT %d`, maxEventsPerRequest+1)
+	rows, err := db.QueryContext(ctx, query, pq.Array(pubkeys))
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(events) > maxEventsPerRequest {
+		return events[:maxEventsPerRequest], true, nil
+	}
+	return events, false, nil
+}
+
+// multiNpubHandler renders the events of several comma-separated npubs grouped by author
+func multiNpubHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, list string) {
+	npubs, hexPubkeys, err := parseNpubList(r.Context(), list)
+	if errors.Is(err, errPrivateKey) {
+		renderError(w, http.StatusBadRequest, privateKeyMessage)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Invalid npub list %q: %v", list, err)
+		renderError(w, http.StatusBadRequest, fmt.Sprintf("Invalid identifier list. Enter up to %d comma-separated identifiers: %s.", maxPubkeys, supportedIdentifiers))
+		return
+	}
+
+	ctx := r.Context()
+	events, truncated, err := queryEventsByPubkeys(ctx, db, hexPubkeys)
+	if err != nil {
+		errorf(ctx, "Failed to query events for %d pubkeys: %v", len(hexPubkeys), err)
+		renderDBError(w, r, db, err, "Failed to load events. Please try again later.")
+		return
+	}
+
+	// Encrypted DMs are hidden unless requested, as on the npub page
+	hiddenDMs := 0
+	if r.URL.Query().Get("show_dms") != "1" {
+		events, hiddenDMs = filterDMs(events)
+	}
+
+	authors := make([]*AuthorEvents, len(hexPubkeys))
+	byPubkey := map[string]*AuthorEvents{}
+	for i, hexPubkey := range hexPubkeys {
+		authors[i] = &AuthorEvents{Npub: npubs[i], HexPubkey: hexPubkey, Profile: &UserProfile{}}
+		byPubkey[hexPubkey] = authors[i]
+	}
+	markSuperseded(events)
+	markDeleted(events, deletedIDs(events))
+	setLocation(events, requestLocation(r))
+	for _, event := range events {
+		if author, ok := byPubkey[event.Pubkey]; ok {
+			author.Events = append(author.Events, event)
+		}
+	}
+
+	// Fetch all author profiles in one round trip per relay
+	authorProfiles := getProfiles(ctx, db, hexPubkeys)
+	for _, author := range authors {
+		if profile, ok := authorProfiles[author.HexPubkey]; ok {
+			author.Profile = profile
+		}
+	}
+
+	tmpl := `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Events for {{len .Authors}} authors - {{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
+    <script src="https://cdn.jsdelivr.net/npm/sweetalert2@11"></script>
+    <script src="{{$.Site.Asset "script.js"}}"></script>
+</head>
+<body>
+    <div class="container">
+        <div class="back-link">
+            <a href="{{$.Site.BasePath}}/">← Back to Home</a>
+        </div>
+
+        <div class="header">
+            <h1>Events for {{len .Authors}} authors</h1>
+            <p><strong>Total Events Found:</strong> {{.Total}}</p>
+        </div>
+
+        {{if .Truncated}}
+        <div class="notice">Only the first {{.Total}} events are shown. Open an author's page to see all of their events.</div>
+        {{end}}
+
+        {{if .HiddenDMs}}
+        <div class="notice">{{.HiddenDMs}} encrypted messages hidden. <a href="{{.ShowDMsURL}}">Show them</a></div>
+        {{end}}
+
+        {{range .Authors}}
+        <div class="author-group">
+            <div class="author-header">
+                {{if .Profile.Picture}}<img src="{{.Profile.Picture}}" alt="Profile Picture" class="author-pic">{{end}}
+                <div>
+                    <h2><a href="{{$.Site.BasePath}}/npub/{{.Npub}}">{{with .Profile.DisplayedName}}{{.}}{{else}}Nostr User{{end}}</a></h2>
+                    <p><strong>npub:</strong> {{.Npub}}</p>
+                    <p><strong>Events:</strong> {{len .Events}}</p>
+                </div>
+            </div>
+            <div class="events-container">
+                {{range .Events}}
+                <div class="event{{if .Superseded}} superseded{{end}}{{if .Deleted}} deleted{{end}}">
+                    <div class="event-header">
+                        <div class="event-header-left">
+                            <span class="event-timestamp">{{.GetFormattedDate}}</span>
+                            {{if .Superseded}}<span class="superseded-label">superseded</span>{{end}}
+                            {{if .Unparseable}}<span class="warning-label">unparseable</span>{{else if .IDMismatch}}<span class="warning-label">id mismatch</span>{{end}}
+                            {{if .IsExpired}}<span class="expired-label">expired</span>{{end}}
+                            {{if .IsFutureDated}}<span class="warning-label">future-dated</span>{{end}}
+                            {{if .Deleted}}<span class="deleted-label">deleted by author</span>{{end}}
+                        </div>
+                        <div class="event-actions">
+                            <button class="copy-btn" onclick="copyEventData(this)">Copy</button>
+                        </div>
+                    </div>
+                    <details{{if $.Expand}} open{{end}}>
+                        <summary class="event-summary">Kind {{.Kind}} · {{.GetFormattedDate}}{{with .Summary}} · {{.}}{{end}}</summary>
+                        <div class="event-content" {{if .ContentTruncated}}data-event-url="{{$.Site.BasePath}}/api/event/{{.ID}}"{{else}}data-content="{{.EventData}}"{{end}}><pre style="white-space: pre-wrap; word-break: break-all;">{{.Indented}}</pre></div>
+                        {{if .ContentTruncated}}<p class="content-truncated">Content truncated. <a href="{{$.Site.BasePath}}/api/event/{{.ID}}/download">Download</a> the event to see it in full.</p>{{end}}
+                    </details>
+                    <div class="event-id">{{.ID}}</div>
+                </div>
+                {{else}}
+                <p>No events found for this pubkey.</p>
+                {{end}}
+            </div>
+        </div>
+        {{end}}
+        <footer>
+            <p>{{.Site.Title}} &copy; 2025</p>
+        </footer>
+    </div>
+</body>
+</html>
+`
+	t, err := template.New("multi").Parse(tmpl)
+	if err != nil {
+		errorf(ctx, "Failed to parse multi template: %v", err)
+		renderError(w, http.StatusInternalServerError, "Failed to render page.")
+		return
+	}
+
+	data := struct {
+		Site       siteInfo
+		Authors    []*AuthorEvents
+		Total      int
+		Expand     bool
+		Truncated  bool
+		HiddenDMs  int
+		ShowDMsURL string
+	}{
+		Site:       site,
+		Authors:    authors,
+		Total:      len(events),
+		Expand:     r.URL.Query().Get("expand") == "1",
+		Truncated:  truncated,
+		HiddenDMs:  hiddenDMs,
+		ShowDMsURL: pageURL(r, "show_dms", "1"),
+	}
+
+	err = t.Execute(w, data)
+	if err != nil {
+		errorf(ctx, "Failed to render multi template: %v", err)
+		renderError(w, http.StatusInternalServerError, "Failed to render page.")
+		return
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestParseNpubList(t *testing.T) {
+	const (
+		alice = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+		bob   = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	)
+	aliceNpub, _ := nip19.EncodePublicKey(alice)
+	bobNpub, _ := nip19.EncodePublicKey(bob)
+	defer func(blocked map[string]bool) { blockedPubkeys = blocked }(blockedPubkeys)
+
+	tests := []struct {
+		name    string
+		list    string
+		blocked []string
+		want    []string
+		wantErr string
+	}{
+		{"two npubs", aliceNpub + "," + bobNpub, nil, []string{alice, bob}, ""},
+		{"hex, spaces and duplicates", " " + alice + " , " + aliceNpub + ",," + bob, nil, []string{alice, bob}, ""},
+		{"blocked pubkeys dropped", aliceNpub + "," + bobNpub, []string{bob}, []string{alice}, ""},
+		{"only blocked", bobNpub + ",", []string{bob}, nil, "no npub given"},
+		{"invalid entry", aliceNpub + ",npub1nope", nil, nil, "npub1nope"},
+		{"too many", aliceNpub + "," + manyPubkeys(maxPubkeys), nil, nil, "too many npubs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blockedPubkeys = map[string]bool{}
+			for _, pk := range tt.blocked {
+				blockedPubkeys[pk] = true
+			}
+			npubs, hexPubkeys, err := parseNpubList(context.Background(), tt.list)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseNpubList() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hexPubkeys, tt.want) {
+				t.Errorf("hex pubkeys = %q, want %q", hexPubkeys, tt.want)
+			}
+			for i, npub := range npubs {
+				if _, hex, _ := nip19.Decode(npub); hex != hexPubkeys[i] {
+					t.Errorf("npub %s does not encode %s", npub, hexPubkeys[i])
+				}
+			}
+		})
+	}
+}
+
+// manyPubkeys returns n distinct hex pubkeys joined by commas
+func manyPubkeys(n int) string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, strings.Repeat(string("0123456789abcdef"[i%16]), 63)+string("0123456789abcdef"[i/16]))
+	}
+	return strings.Join(keys, ",")
+}
+
+// multiPage renders the multi-author page for pubkeys with rows as their
+// stored events
+func multiPage(t *testing.T, query string, rows *sqlmock.Rows, pubkeys ...string) string {
+	t.Helper()
+	for _, pubkey := range pubkeys {
+		profiles.set(pubkey, &UserProfile{Name: "author"})
+		defer profiles.delete(pubkey)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(fmt.Sprintf(`WHERE pubkey = ANY\(\$1\) .* LIMIT %d$`, maxEventsPerRequest+1)).WillReturnRows(rows)
+
+	rec := httptest.NewRecorder()
+	list := strings.Join(pubkeys, ",")
+	multiNpubHandler(db, rec, httptest.NewRequest(http.MethodGet, "/npub/"+list+query, nil), list)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	return rec.Body.String()
+}
+
+func TestMultiNpubPageCapsEvents(t *testing.T) {
+	const (
+		alice = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+		bob   = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	)
+	defer func(limit int) { maxEventsPerRequest = limit }(maxEventsPerRequest)
+	maxEventsPerRequest = 2
+
+	rows := func(n int) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+		for i := 0; i < n; i++ {
+			id := strings.Repeat(string("abc"[i]), 64)
+			rows.AddRow(id, alice, int64(1700000000-i), 1, `{"id":"`+id+`","kind":1,"content":"note","tags":[]}`)
+		}
+		return rows
+	}
+
+	body := multiPage(t, "", rows(3), alice, bob)
+	if !strings.Contains(body, "Only the first 2 events are shown.") {
+		t.Error("the cut listing has no truncation notice")
+	}
+	if strings.Contains(body, strings.Repeat("c", 64)) {
+		t.Error("the event beyond the cap was rendered")
+	}
+
+	body = multiPage(t, "", rows(2), alice, bob)
+	if strings.Contains(body, "Only the first") {
+		t.Error("a listing within the cap has a truncation notice")
+	}
+}
+
+func TestMultiNpubPageHidesDMs(t *testing.T) {
+	const (
+		alice = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+		bob   = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	)
+	note, dm := strings.Repeat("a", 64), strings.Repeat("d", 64)
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(note, alice, int64(1700000000), 1, `{"id":"`+note+`","kind":1,"content":"hello","tags":[]}`).
+			AddRow(dm, bob, int64(1700000000), 4, `{"id":"`+dm+`","kind":4,"content":"c2VjcmV0?iv=aXY=","tags":[]}`)
+	}
+
+	body := multiPage(t, "", rows(), alice, bob)
+	if strings.Contains(body, dm) {
+		t.Error("an encrypted DM is shown by default")
+	}
+	if !strings.Contains(body, "1 encrypted messages hidden.") || !strings.Contains(body, "show_dms=1") {
+		t.Error("the page does not say a DM was hidden")
+	}
+	if !strings.Contains(body, note) {
+		t.Error("the note was hidden with the DM")
+	}
+
+	body = multiPage(t, "?show_dms=1", rows(), alice, bob)
+	if !strings.Contains(body, dm) || strings.Contains(body, "encrypted messages hidden") {
+		t.Error("show_dms=1 does not show the DM")
+	}
+}
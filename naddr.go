@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// naddrToPointer decodes an naddr string into an entity pointer
+func naddrToPointer(naddr string) (nostr.EntityPointer, error) {
+	if !strings.HasPrefix(naddr, "naddr1") {
+		return nostr.EntityPointer{}, fmt.Errorf("invalid naddr format: does not start with naddr1")
+	}
+
+	prefix, value, err := nip19.Decode(naddr)
+	if err != nil {
+		return nostr.EntityPointer{}, fmt.Errorf("invalid naddr: %v", err)
+	}
+
+	if prefix != "naddr" {
+		return nostr.EntityPointer{}, fmt.Errorf("not an naddr: prefix is %s", prefix)
+	}
+
+	pointer, ok := value.(nostr.EntityPointer)
+	if !ok {
+		return nostr.EntityPointer{}, fmt.Errorf("decoded naddr value is not an entity pointer")
+	}
+
+	return pointer, nil
+}
+
+// addressQuery builds the query selecting the events of an entity
+// pointer's pubkey and kind, newest first. The d tag is matched after
+// scanning, since casting every row in SQL fails on one that is not JSON.
+func addressQuery(pointer nostr.EntityPointer) (string, []any) {
+	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = $1 AND event_kind = $2 ORDER BY created_at DESC, id ASC`
+	return query, []any{pointer.PublicKey, pointer.Kind}
+}
+
+// queryEventByAddress retrieves the newest event matching an entity pointer
+func queryEventByAddress(ctx context.Context, db *sql.DB, pointer nostr.EntityPointer) (*Event, error) {
+	defer observeDBQuery("event_by_address", time.Now())
+
+	query, args := addressQuery(pointer)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		ev, err := event.parse()
+		if err != nil {
+			continue
+		}
+		if tag := ev.Tags.GetFirst([]string{"d", ""}); tag != nil && tag.Value() == pointer.Identifier {
+			return &event, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, sql.ErrNoRows
+}
+
+// naddrHandler handles naddr lookup and displays the addressed event
+func naddrHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := dbs.read()
+		naddr := strings.TrimPrefix(r.URL.Path, "/naddr/")
+
+		// If naddr not in URL path, check query param
+		if naddr == "" {
+			naddr = r.URL.Query().Get("q")
+		}
+
+		pointer, err := naddrToPointer(naddr)
+		if err != nil {
+			logf(r.Context(), "Invalid naddr %q: %v", naddr, err)
+			renderError(w, http.StatusBadRequest, "Invalid naddr format")
+			return
+		}
+		if rejectBlocked(w, pointer.PublicKey) {
+			return
+		}
+
+		event, err := queryEventByAddress(r.Context(), db, pointer)
+		if err == sql.ErrNoRows {
+			renderError(w, http.StatusNotFound, "No event found for this address.")
+			return
+		}
+		if err != nil {
+			errorf(r.Context(), "Failed to query event for %s: %v", naddr, err)
+			renderDBError(w, r, db, err, "Failed to load event. Please try again later.")
+			return
+		}
+
+		event.loc = requestLocation(r)
+
+		npub, err := nip19.EncodePublicKey(pointer.PublicKey)
+		if err != nil {
+			logf(r.Context(), "Failed to encode npub for %s: %v", pointer.PublicKey, err)
+		}
+
+		tmpl := `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Pointer.Identifier}} - {{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
+    <script src="https://cdn.jsdelivr.net/npm/sweetalert2@11"></script>
+    <script src="{{$.Site.Asset "script.js"}}"></script>
+</head>
+<body>
+    <div class="container">
+        <div class="back-link">
+            <a href="{{$.Site.BasePath}}/">← Back to Home</a>
+        </div>
+
+        <div class="header">
+            <h1>Kind {{.Pointer.Kind}}: {{.Pointer.Identifier}}</h1>
+            <p><strong>naddr:</strong> {{.Naddr}}</p>
+            {{if .Npub}}<p><strong>Author:</strong> {{npubLink .Pointer.PublicKey}}</p>{{end}}
+        </div>
+
+        <div class="events-container">
+            {{with .Event}}
+            <div class="event">
+                <div class="event-header">
+                    <div class="event-header-left">
+                        <span class="event-timestamp">{{.GetFormattedDate}}</span>
+                        {{if .IsExpired}}<span class="expired-label">expired</span>{{end}}
+                        {{if .IsFutureDated}}<span class="warning-label">future-dated</span>{{end}}
+                    </div>
+                    <div class="event-actions">
+                        <button class="copy-btn" onclick="copyEventData(this)">Copy</button>
+                    </div>
+                </div>
+                <details open>
+                    <div class="event-content" {{if .ContentTruncated}}data-event-url="{{$.Site.BasePath}}/api/event/{{.ID}}"{{else}}data-content="{{.EventData}}"{{end}}><pre style="white-space: pre-wrap; word-break: break-all;">{{.Indented}}</pre></div>
+                    {{if .ContentTruncated}}<p class="content-truncated">Content truncated. <a href="{{$.Site.BasePath}}/api/event/{{.ID}}/download">Download</a> the event to see it in full.</p>{{end}}
+                </details>
+                <div class="event-id">{{.ID}}</div>
+            </div>
+            {{end}}
+        </div>
+        <footer>
+            <p>{{.Site.Title}} &copy; 2025</p>
+        </footer>
+    </div>
+</body>
+</html>
+`
+		t, err := template.New("naddr").Funcs(templateFuncs).Parse(tmpl)
+		if err != nil {
+			errorf(r.Context(), "Failed to parse naddr template: %v", err)
+			renderError(w, http.StatusInternalServerError, "Failed to render page.")
+			return
+		}
+
+		data := struct {
+			Site    siteInfo
+			Naddr   string
+			Npub    string
+			Pointer nostr.EntityPointer
+			Event   *Event
+		}{
+			Site:    site,
+			Naddr:   naddr,
+			Npub:    npub,
+			Pointer: pointer,
+			Event:   event,
+		}
+
+		err = t.Execute(w, data)
+		if err != nil {
+			errorf(r.Context(), "Failed to render naddr template: %v", err)
+			renderError(w, http.StatusInternalServerError, "Failed to render page.")
+			return
+		}
+	}
+}
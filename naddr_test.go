@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestNaddrHandlerEmbedsEventData(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	article := func(content string) nostr.Event {
+		ev := nostr.Event{Kind: 30023, Content: content, CreatedAt: 1700000000, Tags: nostr.Tags{{"d", "post"}}}
+		ev.Sign(sk)
+		return ev
+	}
+	naddr, err := nip19.EncodeEntity(pubkey, 30023, "post", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(limit int) { maxRenderContent = limit }(maxRenderContent)
+	maxRenderContent = 1024
+
+	tests := []struct {
+		name        string
+		event       nostr.Event
+		wantEmbed   bool
+		wantFetched bool
+	}{
+		{"small event is embedded", article("short"), true, false},
+		{"truncated event is fetched on copy", article(strings.Repeat("long ", 1000)), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(`FROM event_backup WHERE pubkey = \$1 AND event_kind = \$2`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(tt.event.ID, tt.event.PubKey, int64(tt.event.CreatedAt), tt.event.Kind, tt.event.String()))
+
+			rec := httptest.NewRecorder()
+			naddrHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/naddr/"+naddr, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "data-content="); got != tt.wantEmbed {
+				t.Errorf("data-content present = %v, want %v", got, tt.wantEmbed)
+			}
+			if got := strings.Contains(body, `data-event-url="/api/event/`+tt.event.ID+`"`); got != tt.wantFetched {
+				t.Errorf("data-event-url present = %v, want %v", got, tt.wantFetched)
+			}
+		})
+	}
+}
+
+func TestAddressQueryMatchesDTagExactly(t *testing.T) {
+	const pubkey = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	tagged := func(id string, tags ...nostr.Tag) string {
+		return (&nostr.Event{ID: id, PubKey: pubkey, Kind: 30023, Tags: tags}).String()
+	}
+	tests := []struct {
+		name       string
+		identifier string
+	}{
+		{"plain identifier", "post"},
+		{"json metacharacters", `a"b\c`},
+		{"sql wildcards", "100%_done"},
+		{"unicode", "日記-2024"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pointer := nostr.EntityPointer{PublicKey: pubkey, Kind: 30023, Identifier: tt.identifier}
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			// Corrupt rows and near misses come first and are skipped
+			mock.ExpectQuery(`FROM event_backup WHERE pubkey = \$1 AND event_kind = \$2 ORDER BY created_at DESC`).
+				WithArgs(pubkey, 30023).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow("e1", pubkey, int64(1700000400), 30023, `{"tags":[["d"`).
+					AddRow("e2", pubkey, int64(1700000300), 30023, nil).
+					AddRow("e3", pubkey, int64(1700000200), 30023, tagged("e3", nostr.Tag{"d", tt.identifier + "x"})).
+					AddRow("e4", pubkey, int64(1700000100), 30023, tagged("e4", nostr.Tag{"title", tt.identifier})).
+					AddRow("e5", pubkey, int64(1700000000), 30023, tagged("e5", nostr.Tag{"d", tt.identifier})))
+			event, err := queryEventByAddress(context.Background(), db, pointer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.ID != "e5" {
+				t.Errorf("matched %s, want e5", event.ID)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("no match", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		mock.ExpectQuery(`FROM event_backup`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+				AddRow("e1", pubkey, int64(1700000000), 30023, "not json"))
+		pointer := nostr.EntityPointer{PublicKey: pubkey, Kind: 30023, Identifier: "post"}
+		if _, err := queryEventByAddress(context.Background(), db, pointer); err != sql.ErrNoRows {
+			t.Errorf("error = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestNaddrToPointer(t *testing.T) {
+	const pubkey = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	article, _ := nip19.EncodeEntity(pubkey, 30023, "my-article", []string{"wss://relay.example"})
+	emptyID, _ := nip19.EncodeEntity(pubkey, 30023, "", nil)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	tests := []struct {
+		name    string
+		naddr   string
+		want    nostr.EntityPointer
+		wantErr bool
+	}{
+		{"article", article, nostr.EntityPointer{PublicKey: pubkey, Kind: 30023, Identifier: "my-article", Relays: []string{"wss://relay.example"}}, false},
+		{"empty identifier is incomplete", emptyID, nostr.EntityPointer{}, true},
+		{"npub", npub, nostr.EntityPointer{}, true},
+		{"bad checksum", article[:len(article)-1] + "q", nostr.EntityPointer{}, true},
+		{"empty", "", nostr.EntityPointer{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := naddrToPointer(tt.naddr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("naddrToPointer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.PublicKey != tt.want.PublicKey || got.Kind != tt.want.Kind || got.Identifier != tt.want.Identifier ||
+				strings.Join(got.Relays, ",") != strings.Join(tt.want.Relays, ",") {
+				t.Errorf("naddrToPointer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
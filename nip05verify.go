@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// nip05VerifyTimeout bounds NIP-05 verification so a slow domain cannot
+// hold up the page
+const nip05VerifyTimeout = 2 * time.Second
+
+// nip05CacheTTL is how long a NIP-05 lookup result is reused
+const nip05CacheTTL = time.Hour
+
+// NIP-05 verification results shown as a badge next to the identifier
+const (
+	nip05Verified    = "verified"
+	nip05Unverified  = "unverified"
+	nip05Unreachable = "unreachable"
+)
+
+type nip05Entry struct {
+	pubkey    string // pubkey listed for the name, "" if none
+	reachable bool
+	expires   time.Time
+}
+
+// nip05CacheSize is the maximum number of cached NIP-05 lookups
+const nip05CacheSize = 4096
+
+// nip05Cache caches NIP-05 lookups by lowercased name@domain
+var nip05Cache = newLRUCache[nip05Entry](nip05CacheSize)
+
+// lookupNip05 returns the pubkey the identifier's domain lists for the name
+func lookupNip05(ctx context.Context, identifier string) nip05Entry {
+	key := strings.ToLower(identifier)
+	entry, ok := nip05Cache.get(key)
+	if ok && time.Now().Before(entry.expires) {
+		return entry
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, nip05VerifyTimeout)
+	defer cancel()
+
+	entry = nip05Entry{}
+	pointer, err := queryNip05(ctx, key)
+	if err != nil {
+		logf(ctx, "Failed to verify NIP-05 %s: %v", identifier, err)
+		if ctx.Err() == context.Canceled {
+			// Don't remember failures caused by the request going away
+			return entry
+		}
+	} else {
+		entry.pubkey = pointer.PublicKey
+		entry.reachable = true
+	}
+
+	entry.expires = time.Now().Add(nip05CacheTTL)
+	nip05Cache.add(key, entry)
+	return entry
+}
+
+// verifyNip05 checks that identifier's domain lists pubkey, returning one
+// of nip05Verified, nip05Unverified, or nip05Unreachable
+func verifyNip05(ctx context.Context, identifier, pubkey string) string {
+	entry := lookupNip05(ctx, identifier)
+	switch {
+	case !entry.reachable:
+		return nip05Unreachable
+	case entry.pubkey == pubkey:
+		return nip05Verified
+	default:
+		return nip05Unverified
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyNip05(t *testing.T) {
+	const other = "fa984bd7dbb282f07e16e7ae87b26a2a7b9b90b7246a44771f0cf5ae58018f52"
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(c *lruCache[nip05Entry]) { nip05Cache = c }(nip05Cache)
+	nip05Cache = newLRUCache[nip05Entry](nip05CacheSize)
+
+	var lookups atomic.Int32
+	wellKnown := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if r.URL.Query().Get("name") == "slow" {
+			select {
+			case <-time.After(10 * time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{
+			"grace":   profilePagePubkey,
+			"mallory": other,
+		}})
+	}))
+	defer wellKnown.Close()
+	defer func(rt http.RoundTripper) { publicHTTPClient.Transport = rt }(publicHTTPClient.Transport)
+	publicHTTPClient.Transport = wellKnown.Client().Transport
+	domain := strings.TrimPrefix(wellKnown.URL, "https://")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name       string
+		identifier string
+		want       string
+	}{
+		{"matching", "grace@" + domain, nip05Verified},
+		{"matching ignoring case", "Grace@" + domain, nip05Verified},
+		{"listed for another pubkey", "mallory@" + domain, nip05Unverified},
+		{"not listed", "nobody@" + domain, nip05Unverified},
+		{"domain down", "grace@" + down, nip05Unreachable},
+		{"domain too slow", "slow@" + domain, nip05Unreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if got := verifyNip05(context.Background(), tt.identifier, profilePagePubkey); got != tt.want {
+				t.Errorf("verifyNip05(%s) = %q, want %q", tt.identifier, got, tt.want)
+			}
+			if d := time.Since(start); d > nip05VerifyTimeout+time.Second {
+				t.Errorf("verification took %v", d)
+			}
+		})
+	}
+
+	// Every result is cached, so asking again makes no requests
+	before := lookups.Load()
+	for _, tt := range tests {
+		verifyNip05(context.Background(), tt.identifier, profilePagePubkey)
+	}
+	if n := lookups.Load() - before; n != 0 {
+		t.Errorf("cached identifiers were looked up %d more times", n)
+	}
+
+	for identifier, badge := range map[string]string{
+		"grace@" + domain:   `<span class="nip05-badge verified">✓ verified</span>`,
+		"mallory@" + domain: `<span class="nip05-badge unverified">✗ unverified</span>`,
+		"grace@" + down:     `<span class="nip05-badge unreachable">? unreachable</span>`,
+	} {
+		if page := renderProfilePage(t, &UserProfile{Name: "grace", Nip05: identifier}); !strings.Contains(page, badge) {
+			t.Errorf("page for %s lacks the badge %s", identifier, badge)
+		}
+	}
+}
+
+func TestVerifyNip05RefusesPrivateDomains(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(c *lruCache[nip05Entry]) { nip05Cache = c }(nip05Cache)
+	nip05Cache = newLRUCache[nip05Entry](nip05CacheSize)
+
+	var reached atomic.Bool
+	internal := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Store(true)
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{"grace": profilePagePubkey}})
+	}))
+	defer internal.Close()
+
+	identifier := "grace@" + strings.TrimPrefix(internal.URL, "https://")
+	if got := verifyNip05(context.Background(), identifier, profilePagePubkey); got != nip05Unreachable {
+		t.Errorf("verifyNip05(%s) = %q, want %q", identifier, got, nip05Unreachable)
+	}
+	if reached.Load() {
+		t.Error("a profile's NIP-05 domain reached a loopback server")
+	}
+}
+
+func TestNip05CacheIsBounded(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(c *lruCache[nip05Entry]) { nip05Cache = c }(nip05Cache)
+	nip05Cache = newLRUCache[nip05Entry](2)
+
+	lookups := map[string]int{}
+	wellKnown := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups[r.URL.Query().Get("name")]++
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{}})
+	}))
+	defer wellKnown.Close()
+	defer func(rt http.RoundTripper) { publicHTTPClient.Transport = rt }(publicHTTPClient.Transport)
+	publicHTTPClient.Transport = wellKnown.Client().Transport
+	domain := strings.TrimPrefix(wellKnown.URL, "https://")
+
+	for _, name := range []string{"a", "b", "a", "c", "b"} {
+		lookupNip05(context.Background(), name+"@"+domain)
+	}
+	// b was evicted by c, while a was used more recently
+	if lookups["a"] != 1 || lookups["b"] != 2 || lookups["c"] != 1 {
+		t.Errorf("lookups = %v, want a once, b twice and c once", lookups)
+	}
+	if n := nip05Cache.order.Len(); n != 2 {
+		t.Errorf("cache holds %d entries, want 2", n)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// httpAuthKind is the kind of NIP-98 HTTP auth events
+const httpAuthKind = 27235
+
+// httpAuthWindow is how far the created_at of a NIP-98 auth event may be
+// from now
+const httpAuthWindow = 60 * time.Second
+
+// httpAuthPubkey verifies the NIP-98 "Authorization: Nostr <base64 event>"
+// header of r and returns the pubkey that signed it. The event must be
+// recent and name the method and URL of r, and a request with a body needs
+// a payload tag with its SHA-256, so that the header cannot be replayed
+// with another body.
+func httpAuthPubkey(r *http.Request, body []byte) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", errors.New("missing NIP-98 authorization")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", errors.New("authorization is not base64")
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return "", errors.New("authorization is not a nostr event")
+	}
+
+	if ev.Kind != httpAuthKind {
+		return "", errors.New("authorization event has the wrong kind")
+	}
+	if d := time.Since(ev.CreatedAt.Time()); d > httpAuthWindow || d < -httpAuthWindow {
+		return "", errors.New("authorization event is too old or too new")
+	}
+	if tag := ev.Tags.GetFirst([]string{"method"}); tag == nil || !strings.EqualFold(tag.Value(), r.Method) {
+		return "", errors.New("authorization event is for another method")
+	}
+	if tag := ev.Tags.GetFirst([]string{"u"}); tag == nil || !httpAuthURLMatches(tag.Value(), r) {
+		return "", errors.New("authorization event is for another URL")
+	}
+	if tag := ev.Tags.GetFirst([]string{"payload"}); tag != nil {
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold(tag.Value(), hex.EncodeToString(sum[:])) {
+			return "", errors.New("authorization event is for another body")
+		}
+	} else if len(body) > 0 {
+		return "", errors.New("authorization event has no payload tag")
+	}
+	if ok, err := ev.CheckSignature(); err != nil || !ok {
+		return "", errors.New("authorization event has an invalid signature")
+	}
+	return ev.PubKey, nil
+}
+
+// httpAuthURLMatches reports whether u names the request r. The scheme is
+// not compared, since TLS may be terminated by a proxy, whose
+// X-Forwarded-Host is used when it is trusted.
+func httpAuthURLMatches(u string, r *http.Request) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := r.Host
+	if remote, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(remote); ip != nil && isTrustedProxy(ip) && r.Header.Get("X-Forwarded-Host") != "" {
+			host = r.Header.Get("X-Forwarded-Host")
+		}
+	}
+	return strings.EqualFold(parsed.Host, host) &&
+		parsed.Path == site.BasePath+r.URL.Path &&
+		parsed.RawQuery == r.URL.RawQuery
+}
+
+// authorizeRequest returns the pubkey whose events r may act on, proven
+// with a NIP-98 Authorization header, or "" when r carries the admin token
+// and may act on anyone's. Otherwise it responds 401 and reports false.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, body []byte) (string, bool) {
+	if hasAdminToken(r) {
+		return "", true
+	}
+	pubkey, err := httpAuthPubkey(r, body)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Nostr")
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	return pubkey, true
+}
+
+// authorizeOwner is authorizeRequest for a request acting on the events
+// of pubkey alone, responding 403 when it is signed by anyone else
+func authorizeOwner(w http.ResponseWriter, r *http.Request, pubkey string, body []byte) bool {
+	signer, ok := authorizeRequest(w, r, body)
+	if !ok {
+		return false
+	}
+	if signer != "" && signer != pubkey {
+		http.Error(w, "Authorization is not signed by this npub", http.StatusForbidden)
+		return false
+	}
+	return true
+}
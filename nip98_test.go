@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip98Authorization returns a NIP-98 Authorization header value signed by
+// sk, after edit has had a chance to change the event before signing
+func nip98Authorization(sk, method, u string, body []byte, edit func(*nostr.Event)) string {
+	sum := sha256.Sum256(body)
+	ev := nostr.Event{
+		Kind:      httpAuthKind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", u}, {"method", method}, {"payload", hex.EncodeToString(sum[:])}},
+	}
+	if edit != nil {
+		edit(&ev)
+	}
+	ev.Sign(sk)
+	return "Nostr " + base64.StdEncoding.EncodeToString([]byte(ev.String()))
+}
+
+func TestHTTPAuthPubkey(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	body := []byte(`["` + strings.Repeat("a", 64) + `"]`)
+	const u = "https://restore.example/restore-selected?confirm=true"
+
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{"valid", nip98Authorization(sk, "POST", u, body, nil), ""},
+		{"method case ignored", nip98Authorization(sk, "post", u, body, nil), ""},
+		{"no payload tag", nip98Authorization(sk, "POST", u, body, func(ev *nostr.Event) { ev.Tags = ev.Tags[:2] }), "authorization event has no payload tag"},
+		{"missing", "", "missing NIP-98 authorization"},
+		{"bearer token", "Bearer secret", "missing NIP-98 authorization"},
+		{"not base64", "Nostr %%%", "authorization is not base64"},
+		{"not an event", "Nostr " + base64.StdEncoding.EncodeToString([]byte("[]")), "authorization is not a nostr event"},
+		{"wrong kind", nip98Authorization(sk, "POST", u, body, func(ev *nostr.Event) { ev.Kind = 1 }), "authorization event has the wrong kind"},
+		{"too old", nip98Authorization(sk, "POST", u, body, func(ev *nostr.Event) { ev.CreatedAt -= 120 }), "authorization event is too old or too new"},
+		{"too new", nip98Authorization(sk, "POST", u, body, func(ev *nostr.Event) { ev.CreatedAt += 120 }), "authorization event is too old or too new"},
+		{"other method", nip98Authorization(sk, "GET", u, body, nil), "authorization event is for another method"},
+		{"other path", nip98Authorization(sk, "POST", "https://restore.example/backup?confirm=true", body, nil), "authorization event is for another URL"},
+		{"other query", nip98Authorization(sk, "POST", "https://restore.example/restore-selected", body, nil), "authorization event is for another URL"},
+		{"other host", nip98Authorization(sk, "POST", "https://evil.example/restore-selected?confirm=true", body, nil), "authorization event is for another URL"},
+		{"other body", nip98Authorization(sk, "POST", u, []byte("[]"), nil), "authorization event is for another body"},
+		{
+			"bad signature",
+			func() string {
+				header := nip98Authorization(sk, "POST", u, body, nil)
+				raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Nostr "))
+				var ev nostr.Event
+				ev.UnmarshalJSON(raw)
+				ev.Sig = strings.Repeat("0", 128)
+				return "Nostr " + base64.StdEncoding.EncodeToString([]byte(ev.String()))
+			}(),
+			"authorization event has an invalid signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, u, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			got, err := httpAuthPubkey(r, body)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("httpAuthPubkey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != pubkey {
+				t.Fatalf("httpAuthPubkey() = %q, %v, want the signer", got, err)
+			}
+		})
+	}
+}
+
+func TestHTTPAuthPubkeyWithoutBody(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	const u = "https://restore.example/npub/npub1x/restore-all"
+
+	// Without a body there is nothing for a payload tag to bind
+	r := httptest.NewRequest(http.MethodPost, u, nil)
+	r.Header.Set("Authorization", nip98Authorization(sk, "POST", u, nil, func(ev *nostr.Event) { ev.Tags = ev.Tags[:2] }))
+	if got, err := httpAuthPubkey(r, nil); err != nil || got != pubkey {
+		t.Errorf("httpAuthPubkey() = %q, %v, want the signer", got, err)
+	}
+
+	// A header made for an empty body cannot carry one
+	r.Header.Set("Authorization", nip98Authorization(sk, "POST", u, nil, nil))
+	if _, err := httpAuthPubkey(r, []byte(`["`+strings.Repeat("b", 64)+`"]`)); err == nil || err.Error() != "authorization event is for another body" {
+		t.Errorf("httpAuthPubkey() with a new body error = %v", err)
+	}
+}
+
+func TestHTTPAuthURLMatchesBehindProxy(t *testing.T) {
+	defer func(s siteInfo) { site = s }(site)
+	site.BasePath = "/restore"
+
+	r := httptest.NewRequest(http.MethodPost, "http://10.0.0.5:8080/restore-selected", nil)
+	r.Header.Set("X-Forwarded-Host", "restore.example")
+	// The base path was stripped before the handler saw the request
+	const u = "https://restore.example/restore/restore-selected"
+
+	r.RemoteAddr = "203.0.113.9:4711"
+	if httpAuthURLMatches(u, r) {
+		t.Error("X-Forwarded-Host from an untrusted client was used")
+	}
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	trustedProxies = []*net.IPNet{loopback}
+	r.RemoteAddr = "127.0.0.1:4711"
+	if !httpAuthURLMatches(u, r) {
+		t.Error("URL signed for the public host and base path does not match behind the proxy")
+	}
+}
+
+func TestAuthorizeOwner(t *testing.T) {
+	owner := nostr.GeneratePrivateKey()
+	ownerPubkey, _ := nostr.GetPublicKey(owner)
+	adminToken = "owner-token"
+	defer func() { adminToken = "" }()
+	const u = "http://example.com/npub/x/restore-all"
+	body := []byte(`{}`)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantOK     bool
+		wantStatus int
+	}{
+		{"owner", nip98Authorization(owner, "POST", u, body, nil), true, http.StatusOK},
+		{"admin token", "Bearer owner-token", true, http.StatusOK},
+		{"someone else", nip98Authorization(nostr.GeneratePrivateKey(), "POST", u, body, nil), false, http.StatusForbidden},
+		{"wrong token", "Bearer guess", false, http.StatusUnauthorized},
+		{"expired signature", nip98Authorization(owner, "POST", u, body, func(ev *nostr.Event) {
+			ev.CreatedAt = nostr.Timestamp(time.Now().Add(-time.Hour).Unix())
+		}), false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, u, nil)
+			r.Header.Set("Authorization", tt.header)
+			rec := httptest.NewRecorder()
+			if got := authorizeOwner(rec, r, ownerPubkey, body); got != tt.wantOK {
+				t.Errorf("authorizeOwner() = %v, want %v", got, tt.wantOK)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Nostr" {
+				t.Error("401 does not ask for NIP-98 authentication")
+			}
+		})
+	}
+}
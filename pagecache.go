@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultPageCacheTTL is used when PAGE_CACHE_TTL is "true"
+const defaultPageCacheTTL = 30 * time.Second
+
+// maxPageCacheEntries bounds the number of cached pages
+const maxPageCacheEntries = 256
+
+// pageCacheTTL is how long rendered pages are reused; 0 disables the cache
+var pageCacheTTL time.Duration
+
+// pageCacheHeaders are the response headers replayed from the cache
+var pageCacheHeaders = []string{"Content-Type", "Content-Disposition", "Cache-Control", "ETag", "Last-Modified"}
+
+// configurePageCache reads PAGE_CACHE_TTL, which is either a duration or
+// "true" for the default TTL. An invalid value is fatal.
+func configurePageCache() {
+	v := os.Getenv("PAGE_CACHE_TTL")
+	if v == "true" {
+		pageCacheTTL = defaultPageCacheTTL
+	} else {
+		pageCacheTTL = durationFromEnv("PAGE_CACHE_TTL", 0)
+	}
+	if pageCacheTTL > 0 {
+		log.Printf("Page cache enabled with TTL %v", pageCacheTTL)
+	}
+}
+
+type cachedPage struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// pageCache holds rendered pages keyed by request URL
+type pageCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedPage
+	stats   cacheStats
+}
+
+var pages = &pageCache{entries: map[string]cachedPage{}}
+
+// get returns the cached page for key if it has not expired
+func (c *pageCache) get(key string) (cachedPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	page, ok := c.entries[key]
+	if !ok || time.Now().After(page.expires) {
+		delete(c.entries, key)
+		c.stats.miss()
+		return cachedPage{}, false
+	}
+	c.stats.hit()
+	return page, true
+}
+
+// set stores page for key, dropping expired entries when the cache is full.
+// The page is not stored if the cache is still full.
+func (c *pageCache) set(key string, page cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxPageCacheEntries {
+		now := time.Now()
+		for k, p := range c.entries {
+			if now.After(p.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxPageCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = page
+}
+
+// clear drops every cached page
+func (c *pageCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]cachedPage{}
+}
+
+// maxCachedPageSize is the largest response body kept in the page cache, so
+// that large pages and exports are streamed through without being buffered
+const maxCachedPageSize = 1 << 20
+
+// pageRecorder captures a response while passing it through
+type pageRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (pr *pageRecorder) WriteHeader(status int) {
+	if pr.status == 0 {
+		pr.status = status
+	}
+	pr.ResponseWriter.WriteHeader(status)
+}
+
+func (pr *pageRecorder) Write(b []byte) (int, error) {
+	if pr.status == 0 {
+		pr.status = http.StatusOK
+	}
+	if !pr.tooLarge {
+		if pr.body.Len()+len(b) > maxCachedPageSize {
+			pr.tooLarge = true
+			pr.body = bytes.Buffer{}
+		} else {
+			pr.body.Write(b)
+		}
+	}
+	return pr.ResponseWriter.Write(b)
+}
+
+// cachePages serves GET requests from the page cache when it is enabled,
+// caching successful responses of h
+func cachePages(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pageCacheTTL <= 0 || r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		if page, ok := pages.get(key); ok {
+			for name, values := range page.header {
+				w.Header()[name] = values
+			}
+			if etag := page.header.Get("ETag"); etag != "" && etagMatches(r, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write(page.body)
+			return
+		}
+
+		pr := &pageRecorder{ResponseWriter: w}
+		h.ServeHTTP(pr, r)
+		if pr.status != http.StatusOK || pr.tooLarge {
+			return
+		}
+
+		header := http.Header{}
+		for _, name := range pageCacheHeaders {
+			if v := w.Header().Values(name); len(v) > 0 {
+				header[http.CanonicalHeaderKey(name)] = v
+			}
+		}
+		pages.set(key, cachedPage{header: header, body: pr.body.Bytes(), expires: time.Now().Add(pageCacheTTL)})
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestCachePagesQueriesOnce(t *testing.T) {
+	const pubkey = "8f3ad2c1b9e07a6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "judy"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(ttl time.Duration) { pageCacheTTL = ttl }(pageCacheTTL)
+	pageCacheTTL = time.Minute
+	defer pages.clear()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	// The events are queried once; a second query would fail the page
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(strings.Repeat("1", 64), pubkey, int64(1700000000), 1, `{"id":"`+strings.Repeat("1", 64)+`","kind":1,"content":"cached note","tags":[]}`))
+
+	rendered := 0
+	page := npubHandler(&databases{primary: db})
+	h := cachePages(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rendered++
+		page(w, r)
+	}))
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "cached note") {
+			t.Fatalf("request %d: status = %d: %s", i+1, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("request %d: Content-Type = %q", i+1, ct)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if rendered != 1 {
+		t.Errorf("page was rendered %d times, want 1", rendered)
+	}
+	if bodies[0] != bodies[1] {
+		t.Error("cached page differs from the rendered one")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Another query string is another page
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/npub/"+npub+"?sort=recent", nil))
+	if rendered != 2 {
+		t.Errorf("page with another query string was rendered %d times in total, want 2", rendered)
+	}
+}
+
+func TestCachePages(t *testing.T) {
+	defer func(ttl time.Duration) { pageCacheTTL = ttl }(pageCacheTTL)
+	defer pages.clear()
+
+	tests := []struct {
+		name         string
+		ttl          time.Duration
+		method       string
+		status       int
+		wantRendered int
+	}{
+		{"disabled", 0, http.MethodGet, http.StatusOK, 2},
+		{"cached", time.Minute, http.MethodGet, http.StatusOK, 1},
+		{"expired", time.Nanosecond, http.MethodGet, http.StatusOK, 2},
+		{"errors are not cached", time.Minute, http.MethodGet, http.StatusInternalServerError, 2},
+		{"posts are not cached", time.Minute, http.MethodPost, http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages.clear()
+			pageCacheTTL = tt.ttl
+			rendered := 0
+			h := cachePages(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rendered++
+				w.WriteHeader(tt.status)
+				io.WriteString(w, "page")
+			}))
+			for i := 0; i < 2; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, "/npub/x", nil))
+				time.Sleep(time.Millisecond)
+			}
+			if rendered != tt.wantRendered {
+				t.Errorf("rendered %d times, want %d", rendered, tt.wantRendered)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxPerPage caps the user-supplied page size
+const maxPerPage = 500
+
+// maxEventsPerRequest caps how many events a single listing loads, whatever
+// the pagination parameters
+var maxEventsPerRequest = 2000
+
+// listOptions controls the ordering and pagination of an event listing
+type listOptions struct {
+	Sort    string
+	PerPage int    // page size; 0 lists everything
+	Page    int    // 1-based page for offset pagination
+	Before  string // keyset cursor taken from the previous page
+
+	// Contains keeps only events whose content includes the term, ignoring
+	// case
+	Contains string
+
+	// Uncapped skips maxEventsPerRequest. The dump command sets it, as do
+	// exports and restore-all, which stream or batch the events instead.
+	Uncapped bool
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// parseListOptions reads sort, per_page, page, before, and contains from the
+// query string
+func parseListOptions(r *http.Request) (listOptions, error) {
+	q := r.URL.Query()
+	opts := listOptions{Sort: q.Get("sort"), Before: q.Get("before"), Contains: strings.TrimSpace(q.Get("contains"))}
+
+	if v := q.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid per_page %q", v)
+		}
+		opts.PerPage = min(n, maxPerPage, maxEventsPerRequest)
+	}
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid page %q", v)
+		}
+		opts.Page = n
+	}
+
+	// Paginating without an explicit page size uses the maximum
+	if opts.PerPage == 0 && (opts.Page > 0 || opts.Before != "") {
+		opts.PerPage = min(maxPerPage, maxEventsPerRequest)
+	}
+	if opts.Before != "" {
+		if _, err := parseCursor(opts.Before, opts.Sort); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// eventCursor identifies the position of an event in a listing
+type eventCursor struct {
+	Kind      int
+	CreatedAt int64
+	ID        string
+}
+
+// encodeCursor returns the cursor for the position after event. The kind is
+// only part of the cursor for the grouped ordering.
+func encodeCursor(event Event, sort string) string {
+	if sort == "recent" {
+		return fmt.Sprintf("%d.%s", event.CreatedAt, event.ID)
+	}
+	return fmt.Sprintf("%d.%d.%s", event.Kind, event.CreatedAt, event.ID)
+}
+
+// parseCursor decodes a cursor produced by encodeCursor
+func parseCursor(s, sort string) (eventCursor, error) {
+	var c eventCursor
+	parts := strings.Split(s, ".")
+	if sort != "recent" {
+		if len(parts) != 3 {
+			return c, fmt.Errorf("invalid cursor %q", s)
+		}
+		kind, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return c, fmt.Errorf("invalid cursor %q", s)
+		}
+		c.Kind = kind
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || !eventIDPattern.MatchString(parts[1]) {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	c.CreatedAt = createdAt
+	c.ID = parts[1]
+	return c, nil
+}
+
+// buildEventsQuery builds the query listing a pubkey's events. An
+// unpaginated listing fetches one event beyond the cap so truncation can be
+// detected.
+func buildEventsQuery(pubkey string, opts listOptions) (string, []any, error) {
+	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE pubkey = $1`
+	args := []any{pubkey}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// Matching the decoded content keeps tags and escapes from matching,
+	// so pages are never shortened by filtering afterwards. Rows that are
+	// not valid JSON are never cast, as one would fail the whole listing;
+	// pg_input_is_valid needs PostgreSQL 16.
+	if opts.Contains != "" {
+		query += ` AND CASE WHEN pg_input_is_valid(event_data, 'jsonb') THEN event_data::jsonb->>'content' END ILIKE ` + arg("%"+likeEscaper.Replace(opts.Contains)+"%")
+	}
+	if opts.PerPage == 0 && opts.Uncapped {
+		return query + " " + eventOrderBy(opts.Sort), args, nil
+	}
+
+	limit := opts.PerPage
+	if limit == 0 {
+		limit = maxEventsPerRequest + 1
+	} else if !opts.Uncapped {
+		limit = min(limit, maxEventsPerRequest)
+	}
+
+	if opts.Before != "" {
+		c, err := parseCursor(opts.Before, opts.Sort)
+		if err != nil {
+			return "", nil, err
+		}
+		if opts.Sort == "recent" {
+			query += fmt.Sprintf(` AND (created_at, id) < (%s, %s)`, arg(c.CreatedAt), arg(c.ID))
+		} else {
+			kind := arg(c.Kind)
+			query += fmt.Sprintf(` AND (event_kind > %s OR (event_kind = %s AND (created_at, id) < (%s, %s)))`, kind, kind, arg(c.CreatedAt), arg(c.ID))
+		}
+	}
+
+	query += " " + eventOrderBy(opts.Sort)
+	query += fmt.Sprintf(" LIMIT %d", limit)
+	if opts.Before == "" && opts.Page > 1 {
+		query += fmt.Sprintf(" OFFSET %d", (opts.Page-1)*opts.PerPage)
+	}
+	return query, args, nil
+}
+
+// nextCursor returns the cursor of the page following events, or "" when
+// the listing is not paginated or this was the last page
+func nextCursor(events []Event, opts listOptions) string {
+	if opts.PerPage == 0 || len(events) < opts.PerPage {
+		return ""
+	}
+	return encodeCursor(events[len(events)-1], opts.Sort)
+}
+
+// pageURL returns the current URL's query string with key set to value
+// and the given keys removed
+func pageURL(r *http.Request, key, value string, remove ...string) string {
+	q := url.Values{}
+	for k, v := range r.URL.Query() {
+		q[k] = v
+	}
+	for _, k := range remove {
+		q.Del(k)
+	}
+	q.Set(key, value)
+	return "?" + q.Encode()
+}
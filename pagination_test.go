@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuildEventsQuery(t *testing.T) {
+	const pubkey = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	const id = "4376c65d2f232afbe9b882a35baa4f6fe8667c4e684749af565f981833ed6a65"
+	tests := []struct {
+		name     string
+		opts     listOptions
+		contains []string
+		absent   []string
+		args     []any
+	}{
+		{
+			name:     "default capped",
+			opts:     listOptions{},
+			contains: []string{"WHERE pubkey = $1", "LIMIT 2001"},
+			absent:   []string{"ILIKE", "OFFSET"},
+			args:     []any{pubkey},
+		},
+		{
+			name:     "contains matches decoded content only",
+			opts:     listOptions{Contains: "50%_off"},
+			contains: []string{`AND CASE WHEN pg_input_is_valid(event_data, 'jsonb') THEN event_data::jsonb->>'content' END ILIKE $2`},
+			args:     []any{pubkey, `%50\%\_off%`},
+		},
+		{
+			name:     "offset page",
+			opts:     listOptions{PerPage: 20, Page: 3},
+			contains: []string{"LIMIT 20", "OFFSET 40"},
+			args:     []any{pubkey},
+		},
+		{
+			name:     "recent cursor",
+			opts:     listOptions{Sort: "recent", PerPage: 20, Before: "1700000000." + id},
+			contains: []string{"AND (created_at, id) < ($2, $3)", "LIMIT 20"},
+			absent:   []string{"OFFSET"},
+			args:     []any{pubkey, int64(1700000000), id},
+		},
+		{
+			name:     "contains before cursor",
+			opts:     listOptions{Sort: "recent", PerPage: 5, Before: "1700000000." + id, Contains: "gm"},
+			contains: []string{"ILIKE $2", "(created_at, id) < ($3, $4)"},
+			args:     []any{pubkey, "%gm%", int64(1700000000), id},
+		},
+		{
+			name:   "uncapped dump",
+			opts:   listOptions{Uncapped: true},
+			absent: []string{"LIMIT", "OFFSET"},
+			args:   []any{pubkey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := buildEventsQuery(pubkey, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(query, s) {
+					t.Errorf("query %q does not contain %q", query, s)
+				}
+			}
+			for _, s := range tt.absent {
+				if strings.Contains(query, s) {
+					t.Errorf("query %q contains %q", query, s)
+				}
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestBuildEventsQueryInvalidCursor(t *testing.T) {
+	if _, _, err := buildEventsQuery("ab", listOptions{Sort: "recent", PerPage: 5, Before: "nope"}); err == nil {
+		t.Fatal("expected an error for an invalid cursor")
+	}
+}
+
+func TestPageURLKeepsQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		key    string
+		value  string
+		remove []string
+		want   url.Values
+	}{
+		{"show dms keeps the filters", "/npub1x?kinds=1&contains=gm&sort=recent", "show_dms", "1", nil,
+			url.Values{"kinds": {"1"}, "contains": {"gm"}, "sort": {"recent"}, "show_dms": {"1"}}},
+		{"repeated values survive", "/npub1x?kinds=1&kinds=7", "view", "compact", nil,
+			url.Values{"kinds": {"1", "7"}, "view": {"compact"}}},
+		{"existing value is replaced", "/npub1x?page=2", "page", "3", nil,
+			url.Values{"page": {"3"}}},
+		{"removed keys are dropped", "/npub1x?page=4&kinds=1", "before", "1700000000.ab", []string{"page"},
+			url.Values{"kinds": {"1"}, "before": {"1700000000.ab"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pageURL(httptest.NewRequest("GET", tt.target, nil), tt.key, tt.value, tt.remove...)
+			if !strings.HasPrefix(got, "?") {
+				t.Fatalf("pageURL = %q, want a relative query", got)
+			}
+			values, err := url.ParseQuery(got[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("pageURL = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+// pageAfter returns the page of events, sorted as the listing is, that the
+// query of opts selects. It evaluates the keyset condition of
+// buildEventsQuery with the arguments it binds, as the database would.
+func pageAfter(t *testing.T, events []Event, opts listOptions) []Event {
+	t.Helper()
+	query, args, err := buildEventsQuery("ab", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page []Event
+	for _, e := range events {
+		if opts.Before != "" {
+			var after bool
+			if opts.Sort == "recent" {
+				createdAt, id := args[1].(int64), args[2].(string)
+				after = e.CreatedAt < createdAt || (e.CreatedAt == createdAt && e.ID < id)
+			} else {
+				kind, createdAt, id := args[1].(int), args[2].(int64), args[3].(string)
+				after = e.Kind > kind || (e.Kind == kind && (e.CreatedAt < createdAt || (e.CreatedAt == createdAt && e.ID < id)))
+			}
+			if !after {
+				continue
+			}
+		}
+		page = append(page, e)
+	}
+	if !strings.Contains(query, fmt.Sprintf("LIMIT %d", opts.PerPage)) {
+		t.Fatalf("query %q is not limited to the page size", query)
+	}
+	return page[:min(len(page), opts.PerPage)]
+}
+
+func TestCursorPagesCoverEveryEventOnce(t *testing.T) {
+	// Events share kinds and timestamps so that only the tiebreakers keep
+	// pages apart
+	var events []Event
+	for i := 0; i < 23; i++ {
+		events = append(events, Event{
+			ID:        fmt.Sprintf("%064x", (i*7919)%101),
+			Kind:      []int{0, 1, 1, 7}[i%4],
+			CreatedAt: 1700000000 + int64(i/3),
+		})
+	}
+
+	for _, sortBy := range []string{"", "recent"} {
+		sorted := append([]Event{}, events...)
+		sort.Slice(sorted, func(i, j int) bool {
+			a, b := sorted[i], sorted[j]
+			if sortBy != "recent" && a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+			if a.CreatedAt != b.CreatedAt {
+				return a.CreatedAt > b.CreatedAt
+			}
+			return a.ID > b.ID
+		})
+
+		for _, perPage := range []int{1, 4, 5, 23, 50} {
+			t.Run(fmt.Sprintf("sort %q per page %d", sortBy, perPage), func(t *testing.T) {
+				opts := listOptions{Sort: sortBy, PerPage: perPage}
+				var listed []Event
+				for pages := 0; ; pages++ {
+					if pages > len(sorted) {
+						t.Fatal("pagination does not end")
+					}
+					page := pageAfter(t, sorted, opts)
+					listed = append(listed, page...)
+					opts.Before = nextCursor(page, opts)
+					if opts.Before == "" {
+						break
+					}
+					if _, err := parseCursor(opts.Before, sortBy); err != nil {
+						t.Fatalf("next cursor %q does not parse: %v", opts.Before, err)
+					}
+				}
+				if !reflect.DeepEqual(listed, sorted) {
+					t.Errorf("pages listed %d events, overlapping or skipping some of the %d", len(listed), len(sorted))
+				}
+			})
+		}
+	}
+}
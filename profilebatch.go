@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newestByAuthor returns the newest event of each wanted author among
+// events, ignoring events from anyone else
+func newestByAuthor(events []*nostr.Event, wanted map[string]bool) map[string]*nostr.Event {
+	newest := map[string]*nostr.Event{}
+	for _, ev := range events {
+		if !wanted[ev.PubKey] {
+			continue
+		}
+		if current, ok := newest[ev.PubKey]; !ok || ev.CreatedAt > current.CreatedAt {
+			newest[ev.PubKey] = ev
+		}
+	}
+	return newest
+}
+
+// fetchProfilesFromRelays fetches the kind-0 profiles of several pubkeys
+// with one subscription per relay listing them all as authors, instead of
+// one per pubkey. Relays are tried in order of health until every profile
+// is found. Pubkeys without a profile on any relay are left out.
+func fetchProfilesFromRelays(ctx context.Context, pubkeys []string) map[string]*UserProfile {
+	result := map[string]*UserProfile{}
+	if relayFetchDisabled || len(pubkeys) == 0 {
+		return result
+	}
+
+	pending := map[string]bool{}
+	for _, pubkey := range pubkeys {
+		pending[pubkey] = true
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+
+	relays := profileRelays(nil)
+	debugf(ctx, "Attempting to fetch %d profiles from %d relays", len(pending), len(relays))
+	for _, url := range relays {
+		if len(pending) == 0 {
+			break
+		}
+		authors := make([]string, 0, len(pending))
+		for pubkey := range pending {
+			authors = append(authors, pubkey)
+		}
+		filter := nostr.Filter{Authors: authors, Kinds: []int{0}}
+
+		start := time.Now()
+		relayCtx, cancelRelay := context.WithTimeout(ctx, profileWait)
+		events, err := queryRelay(relayCtx, url, filter)
+		cancelRelay()
+		if ctx.Err() == nil {
+			relayHealth.record(url, err, time.Since(start))
+		}
+		if err != nil {
+			debugf(ctx, "Failed to query relay %s: %v", url, err)
+			continue
+		}
+
+		for pubkey, ev := range newestByAuthor(events, pending) {
+			var profile UserProfile
+			if err := json.Unmarshal([]byte(ev.Content), &profile); err != nil {
+				logf(ctx, "Failed to unmarshal profile of %s from %s: %v", pubkey, url, err)
+				profile = UserProfile{}
+			} else {
+				profile.SourceRelay = url
+				profile.RawContent = ev.Content
+			}
+			result[pubkey] = &profile
+			delete(pending, pubkey)
+		}
+	}
+	// The gateway has no batch lookup, so the rest are fetched one by one
+	if profileGatewayURL != "" {
+		for pubkey := range pending {
+			if parent.Err() != nil {
+				break
+			}
+			profile, err := fetchProfileFromGateway(parent, pubkey)
+			if err != nil {
+				debugf(ctx, "Failed to fetch profile for %s from gateway: %v", pubkey, err)
+				continue
+			}
+			result[pubkey] = profile
+		}
+	}
+	debugf(ctx, "Batched profile fetch found %d of %d profiles", len(result), len(pubkeys))
+	return result
+}
+
+// getProfiles returns the profiles of several pubkeys like getProfile, but
+// fetches the uncached ones from relays in a single batch. The users' own
+// NIP-65 relays are not consulted, since each would need its own round trip.
+func getProfiles(ctx context.Context, db *sql.DB, pubkeys []string) map[string]*UserProfile {
+	result := map[string]*UserProfile{}
+	var missing []string
+	for _, pubkey := range pubkeys {
+		if profile, ok := profiles.get(pubkey); ok {
+			result[pubkey] = profile
+		} else {
+			missing = append(missing, pubkey)
+		}
+	}
+	if len(missing) == 0 {
+		return result
+	}
+
+	fetched := fetchProfilesFromRelays(ctx, missing)
+	for _, pubkey := range missing {
+		profile, ok := fetched[pubkey]
+		if !ok {
+			profile = &UserProfile{}
+		}
+		profile = withStoredProfile(ctx, db, pubkey, profile)
+		result[pubkey] = profile
+		// Don't cache a profile that may be incomplete because the request was cancelled
+		if ctx.Err() == nil {
+			profiles.set(pubkey, profile)
+		}
+	}
+	return result
+}
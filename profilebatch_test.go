@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// profileRelay starts a relay answering kind-0 subscriptions with those of
+// profiles whose author was asked for, and records the authors of each
+// subscription
+func profileRelay(tb testing.TB, profiles ...nostr.Event) (*mockRelay, func() [][]string) {
+	var mu sync.Mutex
+	var asked [][]string
+	relay := newMockRelay(tb, "", func(reply func(string), msg []byte) {
+		req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope)
+		if !ok {
+			return
+		}
+		authors := append([]string{}, req.Filters[0].Authors...)
+		sort.Strings(authors)
+		mu.Lock()
+		asked = append(asked, authors)
+		mu.Unlock()
+		for _, ev := range profiles {
+			if req.Filters.Match(&ev) {
+				reply(eventMessage(req.SubscriptionID, ev))
+			}
+		}
+		reply(`["EOSE","` + req.SubscriptionID + `"]`)
+	})
+	return relay, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return asked
+	}
+}
+
+// metadataEvent returns a kind-0 event of sk naming the author name
+func metadataEvent(sk, name string, createdAt nostr.Timestamp) nostr.Event {
+	ev := nostr.Event{Kind: 0, Content: fmt.Sprintf(`{"name":%q}`, name), CreatedAt: createdAt, Tags: nostr.Tags{}}
+	ev.Sign(sk)
+	return ev
+}
+
+func TestNewestByAuthor(t *testing.T) {
+	older := &nostr.Event{ID: "older", PubKey: "alice", CreatedAt: 100}
+	newer := &nostr.Event{ID: "newer", PubKey: "alice", CreatedAt: 200}
+	bob := &nostr.Event{ID: "bob", PubKey: "bob", CreatedAt: 150}
+	stranger := &nostr.Event{ID: "stranger", PubKey: "mallory", CreatedAt: 300}
+	wanted := map[string]bool{"alice": true, "bob": true, "carol": true}
+
+	tests := []struct {
+		name   string
+		events []*nostr.Event
+		want   map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{"newer first", []*nostr.Event{newer, older}, map[string]string{"alice": "newer"}},
+		{"older after newer", []*nostr.Event{older, newer}, map[string]string{"alice": "newer"}},
+		{"several authors", []*nostr.Event{bob, older}, map[string]string{"alice": "older", "bob": "bob"}},
+		{"unwanted authors are ignored", []*nostr.Event{stranger, bob}, map[string]string{"bob": "bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for pubkey, ev := range newestByAuthor(tt.events, wanted) {
+				got[pubkey] = ev.ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("newestByAuthor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchProfilesFromRelays(t *testing.T) {
+	var keys, pubkeys []string
+	for i := 0; i < 5; i++ {
+		sk := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(sk)
+		keys, pubkeys = append(keys, sk), append(pubkeys, pubkey)
+	}
+	// The last key is a stranger's, who is never asked for
+	asked := pubkeys[:4]
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	relays, timeout, wait, gateway, health := readRelays, relayTimeout, profileWait, profileGatewayURL, relayHealth
+	t.Cleanup(func() {
+		readRelays, relayTimeout, profileWait, profileGatewayURL, relayHealth = relays, timeout, wait, gateway, health
+	})
+	readRelays, relayTimeout, profileWait, profileGatewayURL = nil, 10*time.Second, 5*time.Second, ""
+	relayHealth = &relayStats{stats: map[string]*relayStat{}}
+
+	first, firstAsked := profileRelay(t,
+		metadataEvent(keys[0], "ash (old)", 1700000000),
+		metadataEvent(keys[0], "ash", 1700000100),
+		metadataEvent(keys[1], "birch", 1700000000),
+		metadataEvent(keys[4], "mallory", 1700000000),
+	)
+	second, secondAsked := profileRelay(t,
+		metadataEvent(keys[1], "birch from the second relay", 1700000200),
+		metadataEvent(keys[2], "cedar", 1700000000),
+	)
+
+	got := fetchProfilesFromRelays(context.Background(), asked)
+	names := map[string]string{}
+	for pubkey, profile := range got {
+		names[pubkey] = profile.Name
+	}
+	want := map[string]string{pubkeys[0]: "ash", pubkeys[1]: "birch", pubkeys[2]: "cedar"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("profiles = %v, want %v", names, want)
+	}
+	if src := got[pubkeys[2]]; src != nil && src.SourceRelay != second.url {
+		t.Errorf("cedar's profile came from %s, want %s", src.SourceRelay, second.url)
+	}
+
+	// One subscription per relay, the second asking only for those still missing
+	sortedAsked := append([]string{}, asked...)
+	sort.Strings(sortedAsked)
+	stillMissing := []string{pubkeys[2], pubkeys[3]}
+	sort.Strings(stillMissing)
+	if got := firstAsked(); len(got) != 1 || strings.Join(got[0], ",") != strings.Join(sortedAsked, ",") {
+		t.Errorf("first relay was asked for %v, want one subscription for %v", got, sortedAsked)
+	}
+	if got := secondAsked(); len(got) != 1 || strings.Join(got[0], ",") != strings.Join(stillMissing, ",") {
+		t.Errorf("second relay was asked for %v, want one subscription for %v", got, stillMissing)
+	}
+	if first.connections() != 1 || second.connections() != 1 {
+		t.Errorf("relays accepted %d and %d connections, want 1 each", first.connections(), second.connections())
+	}
+}
+
+func BenchmarkProfileFetch(b *testing.B) {
+	const authors = 20
+	var pubkeys []string
+	var events []nostr.Event
+	for i := 0; i < authors; i++ {
+		sk := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(sk)
+		pubkeys = append(pubkeys, pubkey)
+		events = append(events, metadataEvent(sk, fmt.Sprintf("author %d", i), 1700000000))
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	relays, timeout, wait, gateway := readRelays, relayTimeout, profileWait, profileGatewayURL
+	b.Cleanup(func() { readRelays, relayTimeout, profileWait, profileGatewayURL = relays, timeout, wait, gateway })
+	readRelays, relayTimeout, profileWait, profileGatewayURL = nil, 10*time.Second, 5*time.Second, ""
+	profileRelay(b, events...)
+	ctx := context.Background()
+
+	b.Run("per author", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pubkey := range pubkeys {
+				if profile, err := fetchProfileFromRelays(ctx, pubkey, nil); err != nil || profile.Name == "" {
+					b.Fatalf("fetchProfileFromRelays(%s) = %+v, %v", pubkey, profile, err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if got := fetchProfilesFromRelays(ctx, pubkeys); len(got) != authors {
+				b.Fatalf("fetchProfilesFromRelays() found %d profiles, want %d", len(got), authors)
+			}
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testProxy is a local proxy recording the addresses it tunnels to
+type testProxy struct {
+	addr string
+
+	mu      sync.Mutex
+	tunnels []string
+	auth    []string
+}
+
+func (p *testProxy) record(target, auth string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tunnels = append(p.tunnels, target)
+	p.auth = append(p.auth, auth)
+}
+
+// serveProxy accepts connections on a local port, handing each to handle
+func serveProxy(t *testing.T, handle func(p *testProxy, conn net.Conn)) *testProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &testProxy{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(p, conn)
+			}()
+		}
+	}()
+	return p
+}
+
+// tunnel copies between client and a new connection to target until either
+// side closes
+func tunnel(client io.ReadWriter, target string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, client)
+	io.Copy(client, upstream)
+}
+
+// httpConnectProxy answers HTTP CONNECT requests, requiring the
+// Proxy-Authorization value auth when it is set
+func httpConnectProxy(auth string) func(p *testProxy, conn net.Conn) {
+	return func(p *testProxy, conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		p.record(req.Host, req.Header.Get("Proxy-Authorization"))
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tunnel(struct {
+			io.Reader
+			io.Writer
+		}{br, conn}, req.Host)
+	}
+}
+
+// socks5Proxy answers unauthenticated SOCKS5 CONNECT requests
+func socks5Proxy(p *testProxy, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(br, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(br, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	p.record(target, "")
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	tunnel(struct {
+		io.Reader
+		io.Writer
+	}{br, conn}, target)
+}
+
+func TestRelayConnectionsUseProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		user     *url.Userinfo
+		handle   func(p *testProxy, conn net.Conn)
+		wantAuth string
+		wantErr  bool
+	}{
+		{name: "http connect", scheme: "http", handle: httpConnectProxy("")},
+		{
+			name: "http connect with credentials", scheme: "http", user: url.UserPassword("relay", "p@ss"),
+			handle: httpConnectProxy("Basic cmVsYXk6cEBzcw=="), wantAuth: "Basic cmVsYXk6cEBzcw==",
+		},
+		{name: "http proxy refusing the tunnel", scheme: "http", handle: httpConnectProxy("Basic secret"), wantErr: true},
+		{name: "socks5", scheme: "socks5", handle: socks5Proxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+					reply(`["EOSE","` + req.SubscriptionID + `"]`)
+				}
+			})
+			proxy := serveProxy(t, tt.handle)
+			dial, err := proxyDialer(&url.URL{Scheme: tt.scheme, Host: proxy.addr, User: tt.user})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func(d netDialFunc) { relayNetDial = d }(relayNetDial)
+			relayNetDial = dial
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialRelay(ctx, relay.url)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dialRelay() through a refusing proxy succeeded")
+				}
+				if relay.connections() != 0 {
+					t.Error("relay was reached despite the refusal")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.query(ctx, nostr.Filter{Kinds: []int{0}}); err != nil {
+				t.Fatalf("query() through the proxy: %v", err)
+			}
+
+			relayHost := strings.TrimPrefix(relay.url, "ws://")
+			proxy.mu.Lock()
+			defer proxy.mu.Unlock()
+			if len(proxy.tunnels) != 1 || proxy.tunnels[0] != relayHost {
+				t.Errorf("proxy tunnels = %q, want [%s]", proxy.tunnels, relayHost)
+			}
+			if proxy.auth[0] != tt.wantAuth {
+				t.Errorf("Proxy-Authorization = %q, want %q", proxy.auth[0], tt.wantAuth)
+			}
+			if relay.connections() != 1 {
+				t.Errorf("relay accepted %d connections, want 1", relay.connections())
+			}
+		})
+	}
+}
+
+func TestProxyAddr(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  string
+	}{
+		{"http://proxy.example", "proxy.example:80"},
+		{"https://proxy.example", "proxy.example:443"},
+		{"socks5://127.0.0.1", "127.0.0.1:1080"},
+		{"socks5://[::1]", "[::1]:1080"},
+		{"http://proxy.example:3128", "proxy.example:3128"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.proxy)
+		if got := proxyAddr(u); got != tt.want {
+			t.Errorf("proxyAddr(%s) = %q, want %q", tt.proxy, got, tt.want)
+		}
+	}
+}
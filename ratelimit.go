@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimitClients is how many clients a rateLimiter tracks before it
+// forgets those whose window has passed
+const maxRateLimitClients = 10000
+
+// rateLimiter allows each client a number of requests per fixed window
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	clients map[string]*rateWindow
+}
+
+// rateWindow counts the requests of one client since start
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, clients: map[string]*rateWindow{}}
+}
+
+// allow reports whether client may make another request at now, counting it
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.clients[client]
+	if !ok || now.Sub(w.start) >= l.window {
+		if !ok && len(l.clients) >= maxRateLimitClients {
+			for c, w := range l.clients {
+				if now.Sub(w.start) >= l.window {
+					delete(l.clients, c)
+				}
+			}
+		}
+		l.clients[client] = &rateWindow{start: now, count: 1}
+		return true
+	}
+	if w.count >= l.limit {
+		return false
+	}
+	w.count++
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type request struct {
+		client string
+		after  time.Duration
+		want   bool
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{
+			name: "limit within a window",
+			requests: []request{
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", time.Second, true},
+				{"198.51.100.1", 2 * time.Second, true},
+				{"198.51.100.1", 3 * time.Second, false},
+			},
+		},
+		{
+			name: "clients are counted separately",
+			requests: []request{
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", 0, true},
+				{"198.51.100.2", 0, true},
+				{"198.51.100.1", 0, false},
+			},
+		},
+		{
+			name: "a new window starts once the last has passed",
+			requests: []request{
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", 0, true},
+				{"198.51.100.1", 59 * time.Second, false},
+				{"198.51.100.1", time.Minute, true},
+				{"198.51.100.1", time.Minute, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(3, time.Minute)
+			for i, r := range tt.requests {
+				if got := l.allow(r.client, start.Add(r.after)); got != r.want {
+					t.Errorf("request %d of %s at +%v allowed = %v, want %v", i, r.client, r.after, got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterForgetsExpiredClients(t *testing.T) {
+	l := newRateLimiter(1, time.Minute)
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < maxRateLimitClients; i++ {
+		l.allow(fmt.Sprintf("client-%d", i), start)
+	}
+	if !l.allow("newcomer", start.Add(2*time.Minute)) {
+		t.Fatal("newcomer refused")
+	}
+	if len(l.clients) != 1 {
+		t.Errorf("limiter tracks %d clients, want only the newcomer", len(l.clients))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+)
+
+// ReactionCount is the number of reactions with the same content
+type ReactionCount struct {
+	Emoji string
+	Count int
+}
+
+// ReactionGroup summarizes the reactions to a single target event
+type ReactionGroup struct {
+	Target string
+	Count  int
+	Emojis []ReactionCount
+}
+
+// reactionTarget returns the id of the event a kind-7 reaction targets,
+// which NIP-25 specifies as the last "e" tag
+func reactionTarget(event Event) string {
+	ev, err := event.parse()
+	if err != nil {
+		return ""
+	}
+	target := ""
+	for _, tag := range ev.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			target = tag[1]
+		}
+	}
+	return target
+}
+
+// reactionEmoji returns the displayed content of a reaction; an empty
+// reaction counts as a like ("+")
+func reactionEmoji(event Event) string {
+	ev, err := event.parse()
+	if err != nil || ev.Content == "" {
+		return "+"
+	}
+	return ev.Content
+}
+
+// groupReactions summarizes the kind-7 reactions with a target per target,
+// most reacted first, and returns the other events in a new slice. Within
+// a group, the most frequent reactions come first.
+func groupReactions(events []Event) ([]ReactionGroup, []Event) {
+	byTarget := map[string]map[string]int{}
+	totals := map[string]int{}
+	var rest []Event
+	for _, event := range events {
+		target := ""
+		if event.Kind == 7 {
+			target = reactionTarget(event)
+		}
+		if target == "" {
+			rest = append(rest, event)
+			continue
+		}
+		if byTarget[target] == nil {
+			byTarget[target] = map[string]int{}
+		}
+		byTarget[target][reactionEmoji(event)]++
+		totals[target]++
+	}
+
+	groups := make([]ReactionGroup, 0, len(byTarget))
+	for target, emojis := range byTarget {
+		group := ReactionGroup{Target: target, Count: totals[target]}
+		for emoji, count := range emojis {
+			group.Emojis = append(group.Emojis, ReactionCount{Emoji: emoji, Count: count})
+		}
+		sort.Slice(group.Emojis, func(i, j int) bool {
+			if group.Emojis[i].Count != group.Emojis[j].Count {
+				return group.Emojis[i].Count > group.Emojis[j].Count
+			}
+			return group.Emojis[i].Emoji < group.Emojis[j].Emoji
+		})
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Target < groups[j].Target
+	})
+	return groups, rest
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// reaction returns a stored kind-7 event with content and e tags to ids
+func reaction(content string, ids ...string) Event {
+	ev := nostr.Event{Kind: 7, Content: content, Tags: nostr.Tags{}}
+	for _, id := range ids {
+		ev.Tags = append(ev.Tags, nostr.Tag{"e", id})
+	}
+	return Event{Kind: 7, EventData: ev.String()}
+}
+
+func TestGroupReactions(t *testing.T) {
+	popular := strings.Repeat("1", 64)
+	quiet := strings.Repeat("2", 64)
+	root := strings.Repeat("3", 64)
+	note := Event{Kind: 1, EventData: `{"kind":1,"content":"hello","tags":[]}`}
+
+	tests := []struct {
+		name     string
+		events   []Event
+		want     []ReactionGroup
+		wantRest int
+	}{
+		{
+			name: "counts per target and emoji",
+			events: []Event{
+				reaction("+", popular), reaction("🤙", popular), reaction("", popular),
+				note, reaction("🤙", quiet), reaction("+", popular),
+			},
+			want: []ReactionGroup{
+				{Target: popular, Count: 4, Emojis: []ReactionCount{{"+", 3}, {"🤙", 1}}},
+				{Target: quiet, Count: 1, Emojis: []ReactionCount{{"🤙", 1}}},
+			},
+			wantRest: 1,
+		},
+		{
+			name:   "the last e tag is the target",
+			events: []Event{reaction("-", root, quiet), reaction("-", quiet)},
+			want:   []ReactionGroup{{Target: quiet, Count: 2, Emojis: []ReactionCount{{"-", 2}}}},
+		},
+		{
+			name:     "reactions without a target stay listed",
+			events:   []Event{reaction("+"), note},
+			want:     []ReactionGroup{},
+			wantRest: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := append([]Event(nil), tt.events...)
+			groups, rest := groupReactions(events)
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Error("the events passed in were modified")
+			}
+			if !reflect.DeepEqual(groups, tt.want) {
+				t.Errorf("groups = %+v, want %+v", groups, tt.want)
+			}
+			if len(rest) != tt.wantRest {
+				t.Errorf("%d events left, want %d", len(rest), tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestNpubPageGroupsReactions(t *testing.T) {
+	const pubkey = "7e1a5c9b3d7f1e5a9c3b7d1f5e9a3c7b1d5f9e3a7c1b5d9f3e7a1c5b9d3f7e1a"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "sage"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	target := strings.Repeat("9", 64)
+
+	for _, tt := range []struct {
+		query       string
+		wantGrouped bool
+	}{
+		{"", false},
+		{"?reactions=grouped", true},
+	} {
+		t.Run("query "+tt.query, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			for i, content := range []string{"+", "🔥", "+"} {
+				id := strings.Repeat(string(rune('a'+i)), 64)
+				rows.AddRow(id, pubkey, int64(1700000000+i), 7, `{"id":"`+id+`","kind":7,"content":"`+content+`","tags":[["e","`+target+`"]]}`)
+			}
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).WillReturnRows(rows)
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			summary := `/api/event/` + target + `">` + target + `</a></td><td>3</td><td>&#43; × 2, 🔥 × 1</td>`
+			if got := strings.Contains(body, summary); got != tt.wantGrouped {
+				t.Errorf("reaction summary shown = %v, want %v", got, tt.wantGrouped)
+			}
+			// Nor are they counted in the kind summary
+			if got := strings.Contains(body, `#kind-7">`); got == tt.wantGrouped {
+				t.Errorf("kind 7 in the summary = %v, want %v", got, !tt.wantGrouped)
+			}
+			// Grouped reactions are no longer listed one by one
+			if got := strings.Contains(body, "/api/event/"+strings.Repeat("a", 64)+"/download"); got == tt.wantGrouped {
+				t.Errorf("individual reaction listed = %v, want %v", got, !tt.wantGrouped)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// readOnly disables restore and backup while keeping browsing available
+var readOnly atomic.Bool
+
+// configureReadOnly enables read-only mode from READ_ONLY and toggles it on SIGHUP
+func configureReadOnly() {
+	if os.Getenv("READ_ONLY") == "true" {
+		readOnly.Store(true)
+		log.Printf("Read-only mode is active: restore and backup are disabled")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			enabled := !readOnly.Load()
+			readOnly.Store(enabled)
+			if enabled {
+				log.Printf("Read-only mode enabled by SIGHUP")
+			} else {
+				log.Printf("Read-only mode disabled by SIGHUP")
+			}
+		}
+	}()
+}
+
+// rejectReadOnly responds with 503 and returns true when in read-only mode
+func rejectReadOnly(w http.ResponseWriter) bool {
+	if !readOnly.Load() {
+		return false
+	}
+	http.Error(w, "The service is in read-only maintenance mode; restore and backup are temporarily disabled.", http.StatusServiceUnavailable)
+	return true
+}
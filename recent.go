@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// showRecent enables the recently backed-up pubkeys list on the home page.
+// It is off by default because it reveals who uses the service.
+var showRecent bool
+
+// recentPubkeysLimit is how many pubkeys the home page lists
+const recentPubkeysLimit = 10
+
+// RecentPubkey is a pubkey with its newest backed-up event
+type RecentPubkey struct {
+	Pubkey string
+	Npub   string
+	Name   string
+	Latest int64
+
+	loc *time.Location // the time zone the date is shown in
+}
+
+// GetFormattedDate formats the time of the newest event
+func (p RecentPubkey) GetFormattedDate() string {
+	return formatTimestamp(p.Latest, p.loc)
+}
+
+// queryRecentPubkeys returns the distinct pubkeys with the newest events
+func queryRecentPubkeys(ctx context.Context, db *sql.DB, limit int) ([]RecentPubkey, error) {
+	defer observeDBQuery("recent_pubkeys", time.Now())
+
+	query := `SELECT pubkey, MAX(created_at) AS latest FROM event_backup WHERE pubkey <> ALL($2) GROUP BY pubkey ORDER BY latest DESC, pubkey LIMIT $1`
+	rows, err := db.QueryContext(ctx, query, limit, pq.Array(blockedList()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []RecentPubkey
+	for rows.Next() {
+		var pubkey string
+		var latest int64
+		if err := rows.Scan(&pubkey, &latest); err != nil {
+			return nil, err
+		}
+		npub, err := nip19.EncodePublicKey(pubkey)
+		if err != nil {
+			continue
+		}
+		result = append(result, RecentPubkey{Pubkey: pubkey, Npub: npub, Latest: latest})
+	}
+	return result, rows.Err()
+}
+
+// recentPubkeys lists the recently active pubkeys with their names, using
+// cached or backed-up profiles so the home page never waits on relays
+func recentPubkeys(ctx context.Context, db *sql.DB) []RecentPubkey {
+	recent, err := queryRecentPubkeys(ctx, db, recentPubkeysLimit)
+	if err != nil {
+		logf(ctx, "Failed to query recent pubkeys: %v", err)
+		return nil
+	}
+
+	for i := range recent {
+		profile, ok := profiles.get(recent[i].Pubkey)
+		if !ok {
+			profile, _ = profileFromBackup(ctx, db, recent[i].Pubkey)
+		}
+		if profile != nil {
+			recent[i].Name = profile.DisplayedName()
+		}
+	}
+	return recent
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestRecentPubkeys(t *testing.T) {
+	const (
+		alice = "0000000000000000000000000000000000000000000000000000000000000a11"
+		bob   = "0000000000000000000000000000000000000000000000000000000000000b0b"
+		carol = "00000000000000000000000000000000000000000000000000000000000ca401"
+		spam  = "5555555555555555555555555555555555555555555555555555555555555555"
+	)
+	blockedPubkeys = map[string]bool{spam: true}
+	defer func() { blockedPubkeys = map[string]bool{} }()
+	profiles.set(alice, &UserProfile{Name: "alice", DisplayName: "Alice"})
+	defer profiles.delete(alice)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// One aggregate row per pubkey, newest first, without the blocked ones
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT pubkey, MAX(created_at) AS latest FROM event_backup WHERE pubkey <> ALL($2) GROUP BY pubkey ORDER BY latest DESC, pubkey LIMIT $1`)).
+		WithArgs(recentPubkeysLimit, pq.Array([]string{spam})).
+		WillReturnRows(sqlmock.NewRows([]string{"pubkey", "latest"}).
+			AddRow(bob, int64(1700000300)).
+			AddRow("not a pubkey", int64(1700000200)).
+			AddRow(alice, int64(1700000100)).
+			AddRow(carol, int64(1700000100)))
+	// Names come from the cache or stored profiles, never from relays
+	mock.ExpectQuery(`event_kind = 0`).WithArgs(bob).
+		WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(`{"kind":0,"content":"{\"name\":\"bob\"}"}`))
+	mock.ExpectQuery(`event_kind = 0`).WithArgs(carol).WillReturnError(sql.ErrNoRows)
+
+	var got []string
+	for _, p := range recentPubkeys(context.Background(), db) {
+		if p.Npub == "" {
+			t.Errorf("pubkey %s has no npub", p.Pubkey)
+		}
+		got = append(got, p.Pubkey+"="+p.Name)
+	}
+	want := []string{bob + "=bob", alice + "=Alice", carol + "="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recentPubkeys() = %q, want %q", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
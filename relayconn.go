@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// errAuthRequired is returned by relayConn.query when the relay wants NIP-42
+// authentication before it answers
+var errAuthRequired = errors.New("relay requires authentication")
+
+// relayConn is a websocket connection to a single relay. Unlike nostr.Relay
+// it is driven synchronously by its caller and starts no goroutines, so
+// nothing outlives Close, not even after a failed dial.
+type relayConn struct {
+	url  string
+	conn net.Conn
+	// challenge is the latest NIP-42 challenge sent by the relay
+	challenge string
+	subs      int
+	release   func()
+	closeOnce sync.Once
+}
+
+// dialRelay opens a websocket connection to url
+func dialRelay(ctx context.Context, url string) (*relayConn, error) {
+	dialer := ws.Dialer{NetDial: relayDial(url)}
+	conn, br, _, err := dialer.Dial(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	if br != nil {
+		conn = bufferedConn{Conn: conn, r: br}
+	}
+	return &relayConn{url: url, conn: conn}, nil
+}
+
+// bufferedConn is a net.Conn whose reads first return what was read ahead
+// during the websocket handshake, such as an AUTH challenge sent at once
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Close closes the connection and frees its connection slot
+func (c *relayConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
+
+// watch bounds blocking reads and writes by the deadline of ctx and makes
+// them return once ctx is cancelled, until the returned function is called
+func (c *relayConn) watch(ctx context.Context) func() bool {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+}
+
+// write sends env to the relay
+func (c *relayConn) write(env nostr.Envelope) error {
+	msg, err := env.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return wsutil.WriteClientText(c.conn, msg)
+}
+
+// read returns the next message from the relay, recording any AUTH
+// challenge it carries
+func (c *relayConn) read() ([]byte, error) {
+	for {
+		msg, op, err := wsutil.ReadServerData(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if op != ws.OpText {
+			continue
+		}
+		if hasLabel(msg, "AUTH") {
+			if env, ok := nostr.ParseMessage(msg).(*nostr.AuthEnvelope); ok && env.Challenge != nil {
+				c.challenge = *env.Challenge
+			}
+		}
+		return msg, nil
+	}
+}
+
+// hasLabel reports whether the relay message msg is of type label, without
+// decoding the rest of it
+func hasLabel(msg []byte, label string) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(msg, " \t\r\n["), []byte(`"`+label+`"`))
+}
+
+// closedMessage parses a NIP-01 CLOSED message, which this version of
+// go-nostr does not know, returning its subscription id and reason
+func closedMessage(msg []byte) (subID, reason string, ok bool) {
+	if !hasLabel(msg, "CLOSED") {
+		return "", "", false
+	}
+	var fields []string
+	if err := json.Unmarshal(msg, &fields); err != nil || len(fields) < 2 {
+		return "", "", false
+	}
+	if len(fields) > 2 {
+		reason = fields[2]
+	}
+	return fields[1], reason, true
+}
+
+// query collects the stored events matching filter until EOSE, or until
+// filter.Limit events have arrived when it is set. If the relay closes the
+// subscription asking for authentication, or sends an AUTH challenge and
+// no events follow, errAuthRequired is returned.
+func (c *relayConn) query(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	defer observeRelay("subscribe", time.Now())
+
+	stop := c.watch(ctx)
+	defer stop()
+
+	c.subs++
+	subID := strconv.Itoa(c.subs)
+	if err := c.write(&nostr.ReqEnvelope{SubscriptionID: subID, Filters: nostr.Filters{filter}}); err != nil {
+		return nil, err
+	}
+	done := func(events []*nostr.Event) ([]*nostr.Event, error) {
+		closeEnv := nostr.CloseEnvelope(subID)
+		c.write(&closeEnv)
+		return events, nil
+	}
+
+	var events []*nostr.Event
+	challenged := c.challenge != ""
+	grace := false
+	if challenged {
+		grace = true
+		c.conn.SetReadDeadline(graceDeadline(ctx))
+	}
+	for {
+		msg, err := c.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return events, ctx.Err()
+			}
+			if deadlinePassed(ctx) {
+				return events, context.DeadlineExceeded
+			}
+			var netErr net.Error
+			if grace && errors.As(err, &netErr) && netErr.Timeout() {
+				if len(events) == 0 {
+					return nil, errAuthRequired
+				}
+				grace = false
+				deadline, _ := ctx.Deadline()
+				c.conn.SetReadDeadline(deadline)
+				continue
+			}
+			return events, err
+		}
+
+		if id, reason, ok := closedMessage(msg); ok {
+			if id != subID {
+				continue
+			}
+			if strings.HasPrefix(reason, "auth-required:") {
+				return nil, errAuthRequired
+			}
+			return events, fmt.Errorf("subscription closed: %s", reason)
+		}
+
+		switch env := nostr.ParseMessage(msg).(type) {
+		case *nostr.EventEnvelope:
+			if env.SubscriptionID == nil || *env.SubscriptionID != subID {
+				continue
+			}
+			ev := env.Event
+			events = append(events, &ev)
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				return done(events)
+			}
+		case *nostr.EOSEEnvelope:
+			if string(*env) != subID {
+				continue
+			}
+			if len(events) == 0 && c.challenge != "" {
+				return nil, errAuthRequired
+			}
+			return done(events)
+		case *nostr.AuthEnvelope:
+			if !challenged && env.Challenge != nil {
+				challenged = true
+				grace = true
+				c.conn.SetReadDeadline(graceDeadline(ctx))
+			}
+		}
+	}
+}
+
+// deadlinePassed reports whether the deadline of ctx has passed. A read
+// timing out at the deadline may return before ctx reports it is done.
+func deadlinePassed(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// graceDeadline is when to stop waiting for events after an AUTH challenge
+func graceDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(authGracePeriod)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// publish sends ev and waits for the relay's OK, returning the relay's
+// reason as the error when it rejects ev. Like nostr.Relay.Publish it
+// returns PublishStatusSent when no answer arrives before ctx is done.
+func (c *relayConn) publish(ctx context.Context, ev nostr.Event) (nostr.Status, error) {
+	stop := c.watch(ctx)
+	defer stop()
+
+	if err := c.write(&nostr.EventEnvelope{Event: ev}); err != nil {
+		return nostr.PublishStatusFailed, err
+	}
+	return c.waitOK(ctx, ev.ID)
+}
+
+// auth answers a NIP-42 challenge with the signed auth event ev
+func (c *relayConn) auth(ctx context.Context, ev nostr.Event) (nostr.Status, error) {
+	stop := c.watch(ctx)
+	defer stop()
+
+	if err := c.write(&nostr.AuthEnvelope{Event: ev}); err != nil {
+		return nostr.PublishStatusFailed, err
+	}
+	return c.waitOK(ctx, ev.ID)
+}
+
+// waitOK waits for the relay's OK message for the event id
+func (c *relayConn) waitOK(ctx context.Context, id string) (nostr.Status, error) {
+	for {
+		msg, err := c.read()
+		if err != nil {
+			if ctx.Err() != nil || deadlinePassed(ctx) {
+				return nostr.PublishStatusSent, nil
+			}
+			return nostr.PublishStatusFailed, err
+		}
+		env, ok := nostr.ParseMessage(msg).(*nostr.OKEnvelope)
+		if !ok || env.EventID != id {
+			continue
+		}
+		if env.OK {
+			return nostr.PublishStatusSucceeded, nil
+		}
+		reason := ""
+		if env.Reason != nil {
+			reason = *env.Reason
+		}
+		return nostr.PublishStatusFailed, fmt.Errorf("rejected: %s", reason)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mockRelay is a websocket relay whose answers are scripted by a handler
+type mockRelay struct {
+	url string
+
+	mu       sync.Mutex
+	conns    int
+	received []string
+}
+
+// newMockRelay starts a relay that sends hello, when set, to each new
+// connection and then passes every client message to handle. The relay is
+// added to the read relays so that it may be dialed on loopback.
+func newMockRelay(t testing.TB, hello string, handle func(reply func(string), msg []byte)) *mockRelay {
+	t.Helper()
+	relay := &mockRelay{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		relay.mu.Lock()
+		relay.conns++
+		relay.mu.Unlock()
+
+		var writeMu sync.Mutex
+		reply := func(msg string) {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			wsutil.WriteServerText(conn, []byte(msg))
+		}
+		if hello != "" {
+			reply(hello)
+		}
+		for {
+			msg, err := wsutil.ReadClientText(conn)
+			if err != nil {
+				return
+			}
+			var fields []json.RawMessage
+			if json.Unmarshal(msg, &fields) == nil && len(fields) > 0 {
+				var label string
+				json.Unmarshal(fields[0], &label)
+				relay.mu.Lock()
+				relay.received = append(relay.received, label)
+				relay.mu.Unlock()
+			}
+			handle(reply, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	relay.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	configured := readRelays
+	readRelays = append(append([]string{}, readRelays...), relay.url)
+	t.Cleanup(func() { readRelays = configured })
+	return relay
+}
+
+// count returns how many client messages of type label the relay received
+func (m *mockRelay) count(label string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, l := range m.received {
+		if l == label {
+			n++
+		}
+	}
+	return n
+}
+
+// connections returns how many websocket connections the relay accepted
+func (m *mockRelay) connections() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns
+}
+
+// eventMessage encodes ev as an EVENT message of the subscription subID
+func eventMessage(subID string, ev nostr.Event) string {
+	b, _ := (&nostr.EventEnvelope{SubscriptionID: &subID, Event: ev}).MarshalJSON()
+	return string(b)
+}
+
+func TestRelayConnQuery(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	notes := make([]nostr.Event, 3)
+	for i := range notes {
+		notes[i] = nostr.Event{Kind: 1, Content: strings.Repeat("n", i+1), CreatedAt: nostr.Timestamp(1700000000 + i), Tags: nostr.Tags{}}
+		notes[i].Sign(sk)
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		answer  func(reply func(string), subID string)
+		want    int
+		wantErr string
+	}{
+		{
+			name: "events until EOSE",
+			answer: func(reply func(string), subID string) {
+				for _, ev := range notes {
+					reply(eventMessage(subID, ev))
+				}
+				reply(`["EOSE","` + subID + `"]`)
+			},
+			want: 3,
+		},
+		{
+			name:  "stops at the limit",
+			limit: 2,
+			answer: func(reply func(string), subID string) {
+				for _, ev := range notes {
+					reply(eventMessage(subID, ev))
+				}
+			},
+			want: 2,
+		},
+		{
+			name: "other subscriptions and notices are ignored",
+			answer: func(reply func(string), subID string) {
+				reply(eventMessage("other", notes[0]))
+				reply(`["NOTICE","slow down"]`)
+				reply(`["EOSE","other"]`)
+				reply(eventMessage(subID, notes[1]))
+				reply(`["EOSE","` + subID + `"]`)
+			},
+			want: 1,
+		},
+		{
+			name: "closed with a reason",
+			answer: func(reply func(string), subID string) {
+				reply(`["CLOSED","` + subID + `","error: shutting down"]`)
+			},
+			wantErr: "subscription closed: error: shutting down",
+		},
+		{
+			name: "closed asking for auth",
+			answer: func(reply func(string), subID string) {
+				reply(`["CLOSED","` + subID + `","auth-required: members only"]`)
+			},
+			wantErr: errAuthRequired.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+					tt.answer(reply, req.SubscriptionID)
+				}
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialRelay(ctx, relay.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			events, err := conn.query(ctx, nostr.Filter{Authors: []string{pubkey}, Limit: tt.limit})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("query() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.want {
+				t.Errorf("query() returned %d events, want %d", len(events), tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayConnPublish(t *testing.T) {
+	ev := nostr.Event{Kind: 1, Content: "restored", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	ev.Sign(nostr.GeneratePrivateKey())
+
+	tests := []struct {
+		name       string
+		answer     func(reply func(string), id string)
+		timeout    time.Duration
+		wantStatus nostr.Status
+		wantErr    string
+	}{
+		{
+			name:       "accepted",
+			answer:     func(reply func(string), id string) { reply(`["OK","` + id + `",true,""]`) },
+			wantStatus: nostr.PublishStatusSucceeded,
+		},
+		{
+			name:       "duplicate is accepted",
+			answer:     func(reply func(string), id string) { reply(`["OK","` + id + `",true,"duplicate: already have it"]`) },
+			wantStatus: nostr.PublishStatusSucceeded,
+		},
+		{
+			name:       "rejected with a reason",
+			answer:     func(reply func(string), id string) { reply(`["OK","` + id + `",false,"blocked: you are banned"]`) },
+			wantStatus: nostr.PublishStatusFailed,
+			wantErr:    "rejected: blocked: you are banned",
+		},
+		{
+			name: "OK for another event is ignored",
+			answer: func(reply func(string), id string) {
+				reply(`["OK","` + strings.Repeat("0", 64) + `",false,"invalid: no"]`)
+				reply(`["OK","` + id + `",true,""]`)
+			},
+			wantStatus: nostr.PublishStatusSucceeded,
+		},
+		{
+			name:       "no answer is sent but unconfirmed",
+			answer:     func(func(string), string) {},
+			timeout:    200 * time.Millisecond,
+			wantStatus: nostr.PublishStatusSent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+					tt.answer(reply, env.Event.ID)
+				}
+			})
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			conn, err := dialRelay(ctx, relay.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			status, err := conn.publish(ctx, ev)
+			if status != tt.wantStatus {
+				t.Errorf("publish() status = %v, want %v", status, tt.wantStatus)
+			}
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("publish() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelayConnKeepsChallengeSentWithHandshake(t *testing.T) {
+	relay := newMockRelay(t, `["AUTH","challenge-at-once"]`, func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialRelay(ctx, relay.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An AUTH challenge followed by an empty result means the relay hides
+	// events from unauthenticated clients
+	if _, err := conn.query(ctx, nostr.Filter{Kinds: []int{0}}); err != errAuthRequired {
+		t.Fatalf("query() error = %v, want errAuthRequired", err)
+	}
+	if conn.challenge != "challenge-at-once" {
+		t.Errorf("challenge = %q", conn.challenge)
+	}
+}
+
+func TestClosedMessage(t *testing.T) {
+	tests := []struct {
+		msg        string
+		wantID     string
+		wantReason string
+		wantOK     bool
+	}{
+		{`["CLOSED","sub1","auth-required: sign in"]`, "sub1", "auth-required: sign in", true},
+		{` [ "CLOSED", "sub2"]`, "sub2", "", true},
+		{`["EOSE","sub1"]`, "", "", false},
+		{`["CLOSED"]`, "", "", false},
+		{`["CLOSED",`, "", "", false},
+	}
+	for _, tt := range tests {
+		id, reason, ok := closedMessage([]byte(tt.msg))
+		if id != tt.wantID || reason != tt.wantReason || ok != tt.wantOK {
+			t.Errorf("closedMessage(%s) = %q, %q, %v", tt.msg, id, reason, ok)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress is returned when a relay that is not configured, or
+// another host named by a user, resolves to an address that is not
+// publicly routable
+var errPrivateAddress = errors.New("host resolves to a private address")
+
+// isPublicIP reports whether ip is a publicly routable unicast address
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast()
+}
+
+// isPublicHost reports whether a relay hostname may be public. Names are
+// only known to be public once resolved, which relayDial checks.
+func isPublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicIP(ip)
+	}
+	return true
+}
+
+// isConfiguredRelay reports whether url is one of the configured read or
+// write relays, which may be on a private network
+func isConfiguredRelay(url string) bool {
+	normalized := normalizeRelays([]string{url})
+	if len(normalized) == 0 {
+		return false
+	}
+	// Appending the lists could write into readRelays' spare capacity,
+	// which other requests are reading
+	for _, relays := range [][]string{readRelays, writeRelays} {
+		for _, relay := range relays {
+			if relay == normalized[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayDial returns the dialer for the relay url. Relays named by users,
+// in restore requests or their relay lists, may only connect to public
+// addresses, so that they cannot reach the internal network.
+func relayDial(url string) netDialFunc {
+	if isConfiguredRelay(url) {
+		return relayNetDial
+	}
+	if relayNetDial == nil {
+		dialer := net.Dialer{Control: publicOnly}
+		return dialer.DialContext
+	}
+	// The proxy resolves the name itself, so it is checked beforehand
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPublicHost(ctx, host); err != nil {
+			return nil, err
+		}
+		return relayNetDial(ctx, network, addr)
+	}
+}
+
+// checkPublicHost resolves host and fails unless every address it has is
+// publicly routable
+func checkPublicHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return fmt.Errorf("%w: %s", errPrivateAddress, ip.IP)
+		}
+	}
+	return nil
+}
+
+// publicOnly is a net.Dialer Control function refusing connections to
+// addresses that are not publicly routable
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// proxiedKey marks the context of a request publicTransport sends through
+// a proxy, with the proxy URL
+type proxiedKey struct{}
+
+// publicTransport dials only public addresses, except for the proxy of
+// requests that publicHTTPClient sends through one
+var publicTransport = &http.Transport{
+	Proxy: func(r *http.Request) (*url.URL, error) {
+		u, _ := r.Context().Value(proxiedKey{}).(*url.URL)
+		return u, nil
+	},
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: 30 * time.Second, Control: publicOnly}
+		if ctx.Value(proxiedKey{}) != nil {
+			dialer.Control = nil
+		}
+		return dialer.DialContext(ctx, network, addr)
+	},
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// publicHTTPClient fetches URLs on hosts named by users, such as NIP-05
+// domains. Like relayDial it only reaches public addresses, and it does
+// not follow redirects, which NIP-05 forbids.
+var publicHTTPClient = &http.Client{
+	Transport: publicRoundTripper{},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicRoundTripper sends requests through publicTransport, using the
+// proxy http.DefaultTransport would
+type publicRoundTripper struct{}
+
+func (publicRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	proxy := http.ProxyFromEnvironment
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		proxy = t.Proxy
+	}
+	if proxy != nil {
+		u, err := proxy(r)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			// The proxy resolves the name itself, so it is checked beforehand
+			if err := checkPublicHost(r.Context(), r.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			r = r.WithContext(context.WithValue(r.Context(), proxiedKey{}, u))
+		}
+	}
+	return publicTransport.RoundTrip(r)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsPublicHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"relay.example", true},
+		{"203.0.113.7", true},
+		{"2001:4860::8888", true},
+		{"localhost", false},
+		{"LOCALHOST.", false},
+		{"relay.localhost", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.0.10", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicHost(tt.host); got != tt.want {
+			t.Errorf("isPublicHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"203.0.113.7:443", false},
+		{"[2001:4860::8888]:443", false},
+		{"127.0.0.1:8080", true},
+		{"10.0.0.1:443", true},
+		{"[::1]:443", true},
+		{"169.254.169.254:80", true},
+	}
+	for _, tt := range tests {
+		err := publicOnly("tcp", tt.address, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("publicOnly(%q) = %v, want error %v", tt.address, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, errPrivateAddress) {
+			t.Errorf("publicOnly(%q) = %v, want errPrivateAddress", tt.address, err)
+		}
+	}
+}
+
+func TestRelayDialRefusesPrivateAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	configured := "ws://" + addr
+	defer func(relays []string, dial netDialFunc) { readRelays, relayNetDial = relays, dial }(readRelays, relayNetDial)
+	readRelays = []string{configured}
+
+	var proxied int
+	proxy := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxied++
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	tests := []struct {
+		name    string
+		proxy   netDialFunc
+		url     string
+		wantErr bool
+	}{
+		{"configured relay on loopback", nil, configured, false},
+		{"user-named relay on loopback", nil, "ws://127.0.0.1:7777", true},
+		{"configured relay through a proxy", proxy, configured, false},
+		{"user-named relay through a proxy", proxy, "ws://127.0.0.1:7777", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayNetDial, proxied = tt.proxy, 0
+			dial := relayDial(tt.url)
+			if dial == nil {
+				// As for relayNetDial, nil dials directly
+				dial = (&net.Dialer{}).DialContext
+			}
+			conn, err := dial(context.Background(), "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errPrivateAddress) {
+				t.Errorf("dial error = %v, want errPrivateAddress", err)
+			}
+			// A refused address never reaches the proxy
+			if want := tt.proxy != nil && !tt.wantErr; (proxied == 1) != want {
+				t.Errorf("proxy dialed %d times", proxied)
+			}
+		})
+	}
+}
+
+func TestIsConfiguredRelayLeavesListsAlone(t *testing.T) {
+	defer func(reads, writes []string) { readRelays, writeRelays = reads, writes }(readRelays, writeRelays)
+	// Spare capacity that appending the write relays would fill
+	readRelays = append(make([]string, 0, 4), "wss://read.example")
+	writeRelays = []string{"wss://write.example"}
+	spare := readRelays[:2]
+	spare[1] = "untouched"
+
+	for url, want := range map[string]bool{
+		"wss://read.example":   true,
+		"wss://write.example/": true,
+		"wss://other.example":  false,
+	} {
+		if got := isConfiguredRelay(url); got != want {
+			t.Errorf("isConfiguredRelay(%q) = %v, want %v", url, got, want)
+		}
+	}
+	if spare[1] != "untouched" {
+		t.Errorf("read relays' backing array was overwritten with %q", spare[1])
+	}
+}
+
+func TestPublicHTTPClient(t *testing.T) {
+	var reached bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer target.Close()
+	if _, err := publicHTTPClient.Get(target.URL); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("loopback request error = %v, want errPrivateAddress", err)
+	}
+	if reached {
+		t.Error("the loopback server was reached")
+	}
+
+	// Proxied requests are checked before the proxy, which may be private
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := http.DefaultTransport.(*http.Transport)
+	defer func(p func(*http.Request) (*url.URL, error)) { transport.Proxy = p }(transport.Proxy)
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	if _, err := publicHTTPClient.Get("http://10.1.2.3/.well-known/nostr.json"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("proxied private request error = %v, want errPrivateAddress", err)
+	}
+	resp, err := publicHTTPClient.Get("http://203.0.113.7/.well-known/nostr.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != "http://203.0.113.7/.well-known/nostr.json" {
+		t.Errorf("proxy received %q, want only the public request", proxied)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// relayInfoTTL is how long a relay's NIP-11 document is reused
+const relayInfoTTL = time.Hour
+
+// relayInfoTimeout bounds each NIP-11 request
+const relayInfoTimeout = 5 * time.Second
+
+// RelayInfo is a relay's NIP-11 document, or the reason it is unavailable
+type RelayInfo struct {
+	URL   string
+	Info  *nip11.RelayInformationDocument
+	Error string
+}
+
+// Limitations summarizes the limitation fields the relay advertises
+func (ri RelayInfo) Limitations() string {
+	if ri.Info == nil || ri.Info.Limitation == nil {
+		return ""
+	}
+	l := ri.Info.Limitation
+	var parts []string
+	add := func(name string, v int) {
+		if v > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", name, v))
+		}
+	}
+	add("max message length", l.MaxMessageLength)
+	add("max subscriptions", l.MaxSubscriptions)
+	add("max filters", l.MaxFilters)
+	add("max limit", l.MaxLimit)
+	add("max event tags", l.MaxEventTags)
+	add("max content length", l.MaxContentLength)
+	add("min PoW difficulty", l.MinPowDifficulty)
+	if l.AuthRequired {
+		parts = append(parts, "auth required")
+	}
+	if l.PaymentRequired {
+		parts = append(parts, "payment required")
+	}
+	return strings.Join(parts, ", ")
+}
+
+type relayInfoEntry struct {
+	info    RelayInfo
+	expires time.Time
+}
+
+// relayInfoCache caches NIP-11 documents by relay URL
+var relayInfoCache = struct {
+	sync.Mutex
+	entries map[string]relayInfoEntry
+}{entries: map[string]relayInfoEntry{}}
+
+// getRelayInfo returns the NIP-11 document of url from the cache or the relay
+func getRelayInfo(ctx context.Context, url string) RelayInfo {
+	relayInfoCache.Lock()
+	entry, ok := relayInfoCache.entries[url]
+	relayInfoCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.info
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, relayInfoTimeout)
+	defer cancel()
+
+	info := RelayInfo{URL: url}
+	doc, err := nip11.Fetch(ctx, url)
+	if err != nil {
+		logf(ctx, "Failed to fetch NIP-11 document for %s: %v", url, err)
+		info.Error = "NIP-11 information unavailable"
+		if ctx.Err() != nil {
+			// Don't remember failures caused by the request going away
+			return info
+		}
+	} else {
+		info.Info = doc
+	}
+
+	relayInfoCache.Lock()
+	relayInfoCache.entries[url] = relayInfoEntry{info: info, expires: time.Now().Add(relayInfoTTL)}
+	relayInfoCache.Unlock()
+	return info
+}
+
+// relaysHandler serves /relays with the NIP-11 details of the configured relays
+func relaysHandler(w http.ResponseWriter, r *http.Request) {
+	urls := normalizeRelays(append(append([]string{}, readRelays...), writeRelays...))
+
+	infos := make([]RelayInfo, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			infos[i] = getRelayInfo(r.Context(), url)
+		}(i, url)
+	}
+	wg.Wait()
+
+	tmpl := `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Relays - {{.Site.Title}}</title>
+    <link rel="stylesheet" href="{{$.Site.Asset "style.css"}}">
+</head>
+<body>
+    <div class="container">
+        <div class="back-link">
+            <a href="{{$.Site.BasePath}}/">← Back to Home</a>
+        </div>
+        <h1>Configured Relays</h1>
+        <table class="relay-table">
+            <tr><th>Relay</th><th>Name</th><th>Software</th><th>Supported NIPs</th><th>Limitations</th></tr>
+            {{range .Relays}}
+            <tr>
+                <td>{{.URL}}</td>
+                {{if .Info}}
+                <td>{{.Info.Name}}</td>
+                <td>{{.Info.Software}}{{with .Info.Version}} {{.}}{{end}}</td>
+                <td>{{range $i, $n := .Info.SupportedNIPs}}{{if $i}}, {{end}}{{$n}}{{end}}</td>
+                <td>{{.Limitations}}</td>
+                {{else}}
+                <td colspan="4" class="relay-error">{{.Error}}</td>
+                {{end}}
+            </tr>
+            {{end}}
+        </table>
+        <footer>
+            <p>{{.Site.Title}} &copy; 2025</p>
+        </footer>
+    </div>
+</body>
+</html>
+`
+	t, err := template.New("relays").Parse(tmpl)
+	if err != nil {
+		errorf(r.Context(), "Failed to parse relays template: %v", err)
+		renderError(w, http.StatusInternalServerError, "Failed to render page.")
+		return
+	}
+
+	data := struct {
+		Site   siteInfo
+		Relays []RelayInfo
+	}{
+		Site:   site,
+		Relays: infos,
+	}
+
+	if err := t.Execute(w, data); err != nil {
+		logf(r.Context(), "Failed to render relays template: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRelaysHandler(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Cleanup(func() {
+		relayInfoCache.Lock()
+		relayInfoCache.entries = map[string]relayInfoEntry{}
+		relayInfoCache.Unlock()
+	})
+
+	var fetches atomic.Int32
+	informative := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/nostr+json" {
+			http.Error(w, "use a websocket", http.StatusUpgradeRequired)
+			return
+		}
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/nostr+json")
+		io.WriteString(w, `{
+			"name": "Sample Relay",
+			"software": "git+https://github.com/hoytech/strfry.git",
+			"version": "1.0.1",
+			"supported_nips": [1, 11, 42],
+			"limitation": {"max_subscriptions": 20, "max_limit": 500, "auth_required": true}
+		}`)
+	}))
+	defer informative.Close()
+	silent := httptest.NewServer(http.NotFoundHandler())
+	defer silent.Close()
+
+	defer func(read, write []string) { readRelays, writeRelays = read, write }(readRelays, writeRelays)
+	readRelays = []string{"ws" + strings.TrimPrefix(informative.URL, "http"), "ws" + strings.TrimPrefix(silent.URL, "http")}
+	writeRelays = readRelays[:1]
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		relaysHandler(rec, httptest.NewRequest(http.MethodGet, "/relays", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		body := rec.Body.String()
+		for _, want := range []string{
+			"<td>Sample Relay</td>",
+			"<td>git&#43;https://github.com/hoytech/strfry.git 1.0.1</td>",
+			"<td>1, 11, 42</td>",
+			"<td>max subscriptions: 20, max limit: 500, auth required</td>",
+			`<td colspan="4" class="relay-error">NIP-11 information unavailable</td>`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("page lacks %s:\n%s", want, body)
+			}
+		}
+		if n := strings.Count(body, "<td>ws://127.0.0.1:"); n != 2 {
+			t.Errorf("page lists %d relays, want the 2 configured ones", n)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("NIP-11 document fetched %d times, want 1 from the cache afterwards", n)
+	}
+}
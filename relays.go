@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+// readRelays are the relays used to fetch profiles
+var readRelays = []string{
+	//"wss://relay.damus.io",
+	"wss://nos.lol",
+	"wss://yabu.me",
+	"wss://nostr.compile-error.net",
+}
+
+// writeRelays are the relays restored events are published to
+var writeRelays = readRelays
+
+// serviceSecretKey is the hex secret key used for NIP-42 authentication
+var serviceSecretKey string
+
+// relayFetchDisabled stops profiles from being fetched from relays, so
+// only profiles stored in event_backup are shown
+var relayFetchDisabled bool
+
+// profileWait bounds how long a single relay may take to answer a profile
+// fetch, including connecting, before it is given up on
+var profileWait = 5 * time.Second
+
+// relayConnectTimeout bounds each individual relay connection attempt
+const relayConnectTimeout = 5 * time.Second
+
+// relayConnectRetries is how many times a failed relay connection is retried
+var relayConnectRetries = 2
+
+// relayRetryDelay is the delay before the first connection retry, doubled
+// on each subsequent attempt
+var relayRetryDelay = 500 * time.Millisecond
+
+// maxRelayConns is the default limit on open outbound relay connections
+const maxRelayConns = 50
+
+// relayConns holds a slot for each open outbound relay connection, so that
+// concurrent requests cannot exhaust file descriptors
+var relayConns = make(chan struct{}, maxRelayConns)
+
+// relayConnWait bounds how long a dial waits for a free connection slot
+const relayConnWait = 10 * time.Second
+
+// errRelayConnsSaturated is returned when no connection slot frees up in time
+var errRelayConnsSaturated = errors.New("too many open relay connections")
+
+// acquireRelayConn waits for a free connection slot
+func acquireRelayConn(ctx context.Context) error {
+	select {
+	case relayConns <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(relayConnWait)
+	defer timer.Stop()
+	select {
+	case relayConns <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errRelayConnsSaturated
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseRelayConn frees a connection slot
+func releaseRelayConn() {
+	<-relayConns
+}
+
+// authGracePeriod is how long to wait for events after an AUTH challenge
+// before assuming the relay requires authentication
+const authGracePeriod = 2 * time.Second
+
+// relaysFromEnv returns the comma-separated relay list in the named
+// environment variable, or def when it is unset or empty
+func relaysFromEnv(name string, def []string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	var relays []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			relays = append(relays, s)
+		}
+	}
+	if len(relays) == 0 {
+		return def
+	}
+	return relays
+}
+
+// normalizeRelays lowercases the scheme and host of each relay URL, drops
+// duplicates, and drops (logging) entries that are not valid ws/wss URLs
+func normalizeRelays(relays []string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, relay := range relays {
+		u, err := url.Parse(strings.TrimSpace(relay))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			log.Printf("Ignoring invalid relay URL %q", relay)
+			continue
+		}
+		u.Host = strings.ToLower(u.Host)
+		u.Path = strings.TrimSuffix(u.Path, "/")
+
+		normalized := u.String()
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		result = append(result, normalized)
+	}
+	return result
+}
+
+// maxPreferredReadRelays limits how many relays from a user's own relay
+// list are tried before the configured read relays
+const maxPreferredReadRelays = 4
+
+// parseRelayList extracts the relays with the given marker ("read" or
+// "write") from a NIP-65 relay list event. An "r" tag without a marker
+// means both read and write.
+func parseRelayList(eventData, marker string) []string {
+	var ev nostr.Event
+	if err := json.Unmarshal([]byte(eventData), &ev); err != nil {
+		return nil
+	}
+
+	var relays []string
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		if len(tag) >= 3 && tag[2] != marker {
+			continue
+		}
+		relays = append(relays, tag[1])
+	}
+	return relays
+}
+
+// parseWriteRelays extracts the relays marked for writing from a NIP-65
+// relay list event
+func parseWriteRelays(eventData string) []string {
+	return parseRelayList(eventData, "write")
+}
+
+// parseReadRelays extracts the relays marked for reading from a NIP-65
+// relay list event
+func parseReadRelays(eventData string) []string {
+	return parseRelayList(eventData, "read")
+}
+
+// queryRelayList returns the newest kind-10002 event in event_backup for
+// pubkey, or "" when there is none
+func queryRelayList(ctx context.Context, db *sql.DB, pubkey string) string {
+	defer observeDBQuery("relay_list", time.Now())
+
+	query := `SELECT event_data FROM event_backup WHERE pubkey = $1 AND event_kind = 10002 ORDER BY created_at DESC, id ASC LIMIT 1`
+	var eventData string
+	err := db.QueryRowContext(ctx, query, pubkey).Scan(&eventData)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logf(ctx, "Failed to query relay list for %s: %v", pubkey, err)
+		}
+		return ""
+	}
+	return eventData
+}
+
+// writeRelaysForPubkey returns the write relays from the newest kind-10002
+// event in event_backup for pubkey, falling back to the configured write relays
+func writeRelaysForPubkey(ctx context.Context, db *sql.DB, pubkey string) []string {
+	relays := parseWriteRelays(queryRelayList(ctx, db, pubkey))
+	if len(relays) == 0 {
+		return writeRelays
+	}
+	return relays
+}
+
+// readRelaysForPubkey returns the valid public read relays from the newest
+// kind-10002 event in event_backup for pubkey, or nil when there are none
+func readRelaysForPubkey(ctx context.Context, db *sql.DB, pubkey string) []string {
+	// Relay lists are user data, so drop invalid and private entries
+	// quietly rather than letting normalizeRelays log them on every request
+	var relays []string
+	for _, relay := range parseReadRelays(queryRelayList(ctx, db, pubkey)) {
+		u, err := url.Parse(strings.TrimSpace(relay))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" || !isPublicHost(u.Hostname()) {
+			continue
+		}
+		relays = append(relays, relay)
+	}
+	relays = normalizeRelays(relays)
+	if len(relays) > maxPreferredReadRelays {
+		relays = relays[:maxPreferredReadRelays]
+	}
+	return relays
+}
+
+// profileRelays returns the relays to fetch a profile from: the user's own
+// read relays first, then the configured read relays ordered by health
+func profileRelays(preferred []string) []string {
+	relays := append([]string{}, preferred...)
+	seen := map[string]bool{}
+	for _, relay := range preferred {
+		seen[relay] = true
+	}
+	for _, relay := range relayHealth.ordered(readRelays) {
+		if !seen[relay] {
+			relays = append(relays, relay)
+		}
+	}
+	return relays
+}
+
+// queryRelay connects to url and returns the stored events matching filter,
+// performing NIP-42 authentication when the relay requires it
+func queryRelay(ctx context.Context, url string, filter nostr.Filter) ([]*nostr.Event, error) {
+	return queryRelayEach(ctx, url, []nostr.Filter{filter})
+}
+
+// queryRelayEach is queryRelay for several filters, each sent as its own
+// subscription over one connection, so that the relay's cap on the events
+// returned applies to each filter rather than all of them
+func queryRelayEach(ctx context.Context, url string, filters []nostr.Filter) ([]*nostr.Event, error) {
+	relay, err := connectRelay(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	var all []*nostr.Event
+	authenticated := false
+	for _, filter := range filters {
+		events, err := relay.query(ctx, filter)
+		if err == errAuthRequired && !authenticated {
+			if serviceSecretKey == "" {
+				debugf(ctx, "Relay %s requires auth, skipping", url)
+				return nil, nil
+			}
+			if relay.challenge == "" {
+				return nil, fmt.Errorf("auth required but no challenge received")
+			}
+			if err := authenticateRelay(ctx, relay, relay.challenge); err != nil {
+				return nil, fmt.Errorf("auth failed: %v", err)
+			}
+			debugf(ctx, "Authenticated to relay %s, retrying subscription", url)
+			authenticated = true
+			events, err = relay.query(ctx, filter)
+		}
+		all = append(all, events...)
+		if err != nil {
+			return all, err
+		}
+	}
+	return all, nil
+}
+
+// connectRelay connects to url, retrying transient failures with
+// exponential backoff without exceeding the deadline of ctx. Every relay
+// connection is dialed here so that it holds a slot of relayConns until
+// it is closed.
+func connectRelay(ctx context.Context, url string) (*relayConn, error) {
+	if err := acquireRelayConn(ctx); err != nil {
+		return nil, err
+	}
+
+	delay := relayRetryDelay
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		connectCtx, cancel := context.WithTimeout(ctx, relayConnectTimeout)
+		relay, err := dialRelay(connectCtx, url)
+		cancel()
+		observeRelay("connect", start)
+		if err == nil {
+			relay.release = releaseRelayConn
+			return relay, nil
+		}
+		// A refused private address will not become public on retry
+		if attempt >= relayConnectRetries || errors.Is(err, errPrivateAddress) {
+			releaseRelayConn()
+			return nil, err
+		}
+
+		debugf(ctx, "Failed to connect to relay %s (attempt %d): %v; retrying in %v", url, attempt+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			releaseRelayConn()
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// authenticateRelay answers a NIP-42 challenge using the service key
+func authenticateRelay(ctx context.Context, relay *relayConn, challenge string) error {
+	pubkey, err := nostr.GetPublicKey(serviceSecretKey)
+	if err != nil {
+		return err
+	}
+
+	ev := nip42.CreateUnsignedAuthEvent(challenge, pubkey, relay.url)
+	if err := ev.Sign(serviceSecretKey); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	status, err := relay.auth(ctx, ev)
+	if err != nil {
+		return err
+	}
+	if status == nostr.PublishStatusFailed {
+		return fmt.Errorf("relay rejected authentication")
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayListData returns the JSON of an unsigned kind-10002 event with tags
+func relayListData(tags ...nostr.Tag) string {
+	ev := nostr.Event{Kind: 10002, Tags: tags}
+	return ev.String()
+}
+
+func TestReadRelaysForPubkey(t *testing.T) {
+	const pubkey = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"no list", "", nil},
+		{
+			"read and unmarked",
+			relayListData(nostr.Tag{"r", "wss://read.example/", "read"}, nostr.Tag{"r", "wss://both.example"}, nostr.Tag{"r", "wss://write.example", "write"}),
+			[]string{"wss://read.example", "wss://both.example"},
+		},
+		{
+			"invalid and private hosts dropped",
+			relayListData(
+				nostr.Tag{"r", "https://not-a-relay.example"},
+				nostr.Tag{"r", "ws://localhost:7777"},
+				nostr.Tag{"r", "ws://127.0.0.1:7777"},
+				nostr.Tag{"r", "wss://10.0.0.5"},
+				nostr.Tag{"r", "wss://[::1]:443"},
+				nostr.Tag{"r", "wss://169.254.169.254"},
+				nostr.Tag{"r", "wss://public.example"},
+			),
+			[]string{"wss://public.example"},
+		},
+		{
+			"capped and deduplicated",
+			relayListData(
+				nostr.Tag{"r", "wss://a.example"}, nostr.Tag{"r", "wss://A.example/"},
+				nostr.Tag{"r", "wss://b.example"}, nostr.Tag{"r", "wss://c.example"},
+				nostr.Tag{"r", "wss://d.example"}, nostr.Tag{"r", "wss://e.example"},
+			),
+			[]string{"wss://a.example", "wss://b.example", "wss://c.example", "wss://d.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			rows := sqlmock.NewRows([]string{"event_data"})
+			if tt.data != "" {
+				rows.AddRow(tt.data)
+			}
+			mock.ExpectQuery(`event_kind = 10002`).WithArgs(pubkey).WillReturnRows(rows)
+
+			if got := readRelaysForPubkey(context.Background(), db, pubkey); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readRelaysForPubkey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayListDirectsProfileFetch(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"olga"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer profiles.delete(pubkey)
+
+	// Registered before newMockRelay's cleanup, so it runs after it
+	relays, dial := readRelays, relayNetDial
+	t.Cleanup(func() { readRelays, relayNetDial = relays, dial })
+	readRelays = nil
+	configured := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	own := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			reply(eventMessage(req.SubscriptionID, metadata))
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+	readRelays = []string{configured.url}
+	// The relay list names a public address, which is dialed on the mock
+	const ownRelay = "ws://203.0.113.10"
+	ownAddr := strings.TrimPrefix(own.url, "ws://")
+	relayNetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "203.0.113.10:80" {
+			addr = ownAddr
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(`event_kind = 10002`).WithArgs(pubkey).
+		WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(relayListData(nostr.Tag{"r", ownRelay, "read"})))
+
+	profile, err := getProfile(context.Background(), db, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "olga" || profile.SourceRelay != ownRelay {
+		t.Errorf("profile = %+v, want olga from %s", profile, ownRelay)
+	}
+	if own.count("REQ") != 1 {
+		t.Errorf("the relay from the relay list received %d subscriptions, want 1", own.count("REQ"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteRelaysForPubkey(t *testing.T) {
+	const pubkey = "2c7cc62a697ea3a7826521f3fd34f0cb273693cbe5e9310f35449f43622a5cdc"
+	defer func(relays []string) { writeRelays = relays }(writeRelays)
+	writeRelays = []string{"wss://configured.example"}
+
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"no relay list uses the configured relays", "", []string{"wss://configured.example"}},
+		{
+			"write and unmarked relays from NIP-65",
+			relayListData(nostr.Tag{"r", "wss://outbox.example", "write"}, nostr.Tag{"r", "wss://inbox.example", "read"}, nostr.Tag{"r", "wss://both.example"}),
+			[]string{"wss://outbox.example", "wss://both.example"},
+		},
+		{
+			"read-only list falls back",
+			relayListData(nostr.Tag{"r", "wss://inbox.example", "read"}),
+			[]string{"wss://configured.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			rows := sqlmock.NewRows([]string{"event_data"})
+			if tt.data != "" {
+				rows.AddRow(tt.data)
+			}
+			mock.ExpectQuery(`event_kind = 10002`).WithArgs(pubkey).WillReturnRows(rows)
+
+			if got := writeRelaysForPubkey(context.Background(), db, pubkey); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeRelaysForPubkey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryRelayAuth(t *testing.T) {
+	author := nostr.GeneratePrivateKey()
+	authorPubkey, _ := nostr.GetPublicKey(author)
+	profile := nostr.Event{Kind: 0, Content: `{"name":"carol"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	profile.Sign(author)
+
+	defer func(key string) { serviceSecretKey = key }(serviceSecretKey)
+
+	tests := []struct {
+		name string
+		// members is whether the relay hides events until authenticated;
+		// otherwise it challenges but answers anyway
+		members  bool
+		acceptOK bool
+		key      bool
+		want     int
+		wantErr  string
+		wantAuth int
+	}{
+		{name: "challenge without a key is skipped", members: true, want: 0},
+		{name: "authenticates and retries", members: true, acceptOK: true, key: true, want: 1, wantAuth: 1},
+		{name: "rejected auth", members: true, key: true, wantErr: "auth failed", wantAuth: 1},
+		{name: "challenge on a public relay", members: false, key: true, want: 1, wantAuth: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceSecretKey = ""
+			if tt.key {
+				serviceSecretKey = nostr.GeneratePrivateKey()
+			}
+			servicePubkey, _ := nostr.GetPublicKey(serviceSecretKey)
+
+			var relay *mockRelay
+			authed := false
+			relay = newMockRelay(t, `["AUTH","c-`+tt.name+`"]`, func(reply func(string), msg []byte) {
+				switch env := nostr.ParseMessage(msg).(type) {
+				case *nostr.AuthEnvelope:
+					tag := env.Event.Tags.GetFirst([]string{"challenge"})
+					valid, _ := env.Event.CheckSignature()
+					if tt.acceptOK && valid && env.Event.PubKey == servicePubkey && tag != nil && tag.Value() == "c-"+tt.name &&
+						env.Event.Tags.GetFirst([]string{"relay", relay.url}) != nil {
+						authed = true
+						reply(`["OK","` + env.Event.ID + `",true,""]`)
+						return
+					}
+					reply(`["OK","` + env.Event.ID + `",false,"restricted: not a member"]`)
+				case *nostr.ReqEnvelope:
+					if tt.members && !authed {
+						reply(`["CLOSED","` + env.SubscriptionID + `","auth-required: members only"]`)
+						return
+					}
+					reply(eventMessage(env.SubscriptionID, profile))
+					reply(`["EOSE","` + env.SubscriptionID + `"]`)
+				}
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			events, err := queryRelay(ctx, relay.url, nostr.Filter{Authors: []string{authorPubkey}, Kinds: []int{0}})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("queryRelay() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.want {
+				t.Errorf("queryRelay() returned %d events, want %d", len(events), tt.want)
+			}
+			if got := relay.count("AUTH"); got != tt.wantAuth {
+				t.Errorf("relay received %d AUTH messages, want %d", got, tt.wantAuth)
+			}
+			if got := relay.connections(); got != 1 {
+				t.Errorf("relay accepted %d connections, want 1", got)
+			}
+		})
+	}
+}
+
+func TestConnectRelayFailuresLeaveNoGoroutines(t *testing.T) {
+	// A listener that is closed at once leaves a port nothing accepts on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "ws://" + l.Addr().String()
+	l.Close()
+	defer func(relays []string, delay time.Duration) { readRelays, relayRetryDelay = relays, delay }(readRelays, relayRetryDelay)
+	readRelays = []string{dead}
+	relayRetryDelay = time.Millisecond
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if _, err := connectRelay(context.Background(), dead); err == nil {
+			t.Fatal("connectRelay() to a closed port succeeded")
+		}
+	}
+	// Give exiting goroutines a moment to finish
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines grew from %d to %d after failed dials", before, after)
+	}
+	if len(relayConns) != 0 {
+		t.Errorf("%d connection slots still held", len(relayConns))
+	}
+}
+
+// flakyRelay starts a relay refusing its first fails websocket handshakes
+// with 503, returning its URL and the number of handshakes attempted
+func flakyRelay(t *testing.T, fails int32) (string, *atomic.Int32) {
+	t.Helper()
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= fails {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, err := wsutil.ReadClientText(conn); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), &attempts
+}
+
+func TestConnectRelayRetries(t *testing.T) {
+	defer func(relays []string, retries int, delay time.Duration) {
+		readRelays, relayConnectRetries, relayRetryDelay = relays, retries, delay
+	}(readRelays, relayConnectRetries, relayRetryDelay)
+	relayRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name         string
+		fails        int32
+		retries      int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "first attempt", fails: 0, retries: 2, wantAttempts: 1},
+		{name: "fails once then succeeds", fails: 1, retries: 2, wantAttempts: 2},
+		{name: "succeeds on the last retry", fails: 2, retries: 2, wantAttempts: 3},
+		{name: "gives up after the retries", fails: 3, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "retries disabled", fails: 1, retries: 0, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, attempts := flakyRelay(t, tt.fails)
+			readRelays = []string{url}
+			relayConnectRetries = tt.retries
+
+			relay, err := connectRelay(context.Background(), url)
+			if err == nil {
+				relay.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("connectRelay() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("relay saw %d handshakes, want %d", got, tt.wantAttempts)
+			}
+			if len(relayConns) != 0 {
+				t.Errorf("%d connection slots still held", len(relayConns))
+			}
+		})
+	}
+
+	t.Run("retries stop at the deadline", func(t *testing.T) {
+		url, attempts := flakyRelay(t, 10)
+		readRelays = []string{url}
+		relayConnectRetries, relayRetryDelay = 5, time.Minute
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := connectRelay(ctx, url); err == nil {
+			t.Fatal("connectRelay() succeeded")
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("connectRelay() took %v waiting to retry past the deadline", d)
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Errorf("relay saw %d handshakes, want 1", got)
+		}
+	})
+}
+
+func TestNormalizeRelays(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	got := normalizeRelays([]string{
+		"wss://relay.damus.io",
+		" WSS://Relay.Damus.IO/ ",
+		"wss://nos.lol",
+		"https://nos.lol",
+		"relay.example.com",
+		"wss://",
+		"wss://nos.lol/",
+		"ws://127.0.0.1:7777/path/",
+	})
+	want := []string{"wss://relay.damus.io", "wss://nos.lol", "ws://127.0.0.1:7777/path"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeRelays() = %q, want %q", got, want)
+	}
+	for _, invalid := range []string{`"https://nos.lol"`, `"relay.example.com"`, `"wss://"`} {
+		if !strings.Contains(logged.String(), "Ignoring invalid relay URL "+invalid) {
+			t.Errorf("invalid relay %s was not logged:\n%s", invalid, logged.String())
+		}
+	}
+	if got := normalizeRelays([]string{"nope"}); len(got) != 0 {
+		t.Errorf("normalizeRelays() of only invalid entries = %q", got)
+	}
+}
+
+// countingConn reports its Close to the dialer that opened it
+type countingConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *countingConn) Close() error {
+	c.closed()
+	return c.Conn.Close()
+}
+
+func TestRelayConnsCapDials(t *testing.T) {
+	url, _ := flakyRelay(t, 0)
+	defer func(relays []string, conns chan struct{}, dial netDialFunc) {
+		readRelays, relayConns, relayNetDial = relays, conns, dial
+	}(readRelays, relayConns, relayNetDial)
+	readRelays = []string{url}
+	relayConns = make(chan struct{}, 2)
+
+	var mu sync.Mutex
+	var open, peak int
+	var dials atomic.Int32
+	relayNetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		open++
+		peak = max(peak, open)
+		mu.Unlock()
+		var once sync.Once
+		return &countingConn{Conn: conn, closed: func() {
+			once.Do(func() {
+				mu.Lock()
+				open--
+				mu.Unlock()
+			})
+		}}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay, err := connectRelay(context.Background(), url)
+			if err != nil {
+				errs <- err
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+			relay.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("connectRelay() error = %v", err)
+	}
+	if peak != 2 {
+		t.Errorf("%d connections were open at once, want the cap of 2", peak)
+	}
+	if got := dials.Load(); got != 6 {
+		t.Errorf("%d dials, want 6 once slots freed up", got)
+	}
+	if len(relayConns) != 0 {
+		t.Errorf("%d connection slots still held", len(relayConns))
+	}
+
+	t.Run("saturated", func(t *testing.T) {
+		relayConns <- struct{}{}
+		relayConns <- struct{}{}
+		defer func() { <-relayConns; <-relayConns }()
+		dials.Store(0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := connectRelay(ctx, url); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("connectRelay() error = %v, want the deadline while waiting for a slot", err)
+		}
+		if got := dials.Load(); got != 0 {
+			t.Errorf("%d dials while saturated, want none", got)
+		}
+	})
+}
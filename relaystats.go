@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// relayStat is the in-memory track record of a single relay
+type relayStat struct {
+	successes int
+	failures  int
+	latency   time.Duration // moving average of successful queries
+}
+
+// score estimates the chance the relay answers, starting at 0.5 for a
+// relay without history
+func (s *relayStat) score() float64 {
+	return float64(s.successes+1) / float64(s.successes+s.failures+2)
+}
+
+// relayStats tracks how relays have performed since the process started
+type relayStats struct {
+	mu    sync.Mutex
+	stats map[string]*relayStat
+}
+
+var relayHealth = &relayStats{stats: map[string]*relayStat{}}
+
+// record notes the outcome of a query to url that took latency
+func (r *relayStats) record(url string, err error, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.stats[url]
+	if !ok {
+		s = &relayStat{}
+		r.stats[url] = s
+	}
+	if err != nil {
+		s.failures++
+		return
+	}
+	s.successes++
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency = (s.latency*3 + latency) / 4
+	}
+}
+
+// ordered returns relays sorted so the historically most reliable, then
+// fastest, relays come first. Ties keep the configured order.
+func (r *relayStats) ordered(relays []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stat := func(url string) relayStat {
+		if s, ok := r.stats[url]; ok {
+			return *s
+		}
+		return relayStat{}
+	}
+
+	result := append([]string{}, relays...)
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := stat(result[i]), stat(result[j])
+		if a.score() != b.score() {
+			return a.score() > b.score()
+		}
+		return a.latency != 0 && (b.latency == 0 || a.latency < b.latency)
+	})
+	return result
+}
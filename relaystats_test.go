@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRelayStatsOrdered(t *testing.T) {
+	failed := errors.New("connection refused")
+	relays := []string{"wss://a.example", "wss://b.example", "wss://c.example"}
+	tests := []struct {
+		name    string
+		history func(s *relayStats)
+		want    []string
+	}{
+		{
+			name:    "no history keeps the configured order",
+			history: func(*relayStats) {},
+			want:    relays,
+		},
+		{
+			name: "a failing relay goes last",
+			history: func(s *relayStats) {
+				s.record("wss://a.example", failed, 0)
+				s.record("wss://a.example", failed, 0)
+			},
+			want: []string{"wss://b.example", "wss://c.example", "wss://a.example"},
+		},
+		{
+			name: "a reliable relay goes first",
+			history: func(s *relayStats) {
+				s.record("wss://c.example", nil, 80*time.Millisecond)
+			},
+			want: []string{"wss://c.example", "wss://a.example", "wss://b.example"},
+		},
+		{
+			name: "equal records are ordered by latency",
+			history: func(s *relayStats) {
+				s.record("wss://a.example", nil, 300*time.Millisecond)
+				s.record("wss://b.example", nil, 40*time.Millisecond)
+				s.record("wss://c.example", nil, 90*time.Millisecond)
+			},
+			want: []string{"wss://b.example", "wss://c.example", "wss://a.example"},
+		},
+		{
+			name: "one failure among many successes still beats a new relay",
+			history: func(s *relayStats) {
+				for i := 0; i < 4; i++ {
+					s.record("wss://b.example", nil, 50*time.Millisecond)
+				}
+				s.record("wss://b.example", failed, 0)
+			},
+			want: []string{"wss://b.example", "wss://a.example", "wss://c.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &relayStats{stats: map[string]*relayStat{}}
+			tt.history(stats)
+			if got := stats.ordered(relays); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ordered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailingRelayIsDeprioritized(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	metadata := nostr.Event{Kind: 0, Content: `{"name":"mallory"}`, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	metadata.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Nothing listens on a port whose listener was closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "ws://" + l.Addr().String()
+	l.Close()
+
+	// Registered before newMockRelay's cleanup, so it runs after it
+	relays, retries, health := readRelays, relayConnectRetries, relayHealth
+	t.Cleanup(func() { readRelays, relayConnectRetries, relayHealth = relays, retries, health })
+	readRelays, relayConnectRetries = []string{down}, 0
+	relayHealth = &relayStats{stats: map[string]*relayStat{}}
+	// The answer is delayed so the refused dial is recorded before the race ends
+	up := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if req, ok := nostr.ParseMessage(msg).(*nostr.ReqEnvelope); ok {
+			time.Sleep(50 * time.Millisecond)
+			reply(eventMessage(req.SubscriptionID, metadata))
+			reply(`["EOSE","` + req.SubscriptionID + `"]`)
+		}
+	})
+
+	if got := profileRelays(nil); !reflect.DeepEqual(got, []string{down, up.url}) {
+		t.Fatalf("relays before any fetch = %v, want the configured order", got)
+	}
+	for i := 0; i < 2; i++ {
+		profile, err := fetchProfileFromRelays(context.Background(), pubkey, nil)
+		if err != nil || profile.Name != "mallory" {
+			t.Fatalf("fetchProfileFromRelays() = %+v, %v", profile, err)
+		}
+	}
+	if got := profileRelays(nil); !reflect.DeepEqual(got, []string{up.url, down}) {
+		t.Errorf("relays after the failures = %v, want the failing relay last", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// maxRenderContent is the most bytes of an event shown inline; larger
+// events are cut short and must be downloaded. Zero means no limit.
+var maxRenderContent = 100 * 1024
+
+// truncateBytes cuts s to at most n bytes at a rune boundary, reporting
+// whether anything was cut. A non-positive n leaves s unchanged.
+func truncateBytes(s string, n int) (string, bool) {
+	if n <= 0 || len(s) <= n {
+		return s, false
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
+
+// ContentTruncated reports whether the event is too large to be shown inline
+// in full
+func (e Event) ContentTruncated() bool {
+	return maxRenderContent > 0 && len(e.EventData) > maxRenderContent
+}
+
+// templateFuncs are the helper functions available to page templates
+var templateFuncs = template.FuncMap{
+	"npubLink": npubLink,
+}
+
+// npubLink links a hex pubkey to its page, showing the npub shortened to
+// its start and end. An invalid pubkey is shown as is.
+func npubLink(pubkey string) template.HTML {
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil || !nostr.IsValidPublicKeyHex(pubkey) {
+		return template.HTML(template.HTMLEscapeString(pubkey))
+	}
+	short := npub[:9] + "…" + npub[len(npub)-4:]
+	return template.HTML(`<a href="` + site.BasePath + `/npub/` + npub + `" title="` + npub + `">` + short + `</a>`)
+}
+
+// contentLinkPattern matches http(s) URLs and nostr: references in content
+var contentLinkPattern = regexp.MustCompile(`https?://[^\s<>"']+|nostr:(?:npub1|nprofile1|note1|nevent1|naddr1)[02-9ac-hj-np-z]+`)
+
+// nostrLink returns the local page for a nostr: reference, or "" if it
+// cannot be decoded
+func nostrLink(ref string) string {
+	bech := strings.TrimPrefix(ref, "nostr:")
+	prefix, value, err := nip19.Decode(bech)
+	if err != nil {
+		return ""
+	}
+
+	switch prefix {
+	case "npub", "nprofile":
+		return site.BasePath + "/npub/" + bech
+	case "naddr":
+		return site.BasePath + "/naddr/" + bech
+	case "note":
+		if id, ok := value.(string); ok {
+			return site.BasePath + "/api/event/" + id
+		}
+	case "nevent":
+		if pointer, ok := value.(nostr.EventPointer); ok {
+			return site.BasePath + "/api/event/" + pointer.ID
+		}
+	}
+	return ""
+}
+
+// renderContent escapes content as HTML, turning http(s) URLs and nostr:
+// references into links
+func renderContent(content string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, loc := range contentLinkPattern.FindAllStringIndex(content, -1) {
+		b.WriteString(template.HTMLEscapeString(content[last:loc[0]]))
+		// Leave trailing punctuation outside the link
+		match := strings.TrimRight(content[loc[0]:loc[1]], ".,;:!?)")
+		last = loc[0] + len(match)
+
+		href := match
+		if strings.HasPrefix(match, "nostr:") {
+			href = nostrLink(match)
+		}
+		if href == "" {
+			b.WriteString(template.HTMLEscapeString(match))
+			continue
+		}
+
+		b.WriteString(`<a href="`)
+		b.WriteString(template.HTMLEscapeString(href))
+		if strings.HasPrefix(href, "/") {
+			b.WriteString(`">`)
+		} else {
+			b.WriteString(`" rel="nofollow noopener" target="_blank">`)
+		}
+		b.WriteString(template.HTMLEscapeString(match))
+		b.WriteString(`</a>`)
+	}
+	b.WriteString(template.HTMLEscapeString(content[last:]))
+	return template.HTML(b.String())
+}
+
+// RenderedContent returns the event content as HTML with links
+func (e Event) RenderedContent() template.HTML {
+	ev, err := e.parse()
+	if err != nil {
+		return ""
+	}
+	content, _ := truncateBytes(ev.Content, maxRenderContent)
+	return renderContent(content)
+}
+
+// highlightContent escapes content as HTML, wrapping every case-insensitive
+// occurrence of term in <mark>
+func highlightContent(content, term string) template.HTML {
+	if term == "" {
+		return template.HTML(template.HTMLEscapeString(content))
+	}
+
+	var b strings.Builder
+	last := 0
+	re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(term))
+	for _, loc := range re.FindAllStringIndex(content, -1) {
+		b.WriteString(template.HTMLEscapeString(content[last:loc[0]]))
+		b.WriteString(`<mark>`)
+		b.WriteString(template.HTMLEscapeString(content[loc[0]:loc[1]]))
+		b.WriteString(`</mark>`)
+		last = loc[1]
+	}
+	b.WriteString(template.HTMLEscapeString(content[last:]))
+	return template.HTML(b.String())
+}
+
+// HighlightedContent returns the event content as HTML with term highlighted
+func (e Event) HighlightedContent(term string) template.HTML {
+	ev, err := e.parse()
+	if err != nil {
+		return ""
+	}
+	content, _ := truncateBytes(ev.Content, maxRenderContent)
+	return highlightContent(content, term)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRenderContent(t *testing.T) {
+	npub, _ := nip19.EncodePublicKey("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	id := strings.Repeat("ab", 32)
+	note, _ := nip19.EncodeNote(id)
+	nevent, _ := nip19.EncodeEvent(id, []string{"wss://relay.example"}, "")
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain text", "gm nostr", "gm nostr"},
+		{
+			"url",
+			"see https://example.com/a?b=1&c=2 now",
+			`see <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener" target="_blank">https://example.com/a?b=1&amp;c=2</a> now`,
+		},
+		{
+			"trailing punctuation stays outside",
+			"(read https://example.com/post).",
+			`(read <a href="https://example.com/post" rel="nofollow noopener" target="_blank">https://example.com/post</a>).`,
+		},
+		{"npub reference", "hi nostr:" + npub, `hi <a href="/npub/` + npub + `">nostr:` + npub + `</a>`},
+		{"note reference", "nostr:" + note, `<a href="/api/event/` + id + `">nostr:` + note + `</a>`},
+		{"nevent reference", "nostr:" + nevent + "!", `<a href="/api/event/` + id + `">nostr:` + nevent + `</a>!`},
+		{"undecodable reference stays text", "nostr:npub1qqqq", "nostr:npub1qqqq"},
+		{"raw html is escaped", `<script>alert("x")</script>`, `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`},
+		{
+			"url cannot break out of the attribute",
+			`https://evil.example/"onmouseover="alert(1)`,
+			`<a href="https://evil.example/" rel="nofollow noopener" target="_blank">https://evil.example/</a>&#34;onmouseover=&#34;alert(1)`,
+		},
+		{"javascript scheme is not linked", "javascript:alert(1)", "javascript:alert(1)"},
+		{
+			"mixed",
+			"<b>" + "nostr:" + npub + "</b> https://a.example",
+			`&lt;b&gt;<a href="/npub/` + npub + `">nostr:` + npub + `</a>&lt;/b&gt; <a href="https://a.example" rel="nofollow noopener" target="_blank">https://a.example</a>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(renderContent(tt.content)); got != tt.want {
+				t.Errorf("renderContent(%q)\n got %s\nwant %s", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		term    string
+		want    string
+	}{
+		{"no term escapes only", "a < b", "", "a &lt; b"},
+		{"case-insensitive", "GM and gm", "gm", "<mark>GM</mark> and <mark>gm</mark>"},
+		{"no match", "hello", "bye", "hello"},
+		{"markup around a match is escaped", `<img src=x onerror="gm">`, "gm", `&lt;img src=x onerror=&#34;<mark>gm</mark>&#34;&gt;`},
+		{"term with html is matched on raw text", "1 <b> 2", "<b>", "1 <mark>&lt;b&gt;</mark> 2"},
+		{"regexp characters are literal", "cost: $5.00 (approx)", "$5.00 (", "cost: <mark>$5.00 (</mark>approx)"},
+		{"ampersand", "tom & jerry", "&", "tom <mark>&amp;</mark> jerry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(highlightContent(tt.content, tt.term)); got != tt.want {
+				t.Errorf("highlightContent(%q, %q)\n got %s\nwant %s", tt.content, tt.term, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		s       string
+		n       int
+		want    string
+		wantCut bool
+	}{
+		{"short", 10, "short", false},
+		{"exact", 5, "exact", false},
+		{"longer text", 6, "longer", true},
+		{"日本語", 4, "日", true},
+		{"日本語", 6, "日本", true},
+		{"héllo", 2, "h", true},
+		{"unlimited", 0, "unlimited", false},
+	}
+	for _, tt := range tests {
+		got, cut := truncateBytes(tt.s, tt.n)
+		if got != tt.want || cut != tt.wantCut {
+			t.Errorf("truncateBytes(%q, %d) = %q, %v, want %q, %v", tt.s, tt.n, got, cut, tt.want, tt.wantCut)
+		}
+	}
+}
+
+func TestNpubLink(t *testing.T) {
+	const pubkey = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	const npub = "npub10xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqpkge6d"
+	const short = "npub10xlx…ge6d"
+	defer func(base string) { site.BasePath = base }(site.BasePath)
+
+	tests := []struct {
+		name     string
+		basePath string
+		in       string
+		want     string
+	}{
+		{"valid", "", pubkey, `<a href="/npub/` + npub + `" title="` + npub + `">` + short + `</a>`},
+		{"under a base path", "/backup", pubkey, `<a href="/backup/npub/` + npub + `" title="` + npub + `">` + short + `</a>`},
+		{"uppercase hex", "", strings.ToUpper(pubkey), strings.ToUpper(pubkey)},
+		{"too short", "", pubkey[:62], pubkey[:62]},
+		{"markup is escaped", "", `<script>`, `&lt;script&gt;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site.BasePath = tt.basePath
+			if got := string(npubLink(tt.in)); got != tt.want {
+				t.Errorf("npubLink(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// replyToID returns the id of the event a kind-1 note replies to, taken
+// from its "e" tag marked "reply", or "" if it is not a marked reply
+func (e Event) replyToID() string {
+	if e.Kind != 1 {
+		return ""
+	}
+	ev, err := e.parse()
+	if err != nil {
+		return ""
+	}
+	for _, tag := range ev.Tags {
+		if len(tag) >= 4 && tag[0] == "e" && tag[3] == "reply" && eventIDPattern.MatchString(tag[1]) {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// queryEventsByIDs returns the stored events with the given ids, by id
+func queryEventsByIDs(ctx context.Context, db *sql.DB, ids []string) (map[string]Event, error) {
+	defer observeDBQuery("events_by_ids", time.Now())
+
+	query := `SELECT id, pubkey, created_at, event_kind, event_data FROM event_backup WHERE id = ANY($1)`
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := map[string]Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events[event.ID] = event
+	}
+	return events, rows.Err()
+}
+
+// attachReplyParents sets ReplyTo on each reply whose parent is stored in
+// event_backup. Only the direct parent is loaded, never its own parent.
+func attachReplyParents(ctx context.Context, db *sql.DB, events []Event) {
+	parentIDs := make([]string, len(events))
+	var ids []string
+	seen := map[string]bool{}
+	for i := range events {
+		id := events[i].replyToID()
+		parentIDs[i] = id
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	parents, err := queryEventsByIDs(ctx, db, ids)
+	if err != nil {
+		logf(ctx, "Failed to load reply parents: %v", err)
+		return
+	}
+	for i, id := range parentIDs {
+		if parent, ok := parents[id]; ok && !isBlocked(parent.Pubkey) {
+			events[i].ReplyTo = &parent
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestReplyToID(t *testing.T) {
+	parent := strings.Repeat("a", 64)
+	root := strings.Repeat("b", 64)
+	tests := []struct {
+		name string
+		kind int
+		tags nostr.Tags
+		want string
+	}{
+		{"marked reply", 1, nostr.Tags{{"e", root, "", "root"}, {"e", parent, "wss://relay.example", "reply"}}, parent},
+		{"root only", 1, nostr.Tags{{"e", root, "", "root"}}, ""},
+		{"unmarked e tag", 1, nostr.Tags{{"e", parent}}, ""},
+		{"malformed id", 1, nostr.Tags{{"e", "not-an-id", "", "reply"}}, ""},
+		{"not a note", 7, nostr.Tags{{"e", parent, "", "reply"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := nostr.Event{Kind: tt.kind, Tags: tt.tags}
+			e := Event{Kind: tt.kind, EventData: ev.String()}
+			if got := e.replyToID(); got != tt.want {
+				t.Errorf("replyToID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachReplyParentsLoadsOneLevel(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	grandparent := nostr.Event{Kind: 1, Content: "the thread starts", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	grandparent.Sign(sk)
+	parent := nostr.Event{Kind: 1, Content: "a reply", CreatedAt: 1700000100, Tags: nostr.Tags{{"e", grandparent.ID, "", "reply"}}}
+	parent.Sign(sk)
+	reply := nostr.Event{Kind: 1, Content: "a reply to the reply", CreatedAt: 1700000200, Tags: nostr.Tags{{"e", parent.ID, "", "reply"}}}
+	reply.Sign(sk)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Only the reply's parent is looked up, in a single query
+	mock.ExpectQuery(`WHERE id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+			AddRow(parent.ID, pubkey, int64(parent.CreatedAt), 1, parent.String()))
+
+	events := []Event{{ID: reply.ID, Pubkey: pubkey, Kind: 1, EventData: reply.String()}}
+	attachReplyParents(context.Background(), db, events)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if events[0].ReplyTo == nil || events[0].ReplyTo.ID != parent.ID {
+		t.Fatalf("ReplyTo = %+v, want the parent %s", events[0].ReplyTo, parent.ID)
+	}
+	if events[0].ReplyTo.ReplyTo != nil {
+		t.Error("the parent's own parent was loaded")
+	}
+}
+
+func TestNpubPageShowsReplyParent(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	parent := nostr.Event{Kind: 1, Content: "is anyone   still\nrunning a relay?", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	parent.Sign(sk)
+	reply := nostr.Event{Kind: 1, Content: "yes, two of them", CreatedAt: 1700000500, Tags: nostr.Tags{{"e", parent.ID, "", "reply"}}}
+	reply.Sign(sk)
+	orphan := nostr.Event{Kind: 1, Content: "replying to a lost note", CreatedAt: 1700000600, Tags: nostr.Tags{{"e", strings.Repeat("c", 64), "", "reply"}}}
+	orphan.Sign(sk)
+	profiles.set(pubkey, &UserProfile{Name: "rowan"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	columns := []string{"id", "pubkey", "created_at", "event_kind", "event_data"}
+	mock.ExpectQuery(`ORDER BY event_kind ASC`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(orphan.ID, pubkey, int64(orphan.CreatedAt), 1, orphan.String()).
+			AddRow(reply.ID, pubkey, int64(reply.CreatedAt), 1, reply.String()))
+	mock.ExpectQuery(`WHERE id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(parent.ID, pubkey, int64(parent.CreatedAt), 1, parent.String()))
+
+	rec := httptest.NewRecorder()
+	npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	body := rec.Body.String()
+	if n := strings.Count(body, `<blockquote class="reply-context">`); n != 1 {
+		t.Errorf("page has %d reply previews, want 1 for the stored parent", n)
+	}
+	if !strings.Contains(body, ": is anyone still running a relay?</blockquote>") {
+		t.Error("reply preview does not quote the parent's content")
+	}
+}
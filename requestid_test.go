@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{"generated", "", false},
+		{"reused from the proxy", "edge-7f3a.42", true},
+		{"invalid incoming id replaced", "bad id\nforged log line", false},
+		{"overlong incoming id replaced", strings.Repeat("a", 65), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+			defer func(flags int) { log.SetFlags(flags) }(log.Flags())
+			log.SetFlags(0)
+
+			h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				logf(r.Context(), "Querying events")
+				errorf(r.Context(), "Query failed")
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/npub/x", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Request-ID")
+			if tt.wantSame && id != tt.incoming {
+				t.Errorf("X-Request-ID = %q, want the incoming %q", id, tt.incoming)
+			}
+			if !tt.wantSame && !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+				t.Errorf("X-Request-ID = %q, want a generated id", id)
+			}
+			want := "[" + id + "] Querying events\n[" + id + "] Query failed\n"
+			if logged.String() != want {
+				t.Errorf("log = %q, want %q", logged.String(), want)
+			}
+		})
+	}
+}
+
+func TestRequestIDsDiffer(t *testing.T) {
+	h := withRequestID(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		id := rec.Header().Get("X-Request-ID")
+		if seen[id] {
+			t.Fatalf("request id %s was generated twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// restoreTimeout bounds how long a server-side restore may run
+const restoreTimeout = 60 * time.Second
+
+// publishTimeout bounds waiting for a relay to acknowledge one event
+const publishTimeout = 7 * time.Second
+
+// maxRestoreSelected caps the number of ids accepted by /restore-selected
+const maxRestoreSelected = 100
+
+// restoreResult is the outcome of restoring one event, with the status
+// reported by each relay it was published to
+type restoreResult struct {
+	ID     string            `json:"id"`
+	Error  string            `json:"error,omitempty"`
+	Relays map[string]string `json:"relays,omitempty"`
+}
+
+// loadRestorableEvent loads a stored event by id and checks that its id
+// and signature are valid, so only authentic events are republished.
+// Events of blocked pubkeys are treated as missing.
+func loadRestorableEvent(ctx context.Context, db *sql.DB, id string) (*nostr.Event, error) {
+	eventData, err := queryEventByID(ctx, db, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("event not found")
+	}
+	if err != nil {
+		logf(ctx, "Failed to query event %s: %v", id, err)
+		return nil, fmt.Errorf("database error")
+	}
+
+	ev, err := restorableEvent(eventData, id)
+	if err == nil && isBlocked(ev.PubKey) {
+		return nil, fmt.Errorf("event not found")
+	}
+	return ev, err
+}
+
+// restorableEvent parses stored event data and checks that its id matches
+// id and its signature is valid
+func restorableEvent(eventData, id string) (*nostr.Event, error) {
+	// Publishing the canonical form means relays see exactly the signed
+	// fields, however the event was stored
+	ev, _, err := canonicalEvent(eventData)
+	if err == errEventIDMismatch || (err == nil && ev.ID != id) {
+		return nil, fmt.Errorf("stored event id does not match")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stored event is not valid JSON")
+	}
+	if ok, err := ev.CheckSignature(); err != nil || !ok {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return ev, nil
+}
+
+// confirmStatus is the status of a published event the relay returned when
+// queried afterwards
+const confirmStatus = "confirmed"
+
+// unconfirmedStatus is the status of a published event the relay did not
+// return when queried afterwards
+const unconfirmedStatus = "sent, unconfirmed"
+
+// publishResult describes the outcome of publishing one event to a relay.
+// A rejection keeps the relay's reason. With confirm, an event the relay
+// did not reject is confirmed only when it was found stored afterwards.
+func publishResult(status nostr.Status, err error, confirm, stored bool) string {
+	if confirm && stored {
+		return confirmStatus
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if confirm && status != nostr.PublishStatusFailed {
+		return unconfirmedStatus
+	}
+	return status.String()
+}
+
+// confirmEvents queries url for the given events, returning the ids of
+// those the relay has stored
+func confirmEvents(ctx context.Context, url string, events []*nostr.Event) (map[string]bool, error) {
+	ids := make([]string, len(events))
+	for i, ev := range events {
+		ids[i] = ev.ID
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	found, err := queryRelay(ctx, url, nostr.Filter{IDs: ids, Limit: len(ids)})
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]bool{}
+	for _, ev := range found {
+		stored[ev.ID] = true
+	}
+	return stored, nil
+}
+
+// publishEvents publishes the events queued for each relay, connecting to
+// each relay once, and returns the status per event id and relay. With
+// confirm, each relay is queried afterwards for the events it was sent, so
+// an event whose acknowledgement was lost can still be reported as stored.
+func publishEvents(ctx context.Context, queued map[string][]*nostr.Event, confirm bool) map[string]map[string]string {
+	results := map[string]map[string]string{}
+	var mu sync.Mutex
+	record := func(id, url, status string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if results[id] == nil {
+			results[id] = map[string]string{}
+		}
+		results[id][url] = status
+	}
+
+	connectFailures := 0
+	var wg sync.WaitGroup
+	for url, events := range queued {
+		wg.Add(1)
+		go func(url string, events []*nostr.Event) {
+			defer wg.Done()
+
+			relay, err := connectRelay(ctx, url)
+			if err != nil {
+				debugf(ctx, "Failed to connect to relay %s: %v", url, err)
+				mu.Lock()
+				connectFailures++
+				mu.Unlock()
+				for _, ev := range events {
+					record(ev.ID, url, "connect failed")
+				}
+				return
+			}
+			defer relay.Close()
+
+			statuses := make([]nostr.Status, len(events))
+			errs := make([]error, len(events))
+			for i, ev := range events {
+				start := time.Now()
+				publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+				statuses[i], errs[i] = relay.publish(publishCtx, *ev)
+				cancel()
+				observeRelay("publish", start)
+			}
+
+			var stored map[string]bool
+			if confirm {
+				stored, err = confirmEvents(ctx, url, events)
+				if err != nil {
+					debugf(ctx, "Failed to confirm events on relay %s: %v", url, err)
+				}
+			}
+
+			for i, ev := range events {
+				record(ev.ID, url, publishResult(statuses[i], errs[i], confirm, stored[ev.ID]))
+			}
+		}(url, events)
+	}
+	wg.Wait()
+	if len(queued) > 0 && connectFailures == len(queued) {
+		warnf(ctx, "Failed to connect to all %d relays for restore", connectFailures)
+	}
+	return results
+}
+
+// maxRequestRelays caps the number of relays a restore request may name
+const maxRequestRelays = 10
+
+// relayOverride is the relay list given in a restore request, replacing
+// the authors' write relays or, with merge, added to them
+type relayOverride struct {
+	relays []string
+	merge  bool
+}
+
+// newRelayOverride validates the relays given in a restore request, which
+// is only served to authorized requests. Private and loopback hosts are
+// refused here, and names resolving to them when dialed.
+func newRelayOverride(relays []string, merge bool) (relayOverride, error) {
+	if len(relays) == 0 {
+		return relayOverride{}, nil
+	}
+	if len(relays) > maxRequestRelays {
+		return relayOverride{}, fmt.Errorf("at most %d relays can be given", maxRequestRelays)
+	}
+	for _, relay := range relays {
+		u, err := url.Parse(strings.TrimSpace(relay))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return relayOverride{}, fmt.Errorf("invalid relay URL %q: must be ws:// or wss://", relay)
+		}
+		if !isPublicHost(u.Hostname()) {
+			return relayOverride{}, fmt.Errorf("invalid relay URL %q: must not be a private address", relay)
+		}
+	}
+	return relayOverride{relays: normalizeRelays(relays), merge: merge}, nil
+}
+
+// isSet reports whether the request named its own relays
+func (o relayOverride) isSet() bool {
+	return len(o.relays) > 0
+}
+
+// apply returns the relays to publish to instead of defaults
+func (o relayOverride) apply(defaults []string) []string {
+	if !o.isSet() {
+		return defaults
+	}
+	if !o.merge {
+		return o.relays
+	}
+	return normalizeRelays(append(append([]string{}, defaults...), o.relays...))
+}
+
+// restoreCall is an in-flight publish of one event that concurrent
+// restores of the same event wait on instead of publishing again
+type restoreCall struct {
+	done   chan struct{}
+	relays map[string]string
+}
+
+// restoresInFlight holds the events currently being published, by id
+var restoresInFlight = struct {
+	sync.Mutex
+	calls map[string]*restoreCall
+}{calls: map[string]*restoreCall{}}
+
+// claimRestore returns the call publishing id and whether the caller leads
+// it, in which case it must publish and then call finishRestore
+func claimRestore(id string) (*restoreCall, bool) {
+	restoresInFlight.Lock()
+	defer restoresInFlight.Unlock()
+
+	if call, ok := restoresInFlight.calls[id]; ok {
+		return call, false
+	}
+	call := &restoreCall{done: make(chan struct{})}
+	restoresInFlight.calls[id] = call
+	return call, true
+}
+
+// finishRestore records the result of a led call and wakes its waiters
+func finishRestore(id string, call *restoreCall, relays map[string]string) {
+	restoresInFlight.Lock()
+	delete(restoresInFlight.calls, id)
+	restoresInFlight.Unlock()
+
+	call.relays = relays
+	close(call.done)
+}
+
+// restoreEvents loads, verifies, and republishes the events with the given
+// ids to their authors' write relays. Unless owner is empty, only events
+// authored by owner are restored. An event already being published by
+// another request is not published again; its result is shared instead,
+// unless override names relays of its own. With confirm, relays are queried
+// to confirm they stored each event.
+func restoreEvents(ctx context.Context, db *sql.DB, ids []string, owner string, confirm bool, override relayOverride) []restoreResult {
+	results := make([]restoreResult, len(ids))
+	queued := map[string][]*nostr.Event{}
+	relaysByPubkey := map[string][]string{}
+	owned := map[string]*restoreCall{}
+	waiting := map[int]*restoreCall{}
+	var published map[string]map[string]string
+	defer func() {
+		for id, call := range owned {
+			finishRestore(id, call, published[id])
+		}
+	}()
+
+	for i, id := range ids {
+		results[i].ID = id
+		if !eventIDPattern.MatchString(id) {
+			results[i].Error = "invalid event id"
+			continue
+		}
+		ev, err := loadRestorableEvent(ctx, db, id)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if owner != "" && ev.PubKey != owner {
+			results[i].Error = "event belongs to another npub"
+			continue
+		}
+		// Relays reject events whose NIP-40 expiration has passed
+		if isExpired(ev, time.Now()) {
+			results[i].Error = "event has expired"
+			continue
+		}
+
+		// A concurrent restore to other relays has no result to share
+		if !override.isSet() {
+			call, leader := claimRestore(id)
+			if !leader {
+				waiting[i] = call
+				continue
+			}
+			owned[id] = call
+		}
+
+		relays, ok := relaysByPubkey[ev.PubKey]
+		if !ok {
+			relays = override.apply(writeRelaysForPubkey(ctx, db, ev.PubKey))
+			relaysByPubkey[ev.PubKey] = relays
+		}
+		for _, url := range relays {
+			queued[url] = append(queued[url], ev)
+		}
+	}
+
+	published = publishEvents(ctx, queued, confirm)
+	for id, call := range owned {
+		finishRestore(id, call, published[id])
+	}
+	owned = nil
+
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		if call, ok := waiting[i]; ok {
+			select {
+			case <-call.done:
+				results[i].Relays = call.relays
+			case <-ctx.Done():
+				results[i].Error = "timed out waiting for a concurrent restore"
+			}
+			continue
+		}
+		results[i].Relays = published[results[i].ID]
+	}
+	return results
+}
+
+// restoreSelectedRequest is the JSON object form of a /restore-selected body
+type restoreSelectedRequest struct {
+	IDs []string `json:"ids"`
+	// Relays replaces the authors' write relays, or is added to them with
+	// MergeRelays
+	Relays      []string `json:"relays"`
+	MergeRelays bool     `json:"merge_relays"`
+}
+
+// restoreSelectedHandler serves POST /restore-selected, republishing the
+// events whose ids are given as a JSON array, or as "ids" of a JSON object
+// that may also name the relays to publish to. The request must be signed
+// with NIP-98 by the author of the events, or carry the admin token. With
+// ?confirm=true each relay is queried afterwards to confirm it stored the
+// events.
+func restoreSelectedHandler(dbs *databases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if rejectReadOnly(w) {
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		owner, ok := authorizeRequest(w, r, body)
+		if !ok {
+			return
+		}
+
+		var req restoreSelectedRequest
+		if err := json.Unmarshal(body, &req.IDs); err != nil {
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, `Request body must be a JSON array of event ids or an object like {"ids": [...], "relays": [...]}`, http.StatusBadRequest)
+				return
+			}
+		}
+		override, err := newRelayOverride(req.Relays, req.MergeRelays)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids := req.IDs
+
+		seen := map[string]bool{}
+		unique := ids[:0]
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				unique = append(unique, id)
+			}
+		}
+		if len(unique) == 0 {
+			http.Error(w, "No event ids given", http.StatusBadRequest)
+			return
+		}
+		if len(unique) > maxRestoreSelected {
+			http.Error(w, fmt.Sprintf("At most %d events can be restored at once", maxRestoreSelected), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), restoreTimeout)
+		defer cancel()
+
+		confirm := r.URL.Query().Get("confirm") == "true"
+		results := restoreEvents(ctx, dbs.read(), unique, owner, confirm, override)
+		logf(ctx, "Restore of %d selected events requested by %s finished", len(results), clientIP(r))
+		writeJSON(w, http.StatusOK, map[string]any{"results": results})
+	}
+}
+
+// restoreAllTimeout bounds how long restoring all of an author's events may run
+const restoreAllTimeout = 5 * time.Minute
+
+// restoreAllBatchSize is how many events restore-all loads at a time
+var restoreAllBatchSize = 500
+
+// restoreAllRequest is the JSON body of POST /npub/{npub}/restore-all
+type restoreAllRequest struct {
+	// Mode is "strict" to stop at the first failed publish, or "besteffort"
+	// (the default) to publish every event regardless
+	Mode string `json:"mode"`
+	// IncludeExpired also publishes events whose NIP-40 expiration has passed
+	IncludeExpired bool `json:"include_expired"`
+	// IncludeDeleted also publishes events the author deleted with NIP-09
+	IncludeDeleted bool `json:"include_deleted"`
+	// ExcludeFutureDated skips events dated more than FUTURE_SKEW ahead,
+	// which some relays reject
+	ExcludeFutureDated bool `json:"exclude_future_dated"`
+	// Relays replaces the author's write relays, or is added to them with
+	// MergeRelays
+	Relays      []string `json:"relays"`
+	MergeRelays bool     `json:"merge_relays"`
+}
+
+// restoreFailure identifies the publish that stopped a strict restore
+type restoreFailure struct {
+	ID    string `json:"id"`
+	Relay string `json:"relay"`
+	Error string `json:"error"`
+}
+
+// relayTally counts the publishes to one relay by outcome
+type relayTally struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// restoreAllSummary is the outcome of restoring all of an author's events
+type restoreAllSummary struct {
+	Mode        string                 `json:"mode"`
+	Total       int                    `json:"total"`
+	Published   int                    `json:"published"`
+	Failed      int                    `json:"failed"`
+	Invalid     int                    `json:"invalid"`
+	Expired     int                    `json:"expired"`
+	Deleted     int                    `json:"deleted"`
+	FutureDated int                    `json:"future_dated"`
+	Relays      map[string]*relayTally `json:"relays"`
+	Aborted     *restoreFailure        `json:"aborted,omitempty"`
+}
+
+// restorer publishes events to relays one event at a time, connecting to
+// each relay once. An event counts as published when at least one relay
+// accepted it. In strict mode it stops at the first connection failure or
+// rejection, recording it in Aborted.
+type restorer struct {
+	ctx       context.Context
+	relays    []string
+	connected map[string]*relayConn
+	strict    bool
+	summary   restoreAllSummary
+}
+
+// newRestorer connects to relays. The caller must close the restorer.
+func newRestorer(ctx context.Context, relays []string, strict bool) *restorer {
+	r := &restorer{
+		ctx:       ctx,
+		relays:    relays,
+		connected: map[string]*relayConn{},
+		strict:    strict,
+		summary:   restoreAllSummary{Mode: "besteffort", Relays: map[string]*relayTally{}},
+	}
+	if strict {
+		r.summary.Mode = "strict"
+	}
+	for _, url := range relays {
+		r.summary.Relays[url] = &relayTally{}
+		relay, err := connectRelay(ctx, url)
+		if err != nil {
+			debugf(ctx, "Failed to connect to relay %s: %v", url, err)
+			if strict {
+				r.summary.Aborted = &restoreFailure{Relay: url, Error: "connect failed: " + err.Error()}
+				return r
+			}
+			continue
+		}
+		r.connected[url] = relay
+	}
+	if len(relays) > 0 && len(r.connected) == 0 {
+		warnf(ctx, "Failed to connect to all %d relays for restore", len(relays))
+	}
+	return r
+}
+
+// publish sends ev to every connected relay, returning false once the
+// restore was aborted
+func (r *restorer) publish(ev *nostr.Event) bool {
+	if r.summary.Aborted != nil {
+		return false
+	}
+	accepted := false
+	for _, url := range r.relays {
+		relay, ok := r.connected[url]
+		if !ok {
+			r.summary.Relays[url].Failed++
+			continue
+		}
+
+		start := time.Now()
+		publishCtx, cancel := context.WithTimeout(r.ctx, publishTimeout)
+		status, err := relay.publish(publishCtx, *ev)
+		cancel()
+		observeRelay("publish", start)
+		if err == nil && status == nostr.PublishStatusFailed {
+			err = fmt.Errorf("rejected by relay")
+		}
+		if err != nil {
+			r.summary.Relays[url].Failed++
+			if r.strict {
+				r.summary.Failed++
+				r.summary.Aborted = &restoreFailure{ID: ev.ID, Relay: url, Error: err.Error()}
+				return false
+			}
+			continue
+		}
+		r.summary.Relays[url].Succeeded++
+		accepted = true
+	}
+	if accepted {
+		r.summary.Published++
+	} else {
+		r.summary.Failed++
+	}
+	return true
+}
+
+// close closes the relay connections
+func (r *restorer) close() {
+	for _, relay := range r.connected {
+		relay.Close()
+	}
+}
+
+// restoreAll publishes events to relays with a restorer
+func restoreAll(ctx context.Context, relays []string, events []*nostr.Event, strict bool) restoreAllSummary {
+	r := newRestorer(ctx, relays, strict)
+	defer r.close()
+	r.summary.Total = len(events)
+	for _, ev := range events {
+		if !r.publish(ev) {
+			break
+		}
+	}
+	return r.summary
+}
+
+// restoreAllHandler serves POST /npub/{npub}/restore-all, republishing all
+// valid stored events of the author to their write relays. The body must
+// be a JSON object, so that cross-site form posts are refused, and the
+// request must be signed with NIP-98 by the author or carry the admin token.
+func restoreAllHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, npub string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectReadOnly(w) {
+		return
+	}
+
+	hexPubkey, err := npubToHex(npub)
+	if errors.Is(err, errPrivateKey) {
+		http.Error(w, privateKeyMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid npub format", http.StatusBadRequest)
+		return
+	}
+	if isBlocked(hexPubkey) {
+		http.Error(w, unavailableMessage, http.StatusNotFound)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !authorizeOwner(w, r, hexPubkey, body) {
+		return
+	}
+
+	var req restoreAllRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, `Request body must be a JSON object like {"mode": "strict"}`, http.StatusBadRequest)
+		return
+	}
+	switch req.Mode {
+	case "", "besteffort", "strict":
+	default:
+		http.Error(w, `Mode must be "strict" or "besteffort"`, http.StatusBadRequest)
+		return
+	}
+	override, err := newRelayOverride(req.Relays, req.MergeRelays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), restoreAllTimeout)
+	defer cancel()
+
+	// The events are loaded in batches, so that an author's whole history
+	// is never held in memory. Only authentic events are republished; the
+	// rest are counted as invalid. Expired and deleted events are skipped
+	// unless asked for, and future-dated ones when asked to.
+	deleted := queryDeletions(ctx, db, hexPubkey)
+	relays := override.apply(writeRelaysForPubkey(ctx, db, hexPubkey))
+	restore := newRestorer(ctx, relays, req.Mode == "strict")
+	defer restore.close()
+	summary := &restore.summary
+	now := time.Now()
+	opts := listOptions{Sort: "recent", PerPage: restoreAllBatchSize, Uncapped: true}
+	for summary.Aborted == nil {
+		stored, _, err := queryEventsByPubkey(ctx, db, hexPubkey, opts)
+		if err != nil {
+			errorf(ctx, "Failed to query events for %s: %v", hexPubkey, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		markDeleted(stored, deleted)
+		for _, event := range stored {
+			ev, err := restorableEvent(event.EventData, event.ID)
+			if err != nil {
+				summary.Invalid++
+				continue
+			}
+			if !req.IncludeExpired && isExpired(ev, now) {
+				summary.Expired++
+				continue
+			}
+			if !req.IncludeDeleted && event.Deleted {
+				summary.Deleted++
+				continue
+			}
+			if req.ExcludeFutureDated && isFutureDated(event.CreatedAt, now) {
+				summary.FutureDated++
+				continue
+			}
+			// Events after a strict abort are not counted, as they are
+			// not loaded
+			summary.Total++
+			if !restore.publish(ev) {
+				break
+			}
+		}
+		if opts.Before = nextCursor(stored, opts); opts.Before == "" {
+			break
+		}
+	}
+
+	logf(ctx, "Restore of all %d events of %s requested by %s finished: %d published, %d failed",
+		summary.Total, hexPubkey, clientIP(r), summary.Published, summary.Failed)
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,992 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRestoreSelectedReadOnly(t *testing.T) {
+	note := nostr.Event{Kind: 1, Content: "bring me back", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	note.Sign(nostr.GeneratePrivateKey())
+	adminToken = "maintenance-token"
+	defer func() { adminToken = "" }()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, enabled := range []bool{true, false} {
+		name := "writable"
+		if enabled {
+			name = "read-only"
+		}
+		t.Run(name, func(t *testing.T) {
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+					reply(`["OK","` + env.Event.ID + `",true,""]`)
+				}
+			})
+			defer func(relays []string) { writeRelays = relays }(writeRelays)
+			writeRelays = []string{relay.url}
+			readOnly.Store(enabled)
+			defer readOnly.Store(false)
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if !enabled {
+				mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(note.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(note.String()))
+				mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/restore-selected", strings.NewReader(`["`+note.ID+`"]`))
+			req.Header.Set("Authorization", "Bearer maintenance-token")
+			rec := httptest.NewRecorder()
+			restoreSelectedHandler(&databases{primary: db})(rec, req)
+
+			if enabled {
+				if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "read-only maintenance mode") {
+					t.Errorf("status = %d, body = %s, want 503 explaining the maintenance", rec.Code, rec.Body)
+				}
+				if relay.connections() != 0 {
+					t.Error("a relay was contacted in read-only mode")
+				}
+			} else {
+				var body struct {
+					Results []restoreResult `json:"results"`
+				}
+				if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil || len(body.Results) != 1 {
+					t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+				}
+				if got := body.Results[0].Relays[relay.url]; got != nostr.PublishStatusSucceeded.String() {
+					t.Errorf("relay status = %q, want %q", got, nostr.PublishStatusSucceeded.String())
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRestoreSelectedPublishesEachEvent(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	first := nostr.Event{Kind: 1, Content: "first", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	first.Sign(sk)
+	second := nostr.Event{Kind: 3, Content: "", CreatedAt: 1700000001, Tags: nostr.Tags{{"p", first.PubKey}}}
+	second.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var mu sync.Mutex
+	var published []string
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			mu.Lock()
+			published = append(published, env.Event.ID)
+			mu.Unlock()
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	for _, ev := range []nostr.Event{first, second} {
+		mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(ev.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(ev.String()))
+	}
+	// Both events share an author, whose relay list is looked up once
+	mock.ExpectQuery(`event_kind = 10002`).WithArgs(first.PubKey).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+	// The duplicate id is restored once
+	body := []byte(`["` + first.ID + `","` + second.ID + `","` + first.ID + `"]`)
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/restore-selected", bytes.NewReader(body))
+	req.Header.Set("Authorization", nip98Authorization(sk, http.MethodPost, "http://example.com/restore-selected", body, nil))
+	rec := httptest.NewRecorder()
+	restoreSelectedHandler(&databases{primary: db})(rec, req)
+
+	var resp struct {
+		Results []restoreResult `json:"results"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].ID != first.ID || resp.Results[1].ID != second.ID {
+		t.Fatalf("results = %+v, want one per distinct id in order", resp.Results)
+	}
+	for _, result := range resp.Results {
+		if result.Error != "" || result.Relays[relay.url] != nostr.PublishStatusSucceeded.String() {
+			t.Errorf("result for %s = %+v", result.ID, result)
+		}
+	}
+	sort.Strings(published)
+	want := []string{first.ID, second.ID}
+	sort.Strings(want)
+	if !reflect.DeepEqual(published, want) {
+		t.Errorf("relay received %q, want %q", published, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadRestorableEventWithoutData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	id := strings.Repeat("a", 64)
+	mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(nil))
+
+	_, err = loadRestorableEvent(context.Background(), db, id)
+	if err == nil || err.Error() != "stored event is not valid JSON" {
+		t.Errorf("loadRestorableEvent() error = %v, want the event refused as invalid", err)
+	}
+}
+
+func TestRestoreSelectedRejects(t *testing.T) {
+	adminToken = "selected-token"
+	defer func() { adminToken = "" }()
+	tooMany := make([]string, maxRestoreSelected+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%064x", i)
+	}
+	many, _ := json.Marshal(tooMany)
+
+	tests := []struct {
+		name       string
+		method     string
+		auth       string
+		body       string
+		wantStatus int
+	}{
+		{"GET", http.MethodGet, "Bearer selected-token", `[]`, http.StatusMethodNotAllowed},
+		{"unauthenticated", http.MethodPost, "", `["` + strings.Repeat("a", 64) + `"]`, http.StatusUnauthorized},
+		{"not JSON", http.MethodPost, "Bearer selected-token", `ids=1`, http.StatusBadRequest},
+		{"no ids", http.MethodPost, "Bearer selected-token", `{"ids":[]}`, http.StatusBadRequest},
+		{"too many ids", http.MethodPost, "Bearer selected-token", string(many), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/restore-selected", strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			// Each request is refused before the database is used
+			restoreSelectedHandler(&databases{})(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestConcurrentRestoresPublishOnce(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+
+	// Restores scoped to the author, as signed ones are, coalesce too
+	for _, owner := range []string{"", author} {
+		name := "admin"
+		if owner != "" {
+			name = "signed by the author"
+		}
+		t.Run(name, func(t *testing.T) {
+			ev := nostr.Event{Kind: 1, Content: "double click " + name, CreatedAt: 1700000000, Tags: nostr.Tags{}}
+			ev.Sign(sk)
+
+			// The relay holds its OK until the second restore is waiting
+			release := make(chan struct{})
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+					<-release
+					reply(`["OK","` + env.Event.ID + `",true,""]`)
+				}
+			})
+			writeRelays = []string{relay.url}
+
+			stored := func(relayList bool) (*sql.DB, sqlmock.Sqlmock) {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { db.Close() })
+				mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(ev.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(ev.String()))
+				if relayList {
+					mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+				}
+				return db, mock
+			}
+			firstDB, _ := stored(true)
+			// The second restore shares the result, so never looks up relays
+			secondDB, secondMock := stored(false)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			results := make([][]restoreResult, 2)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				results[0] = restoreEvents(ctx, firstDB, []string{ev.ID}, owner, false, relayOverride{})
+			}()
+			waitFor(t, func() bool { return relay.count("EVENT") == 1 })
+			go func() {
+				defer wg.Done()
+				results[1] = restoreEvents(ctx, secondDB, []string{ev.ID}, owner, false, relayOverride{})
+			}()
+			// Loading the event is all the second restore does before it waits
+			waitFor(t, func() bool { return secondMock.ExpectationsWereMet() == nil })
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if n := relay.count("EVENT"); n != 1 {
+				t.Errorf("relay received %d publishes, want 1", n)
+			}
+			for i, r := range results {
+				if len(r) != 1 || r[0].Error != "" || r[0].Relays[relay.url] != nostr.PublishStatusSucceeded.String() {
+					t.Errorf("restore %d = %+v, want the shared success", i, r)
+				}
+			}
+			restoresInFlight.Lock()
+			_, inFlight := restoresInFlight.calls[ev.ID]
+			restoresInFlight.Unlock()
+			if inFlight {
+				t.Error("the finished restore is still in flight")
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishResult(t *testing.T) {
+	rejected := errors.New("rejected: blocked: spam")
+	tests := []struct {
+		name    string
+		status  nostr.Status
+		err     error
+		confirm bool
+		stored  bool
+		want    string
+	}{
+		{"accepted", nostr.PublishStatusSucceeded, nil, false, false, nostr.PublishStatusSucceeded.String()},
+		{"rejected", nostr.PublishStatusFailed, rejected, false, false, rejected.Error()},
+		{"accepted and confirmed", nostr.PublishStatusSucceeded, nil, true, true, confirmStatus},
+		{"accepted but not found", nostr.PublishStatusSucceeded, nil, true, false, unconfirmedStatus},
+		{"no answer but not found", nostr.PublishStatusSent, nil, true, false, unconfirmedStatus},
+		{"connection lost but stored", nostr.PublishStatusFailed, io.EOF, true, true, confirmStatus},
+		{"rejected and not found", nostr.PublishStatusFailed, rejected, true, false, rejected.Error()},
+	}
+	for _, tt := range tests {
+		if got := publishResult(tt.status, tt.err, tt.confirm, tt.stored); got != tt.want {
+			t.Errorf("%s: publishResult() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// storingRelay is a relay that keeps the events published to it and
+// returns them when queried. With drop it closes the connection on
+// receiving an event, before acknowledging it.
+func storingRelay(t *testing.T, drop bool) (string, *sync.Map) {
+	t.Helper()
+	var stored sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := wsutil.ReadClientText(conn)
+			if err != nil {
+				return
+			}
+			switch env := nostr.ParseMessage(msg).(type) {
+			case *nostr.EventEnvelope:
+				stored.Store(env.Event.ID, env.Event)
+				if drop {
+					return
+				}
+				wsutil.WriteServerText(conn, []byte(`["OK","`+env.Event.ID+`",true,""]`))
+			case *nostr.ReqEnvelope:
+				for _, id := range env.Filters[0].IDs {
+					if ev, ok := stored.Load(id); ok {
+						wsutil.WriteServerText(conn, []byte(eventMessage(env.SubscriptionID, ev.(nostr.Event))))
+					}
+				}
+				wsutil.WriteServerText(conn, []byte(`["EOSE","`+env.SubscriptionID+`"]`))
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), &stored
+}
+
+func TestPublishEventsConfirm(t *testing.T) {
+	ev := nostr.Event{Kind: 1, Content: "confirm me", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	ev.Sign(nostr.GeneratePrivateKey())
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	keeping, _ := storingRelay(t, false)
+	dropping, droppedStore := storingRelay(t, true)
+	// Acknowledges every event but keeps none
+	forgetting := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		switch env := nostr.ParseMessage(msg).(type) {
+		case *nostr.EventEnvelope:
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		case *nostr.ReqEnvelope:
+			reply(`["EOSE","` + env.SubscriptionID + `"]`)
+		}
+	})
+	rejecting := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		switch env := nostr.ParseMessage(msg).(type) {
+		case *nostr.EventEnvelope:
+			reply(`["OK","` + env.Event.ID + `",false,"blocked: not a member"]`)
+		case *nostr.ReqEnvelope:
+			reply(`["EOSE","` + env.SubscriptionID + `"]`)
+		}
+	})
+	// The relays must be configured to be dialed on loopback
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{keeping, dropping}
+
+	queue := func() map[string][]*nostr.Event {
+		queued := map[string][]*nostr.Event{}
+		for _, url := range []string{keeping, dropping, forgetting.url, rejecting.url} {
+			queued[url] = []*nostr.Event{&ev}
+		}
+		return queued
+	}
+
+	t.Run("confirmed", func(t *testing.T) {
+		got := publishEvents(context.Background(), queue(), true)[ev.ID]
+		want := map[string]string{
+			keeping:        confirmStatus,
+			dropping:       confirmStatus,
+			forgetting.url: unconfirmedStatus,
+			rejecting.url:  "rejected: blocked: not a member",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("statuses = %v, want %v", got, want)
+		}
+		if _, ok := droppedStore.Load(ev.ID); !ok {
+			t.Error("the dropping relay did not store the event")
+		}
+		if forgetting.count("REQ") != 1 {
+			t.Errorf("relay was queried %d times to confirm, want 1", forgetting.count("REQ"))
+		}
+	})
+	t.Run("without confirmation", func(t *testing.T) {
+		reqs := forgetting.count("REQ")
+		got := publishEvents(context.Background(), queue(), false)[ev.ID]
+		if got[keeping] != nostr.PublishStatusSucceeded.String() || got[forgetting.url] != nostr.PublishStatusSucceeded.String() {
+			t.Errorf("statuses = %v, want plain success for accepting relays", got)
+		}
+		if got[dropping] == confirmStatus || got[dropping] == nostr.PublishStatusSucceeded.String() {
+			t.Errorf("lost acknowledgement reported as %q", got[dropping])
+		}
+		if forgetting.count("REQ") != reqs {
+			t.Error("relay was queried although confirmation was not asked for")
+		}
+	})
+}
+
+func TestRestoreAllModes(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	events := make([]*nostr.Event, 3)
+	for i := range events {
+		events[i] = &nostr.Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: nostr.Timestamp(1700000000 + i), Tags: nostr.Tags{}}
+		events[i].Sign(sk)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Nothing listens on a port whose listener was closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "ws://" + l.Addr().String()
+	l.Close()
+	relays, retries := readRelays, relayConnectRetries
+	t.Cleanup(func() { readRelays, relayConnectRetries = relays, retries })
+	readRelays, relayConnectRetries = append(readRelays, down), 0
+
+	tests := []struct {
+		name        string
+		strict      bool
+		unreachable bool
+		wantEvents  int
+		want        restoreAllSummary
+	}{
+		{
+			name:       "best effort publishes everything",
+			wantEvents: 3,
+			want:       restoreAllSummary{Mode: "besteffort", Total: 3, Published: 2, Failed: 1},
+		},
+		{
+			name:       "strict stops at the rejection",
+			strict:     true,
+			wantEvents: 2,
+			want: restoreAllSummary{Mode: "strict", Total: 3, Published: 1, Failed: 1,
+				Aborted: &restoreFailure{ID: events[1].ID, Error: "rejected: invalid: too old"}},
+		},
+		{
+			name:        "best effort skips an unreachable relay",
+			unreachable: true,
+			wantEvents:  3,
+			want:        restoreAllSummary{Mode: "besteffort", Total: 3, Published: 2, Failed: 1},
+		},
+		{
+			name:        "strict stops at an unreachable relay",
+			strict:      true,
+			unreachable: true,
+			want:        restoreAllSummary{Mode: "strict", Total: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The relay rejects the second event only
+			relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+				if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+					result := `true,""`
+					if env.Event.ID == events[1].ID {
+						result = `false,"invalid: too old"`
+					}
+					reply(`["OK","` + env.Event.ID + `",` + result + `]`)
+				}
+			})
+			targets := []string{relay.url}
+			if tt.unreachable {
+				targets = []string{down, relay.url}
+			}
+
+			got := restoreAll(context.Background(), targets, events, tt.strict)
+			if tt.want.Aborted != nil {
+				tt.want.Aborted.Relay = relay.url
+			}
+			if tt.unreachable && tt.strict {
+				if got.Aborted == nil || got.Aborted.Relay != down || !strings.HasPrefix(got.Aborted.Error, "connect failed: ") {
+					t.Errorf("aborted = %+v, want a connect failure of %s", got.Aborted, down)
+				}
+				got.Aborted = nil
+			}
+			got.Relays = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summary = %+v, want %+v", got, tt.want)
+			}
+			if n := relay.count("EVENT"); n != tt.wantEvents {
+				t.Errorf("relay received %d events, want %d", n, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestRestoreAllHandler(t *testing.T) {
+	owner := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(owner)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	notes := make([]nostr.Event, 2)
+	for i := range notes {
+		notes[i] = nostr.Event{Kind: 1, Content: fmt.Sprintf("restore %d", i), CreatedAt: nostr.Timestamp(1700000100 - i), Tags: nostr.Tags{}}
+		notes[i].Sign(owner)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	u := "http://example.com/npub/" + npub + "/restore-all"
+
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		auth        func(body string) string
+		wantStatus  int
+	}{
+		{
+			name:        "form post",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "mode=strict",
+			auth:        func(string) string { return "" },
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "unsigned",
+			contentType: "application/json",
+			body:        `{}`,
+			auth:        func(string) string { return "" },
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:        "signed by someone else",
+			contentType: "application/json",
+			body:        `{}`,
+			auth: func(body string) string {
+				return nip98Authorization(nostr.GeneratePrivateKey(), "POST", u, []byte(body), nil)
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:        "unknown mode",
+			contentType: "application/json",
+			body:        `{"mode":"yolo"}`,
+			auth:        func(body string) string { return nip98Authorization(owner, "POST", u, []byte(body), nil) },
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "owner",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"mode":"strict"}`,
+			auth:        func(body string) string { return nip98Authorization(owner, "POST", u, []byte(body), nil) },
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			if tt.wantStatus == http.StatusOK {
+				rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+				for _, ev := range notes {
+					rows.AddRow(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, ev.String())
+				}
+				mock.ExpectQuery(`WHERE pubkey = \$1 ORDER BY created_at DESC`).WillReturnRows(rows)
+				mock.ExpectQuery(`event_kind = 5`).WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+				mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+			}
+
+			r := httptest.NewRequest(http.MethodPost, u, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			if auth := tt.auth(tt.body); auth != "" {
+				r.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			restoreAllHandler(db, rec, r, npub)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var summary restoreAllSummary
+			if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Mode != "strict" || summary.Total != 2 || summary.Published != 2 || summary.Aborted != nil {
+				t.Errorf("summary = %+v, want both events published in strict mode", summary)
+			}
+		})
+	}
+}
+
+func TestRestoreAllHandlerLoadsBatches(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	notes := make([]nostr.Event, 3)
+	for i := range notes {
+		notes[i] = nostr.Event{Kind: 1, Content: fmt.Sprintf("batch %d", i), CreatedAt: nostr.Timestamp(1700000100 - i), Tags: nostr.Tags{}}
+		notes[i].Sign(sk)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	adminToken = "batch-token"
+	defer func() { adminToken = "" }()
+	defer func(size int) { restoreAllBatchSize = size }(restoreAllBatchSize)
+	restoreAllBatchSize = 2
+
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	columns := []string{"id", "pubkey", "created_at", "event_kind", "event_data"}
+	first := sqlmock.NewRows(columns)
+	for _, ev := range notes[:2] {
+		first.AddRow(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, ev.String())
+	}
+	mock.ExpectQuery(`WHERE pubkey = \$1 ORDER BY created_at DESC, id DESC LIMIT 2$`).
+		WithArgs(pubkey).WillReturnRows(first)
+	mock.ExpectQuery(`WHERE pubkey = \$1 AND \(created_at, id\) < \(\$2, \$3\) ORDER BY created_at DESC, id DESC LIMIT 2$`).
+		WithArgs(pubkey, int64(notes[1].CreatedAt), notes[1].ID).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(notes[2].ID, pubkey, int64(notes[2].CreatedAt), notes[2].Kind, notes[2].String()))
+	mock.ExpectQuery(`event_kind = 5`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+	r := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/restore-all", strings.NewReader(`{}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer batch-token")
+	rec := httptest.NewRecorder()
+	restoreAllHandler(db, rec, r, npub)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	var summary restoreAllSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 3 || summary.Published != 3 {
+		t.Errorf("summary = %+v, want all 3 events published", summary)
+	}
+	if n := relay.count("EVENT"); n != 3 {
+		t.Errorf("relay received %d events, want 3", n)
+	}
+	if n := relay.connections(); n != 1 {
+		t.Errorf("relay got %d connections, want 1", n)
+	}
+}
+
+func TestRestoreAllSkipsExpiredEvents(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	lasting := nostr.Event{Kind: 1, Content: "still here", CreatedAt: 1700000200, Tags: nostr.Tags{}}
+	lasting.Sign(sk)
+	expired := nostr.Event{Kind: 1, Content: "gone by now", CreatedAt: 1700000100, Tags: nostr.Tags{{"expiration", "1700003600"}}}
+	expired.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	adminToken = "restore-token"
+	defer func() { adminToken = "" }()
+
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	tests := []struct {
+		body          string
+		wantPublished int
+		wantExpired   int
+	}{
+		{`{}`, 1, 1},
+		{`{"include_expired":true}`, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			for _, ev := range []nostr.Event{lasting, expired} {
+				rows.AddRow(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, ev.String())
+			}
+			mock.ExpectQuery(`WHERE pubkey = \$1 ORDER BY created_at DESC`).WillReturnRows(rows)
+			mock.ExpectQuery(`event_kind = 5`).WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+			mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+			r := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/restore-all", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", "Bearer restore-token")
+			rec := httptest.NewRecorder()
+			events := relay.count("EVENT")
+			restoreAllHandler(db, rec, r, npub)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var summary restoreAllSummary
+			if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Published != tt.wantPublished || summary.Expired != tt.wantExpired {
+				t.Errorf("published, expired = %d, %d, want %d, %d", summary.Published, summary.Expired, tt.wantPublished, tt.wantExpired)
+			}
+			if n := relay.count("EVENT") - events; n != tt.wantPublished {
+				t.Errorf("relay received %d events, want %d", n, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestRestoreAllExcludesFutureDatedEvents(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	now := time.Now()
+	var notes []nostr.Event
+	for i, at := range []time.Time{now.Add(-time.Hour), now.Add(time.Minute), now.Add(7 * 24 * time.Hour)} {
+		ev := nostr.Event{Kind: 1, Content: "note " + strconv.Itoa(i), CreatedAt: nostr.Timestamp(at.Unix()), Tags: nostr.Tags{}}
+		ev.Sign(sk)
+		notes = append(notes, ev)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	adminToken = "future-token"
+	defer func() { adminToken = "" }()
+
+	relay := newMockRelay(t, "", func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	})
+	writes := writeRelays
+	t.Cleanup(func() { writeRelays = writes })
+	writeRelays = []string{relay.url}
+
+	tests := []struct {
+		body          string
+		wantPublished int
+		wantFuture    int
+	}{
+		{`{}`, 3, 0},
+		{`{"exclude_future_dated":true}`, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"})
+			for _, ev := range notes {
+				rows.AddRow(ev.ID, pubkey, int64(ev.CreatedAt), ev.Kind, ev.String())
+			}
+			mock.ExpectQuery(`WHERE pubkey = \$1 ORDER BY created_at DESC`).WillReturnRows(rows)
+			mock.ExpectQuery(`event_kind = 5`).WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}))
+			mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+			r := httptest.NewRequest(http.MethodPost, "/npub/"+npub+"/restore-all", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", "Bearer future-token")
+			rec := httptest.NewRecorder()
+			restoreAllHandler(db, rec, r, npub)
+			var summary restoreAllSummary
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &summary) != nil {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if summary.Published != tt.wantPublished || summary.FutureDated != tt.wantFuture {
+				t.Errorf("published, future-dated = %d, %d, want %d, %d",
+					summary.Published, summary.FutureDated, tt.wantPublished, tt.wantFuture)
+			}
+		})
+	}
+}
+
+func TestNewRelayOverride(t *testing.T) {
+	tooMany := make([]string, maxRequestRelays+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("wss://relay%d.example", i)
+	}
+	defaults := []string{"wss://default.example"}
+	tests := []struct {
+		name    string
+		relays  []string
+		merge   bool
+		want    []string
+		wantErr string
+	}{
+		{name: "none keeps the defaults", want: defaults},
+		{name: "replaces the defaults", relays: []string{"wss://Mine.example/", " wss://mine.example"}, want: []string{"wss://mine.example"}},
+		{name: "merged with the defaults", relays: []string{"wss://mine.example", "wss://default.example"}, merge: true, want: []string{"wss://default.example", "wss://mine.example"}},
+		{name: "not a websocket URL", relays: []string{"https://relay.example"}, wantErr: "must be ws:// or wss://"},
+		{name: "no host", relays: []string{"wss://"}, wantErr: "must be ws:// or wss://"},
+		{name: "loopback", relays: []string{"ws://127.0.0.1:7777"}, wantErr: "must not be a private address"},
+		{name: "localhost", relays: []string{"ws://relay.localhost"}, wantErr: "must not be a private address"},
+		{name: "private network", relays: []string{"wss://mine.example", "wss://192.168.1.9"}, wantErr: "must not be a private address"},
+		{name: "too many", relays: tooMany, wantErr: fmt.Sprintf("at most %d relays", maxRequestRelays)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override, err := newRelayOverride(tt.relays, tt.merge)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newRelayOverride() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := override.apply(defaults); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreSelectedToRequestedRelays(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	note := nostr.Event{Kind: 1, Content: "send it elsewhere", CreatedAt: 1700000000, Tags: nostr.Tags{}}
+	note.Sign(sk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	adminToken = "relays-token"
+	defer func() { adminToken = "" }()
+
+	accept := func(reply func(string), msg []byte) {
+		if env, ok := nostr.ParseMessage(msg).(*nostr.EventEnvelope); ok {
+			reply(`["OK","` + env.Event.ID + `",true,""]`)
+		}
+	}
+	// Registered before newMockRelay's cleanup, so it runs after it
+	writes, dial := writeRelays, relayNetDial
+	t.Cleanup(func() { writeRelays, relayNetDial = writes, dial })
+	configured := newMockRelay(t, "", accept)
+	writeRelays = []string{configured.url}
+	// Requested relays must be public, so public addresses are dialed on mocks
+	mocks := map[string]*mockRelay{
+		"ws://203.0.113.21": newMockRelay(t, "", accept),
+		"ws://203.0.113.22": newMockRelay(t, "", accept),
+	}
+	relayNetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if relay, ok := mocks["ws://"+strings.TrimSuffix(addr, ":80")]; ok {
+			u, _ := url.Parse(relay.url)
+			addr = u.Host
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	tests := []struct {
+		name      string
+		merge     bool
+		wantRelay []string
+	}{
+		{"replace", false, []string{"ws://203.0.113.21", "ws://203.0.113.22"}},
+		{"merge", true, []string{configured.url, "ws://203.0.113.21", "ws://203.0.113.22"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery(`SELECT event_data FROM event_backup WHERE id = \$1`).WithArgs(note.ID).
+				WillReturnRows(sqlmock.NewRows([]string{"event_data"}).AddRow(note.String()))
+			mock.ExpectQuery(`event_kind = 10002`).WillReturnRows(sqlmock.NewRows([]string{"event_data"}))
+
+			before := map[string]int{configured.url: configured.count("EVENT")}
+			for u, relay := range mocks {
+				before[u] = relay.count("EVENT")
+			}
+			body := fmt.Sprintf(`{"ids":["%s"],"relays":["ws://203.0.113.21","ws://203.0.113.22"],"merge_relays":%v}`, note.ID, tt.merge)
+			req := httptest.NewRequest(http.MethodPost, "/restore-selected", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer relays-token")
+			rec := httptest.NewRecorder()
+			restoreSelectedHandler(&databases{primary: db})(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+
+			var resp struct {
+				Results []restoreResult `json:"results"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+				t.Fatalf("body = %s", rec.Body)
+			}
+			var got []string
+			for u, status := range resp.Results[0].Relays {
+				if status != nostr.PublishStatusSucceeded.String() {
+					t.Errorf("%s: %s", u, status)
+				}
+				got = append(got, u)
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.wantRelay...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("results for %v, want exactly %v", got, want)
+			}
+			if n := configured.count("EVENT") - before[configured.url]; (n == 1) != tt.merge {
+				t.Errorf("configured relay received %d events, merge = %v", n, tt.merge)
+			}
+			for u, relay := range mocks {
+				if n := relay.count("EVENT") - before[u]; n != 1 {
+					t.Errorf("%s received %d events, want 1", u, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// robotsAllow lets crawlers index profile pages, for public archives
+var robotsAllow bool
+
+// robotsDisallow keeps crawlers off the pages that query relays and the
+// database on every visit
+var robotsDisallow = []string{"/npub/", "/naddr/", "/api/"}
+
+// robotsAllowPages permits crawling the pages but still not the API
+var robotsAllowPages = []string{"/api/"}
+
+// robotsTxt returns the robots.txt disallowing paths under basePath
+func robotsTxt(basePath string, paths []string) string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	for _, p := range paths {
+		b.WriteString("Disallow: " + basePath + p + "\n")
+	}
+	return b.String()
+}
+
+// robotsHandler serves GET /robots.txt according to ROBOTS_ALLOW. Crawlers
+// only read /robots.txt at the root of the host, so when BASE_PATH is set
+// the reverse proxy must serve this file there; its rules already carry
+// the prefix.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	paths := robotsDisallow
+	if robotsAllow {
+		paths = robotsAllowPages
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write([]byte(robotsTxt(site.BasePath, paths)))
+}
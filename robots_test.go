@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRobotsHandler(t *testing.T) {
+	defer func(allow bool, basePath string) { robotsAllow, site.BasePath = allow, basePath }(robotsAllow, site.BasePath)
+
+	tests := []struct {
+		name     string
+		allow    bool
+		basePath string
+		want     string
+	}{
+		{"root, pages disallowed", false, "", "User-agent: *\nDisallow: /npub/\nDisallow: /naddr/\nDisallow: /api/\n"},
+		{"root, pages allowed", true, "", "User-agent: *\nDisallow: /api/\n"},
+		{"base path, pages disallowed", false, "/restore", "User-agent: *\nDisallow: /restore/npub/\nDisallow: /restore/naddr/\nDisallow: /restore/api/\n"},
+		{"base path, pages allowed", true, "/tools/restore", "User-agent: *\nDisallow: /tools/restore/api/\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			robotsAllow, site.BasePath = tt.allow, tt.basePath
+			rec := httptest.NewRecorder()
+			robotsHandler(rec, httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("robots.txt =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// staticMaxAge is how long browsers may cache static files, set with
+// STATIC_MAX_AGE
+var staticMaxAge = time.Hour
+
+// versionedMaxAge is used for asset URLs carrying a content hash, which
+// change whenever the file does
+const versionedMaxAge = 365 * 24 * time.Hour
+
+// staticTypes are the content types of the static files, set explicitly
+// since the scratch image has no MIME database
+var staticTypes = map[string]string{
+	".css": "text/css; charset=utf-8",
+	".js":  "text/javascript; charset=utf-8",
+}
+
+var (
+	assetHashesOnce sync.Once
+	assetHashes     map[string]string
+)
+
+// assetHash returns a short hash of the embedded static file name, or ""
+// if there is no such file
+func assetHash(name string) string {
+	assetHashesOnce.Do(func() {
+		assetHashes = map[string]string{}
+		entries, err := staticFiles.ReadDir("static")
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			b, err := staticFiles.ReadFile("static/" + entry.Name())
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(b)
+			assetHashes[entry.Name()] = hex.EncodeToString(sum[:5])
+		}
+	})
+	return assetHashes[name]
+}
+
+// Asset returns the URL of a static file, versioned with its content hash
+// so that it can be cached for long
+func (s siteInfo) Asset(name string) string {
+	u := s.BasePath + "/static/" + name
+	if hash := assetHash(name); hash != "" {
+		u += "?v=" + hash
+	}
+	return u
+}
+
+// staticHandler sets the content type and caching headers of static files
+// served by h
+func staticHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ctype, ok := staticTypes[path.Ext(r.URL.Path)]; ok {
+			w.Header().Set("Content-Type", ctype)
+		}
+		maxAge := staticMaxAge
+		if v := r.URL.Query().Get("v"); v != "" && v == assetHash(path.Base(r.URL.Path)) {
+			maxAge = versionedMaxAge
+		}
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		h.ServeHTTP(w, r)
+	})
+}
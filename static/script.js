@@ -1,14 +1,47 @@
-function copyEventData(button) {
-    // Find the parent event div and then the event-content div
-    const eventDiv = button.closest('.event');
+// eventJSON returns the JSON of the event shown in eventDiv. Truncated
+// events are too large to embed in the page, so they are fetched instead.
+async function eventJSON(eventDiv) {
     const contentDiv = eventDiv.querySelector('.event-content');
     const content = contentDiv.getAttribute('data-content');
-    
-    navigator.clipboard.writeText(content).then(function() {
+    if (content !== null) {
+        return content;
+    }
+    const response = await fetch(contentDiv.getAttribute('data-event-url'));
+    if (!response.ok) {
+        throw new Error(`failed to fetch the event: ${response.status}`);
+    }
+    return response.text();
+}
+
+async function copyEventData(button) {
+    // Find the parent event div and then its event data
+    const eventDiv = button.closest('.event');
+
+    try {
+        const content = await eventJSON(eventDiv);
+        await navigator.clipboard.writeText(content);
+
         // Change button text temporarily to indicate success
         const originalText = button.textContent;
         button.textContent = 'Copied!';
-        
+
+        setTimeout(() => {
+            button.textContent = originalText;
+        }, 2000);
+    } catch (err) {
+        console.error('Failed to copy: ', err);
+        alert('Failed to copy to clipboard');
+    }
+}
+
+function copyNevent(button) {
+    const uri = 'nostr:' + button.getAttribute('data-nevent');
+
+    navigator.clipboard.writeText(uri).then(function() {
+        // Change button text temporarily to indicate success
+        const originalText = button.textContent;
+        button.textContent = 'Copied!';
+
         setTimeout(() => {
             button.textContent = originalText;
         }, 2000);
@@ -18,14 +51,37 @@ function copyEventData(button) {
     });
 }
 
+// showRestoreConfirmation restores the event of an event card after
+// confirmation. The button stays disabled until the restore has finished,
+// so that repeated clicks cannot publish the event several times.
 async function showRestoreConfirmation(button) {
-    // Find the parent event div and then the event-content div
-    const eventDiv = button.closest('.event');
-    const contentDiv = eventDiv.querySelector('.event-content');
-    const eventData = contentDiv.getAttribute('data-content');
+    if (button.disabled) {
+        return;
+    }
+    button.disabled = true;
+    try {
+        await confirmAndRestore(button);
+    } finally {
+        button.disabled = false;
+    }
+}
 
-    // Parse the event data
-    const event = JSON.parse(eventData);
+async function confirmAndRestore(button) {
+    if (window.readOnly) {
+        alert('The service is in read-only maintenance mode; restore is temporarily disabled.');
+        return;
+    }
+
+    // Find the parent event div and parse its event data
+    const eventDiv = button.closest('.event');
+    let event;
+    try {
+        event = JSON.parse(await eventJSON(eventDiv));
+    } catch (error) {
+        console.error('Error loading event:', error);
+        alert('Error loading the event: ' + error.message);
+        return;
+    }
 
     // Check if the event belongs to the current user
     if (!window.nostr) {
@@ -47,13 +103,12 @@ async function showRestoreConfirmation(button) {
         return;
     }
 
-    // Define the relays to send to
-    const relays = [
-        "wss://relay.damus.io",
-        "wss://nos.lol",
-        "wss://yabu.me",
-        "wss://nostr.compile-error.net"
-    ];
+    // Define the relays to send to (provided by the server)
+    const relays = window.writeRelays || [];
+    if (relays.length === 0) {
+        alert('No write relays are configured.');
+        return;
+    }
 
     // Show confirmation dialog
     const relayList = relays.join('<br>');
@@ -62,12 +117,12 @@ async function showRestoreConfirmation(button) {
         console.warn('SweetAlert2 not loaded; falling back to confirm()');
         const fallbackConfirmed = confirm(`Restore this event to the following relays?\n\n${relays.join('\n')}`);
         if (fallbackConfirmed) {
-            restoreEvent(event, relays);
+            await restoreEvent(event, relays);
         }
         return;
     }
 
-    Swal.fire({
+    const result = await Swal.fire({
         title: 'Restore this event?',
         html: `<p style="margin:0 0 6px;">Relays to publish to:</p><pre style="text-align:left;white-space:pre-wrap;">${relayList}</pre>`,
         icon: 'question',
@@ -76,11 +131,10 @@ async function showRestoreConfirmation(button) {
         cancelButtonText: 'Cancel',
         reverseButtons: true,
         focusCancel: true,
-    }).then((result) => {
-        if (result.isConfirmed) {
-            restoreEvent(event, relays);
-        }
     });
+    if (result.isConfirmed) {
+        await restoreEvent(event, relays);
+    }
 }
 
 async function restoreEvent(event, relays) {
@@ -99,10 +153,8 @@ async function restoreEvent(event, relays) {
         
         const signedEvent = await window.nostr.signEvent(updatedEvent);
         
-        // Send to relays
-        relays.forEach(relayUrl => {
-            sendEventToRelay(signedEvent, relayUrl);
-        });
+        // Send to relays and wait until each has answered or given up
+        await Promise.all(relays.map(relayUrl => sendEventToRelay(signedEvent, relayUrl)));
         
         alert('Event restoration initiated. Check your Nostr client for status.');
     } catch (error) {
@@ -111,23 +163,77 @@ async function restoreEvent(event, relays) {
     }
 }
 
+// relayAnswerTimeout is how long to wait for a relay to acknowledge an event
+const relayAnswerTimeout = 10000;
+
+// sendEventToRelay publishes event to relayUrl, resolving once the relay
+// acknowledged it, the connection ended, or relayAnswerTimeout passed
 function sendEventToRelay(event, relayUrl) {
-    try {
-        const ws = new WebSocket(relayUrl);
+    return new Promise(resolve => {
+        let ws;
+        const timer = setTimeout(() => {
+            console.warn(`No answer from ${relayUrl}`);
+            if (ws) {
+                ws.close();
+            }
+            resolve();
+        }, relayAnswerTimeout);
+        const done = () => {
+            clearTimeout(timer);
+            resolve();
+        };
+
+        try {
+            ws = new WebSocket(relayUrl);
+        } catch (error) {
+            console.error(`Failed to connect to ${relayUrl}:`, error);
+            done();
+            return;
+        }
         
         ws.onopen = () => {
             const request = ["EVENT", event];
             ws.send(JSON.stringify(request));
         };
+
+        ws.onmessage = (message) => {
+            try {
+                const [label, id] = JSON.parse(message.data);
+                if (label === 'OK' && id === event.id) {
+                    ws.close();
+                }
+            } catch (error) {
+                console.error(`Invalid message from ${relayUrl}:`, error);
+            }
+        };
         
         ws.onclose = () => {
             console.log(`Disconnected from ${relayUrl}`);
+            done();
         };
         
         ws.onerror = (error) => {
             console.error(`Error connecting to ${relayUrl}:`, error);
         };
-    } catch (error) {
-        console.error(`Failed to connect to ${relayUrl}:`, error);
-    }
+    });
+}
+
+// isPrivateKey mirrors the server's check for a pasted nsec
+function isPrivateKey(input) {
+    return input.toLowerCase().includes('nsec1');
 }
+
+// A pasted nsec is caught before the search is submitted, since the form
+// would otherwise send it to the server in the URL
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('.search-box form').forEach(form => {
+        form.addEventListener('submit', function(event) {
+            const input = form.querySelector('input[name="q"]');
+            if (input && isPrivateKey(input.value)) {
+                event.preventDefault();
+                input.value = '';
+                alert('You pasted a private key (nsec). Never share this with anyone; the input has been cleared.');
+            }
+        });
+    });
+});
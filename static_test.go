@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticHandler(t *testing.T) {
+	defer func(age time.Duration) { staticMaxAge = age }(staticMaxAge)
+	staticMaxAge = 10 * time.Minute
+	staticFS, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/static/", staticHandler(http.StripPrefix("/static/", http.FileServer(http.FS(staticFS)))))
+	cssHash := assetHash("style.css")
+	if cssHash == "" {
+		t.Fatal("style.css has no content hash")
+	}
+
+	tests := []struct {
+		path      string
+		wantCode  int
+		wantType  string
+		wantCache string
+	}{
+		{"/static/style.css", http.StatusOK, "text/css; charset=utf-8", "public, max-age=600"},
+		{"/static/script.js", http.StatusOK, "text/javascript; charset=utf-8", "public, max-age=600"},
+		{"/static/style.css?v=" + cssHash, http.StatusOK, "text/css; charset=utf-8", "public, max-age=31536000"},
+		// A stale hash must not be cached for a year
+		{"/static/style.css?v=0000000000", http.StatusOK, "text/css; charset=utf-8", "public, max-age=600"},
+		{"/static/script.js?v=" + cssHash, http.StatusOK, "text/javascript; charset=utf-8", "public, max-age=600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantCache {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCache)
+			}
+		})
+	}
+}
+
+func TestAsset(t *testing.T) {
+	tests := []struct {
+		base string
+		name string
+		want string
+	}{
+		{"", "style.css", "/static/style.css?v=" + assetHash("style.css")},
+		{"/restore", "script.js", "/restore/static/script.js?v=" + assetHash("script.js")},
+		{"", "missing.png", "/static/missing.png"},
+	}
+	for _, tt := range tests {
+		if got := (siteInfo{BasePath: tt.base}).Asset(tt.name); got != tt.want {
+			t.Errorf("Asset(%q) under %q = %q, want %q", tt.name, tt.base, got, tt.want)
+		}
+	}
+	if h := assetHash("style.css"); len(h) != 10 || strings.Trim(h, "0123456789abcdef") != "" {
+		t.Errorf("assetHash(style.css) = %q, want 10 hex digits", h)
+	}
+	if assetHash("style.css") == assetHash("script.js") {
+		t.Error("different files share a hash")
+	}
+}
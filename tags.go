@@ -0,0 +1,66 @@
+package main
+
+// tagDescriptions explain well-known tag names
+var tagDescriptions = map[string]string{
+	"e":               "referenced event",
+	"p":               "referenced pubkey",
+	"a":               "referenced addressable event",
+	"d":               "identifier of a parameterized replaceable event",
+	"t":               "hashtag",
+	"r":               "reference URL or relay",
+	"q":               "quoted event",
+	"k":               "referenced kind",
+	"g":               "geohash",
+	"h":               "group id",
+	"l":               "label",
+	"L":               "label namespace",
+	"nonce":           "proof of work nonce and target",
+	"expiration":      "expiration timestamp",
+	"subject":         "subject",
+	"title":           "title",
+	"summary":         "summary",
+	"image":           "image URL",
+	"published_at":    "original publication timestamp",
+	"alt":             "alternative text description",
+	"client":          "publishing client",
+	"emoji":           "custom emoji shortcode and image",
+	"relays":          "relays to use",
+	"challenge":       "authentication challenge",
+	"amount":          "amount in millisats",
+	"bolt11":          "lightning invoice",
+	"preimage":        "payment preimage",
+	"description":     "zap request",
+	"content-warning": "content warning",
+}
+
+// tagDescription returns the meaning of a tag name, or "unknown"
+func tagDescription(name string) string {
+	if description, ok := tagDescriptions[name]; ok {
+		return description
+	}
+	return "unknown"
+}
+
+// TagInfo is a single tag of an event with its meaning
+type TagInfo struct {
+	Name        string
+	Values      []string
+	Description string
+}
+
+// TagInfos returns every tag of the event with its description
+func (e Event) TagInfos() []TagInfo {
+	ev, err := e.parse()
+	if err != nil {
+		return nil
+	}
+
+	var tags []TagInfo
+	for _, tag := range ev.Tags {
+		if len(tag) == 0 {
+			continue
+		}
+		tags = append(tags, TagInfo{Name: tag[0], Values: tag[1:], Description: tagDescription(tag[0])})
+	}
+	return tags
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagInfos(t *testing.T) {
+	event := Event{EventData: `{"kind":1,"content":"gm","tags":[
+		["e","5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36","wss://relay.example","reply"],
+		["p","f7234bd4c1394dda46d09f35bd384dd30cc552ad5541990f98844fb06676e9ca"],
+		["a","30023:f7234bd4c1394dda46d09f35bd384dd30cc552ad5541990f98844fb06676e9ca:my-article"],
+		["d","my-article"],
+		["t","nostr"],
+		["nonce","776797","20"],
+		["expiration","1600000000"],
+		[],
+		["x-custom","value"],
+		["E"]
+	]}`}
+	want := []TagInfo{
+		{"e", []string{"5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36", "wss://relay.example", "reply"}, "referenced event"},
+		{"p", []string{"f7234bd4c1394dda46d09f35bd384dd30cc552ad5541990f98844fb06676e9ca"}, "referenced pubkey"},
+		{"a", []string{"30023:f7234bd4c1394dda46d09f35bd384dd30cc552ad5541990f98844fb06676e9ca:my-article"}, "referenced addressable event"},
+		{"d", []string{"my-article"}, "identifier of a parameterized replaceable event"},
+		{"t", []string{"nostr"}, "hashtag"},
+		{"nonce", []string{"776797", "20"}, "proof of work nonce and target"},
+		{"expiration", []string{"1600000000"}, "expiration timestamp"},
+		{"x-custom", []string{"value"}, "unknown"},
+		{"E", []string{}, "unknown"},
+	}
+	if got := event.TagInfos(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TagInfos() =\n%v\nwant\n%v", got, want)
+	}
+
+	if got := (Event{EventData: "not json"}).TagInfos(); got != nil {
+		t.Errorf("TagInfos() of unparseable data = %v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	// The image is built from scratch, which has no zoneinfo database
+	_ "time/tzdata"
+)
+
+// dateLayout formats timestamps with the zone abbreviation, so the zone is
+// never ambiguous
+const dateLayout = "2006-01-02 15:04:05 MST"
+
+// displayLocation is the time zone timestamps are shown in when the
+// request does not ask for one
+var displayLocation = time.UTC
+
+// loadDisplayLocation loads the IANA time zone name, or returns nil when it
+// is not a valid zone. "Local" is rejected so the server's own zone is
+// never used implicitly.
+func loadDisplayLocation(name string) *time.Location {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+// configureDisplayTZ reads DISPLAY_TZ, falling back to UTC when it is
+// invalid
+func configureDisplayTZ() {
+	v := os.Getenv("DISPLAY_TZ")
+	if v == "" {
+		return
+	}
+	loc := loadDisplayLocation(v)
+	if loc == nil {
+		log.Printf("Invalid DISPLAY_TZ %q, showing times in UTC", v)
+		return
+	}
+	displayLocation = loc
+}
+
+// requestLocation returns the time zone named by ?tz=, or displayLocation
+// when it is unset or invalid
+func requestLocation(r *http.Request) *time.Location {
+	if loc := loadDisplayLocation(r.URL.Query().Get("tz")); loc != nil {
+		return loc
+	}
+	return displayLocation
+}
+
+// formatTimestamp formats a unix timestamp in loc, or in displayLocation
+// when loc is nil
+func formatTimestamp(ts int64, loc *time.Location) string {
+	if loc == nil {
+		loc = displayLocation
+	}
+	return time.Unix(ts, 0).In(loc).Format(dateLayout)
+}
+
+// setLocation sets the time zone events and their reply parents are shown in
+func setLocation(events []Event, loc *time.Location) {
+	for i := range events {
+		events[i].loc = loc
+		if events[i].ReplyTo != nil {
+			events[i].ReplyTo.loc = loc
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	newYork, _ := time.LoadLocation("America/New_York")
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+
+	tests := []struct {
+		name    string
+		display *time.Location
+		loc     *time.Location
+		want    string
+	}{
+		{"UTC by default", time.UTC, nil, "2023-11-14 22:13:20 UTC"},
+		{"Tokyo", time.UTC, tokyo, "2023-11-15 07:13:20 JST"},
+		{"New York", time.UTC, newYork, "2023-11-14 17:13:20 EST"},
+		{"configured display zone", tokyo, nil, "2023-11-15 07:13:20 JST"},
+		{"request zone over the display zone", tokyo, newYork, "2023-11-14 17:13:20 EST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			displayLocation = tt.display
+			if got := formatTimestamp(1700000000, tt.loc); got != tt.want {
+				t.Errorf("formatTimestamp() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLocation(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "UTC"},
+		{"?tz=Asia/Tokyo", "Asia/Tokyo"},
+		{"?tz=Europe/Berlin", "Europe/Berlin"},
+		{"?tz=Mars/Olympus_Mons", "UTC"},
+		{"?tz=Local", "UTC"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/npub/x"+tt.query, nil)
+		if got := requestLocation(r).String(); got != tt.want {
+			t.Errorf("requestLocation(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureDisplayTZ(t *testing.T) {
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for env, want := range map[string]string{
+		"":                "UTC",
+		"Asia/Tokyo":      "Asia/Tokyo",
+		" Asia/Kolkata ":  "Asia/Kolkata",
+		"Nowhere/Special": "UTC",
+		"Local":           "UTC",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("DISPLAY_TZ", env)
+			displayLocation = time.UTC
+			configureDisplayTZ()
+			if got := displayLocation.String(); got != want {
+				t.Errorf("displayLocation = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNpubPageTimeZone(t *testing.T) {
+	const pubkey = "b4e2a6c8d0f2e4a6c8b0d2f4e6a8c0b2d4f6e8a0c2b4d6f8e0a2c4b6d8f0e2a4"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	profiles.set(pubkey, &UserProfile{Name: "vale"})
+	defer profiles.delete(pubkey)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for query, want := range map[string]string{
+		"":               "2023-11-14 22:13:20 UTC",
+		"?tz=Asia/Tokyo": "2023-11-15 07:13:20 JST",
+	} {
+		t.Run("query "+query, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+			id := strings.Repeat("7", 64)
+			mock.ExpectQuery(`ORDER BY event_kind ASC`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "pubkey", "created_at", "event_kind", "event_data"}).
+					AddRow(id, pubkey, int64(1700000000), 1, `{"id":"`+id+`","kind":1,"content":"tick","tags":[]}`))
+
+			rec := httptest.NewRecorder()
+			npubHandler(&databases{primary: db})(rec, httptest.NewRequest(http.MethodGet, "/npub/"+npub+query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("page does not show the event at %s", want)
+			}
+		})
+	}
+}
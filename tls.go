@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// tlsFilesFromEnv returns TLS_CERT_FILE and TLS_KEY_FILE, which must be set
+// together. The pair is loaded once so a bad certificate fails at startup.
+func tlsFilesFromEnv() (certFile, keyFile string, err error) {
+	certFile = os.Getenv("TLS_CERT_FILE")
+	keyFile = os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return "", "", nil
+	}
+	if certFile == "" || keyFile == "" {
+		return "", "", fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return "", "", fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return certFile, keyFile, nil
+}
+
+// httpsRedirectHandler redirects every request to the same URL over HTTPS
+// on tlsAddr's port
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPSRedirect listens for plain HTTP on addr and redirects to HTTPS
+func serveHTTPSRedirect(addr, tlsAddr string) {
+	log.Printf("Redirecting HTTP on %s to HTTPS", addr)
+	log.Fatal(http.ListenAndServe(addr, httpsRedirectHandler(tlsAddr)))
+}
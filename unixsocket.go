@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultSocketMode lets the owner and group, such as a reverse proxy
+// sharing the group, connect to the socket
+const defaultSocketMode = 0o660
+
+// shutdownTimeout bounds how long in-flight requests may finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// socketModeFromEnv returns the octal permissions in UNIX_SOCKET_MODE, or
+// defaultSocketMode when it is unset
+func socketModeFromEnv() (os.FileMode, error) {
+	v := os.Getenv("UNIX_SOCKET_MODE")
+	if v == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid UNIX_SOCKET_MODE %q: must be octal permissions such as 660", v)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenUnix listens on the Unix socket at path with the given permissions.
+// A stale socket left by a previous run is removed first, but a socket that
+// still accepts connections or any other file at path is an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// serveUnix serves handler on the Unix socket at path until SIGINT or
+// SIGTERM, then shuts down gracefully and removes the socket file
+func serveUnix(path string, mode os.FileMode, handler http.Handler) error {
+	l, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	srv := &http.Server{Handler: handler}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-stop
+		log.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown did not complete: %v", err)
+		}
+	}()
+
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Serve returns as soon as shutdown starts, so wait for it to finish
+	<-done
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketModeFromEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"", defaultSocketMode, false},
+		{"600", 0o600, false},
+		{"0666", 0o666, false},
+		{"rw-rw----", 0, true},
+		{"1777", 0, true},
+		{"8", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("UNIX_SOCKET_MODE", tt.env)
+			got, err := socketModeFromEnv()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("socketModeFromEnv() = %o, %v, want %o, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr string
+	}{
+		{name: "no file", setup: func(*testing.T, string) {}},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Leave the socket file behind as a crashed process would
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				l.Close()
+			},
+		},
+		{
+			name: "socket in use",
+			setup: func(t *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { l.Close() })
+			},
+			wantErr: "in use by another process",
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.sock")
+			tt.setup(t, path)
+
+			l, err := listenUnix(path, 0o640)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listenUnix() error = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf("existing file was removed: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listenUnix() error = %v", err)
+			}
+			defer l.Close()
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0o640 {
+				t.Errorf("socket permissions = %o, want 640", perm)
+			}
+		})
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "app.sock")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over the socket "+r.URL.Path)
+	})
+	served := make(chan error, 1)
+	go func() { served <- serveUnix(path, defaultSocketMode, handler) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://unix/version"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("request over the socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "over the socket /version" {
+		t.Errorf("body = %q", body)
+	}
+
+	// The server is listening, so its signal handler is installed
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveUnix() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveUnix() did not return after SIGTERM")
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind: %v", err)
+	}
+}